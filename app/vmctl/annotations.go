@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/opentsdb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/vm"
+)
+
+// annotationMetric is the name of the series OpenTSDB annotations are imported as
+const annotationMetric = "otsdb_annotation"
+
+// annotationCustomPrefix is the prefix of labels for custom fields of annotations,
+// so they don't clash with tags of the annotated series
+const annotationCustomPrefix = "custom_"
+
+// sendAnnotations sends annotations of data to the importer as otsdb_annotation series
+// with value 1 at the annotation start time. Series annotations get the metric name
+// and the tags of the annotated series transformed the same way as for the series itself,
+// while global annotations get global="true" label.
+func (op *otsdbProcessor) sendAnnotations(data opentsdb.Metric) error {
+	var tags map[string]string
+	if len(data.Annotations) > 0 {
+		m := opentsdb.Metric{Metric: data.Metric, Tags: make(map[string]string, len(data.Tags))}
+		for k, v := range data.Tags {
+			m.Tags[k] = v
+		}
+		op.tags.Apply(&m)
+		tags = m.Tags
+		tags["metric"] = m.Metric
+	}
+	for _, a := range data.Annotations {
+		labels := make(map[string]string, len(tags)+len(a.Custom)+1)
+		for k, v := range tags {
+			labels[k] = v
+		}
+		if err := op.importAnnotation(a, labels); err != nil {
+			return err
+		}
+	}
+	for _, a := range data.GlobalAnnotations {
+		if err := op.importAnnotation(a, map[string]string{"global": "true"}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (op *otsdbProcessor) importAnnotation(a opentsdb.Annotation, labels map[string]string) error {
+	labels["description"] = a.Description
+	for k, v := range a.Custom {
+		k = annotationCustomPrefix + k
+		if op.tags.SanitizeLabels {
+			k = opentsdb.SanitizeLabelName(k)
+		}
+		labels[k] = v
+	}
+	ts := vm.TimeSeries{
+		Name:       annotationMetric,
+		LabelPairs: tagsToLabels(labels),
+		Timestamps: []int64{a.StartTimeMillis()},
+		Values:     []float64{1},
+	}
+	labels["__name__"] = annotationMetric
+	if !op.annotations.Add(fmt.Sprintf("%s@%d", vm.Selector(labels), a.StartTime)) {
+		return nil
+	}
+	if op.noImport {
+		return nil
+	}
+	return op.im.Input(&ts)
+}
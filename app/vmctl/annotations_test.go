@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/opentsdb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/vm"
+)
+
+func TestOtsdbProcessorImportAnnotations(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.cpu": {
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host1"}},
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host2"}},
+		},
+	}
+	otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+	otsdbSrv.annotations = []opentsdb.Annotation{{
+		TSUID:       "000001000001000001",
+		Description: "deploy v1.2",
+		Notes:       "long notes aren't imported",
+		Custom:      map[string]string{"owner": "team-a"},
+		StartTime:   testTS,
+	}}
+	otsdbSrv.globalAnnotations = []opentsdb.Annotation{{
+		Description: "datacenter outage",
+		StartTime:   testTS + 60,
+	}}
+	defer otsdbSrv.Close()
+
+	type importedSeries struct {
+		Metric     map[string]string `json:"metric"`
+		Values     []float64         `json:"values"`
+		Timestamps []int64           `json:"timestamps"`
+	}
+	var mu sync.Mutex
+	var annotations []importedSeries
+	vmSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		sc := bufio.NewScanner(r.Body)
+		for sc.Scan() {
+			var s importedSeries
+			if err := json.Unmarshal(sc.Bytes(), &s); err != nil {
+				t.Errorf("cannot parse imported series %q: %s", sc.Text(), err)
+				continue
+			}
+			if s.Metric["__name__"] == annotationMetric {
+				mu.Lock()
+				annotations = append(annotations, s)
+				mu.Unlock()
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer vmSrv.Close()
+
+	oc, err := opentsdb.NewClient(opentsdb.Config{
+		Addr:              otsdbSrv.URL,
+		Limit:             100,
+		Retentions:        []string{"sum-1m-avg:1h:1d"},
+		Filters:           []string{"sys"},
+		ImportAnnotations: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create OpenTSDB client: %s", err)
+	}
+	im, err := vm.NewImporter(context.Background(), vm.Config{
+		Addr:               vmSrv.URL,
+		Concurrency:        1,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	op := &otsdbProcessor{
+		oc:                oc,
+		im:                im,
+		otsdbcc:           1,
+		importAnnotations: true,
+		tags:              opentsdb.TagTransform{Renames: map[string]string{"host": "instance"}},
+	}
+	if err := op.run(context.Background(), true, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// annotations returned by every query range are imported once,
+	// while series annotations get the metric name and labels of the imported series
+	sort.Slice(annotations, func(i, j int) bool {
+		a, b := annotations[i].Metric, annotations[j].Metric
+		return a["global"]+a["instance"] < b["global"]+b["instance"]
+	})
+	want := []importedSeries{
+		{
+			Metric: map[string]string{"__name__": annotationMetric, "metric": "sys_cpu", "instance": "host1",
+				"description": "deploy v1.2", "custom_owner": "team-a"},
+			Values:     []float64{1},
+			Timestamps: []int64{testTS * 1000},
+		},
+		{
+			Metric: map[string]string{"__name__": annotationMetric, "metric": "sys_cpu", "instance": "host2",
+				"description": "deploy v1.2", "custom_owner": "team-a"},
+			Values:     []float64{1},
+			Timestamps: []int64{testTS * 1000},
+		},
+		{
+			Metric:     map[string]string{"__name__": annotationMetric, "global": "true", "description": "datacenter outage"},
+			Values:     []float64{1},
+			Timestamps: []int64{(testTS + 60) * 1000},
+		},
+	}
+	if !reflect.DeepEqual(annotations, want) {
+		t.Fatalf("unexpected imported annotations\n%+v\nwant\n%+v", annotations, want)
+	}
+	if n := op.annotations.Count(); n != len(want) {
+		t.Fatalf("unexpected number of imported annotations %d; want %d", n, len(want))
+	}
+}
@@ -38,12 +38,26 @@ func New() *Backoff {
 	}
 }
 
-// Retry process retries until all attempts are completed
+// NewWithParams initialize backoff object with the given number of attempts
+// and the minimal duration between them. The default backoff factor is used.
+func NewWithParams(retries int, minDuration time.Duration) *Backoff {
+	if retries < 1 {
+		retries = 1
+	}
+	return &Backoff{
+		retries:     retries,
+		factor:      backoffFactor,
+		minDuration: minDuration,
+	}
+}
+
+// Retry process retries until all attempts are completed.
+// Retries are stopped once ctx is cancelled, and ctx error is returned.
 func (b *Backoff) Retry(ctx context.Context, cb retryableFunc) (uint64, error) {
 	var attempt uint64
+	var err error
 	for i := 0; i < b.retries; i++ {
-		// @TODO we should use context to cancel retries
-		err := cb()
+		err = cb()
 		if err == nil {
 			return attempt, nil
 		}
@@ -51,11 +65,25 @@ func (b *Backoff) Retry(ctx context.Context, cb retryableFunc) (uint64, error) {
 			logger.Errorf("unrecoverable error: %s", err)
 			return attempt, err // fail fast if not recoverable
 		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return attempt, ctxErr
+		}
 		attempt++
+		if i == b.retries-1 {
+			// there is nothing to wait for after the last attempt
+			break
+		}
 		backoff := float64(b.minDuration) * math.Pow(b.factor, float64(i))
 		dur := time.Duration(backoff)
 		logger.Errorf("got error: %s on attempt: %d; will retry in %v", err, attempt, dur)
-		time.Sleep(time.Duration(backoff))
+		t := time.NewTimer(dur)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return attempt, ctx.Err()
+		case <-t.C:
+		}
 	}
-	return attempt, fmt.Errorf("execution failed after %d retry attempts", b.retries)
+	// the last error is wrapped, so the callers could check its type
+	return attempt, fmt.Errorf("execution failed after %d retry attempts: %w", b.retries, err)
 }
@@ -2,6 +2,7 @@ package backoff
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -94,3 +95,69 @@ func TestRetry_Do(t *testing.T) {
 		})
 	}
 }
+
+func TestRetryCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := NewWithParams(5, time.Hour)
+	start := time.Now()
+	calls := 0
+	attempts, err := b.Retry(ctx, func() error {
+		calls++
+		time.AfterFunc(10*time.Millisecond, cancel)
+		return fmt.Errorf("got some error")
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expecting context.Canceled error; got %v", err)
+	}
+	if calls != 1 || attempts != 1 {
+		t.Fatalf("unexpected calls %d and attempts %d; want 1 and 1", calls, attempts)
+	}
+	if d := time.Since(start); d > time.Minute {
+		t.Fatalf("retry must be stopped on cancellation; took %s", d)
+	}
+
+	// the deadline stops retries the same way as cancellation
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = b.Retry(ctx, func() error {
+		return fmt.Errorf("got some error")
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expecting context.DeadlineExceeded error; got %v", err)
+	}
+}
+
+func TestRetryWrapsLastError(t *testing.T) {
+	errLast := errors.New("last error")
+	b := NewWithParams(2, time.Millisecond)
+	calls := 0
+	_, err := b.Retry(context.Background(), func() error {
+		calls++
+		if calls == 2 {
+			return errLast
+		}
+		return fmt.Errorf("got some error")
+	})
+	// the callers must be able to check the type of the last error
+	if !errors.Is(err, errLast) {
+		t.Fatalf("expecting the last error to be wrapped; got %v", err)
+	}
+}
+
+func TestRetryNoWaitAfterLastAttempt(t *testing.T) {
+	b := NewWithParams(1, time.Hour)
+	start := time.Now()
+	attempts, err := b.Retry(context.Background(), func() error {
+		return fmt.Errorf("got some error")
+	})
+	if err == nil {
+		t.Fatalf("expecting error")
+	}
+	if attempts != 1 {
+		t.Fatalf("unexpected attempts %d; want 1", attempts)
+	}
+	if d := time.Since(start); d > time.Minute {
+		t.Fatalf("retry must not wait after the last attempt; took %s", d)
+	}
+}
@@ -14,8 +14,13 @@ func Add(bar *pb.ProgressBar) { pool.Add(bar) }
 // Must be called after all progress bars were added
 func Start() error { return pool.Start() }
 
-// Stop stops the global pool
-func Stop() { _ = pool.Stop() }
+// Stop stops the global pool.
+// The pool is replaced with the empty one, so it could be started
+// again with new progress bars, e.g. on the next run in follow mode.
+func Stop() {
+	_ = pool.Stop()
+	pool = pb.NewPool()
+}
 
 // AddWithTemplate adds bar with the given template
 // to the global pool
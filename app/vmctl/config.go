@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// applyConfigFile sets flags of the command from the YAML file at path.
+// The file must contain a map of flag names without the given prefix to their values.
+// For example, `addr: http://localhost:4242` sets `--otsdb-addr` flag for "otsdb-" prefix.
+// List values are allowed only for the flags which can be set multiple times.
+// Flags set via command line take precedence over the file.
+// Keys which don't correspond to any flag with the given prefix are rejected.
+func applyConfigFile(c *cli.Context, path, prefix string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read config file %q: %s", path, err)
+	}
+	var cfg yaml.MapSlice
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return fmt.Errorf("cannot parse config file %q: %s", path, err)
+	}
+	flags := make(map[string]cli.Flag)
+	for _, f := range c.Command.Flags {
+		for _, name := range f.Names() {
+			if strings.HasPrefix(name, prefix) {
+				flags[name] = f
+			}
+		}
+	}
+	seen := make(map[string]struct{}, len(cfg))
+	for _, item := range cfg {
+		key, ok := item.Key.(string)
+		if !ok {
+			return fmt.Errorf("unexpected key %v in config file %q; want string", item.Key, path)
+		}
+		if _, ok := seen[key]; ok {
+			return fmt.Errorf("duplicate key %q in config file %q", key, path)
+		}
+		seen[key] = struct{}{}
+		name := prefix + key
+		f, ok := flags[name]
+		if !ok {
+			return fmt.Errorf("unknown key %q in config file %q: there is no --%s flag", key, path, name)
+		}
+		values, err := configValues(f, item.Value)
+		if err != nil {
+			return fmt.Errorf("cannot apply key %q from config file %q: %s", key, path, err)
+		}
+		if c.IsSet(name) {
+			// command-line flags override the file
+			continue
+		}
+		for _, v := range values {
+			if err := c.Set(name, v); err != nil {
+				return fmt.Errorf("cannot apply key %q from config file %q: %s", key, path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configValues converts YAML value to the list of values for setting flag f
+func configValues(f cli.Flag, value interface{}) ([]string, error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		s, err := configScalar(value)
+		if err != nil {
+			return nil, err
+		}
+		return []string{s}, nil
+	}
+	if sf, ok := f.(cli.DocGenerationSliceFlag); !ok || !sf.IsSliceFlag() {
+		return nil, fmt.Errorf("list value isn't supported by non-list flag")
+	}
+	values := make([]string, 0, len(list))
+	for _, v := range list {
+		s, err := configScalar(v)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, s)
+	}
+	return values, nil
+}
+
+func configScalar(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case int, int64, uint64, float64, bool:
+		return fmt.Sprint(v), nil
+	case nil:
+		return "", fmt.Errorf("value is missing")
+	default:
+		return "", fmt.Errorf("unsupported value %v; want string, number or bool", v)
+	}
+}
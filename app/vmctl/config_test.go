@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestApplyConfigFile(t *testing.T) {
+	type result struct {
+		Addr       string
+		Password   string
+		Retentions []string
+		Limit      int
+		Timeout    time.Duration
+		Insecure   bool
+		VMAddr     string
+	}
+	f := func(cfg string, args []string, want result, wantErr bool) {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(cfg), 0600); err != nil {
+			t.Fatalf("cannot write config file: %s", err)
+		}
+		var got result
+		app := &cli.App{
+			Commands: []*cli.Command{{
+				Name: "opentsdb",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: otsdbAddr, Value: "http://localhost:4242"},
+					&cli.StringFlag{Name: otsdbPassword},
+					&cli.StringSliceFlag{Name: otsdbRetentions},
+					&cli.IntFlag{Name: otsdbQueryLimit},
+					&cli.DurationFlag{Name: otsdbHTTPTimeout},
+					&cli.BoolFlag{Name: otsdbTLSInsecure},
+					&cli.StringFlag{Name: vmAddr},
+				},
+				Action: func(c *cli.Context) error {
+					if err := applyConfigFile(c, path, "otsdb-"); err != nil {
+						return err
+					}
+					got = result{
+						Addr:       c.String(otsdbAddr),
+						Password:   c.String(otsdbPassword),
+						Retentions: c.StringSlice(otsdbRetentions),
+						Limit:      c.Int(otsdbQueryLimit),
+						Timeout:    c.Duration(otsdbHTTPTimeout),
+						Insecure:   c.Bool(otsdbTLSInsecure),
+						VMAddr:     c.String(vmAddr),
+					}
+					return nil
+				},
+			}},
+		}
+		err := app.Run(append([]string{"vmctl", "opentsdb"}, args...))
+		if err != nil {
+			if !wantErr {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			return
+		}
+		if wantErr {
+			t.Fatalf("expecting error for config %q", cfg)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected flags %+v; want %+v", got, want)
+		}
+	}
+
+	cfg := `
+addr: http://opentsdb:4242
+password: secret
+retentions:
+  - sum-1m-avg:1h:1d
+  - sum-1h-avg:1h:30d
+query-limit: 100
+http-timeout: 1m
+tls-insecure-skip-verify: true
+`
+	f(cfg, nil, result{
+		Addr:       "http://opentsdb:4242",
+		Password:   "secret",
+		Retentions: []string{"sum-1m-avg:1h:1d", "sum-1h-avg:1h:30d"},
+		Limit:      100,
+		Timeout:    time.Minute,
+		Insecure:   true,
+	}, false)
+	// command-line flags override the file
+	f(cfg, []string{"--" + otsdbAddr, "http://other:4242", "--" + otsdbRetentions, "sum-1m-avg:1h:3d"}, result{
+		Addr:       "http://other:4242",
+		Password:   "secret",
+		Retentions: []string{"sum-1m-avg:1h:3d"},
+		Limit:      100,
+		Timeout:    time.Minute,
+		Insecure:   true,
+	}, false)
+	f("", nil, result{Addr: "http://localhost:4242"}, false)
+	// unknown key
+	f("foo: bar", nil, result{}, true)
+	// flags of other modes can't be set
+	f("vm-addr: http://victoria:8428", nil, result{}, true)
+	// list value for non-list flag
+	f("addr: [http://opentsdb:4242]", nil, result{}, true)
+	// nested value
+	f("addr: {host: opentsdb}", nil, result{}, true)
+	// missing value
+	f("addr:", nil, result{}, true)
+	// invalid value
+	f("query-limit: foo", nil, result{}, true)
+	// duplicate key
+	f("addr: http://opentsdb:4242\naddr: http://other:4242", nil, result{}, true)
+}
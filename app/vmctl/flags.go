@@ -2,16 +2,25 @@ package main
 
 import (
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/urfave/cli/v2"
 
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/opentsdb"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/stepper"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/vm"
 )
 
 const (
-	globalSilent  = "s"
-	globalVerbose = "verbose"
+	globalSilent        = "s"
+	globalVerbose       = "verbose"
+	globalStatsFormat   = "stats-format"
+	globalMetricsAddr   = "metrics-addr"
+	globalQuietProgress = "quiet-progress"
+	globalReportFile    = "report-file"
+	globalLogSampleRate = "log-sample-rate"
+	globalRequestID     = "request-id"
 )
 
 var (
@@ -26,6 +35,44 @@ var (
 			Value: false,
 			Usage: "Whether to enable verbosity in logs output.",
 		},
+		&cli.StringFlag{
+			Name:  globalStatsFormat,
+			Value: vm.StatsFormatText,
+			Usage: fmt.Sprintf("Format of the importer stats printed during and after the migration. "+
+				"Supported values are %q and %q. The %q format prints stats as a single-line JSON object",
+				vm.StatsFormatText, vm.StatsFormatJSON, vm.StatsFormatJSON),
+		},
+		&cli.StringFlag{
+			Name: globalMetricsAddr,
+			Usage: "Optional TCP address for exposing vmctl metrics such as the number of imported samples " +
+				"in Prometheus text exposition format at /metrics page, for example ':8435'. " +
+				"By default, metrics aren't exposed",
+		},
+		&cli.BoolFlag{
+			Name: globalQuietProgress,
+			Usage: "Whether to log the progress periodically instead of rendering the live progress bar. " +
+				"It keeps the logs readable when vmctl output is captured by CI systems or systemd. " +
+				"The progress is logged every --" + otsdbQueueLogInterval + ". Currently it is supported only in opentsdb mode",
+		},
+		&cli.StringFlag{
+			Name: globalReportFile,
+			Usage: "Optional path for writing the migration report with per-metric stats such as the number of imported series and samples. " +
+				"The report is written in CSV format if the path has .csv extension and in JSON format otherwise. " +
+				"It is written even if the migration fails or is interrupted. Currently it is supported only in opentsdb mode",
+		},
+		&cli.Uint64Flag{
+			Name: globalLogSampleRate,
+			Usage: "Log only 1 of every N debug messages logged per request, so debug logging doesn't flood the disk during big migrations. " +
+				"It applies to import requests logged in --" + globalVerbose + " mode and to data queries logged via --" + otsdbPrintQuery + " " +
+				"if --" + otsdbPrintQuerySampleRate + " isn't set. By default, every message is logged",
+			Value: 1,
+		},
+		&cli.BoolFlag{
+			Name: globalRequestID,
+			Usage: "Whether to send X-Request-Id header with the ID generated once per vmctl run with every request " +
+				"to the source and VictoriaMetrics. The ID is logged at start, so vmctl activity could be found in access logs. " +
+				"Currently it is supported only for OpenTSDB and VictoriaMetrics importer requests",
+		},
 	}
 )
 
@@ -34,12 +81,24 @@ const (
 	vmUser               = "vm-user"
 	vmPassword           = "vm-password"
 	vmAccountID          = "vm-account-id"
+	vmProjectID          = "vm-project-id"
 	vmConcurrency        = "vm-concurrency"
 	vmCompress           = "vm-compress"
+	vmCompressLevel      = "vm-compression-level"
 	vmBatchSize          = "vm-batch-size"
+	vmFlushInterval      = "vm-flush-interval"
 	vmSignificantFigures = "vm-significant-figures"
 	vmRoundDigits        = "vm-round-digits"
 	vmDisableProgressBar = "vm-disable-progress-bar"
+	vmCertFile           = "vm-cert-file"
+	vmKeyFile            = "vm-key-file"
+	vmCAFile             = "vm-ca-file"
+	vmInsecureSkipVerify = "vm-insecure-skip-verify"
+	vmHTTPHeader         = "vm-http-header"
+	vmImportFormat       = "vm-import-format"
+	vmImportPath         = "vm-import-path"
+	vmUserAgent          = "vm-user-agent"
+	vmMatchDedupInterval = "vm-match-dedup-interval"
 
 	// also used in vm-native
 	vmExtraLabel = "vm-extra-label"
@@ -56,7 +115,8 @@ var (
 			Usage: "VictoriaMetrics address to perform import requests. \n" +
 				"Should be the same as --httpListenAddr value for single-node version or vminsert component. \n" +
 				"When importing into the clustered version do not forget to set additionally --vm-account-id flag. \n" +
-				"Please note, that `vmctl` performs initial readiness check for the given address by checking `/health` endpoint.",
+				"Multiple comma-separated addresses may be set for spreading import requests among them in round-robin manner. \n" +
+				"Please note, that `vmctl` performs initial readiness check for the given addresses by checking `/health` endpoint.",
 		},
 		&cli.StringFlag{
 			Name:    vmUser,
@@ -75,6 +135,11 @@ var (
 				"It is possible to set it as accountID:projectID, where projectID is also arbitrary 32-bit integer. \n" +
 				"If projectID isn't set, then it equals to 0",
 		},
+		&cli.StringFlag{
+			Name: vmProjectID,
+			Usage: "ProjectID is an arbitrary 32-bit integer identifying namespace for data ingestion within the given AccountID. \n" +
+				"Requires --vm-account-id to be set and can't be used if --vm-account-id is already set as accountID:projectID",
+		},
 		&cli.UintFlag{
 			Name:  vmConcurrency,
 			Usage: "Number of workers concurrently performing import requests to VM",
@@ -85,11 +150,25 @@ var (
 			Value: true,
 			Usage: "Whether to apply gzip compression to import requests",
 		},
+		&cli.IntFlag{
+			Name:  vmCompressLevel,
+			Value: 1,
+			Usage: "Gzip compression level for import requests if --" + vmCompress + " is set. " +
+				"Supported values are in range [1..9], where 1 is the fastest and 9 is the best compression, " +
+				"-1 for the default gzip level and -2 for Huffman-only compression. " +
+				"Use --" + vmCompress + "=false for disabling the compression if CPU is the bottleneck",
+		},
 		&cli.IntFlag{
 			Name:  vmBatchSize,
 			Value: 200e3,
 			Usage: "How many samples importer collects before sending the import request to VM",
 		},
+		&cli.DurationFlag{
+			Name: vmFlushInterval,
+			Usage: "The max duration importer collects samples before sending the import request to VM, " +
+				"even if --" + vmBatchSize + " isn't reached. It may be useful for sources with many small series, " +
+				"so big batches are sent at least once per the interval. Zero value disables time-based flushing",
+		},
 		&cli.IntFlag{
 			Name:  vmSignificantFigures,
 			Value: 0,
@@ -104,6 +183,13 @@ var (
 			Usage: "Round metric values to the given number of decimal digits after the point. " +
 				"This option may be used for increasing on-disk compression level for the stored metrics",
 		},
+		&cli.DurationFlag{
+			Name: vmMatchDedupInterval,
+			Usage: "Leave at most one sample per the given interval for every series before importing, " +
+				"the same way as VictoriaMetrics does for -dedup.minScrapeInterval. " +
+				"Set it to -dedup.minScrapeInterval of the destination VictoriaMetrics for not sending the samples, " +
+				"which would be removed by deduplication anyway. Zero value disables deduplication before importing",
+		},
 		&cli.StringSliceFlag{
 			Name:  vmExtraLabel,
 			Value: nil,
@@ -113,54 +199,335 @@ var (
 		&cli.Int64Flag{
 			Name: vmRateLimit,
 			Usage: "Optional data transfer rate limit in bytes per second.\n" +
+				"The limit is shared among all the import workers and is applied to the bytes sent over the network, e.g. after compression.\n" +
 				"By default the rate limit is disabled. It can be useful for limiting load on configured via '--vmAddr' destination.",
 		},
 		&cli.BoolFlag{
 			Name:  vmDisableProgressBar,
 			Usage: "Whether to disable progress bar per each worker during the import.",
 		},
+		&cli.StringFlag{
+			Name:  vmCertFile,
+			Usage: "Optional path to client-side TLS certificate file to use when connecting to VictoriaMetrics",
+		},
+		&cli.StringFlag{
+			Name:  vmKeyFile,
+			Usage: "Optional path to client-side TLS certificate key to use when connecting to VictoriaMetrics",
+		},
+		&cli.StringFlag{
+			Name:  vmCAFile,
+			Usage: "Optional path to TLS CA file to use for verifying connections to VictoriaMetrics. By default, system CA is used",
+		},
+		&cli.BoolFlag{
+			Name:  vmInsecureSkipVerify,
+			Usage: "Whether to skip TLS certificate verification when connecting to VictoriaMetrics",
+		},
+		&cli.StringSliceFlag{
+			Name: vmHTTPHeader,
+			Usage: "Optional HTTP header in 'Name: value' format to send with every request to VictoriaMetrics. " +
+				"Flag can be set multiple times, to send few headers. Basic auth set via --" + vmUser + " takes precedence " +
+				"over the Authorization header set via this flag",
+		},
+		&cli.StringFlag{
+			Name: vmImportFormat,
+			Usage: fmt.Sprintf("Format of import requests to VictoriaMetrics. Supported values are %q, %q, %q and %q. "+
+				"Every format is sent to its own import path, see --%s",
+				vm.ImportFormatJSONL, vm.ImportFormatPrometheus, vm.ImportFormatCSV, vm.ImportFormatNative, vmImportPath),
+			Value: vm.ImportFormatJSONL,
+		},
+		&cli.StringFlag{
+			Name: vmImportPath,
+			Usage: "Optional path for import requests to VictoriaMetrics, which overrides the default path for --" + vmImportFormat + ". " +
+				"For example, '/api/v1/import/prometheus'. For cluster version the path is relative to '/insert/<accountID>/prometheus'",
+		},
+		&cli.StringFlag{
+			Name: vmUserAgent,
+			Usage: "Optional User-Agent header to send with every request to VictoriaMetrics. " +
+				"By default, 'vmctl/<version> vm-import' is sent",
+		},
 	}
 )
 
 const (
-	otsdbAddr        = "otsdb-addr"
-	otsdbConcurrency = "otsdb-concurrency"
-	otsdbQueryLimit  = "otsdb-query-limit"
-	otsdbOffsetDays  = "otsdb-offset-days"
-	otsdbHardTSStart = "otsdb-hard-ts-start"
-	otsdbRetentions  = "otsdb-retentions"
-	otsdbFilters     = "otsdb-filters"
-	otsdbNormalize   = "otsdb-normalize"
-	otsdbMsecsTime   = "otsdb-msecstime"
+	otsdbAddr            = "otsdb-addr"
+	otsdbConcurrency     = "otsdb-concurrency"
+	otsdbQueryLimit      = "otsdb-query-limit"
+	otsdbOffsetDays      = "otsdb-offset-days"
+	otsdbHardTSStart     = "otsdb-hard-ts-start"
+	otsdbHardTSEnd       = "otsdb-hard-ts-end"
+	otsdbStartTS         = "otsdb-start-ts"
+	otsdbEndTS           = "otsdb-end-ts"
+	otsdbRetentions      = "otsdb-retentions"
+	otsdbFilters         = "otsdb-filters"
+	otsdbNormalize       = "otsdb-normalize"
+	otsdbNormalizeMetric = "otsdb-normalize-metric"
+	otsdbNormalizeTags   = "otsdb-normalize-tags"
+	otsdbMsecsTime       = "otsdb-msecstime"
+
+	otsdbCheckpointFile    = "otsdb-checkpoint-file"
+	otsdbMetricConcurrency = "otsdb-metric-concurrency"
+	otsdbRetries           = "otsdb-retries"
+	otsdbRetryInterval     = "otsdb-retry-interval"
+	otsdbMetricInclude     = "otsdb-metric-include-regex"
+	otsdbMetricExclude     = "otsdb-metric-exclude-regex"
+	otsdbUser              = "otsdb-username"
+	otsdbPassword          = "otsdb-password"
+	otsdbBearerToken       = "otsdb-bearer-token"
+	otsdbBearerTokenFile   = "otsdb-bearer-token-file"
+	otsdbTLSCAFile         = "otsdb-tls-ca-file"
+	otsdbTLSCertFile       = "otsdb-tls-cert-file"
+	otsdbTLSKeyFile        = "otsdb-tls-key-file"
+	otsdbTLSInsecure       = "otsdb-tls-insecure-skip-verify"
+	otsdbDryRun            = "otsdb-dry-run"
+	otsdbQueryRateLimit    = "otsdb-query-rate-limit"
+	otsdbRelabelConfig     = "otsdb-relabel-config"
+	otsdbKeepTags          = "otsdb-keep-tags"
+	otsdbDropTags          = "otsdb-drop-tags"
+	otsdbIncremental       = "otsdb-incremental"
+	otsdbListMetricsFile   = "otsdb-list-metrics-file"
+	otsdbHTTPTimeout       = "otsdb-http-timeout"
+	otsdbDedup             = "otsdb-dedup"
+	otsdbUseExpAPI         = "otsdb-use-exp-api"
+	otsdbFillPolicy        = "otsdb-fill-policy"
+	otsdbVerify            = "otsdb-verify"
+	otsdbVerifySample      = "otsdb-verify-sample"
+	otsdbVerifyTolerance   = "otsdb-verify-tolerance"
+	otsdbMaxInflight       = "otsdb-max-inflight-samples"
+	otsdbStrict            = "otsdb-strict"
+	otsdbSkipErrors        = "otsdb-skip-errors"
+	otsdbErrorLogFile      = "otsdb-error-log-file"
+	otsdbRetryManifest     = "otsdb-retry-manifest"
+	otsdbRetryFrom         = "otsdb-retry-from"
+	otsdbLookupTags        = "otsdb-lookup-tags"
+	otsdbUseLookup         = "otsdb-use-lookup"
+	otsdbIdentityTags      = "otsdb-identity-tags"
+	otsdbSlowestMetrics    = "otsdb-slowest-metrics"
+	otsdbConfigFile        = "otsdb-config-file"
+	otsdbMaxRuntime        = "otsdb-max-runtime"
+	otsdbDatapointsLimit   = "otsdb-datapoints-limit"
+	otsdbMaxIdleConns      = "otsdb-max-idle-conns"
+	otsdbIdleConnTimeout   = "otsdb-idle-conn-timeout"
+	otsdbAutoRanges        = "otsdb-auto-ranges"
+	otsdbRowSize           = "otsdb-row-size"
+
+	otsdbCheckpointInterval = "otsdb-checkpoint-interval"
+	otsdbConfirmUnder       = "otsdb-confirm-under"
+
+	otsdbRetentionConcurrency = "otsdb-retention-concurrency"
+	otsdbQueueLogInterval     = "otsdb-queue-log-interval"
+	otsdbMetricsFile          = "otsdb-metrics-file"
+	otsdbTagRename            = "otsdb-tag-rename"
+	otsdbSanitizeLabels       = "otsdb-sanitize-labels"
+	otsdbSeriesChunk          = "otsdb-series-chunk"
+	otsdbSeriesTimeout        = "otsdb-series-timeout"
+	otsdbValueTransform       = "otsdb-value-transform"
+	otsdbAlignDownsample      = "otsdb-align-downsample"
+	otsdbTimezone             = "otsdb-timezone"
+	otsdbQueryJitter          = "otsdb-query-jitter"
+	otsdbKeepNaN              = "otsdb-keep-nan"
+	otsdbPrintQuery           = "otsdb-print-query"
+	otsdbPrintQuerySampleRate = "otsdb-print-query-sample-rate"
+	otsdbImportAnnotations    = "otsdb-import-annotations"
+	otsdbNoImport             = "otsdb-no-import"
+	otsdbDiscovery            = "otsdb-discovery"
+	otsdbRetentionOverride    = "otsdb-retention-override"
+	otsdbMaxQueryDuration     = "otsdb-max-query-duration"
+	otsdbStateFile            = "otsdb-state-file"
+	otsdbStateOverlap         = "otsdb-state-overlap"
+	otsdbQueryParam           = "otsdb-query-param"
+	otsdbHTTPHeader           = "otsdb-http-header"
+	otsdbFollow               = "otsdb-follow"
+	otsdbFollowInterval       = "otsdb-follow-interval"
+	otsdbUserAgent            = "otsdb-user-agent"
+	otsdbSortMetrics          = "otsdb-sort-metrics"
+	otsdbBufferResponses      = "otsdb-buffer-responses"
+	otsdbFlattenTags          = "otsdb-flatten-tags"
+	otsdbOutput               = "output"
+	otsdbRemoteWriteURL       = "remote-write-url"
+	otsdbOutputDir            = "output-dir"
+	otsdbOutputFileSize       = "output-file-size"
+
+	// supported values of --output
+	outputVM          = "vm"
+	outputRemoteWrite = "remote_write"
+	outputFile        = "file"
 )
 
 var (
 	otsdbFlags = []cli.Flag{
 		&cli.StringFlag{
-			Name:     otsdbAddr,
-			Value:    "http://localhost:4242",
-			Required: true,
-			Usage:    "OpenTSDB server addr",
+			Name:  otsdbAddr,
+			Value: "http://localhost:4242",
+			Usage: "OpenTSDB server addr. Multiple comma-separated addresses of OpenTSDB nodes may be set, e.g. nodes behind a load balancer. " +
+				"Requests are sent to the addresses in round-robin manner, so retries of failed requests go to the next address. " +
+				"It must be set either via command line or via --" + otsdbConfigFile,
+		},
+		&cli.StringFlag{
+			Name: otsdbConfigFile,
+			Usage: "Optional path to YAML file with values of --otsdb-* flags. Keys are flag names without \"otsdb-\" prefix, " +
+				"e.g. addr, retentions or password. Flags set via command line override the values from the file",
+		},
+		&cli.StringFlag{
+			Name:    otsdbUser,
+			Usage:   "OpenTSDB username for basic auth",
+			EnvVars: []string{"OTSDB_USERNAME"},
+		},
+		&cli.StringFlag{
+			Name:    otsdbPassword,
+			Usage:   "OpenTSDB password for basic auth",
+			EnvVars: []string{"OTSDB_PASSWORD"},
+		},
+		&cli.StringFlag{
+			Name:  otsdbBearerToken,
+			Usage: "Optional bearer auth token to use for requests to OpenTSDB",
+		},
+		&cli.StringFlag{
+			Name:  otsdbBearerTokenFile,
+			Usage: "Optional path to the file with bearer auth token to use for requests to OpenTSDB",
+		},
+		&cli.StringSliceFlag{
+			Name: otsdbQueryParam,
+			Usage: "Optional query arg in key=value format to add to every data query to OpenTSDB, " +
+				"e.g. for bypassing or populating the cache of a proxy in front of OpenTSDB. " +
+				"Flag can be set multiple times, to add few query args",
+		},
+		&cli.StringSliceFlag{
+			Name: otsdbHTTPHeader,
+			Usage: "Optional HTTP header in 'Name: value' format to send with every request to OpenTSDB. " +
+				"Flag can be set multiple times, to send few headers. Auth set via --" + otsdbUser + " or --" + otsdbBearerToken + " " +
+				"takes precedence over the Authorization header set via this flag",
+		},
+		&cli.StringFlag{
+			Name: otsdbUserAgent,
+			Usage: "Optional User-Agent header to send with every request to OpenTSDB, so vmctl requests could be told apart " +
+				"in OpenTSDB and proxy logs. By default, 'vmctl/<version> otsdb-import' is sent",
+		},
+		&cli.StringFlag{
+			Name:  otsdbTLSCAFile,
+			Usage: "Optional path to TLS CA file to use for verifying connections to OpenTSDB. By default, system CA is used",
+		},
+		&cli.StringFlag{
+			Name:  otsdbTLSCertFile,
+			Usage: "Optional path to client-side TLS certificate file to use when connecting to OpenTSDB",
+		},
+		&cli.StringFlag{
+			Name:  otsdbTLSKeyFile,
+			Usage: "Optional path to client-side TLS certificate key to use when connecting to OpenTSDB",
+		},
+		&cli.BoolFlag{
+			Name:  otsdbTLSInsecure,
+			Usage: "Whether to skip TLS certificate verification when connecting to OpenTSDB",
 		},
 		&cli.IntFlag{
-			Name:  otsdbConcurrency,
-			Usage: "Number of concurrently running fetch queries to OpenTSDB per metric",
+			Name: otsdbConcurrency,
+			Usage: "Number of concurrently running fetch queries to OpenTSDB per metric. " +
+				"It also limits the number of concurrent metric discovery queries for --" + otsdbFilters,
 			Value: 1,
 		},
+		&cli.IntSliceFlag{
+			Name: otsdbRetentionConcurrency,
+			Usage: "Optional number of concurrently running fetch queries to OpenTSDB per metric for every retention " +
+				"in the order of --" + otsdbRetentions + " or --" + otsdbAutoRanges + ", e.g. --" + otsdbRetentionConcurrency + "=4,1. " +
+				"Every retention gets its own pool of workers, so slow queries of high-resolution retentions don't delay " +
+				"queries of low-resolution ones. By default, all the retentions share --" + otsdbConcurrency + " workers",
+		},
+		&cli.IntFlag{
+			Name: otsdbSeriesChunk,
+			Usage: "Optional number of series of a metric to process at once. Series of the metric are fetched in chunks " +
+				"of the given size, and the fetched data is sent to VictoriaMetrics before fetching the next chunk. " +
+				"It limits memory usage for metrics with many series. By default, all the series of the metric are processed at once",
+		},
+		&cli.IntFlag{
+			Name: otsdbMetricConcurrency,
+			Usage: "Number of metrics processed concurrently. Each metric gets its own pool of " +
+				"--otsdb-concurrency fetch workers, so the total number of concurrent queries to OpenTSDB " +
+				"is --otsdb-metric-concurrency * --otsdb-concurrency",
+			Value: 1,
+		},
+		&cli.Int64Flag{
+			Name: otsdbQueryRateLimit,
+			Usage: "Optional limit on the number of data queries per second sent to OpenTSDB. " +
+				"The limit is applied to all the concurrently running fetch workers altogether. " +
+				"By default, the rate limit is disabled",
+		},
+		&cli.DurationFlag{
+			Name: otsdbQueryJitter,
+			Usage: "Optional max delay of the first data query of every fetch worker. Every worker waits for a random duration " +
+				"in the range [0, --" + otsdbQueryJitter + ") before its first query, so concurrently started workers don't query " +
+				"the same HBase regions at once. By default, workers start querying immediately",
+		},
+		&cli.BoolFlag{
+			Name: otsdbPrintQuery,
+			Usage: "Whether to log queries sent to OpenTSDB as curl commands for reproducing them manually. " +
+				"Credentials are redacted. Discovery queries are always logged, while data queries are sampled according to --" + otsdbPrintQuerySampleRate,
+		},
+		&cli.Float64Flag{
+			Name: otsdbPrintQuerySampleRate,
+			Usage: "The share of data queries logged if --" + otsdbPrintQuery + " is set, e.g. 0.01 logs every 100th data query. " +
+				"Set it to 1 for logging every data query. If it isn't set, but --" + globalLogSampleRate + " is set, 1 of every --" + globalLogSampleRate + " data queries is logged",
+			Value: 0.001,
+		},
 		&cli.StringSliceFlag{
-			Name:     otsdbRetentions,
-			Value:    nil,
-			Required: true,
+			Name:  otsdbRetentions,
+			Value: nil,
 			Usage: "Retentions patterns to collect on. Each pattern should describe the aggregation performed " +
 				"for the query, the row size (in HBase) that will define how long each individual query is, " +
 				"and the time range to query for. e.g. sum-1m-avg:1h:3d. " +
 				"The first time range defined should be a multiple of the row size in HBase. " +
-				"e.g. if the row size is 2 hours, 4h is good, 5h less so. We want each query to land on unique rows.",
+				"e.g. if the row size is 2 hours, 4h is good, 5h less so. We want each query to land on unique rows. " +
+				"Either this flag or --" + otsdbAutoRanges + " must be set",
+		},
+		&cli.StringSliceFlag{
+			Name: otsdbAutoRanges,
+			Usage: "Aggregation patterns with the total lookback for deriving query ranges automatically instead of --" + otsdbRetentions + ", " +
+				"e.g. sum-1m-avg:3d. Query ranges are calculated as a multiple of both --" + otsdbRowSize + " and the aggregation interval, " +
+				"so each query lands on unique rows. The derived ranges are printed on start",
+		},
+		&cli.StringSliceFlag{
+			Name: otsdbRetentionOverride,
+			Usage: "Optional per-metric retentions in metric=pattern format, which are used instead of --" + otsdbRetentions + " " +
+				"for the given metric, e.g. sys.cpu=sum-10s-avg:1h:1d. The pattern has the format of --" + otsdbRetentions + ", " +
+				"or of --" + otsdbAutoRanges + " if they are set. The flag may be set multiple times, including multiple patterns for the same metric. " +
+				"The metric must be set to the original OpenTSDB metric name. Metrics without overrides use --" + otsdbRetentions + " " +
+				"or --" + otsdbAutoRanges + ". Can't be used together with --" + otsdbRetentionConcurrency,
+		},
+		&cli.DurationFlag{
+			Name:  otsdbRowSize,
+			Usage: "The size of rows in HBase used for deriving query ranges via --" + otsdbAutoRanges,
+			Value: time.Hour,
+		},
+		&cli.BoolFlag{
+			Name: otsdbAlignDownsample,
+			Usage: "Whether to align downsampled intervals to calendar boundaries in --" + otsdbTimezone + ". " +
+				"The calendar modifier is added to the downsample spec of queries, e.g. sum:1dc-avg-none, " +
+				"and query ranges are aligned to the aggregation interval, so intervals aren't split between queries. " +
+				"Only aggregation intervals in s, m, h and d units are supported. Can't be used together with --" + otsdbUseExpAPI,
+		},
+		&cli.StringFlag{
+			Name:  otsdbTimezone,
+			Usage: "Timezone of calendar boundaries for --" + otsdbAlignDownsample + ", e.g. Europe/Berlin",
+			Value: "UTC",
 		},
 		&cli.StringSliceFlag{
 			Name:  otsdbFilters,
-			Value: cli.NewStringSlice("a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l", "m", "n", "o", "p", "q", "r", "s", "t", "u", "v", "w", "x", "y", "z"),
-			Usage: "Filters to process for discovering metrics in OpenTSDB",
+			Value: cli.NewStringSlice(opentsdb.DefaultFilters...),
+			Usage: "Filters to process for discovering metrics in OpenTSDB. Filters without = are metric name prefixes. " +
+				"Filters in key=value format restrict the imported series by tag values: key=v1|v2 matches any of the values, " +
+				"key=web* matches the wildcard, while key=literal_or(v1|v2), key=wildcard(web*) and key=regexp(web-[0-9]+) " +
+				"set the type of OpenTSDB filter explicitly. If only tag filters are set, metrics are discovered for all the a-z prefixes. " +
+				"For example, --" + otsdbFilters + "=sys --" + otsdbFilters + "=dc=eu --" + otsdbFilters + "=host=web*",
+		},
+		&cli.StringSliceFlag{
+			Name: otsdbMetricInclude,
+			Usage: "Optional regex for filtering metrics discovered via --otsdb-filters. " +
+				"If set, only metrics matching at least one of the regexes are imported. " +
+				"Flag can be set multiple times",
+		},
+		&cli.StringSliceFlag{
+			Name: otsdbMetricExclude,
+			Usage: "Optional regex for filtering metrics discovered via --otsdb-filters. " +
+				"Metrics matching at least one of the regexes are not imported. " +
+				"Exclude regexes are applied after include regexes. Flag can be set multiple times",
 		},
 		&cli.Int64Flag{
 			Name:  otsdbOffsetDays,
@@ -172,6 +539,24 @@ var (
 			Usage: "A specific timestamp to start from, will override using an offset",
 			Value: 0,
 		},
+		&cli.Int64Flag{
+			Name: otsdbHardTSEnd,
+			Usage: "A specific timestamp to bound the collected data by. Data with timestamps after it isn't collected. " +
+				"The timestamp must be in the same units as the OpenTSDB data, see --" + otsdbMsecsTime + ". " +
+				"By default, the data isn't bounded",
+			Value: 0,
+		},
+		&cli.StringFlag{
+			Name: otsdbStartTS,
+			Usage: "Optional lower bound for timestamps of the collected data in RFC3339 format, e.g. 2023-01-01T00:00:00Z, " +
+				"or as a date, e.g. 2023-01-01. Data with timestamps before it isn't collected",
+		},
+		&cli.StringFlag{
+			Name: otsdbEndTS,
+			Usage: "Optional upper bound for timestamps of the collected data in RFC3339 format, e.g. 2023-02-01T00:00:00Z, " +
+				"or as a date, e.g. 2023-02-01. Query ranges are calculated back from it, so it can't be used together with --" +
+				otsdbHardTSStart + " or --" + otsdbOffsetDays,
+		},
 		/*
 			because the defaults are set *extremely* low in OpenTSDB (10-25 results), we will
 			set a larger default limit, but still allow a user to increase/decrease it
@@ -181,15 +566,355 @@ var (
 			Usage: "Result limit on meta queries to OpenTSDB (affects both metric name and tag value queries, recommended to use a value exceeding your largest series)",
 			Value: 100e6,
 		},
+		&cli.GenericFlag{
+			Name: otsdbMsecsTime,
+			Usage: "Whether OpenTSDB is writing values in milliseconds or seconds. " +
+				"Supported values are true, false and auto. If set to auto, the unit of every returned timestamp " +
+				"is detected by its magnitude, while query time ranges are sent in seconds",
+			Value: &msecsTimeValue{},
+		},
 		&cli.BoolFlag{
-			Name:  otsdbMsecsTime,
+			Name:  otsdbNormalize,
 			Value: false,
-			Usage: "Whether OpenTSDB is writing values in milliseconds or seconds",
+			Usage: "Whether to normalize all data received to lower case before forwarding to VictoriaMetrics. " +
+				"Lowercases metric names, tag keys and tag values. It is the same as setting both --" + otsdbNormalizeMetric +
+				" and --" + otsdbNormalizeTags,
 		},
 		&cli.BoolFlag{
-			Name:  otsdbNormalize,
+			Name:  otsdbNormalizeMetric,
 			Value: false,
-			Usage: "Whether to normalize all data received to lower case before forwarding to VictoriaMetrics",
+			Usage: "Whether to lowercase metric names received from OpenTSDB before forwarding to VictoriaMetrics",
+		},
+		&cli.BoolFlag{
+			Name:  otsdbNormalizeTags,
+			Value: false,
+			Usage: "Whether to lowercase tag keys and tag values received from OpenTSDB before forwarding to VictoriaMetrics",
+		},
+		&cli.IntFlag{
+			Name: otsdbRetries,
+			Usage: "Number of retries for failed requests to OpenTSDB. " +
+				"Only network errors and 5xx responses are retried, 4xx responses fail immediately",
+			Value: 3,
+		},
+		&cli.DurationFlag{
+			Name:  otsdbRetryInterval,
+			Usage: "Minimal interval between retries of failed requests to OpenTSDB. The interval grows exponentially with each retry",
+			Value: time.Second,
+		},
+		&cli.DurationFlag{
+			Name: otsdbHTTPTimeout,
+			Usage: "Timeout for a single request to OpenTSDB, including reading the response. " +
+				"Timed out requests are retried according to --otsdb-retries. By default, there is no timeout",
+		},
+		&cli.DurationFlag{
+			Name: otsdbSeriesTimeout,
+			Usage: "Timeout for fetching the data of a single series on a single time range, including all the retries " +
+				"and splits of requests to OpenTSDB. Timed out series are logged and skipped, so a stuck series doesn't stall the migration. " +
+				"They are written to --" + otsdbRetryManifest + " if it is set. In --" + otsdbStrict + " mode timed out series fail the migration. " +
+				"It should be bigger than --" + otsdbHTTPTimeout + " multiplied by the number of attempts. By default, there is no timeout",
+		},
+		&cli.StringFlag{
+			Name: otsdbCheckpointFile,
+			Usage: "Optional path to the file for persisting the import progress. " +
+				"The list of imported metrics is written into the file after each metric is processed. " +
+				"On restart, metrics recorded in the file are skipped, so the interrupted migration could be resumed.",
+		},
+		&cli.DurationFlag{
+			Name: otsdbCheckpointInterval,
+			Usage: "How often to persist the progress of metrics in progress into --" + otsdbCheckpointFile + ". " +
+				"On restart, the metric in progress is resumed from the first series which wasn't completely imported. " +
+				"Zero value disables persisting the progress of metrics in progress",
+			Value: time.Minute,
+		},
+		&cli.BoolFlag{
+			Name: otsdbDryRun,
+			Usage: "Whether to only discover metrics and series in OpenTSDB and print the summary " +
+				"of what would be transferred. No data is fetched from OpenTSDB and VictoriaMetrics isn't contacted",
+		},
+		&cli.StringFlag{
+			Name: otsdbRelabelConfig,
+			Usage: "Optional path to YAML file with rules for rewriting metric names and tag keys " +
+				"of the data fetched from OpenTSDB before importing it into VictoriaMetrics",
+		},
+		&cli.StringSliceFlag{
+			Name: otsdbKeepTags,
+			Usage: "Optional list of OpenTSDB tags to import. All the other tags are dropped. " +
+				"By default, all the tags are imported",
+		},
+		&cli.StringSliceFlag{
+			Name:  otsdbDropTags,
+			Usage: "Optional list of OpenTSDB tags to drop before importing the data",
+		},
+		&cli.StringSliceFlag{
+			Name: otsdbFlattenTags,
+			Usage: "Optional list of OpenTSDB tags, values of which are appended to the metric name in the given order " +
+				"instead of importing them as labels, e.g. sys.cpu{host=web1} is imported as sys_cpu_web1 for --" + otsdbFlattenTags + "=host. " +
+				"Tag values are sanitized the same way as metric names. Tags are flattened before any other tag transformations. " +
+				"OpenTSDB series imported as the same series after flattening fail the import",
+		},
+		&cli.StringSliceFlag{
+			Name: otsdbTagRename,
+			Usage: "Optional list of OpenTSDB tag renames in old=new format, e.g. --" + otsdbTagRename + "=fqdn=instance. " +
+				"Renames are applied after --" + otsdbKeepTags + ", --" + otsdbDropTags + " and relabeling rules. " +
+				"The renamed tag overrides the tag which already has the new name",
+		},
+		&cli.StringSliceFlag{
+			Name: otsdbValueTransform,
+			Usage: "Optional list of value transforms in metric=scale[,offset] format for unit conversions during the import, " +
+				"e.g. --" + otsdbValueTransform + "=sys.temp=0.5555555555555556,-17.77777777777778 converts Fahrenheit to Celsius. " +
+				"Values are converted via value*scale+offset, while NaN and Inf values are left untouched. " +
+				"The metric is the original OpenTSDB metric name. Set the metric to * for transforming values of the rest of metrics",
+		},
+		&cli.BoolFlag{
+			Name: otsdbSanitizeLabels,
+			Usage: "Whether to replace chars of tag keys which aren't allowed in Prometheus label names with underscores " +
+				"after applying --" + otsdbTagRename + ". Keys starting with a digit are prefixed with underscore",
+		},
+		&cli.BoolFlag{
+			Name: otsdbIncremental,
+			Usage: "Whether to fetch only the data newer than the latest sample of every series " +
+				"already present in VictoriaMetrics. Series missing in VictoriaMetrics are fetched completely. " +
+				"See also --vm-addr",
+		},
+		&cli.StringFlag{
+			Name: otsdbStateFile,
+			Usage: "Optional path to file with per-metric watermarks for recurring syncs, e.g. hourly. " +
+				"Every metric is fetched starting from its watermark minus --" + otsdbStateOverlap + ", " +
+				"while watermarks of successfully imported metrics are updated at the end of the run. " +
+				"The file is created if it doesn't exist. Can't be used together with --" + otsdbIncremental + ", --" + otsdbCheckpointFile + ", " +
+				"--" + otsdbNoImport + " and --" + otsdbRetryFrom,
+		},
+		&cli.DurationFlag{
+			Name: otsdbStateOverlap,
+			Usage: "The time range before the watermark from --" + otsdbStateFile + " which is fetched again on the next run, " +
+				"so the data written to OpenTSDB with a delay isn't missed",
+			Value: 5 * time.Minute,
+		},
+		&cli.BoolFlag{
+			Name: otsdbFollow,
+			Usage: "Whether to keep running after the import and to forward new data from OpenTSDB every --" + otsdbFollowInterval + " " +
+				"until vmctl is stopped. Only the data newer than per-metric watermarks minus --" + otsdbStateOverlap + " is fetched, " +
+				"the same way as for --" + otsdbStateFile + ". Watermarks are kept in memory if --" + otsdbStateFile + " isn't set",
+		},
+		&cli.DurationFlag{
+			Name:  otsdbFollowInterval,
+			Usage: "The interval for fetching new data from OpenTSDB in --" + otsdbFollow + " mode",
+			Value: time.Minute,
+		},
+		&cli.StringFlag{
+			Name: otsdbMetricsFile,
+			Usage: "Optional path to file with the list of metrics to import, one metric per line. " +
+				"If set, metrics aren't discovered via --" + otsdbFilters + ", so suggest API limits don't apply. " +
+				"Empty lines and lines starting with # are ignored. The file may be produced via --" + otsdbListMetricsFile,
+		},
+		&cli.StringFlag{
+			Name: otsdbListMetricsFile,
+			Usage: "Optional path to file for writing the sorted list of discovered metrics to, one metric per line. " +
+				"If set together with --otsdb-dry-run, vmctl exits right after writing the list",
+		},
+		&cli.BoolFlag{
+			Name: otsdbSortMetrics,
+			Usage: "Whether to process discovered metrics in alphabetical order instead of the order returned by OpenTSDB, " +
+				"which may vary between runs. It makes logs and checkpoints of different runs comparable. " +
+				"Metrics from --" + otsdbMetricsFile + " are always processed in the order of the file",
+			Value: true,
+		},
+		&cli.BoolFlag{
+			Name: otsdbBufferResponses,
+			Usage: "Whether to read the whole response of OpenTSDB data queries into memory before decoding it. " +
+				"By default, responses are decoded while they are being read, which reduces memory usage for wide series. " +
+				"Responses of --" + otsdbUseExpAPI + " queries are always read as a whole",
+		},
+		&cli.StringFlag{
+			Name:  otsdbOutput,
+			Value: outputVM,
+			Usage: "Where to send the data fetched from OpenTSDB. Supported values: " +
+				"'" + outputVM + "' for importing it into VictoriaMetrics at --" + vmAddr + ", " +
+				"'" + outputRemoteWrite + "' for sending it via Prometheus remote write protocol to --" + otsdbRemoteWriteURL + ", " +
+				"'" + outputFile + "' for writing it to dump files in --" + otsdbOutputDir + ", which can be imported later via 'vmctl load'",
+		},
+		&cli.StringFlag{
+			Name: otsdbRemoteWriteURL,
+			Usage: "URL of Prometheus remote write receiver for --" + otsdbOutput + "=" + outputRemoteWrite + ", " +
+				"e.g. http://prometheus:9090/api/v1/write. --" + vmUser + ", --" + vmPassword + ", --" + vmHTTPHeader + " " +
+				"and TLS flags for VictoriaMetrics are used for the requests to the receiver",
+		},
+		&cli.StringFlag{
+			Name: otsdbOutputDir,
+			Usage: "Path to the directory for dump files for --" + otsdbOutput + "=" + outputFile + ". " +
+				"The files contain the bodies of import requests in --" + vmImportFormat + ", which must be jsonl or native, " +
+				"gzipped if --" + vmCompress + " is set. Every record of the files is protected by a checksum",
+		},
+		&cli.Int64Flag{
+			Name:  otsdbOutputFileSize,
+			Value: 1 << 30,
+			Usage: "Max size in bytes of dump file for --" + otsdbOutput + "=" + outputFile + ", after reaching which the next file is started. " +
+				"Zero value means the size isn't limited",
+		},
+		&cli.BoolFlag{
+			Name: otsdbDedup,
+			Usage: "Whether to sort samples returned by OpenTSDB by timestamp and leave only the last sample " +
+				"for duplicate timestamps before importing them",
+		},
+		&cli.BoolFlag{
+			Name: otsdbUseExpAPI,
+			Usage: "Whether to fetch data via OpenTSDB expression API /api/query/exp instead of /api/query. " +
+				"Requires OpenTSDB v2.3 or newer",
+		},
+		&cli.StringFlag{
+			Name: otsdbFillPolicy,
+			Usage: "Fill policy for missing values in downsampled data. Supported values are: none, nan, null, zero, previous. " +
+				"Missing values returned for nan and null policies are dropped before importing the data, unless --" + otsdbKeepNaN + " is set",
+			Value: opentsdb.FillPolicyNone,
+		},
+		&cli.BoolFlag{
+			Name: otsdbImportAnnotations,
+			Usage: "Whether to import OpenTSDB series and global annotations in the time ranges of data queries " +
+				"as otsdb_annotation series with value 1 at the annotation start time. " +
+				"Can't be used together with --" + otsdbUseExpAPI,
+		},
+		&cli.BoolFlag{
+			Name: otsdbNoImport,
+			Usage: "Whether to fetch the data from OpenTSDB and drop it instead of importing it into VictoriaMetrics. " +
+				"Useful for measuring the read speed of OpenTSDB, since VictoriaMetrics isn't required to be available. " +
+				"Unlike --" + otsdbDryRun + ", the data is fetched. " +
+				"Can't be used together with --" + otsdbDryRun + ", --" + otsdbCheckpointFile + ", --" + otsdbIncremental + " and --" + otsdbVerify,
+		},
+		&cli.BoolFlag{
+			Name: otsdbKeepNaN,
+			Usage: "Whether to import NaN values returned by OpenTSDB for missing data instead of dropping them. " +
+				"OpenTSDB may return missing values as null, NaN or \"NaN\" depending on --" + otsdbFillPolicy + " and its version, " +
+				"and all of them are imported as NaN",
+		},
+		&cli.BoolFlag{
+			Name: otsdbVerify,
+			Usage: "Whether to verify the imported data after the import is finished. " +
+				"Verification compares the number of samples in OpenTSDB and VictoriaMetrics " +
+				"for a random sample of imported series on the first query range of the first retention. " +
+				"vmctl exits with non-zero code if mismatches are found",
+		},
+		&cli.IntFlag{
+			Name:  otsdbVerifySample,
+			Usage: "The number of randomly chosen series to verify. See --" + otsdbVerify,
+			Value: 10,
+		},
+		&cli.Float64Flag{
+			Name: otsdbVerifyTolerance,
+			Usage: "The allowed relative difference between the number of samples in OpenTSDB and VictoriaMetrics " +
+				"for every verified series. For example, 0.01 allows 1% difference. See --" + otsdbVerify,
+			Value: 0,
+		},
+		&cli.Int64Flag{
+			Name: otsdbMaxInflight,
+			Usage: "The maximum number of samples fetched from OpenTSDB, but not yet imported into VictoriaMetrics. " +
+				"New queries to OpenTSDB are delayed once the limit is reached. This bounds memory usage at the cost of throughput. " +
+				"The limit must be not lower than --" + vmConcurrency + " * --" + vmBatchSize + ". By default, the number isn't limited",
+			Value: 0,
+		},
+		&cli.BoolFlag{
+			Name: otsdbStrict,
+			Usage: fmt.Sprintf("Whether to exit with code %d if any series failed to be fetched from OpenTSDB or imported into VictoriaMetrics. "+
+				"OpenTSDB queries with bad response aren't skipped in this mode. "+
+				"Discovered metrics without series fail the migration before the import in this mode. "+
+				"The number of failed series is printed before exit. It may be used for gating CI pipelines on the migration result", strictExitCode),
+		},
+		&cli.BoolFlag{
+			Name: otsdbSkipErrors,
+			Usage: "Whether to skip series failed to be fetched from OpenTSDB instead of stopping the migration. " +
+				"OpenTSDB queries with bad response are skipped as well. The list of skipped series is printed " +
+				"at the end of the migration or is written to --" + otsdbErrorLogFile + ". Can't be used together with --" + otsdbStrict,
+		},
+		&cli.StringFlag{
+			Name: otsdbErrorLogFile,
+			Usage: "Optional path to the file for writing the list of series skipped because of errors, one series selector per line. " +
+				"Can be used only together with --" + otsdbSkipErrors,
+		},
+		&cli.StringFlag{
+			Name: otsdbRetryManifest,
+			Usage: "Optional path to the JSON file for writing the failed queries to OpenTSDB, including series, retention and time range. " +
+				"The file can be passed to --" + otsdbRetryFrom + " for re-processing only the failed queries. " +
+				"It is mostly useful together with --" + otsdbSkipErrors,
+		},
+		&cli.StringFlag{
+			Name: otsdbRetryFrom,
+			Usage: "Optional path to the retry manifest written via --" + otsdbRetryManifest + ". " +
+				"If set, only the queries from the manifest are processed, while metrics and series discovery is skipped",
+		},
+		&cli.StringSliceFlag{
+			Name: otsdbLookupTags,
+			Usage: "Optional tag filters in key=value format for narrowing series discovery via /api/search/lookup. " +
+				"Only series matching all the filters are imported. Value may be set to * for matching any value of the tag. " +
+				"For example, --" + otsdbLookupTags + "=dc=us-west-1 --" + otsdbLookupTags + "=host=*",
+		},
+		&cli.BoolFlag{
+			Name: otsdbUseLookup,
+			Usage: "Whether to discover metrics via /api/search/lookup with --" + otsdbLookupTags + " instead of /api/suggest. " +
+				"Only metrics having series matching the tag filters and starting with --" + otsdbFilters + " are imported. " +
+				"Please note, --" + otsdbQueryLimit + " limits the number of series returned by lookup",
+		},
+		&cli.StringFlag{
+			Name: otsdbDiscovery,
+			Usage: "Strategy of metrics discovery. Supported values are: suggest, uidmeta. " +
+				"suggest discovers metrics via /api/suggest, which may truncate the results on installs with many metrics. " +
+				"uidmeta enumerates metric UIDs via /api/search/uidmeta page by page, so the discovery is complete, " +
+				"but it requires a search plugin in OpenTSDB. Can't be set to uidmeta together with --" + otsdbUseLookup,
+			Value: opentsdb.DiscoverySuggest,
+		},
+		&cli.StringSliceFlag{
+			Name: otsdbIdentityTags,
+			Usage: "Optional allow-list of tags identifying series of the metric in metric=tag1,tag2 format. " +
+				"Series of the metric which differ only by other tags are merged via the first order aggregation of --" + otsdbRetentions + ", " +
+				"while other tags are dropped. For example, --" + otsdbIdentityTags + "=sys.cpu.user=host,dc",
+		},
+		&cli.DurationFlag{
+			Name: otsdbMaxRuntime,
+			Usage: "Optional limit for the duration of the whole OpenTSDB migration. Once exceeded, vmctl stops sending new queries, " +
+				"waits for in-flight queries, flushes the fetched data to VictoriaMetrics, saves --" + otsdbCheckpointFile + " " +
+				"and exits with code 3. By default, the duration isn't limited",
+		},
+		&cli.IntFlag{
+			Name: otsdbConfirmUnder,
+			Usage: "Optional threshold for the number of discovered metrics. If set, the import continues without confirmation prompt " +
+				"when fewer metrics are discovered, and asks for confirmation otherwise. In silent mode (-" + globalSilent + ") vmctl refuses " +
+				"to import the number of metrics reaching the threshold. This guards against filters matching much more than expected. " +
+				"By default, the confirmation depends on silent mode only",
+		},
+		&cli.DurationFlag{
+			Name: otsdbQueueLogInterval,
+			Usage: "The interval for logging the state of VictoriaMetrics importer queue if --" + globalVerbose + " is set " +
+				"and for logging the progress if --" + globalQuietProgress + " is set. " +
+				"The full queue with all the importer workers busy means VictoriaMetrics can't keep up with the data fetched from OpenTSDB. " +
+				"Zero value disables the logging",
+			Value: 30 * time.Second,
+		},
+		&cli.IntFlag{
+			Name: otsdbSlowestMetrics,
+			Usage: "The number of the slowest metrics to report at the end of the import if --" + globalVerbose + " is set. " +
+				"Every metric is reported with its processing duration and the number of imported series and samples",
+			Value: 10,
+		},
+		&cli.IntFlag{
+			Name: otsdbDatapointsLimit,
+			Usage: "The maximum number of datapoints OpenTSDB returns per data query, if the deployment caps responses. " +
+				"Responses reaching the limit are considered truncated, so the queried time range is split in half " +
+				"and re-queried until the results fit the limit. By default, responses aren't checked for truncation",
+		},
+		&cli.DurationFlag{
+			Name: otsdbMaxQueryDuration,
+			Usage: "The maximum time range of a single data query to OpenTSDB. Longer query ranges are subdivided into queries " +
+				"of up to the given duration aligned to the aggregation interval, so a misconfigured retention can't produce " +
+				"a single query for years of data. By default, query ranges aren't subdivided",
+		},
+		&cli.IntFlag{
+			Name: otsdbMaxIdleConns,
+			Usage: "The maximum number of idle keep-alive connections to OpenTSDB. Connections exceeding the limit are closed " +
+				"after each request, so the value should be not lower than the number of concurrent queries. " +
+				"By default, it equals to --" + otsdbConcurrency + " (or the sum of --" + otsdbRetentionConcurrency + " values) * --" + otsdbMetricConcurrency,
+		},
+		&cli.DurationFlag{
+			Name:  otsdbIdleConnTimeout,
+			Usage: "The maximum amount of time an idle keep-alive connection to OpenTSDB remains open",
+			Value: 90 * time.Second,
 		},
 	}
 )
@@ -545,6 +1270,20 @@ var (
 	}
 )
 
+const (
+	loadInputDir = "input-dir"
+)
+
+var (
+	loadFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:     loadInputDir,
+			Usage:    "Path to the directory with dump files written via 'vmctl opentsdb --" + otsdbOutput + "=" + outputFile + "'",
+			Required: true,
+		},
+	}
+)
+
 func mergeFlags(flags ...[]cli.Flag) []cli.Flag {
 	var result []cli.Flag
 	for _, f := range flags {
@@ -552,3 +1291,34 @@ func mergeFlags(flags ...[]cli.Flag) []cli.Flag {
 	}
 	return result
 }
+
+// msecsTimeValue is the value of --otsdb-msecstime flag.
+// It may be set to true, false or auto, while the flag
+// without value means true for backward compatibility.
+type msecsTimeValue struct {
+	msecs bool
+	auto  bool
+}
+
+// IsBoolFlag allows passing the flag without value
+func (v *msecsTimeValue) IsBoolFlag() bool { return true }
+
+func (v *msecsTimeValue) String() string {
+	if v.auto {
+		return "auto"
+	}
+	return strconv.FormatBool(v.msecs)
+}
+
+func (v *msecsTimeValue) Set(s string) error {
+	if s == "auto" {
+		v.msecs, v.auto = false, true
+		return nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("unexpected value %q; supported values are true, false and auto", s)
+	}
+	v.msecs, v.auto = b, false
+	return nil
+}
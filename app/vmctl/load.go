@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/barpool"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/vm"
+	"github.com/cheggaaa/pb/v3"
+)
+
+type loadProcessor struct {
+	// paths of dump files to load
+	paths []string
+	// importer sends the records of dump files
+	// to VictoriaMetrics
+	im *vm.Importer
+	// cc stands for concurrency
+	// and defines number of concurrently
+	// sent records
+	cc int
+}
+
+// dumpFilesFormat returns the import format of dump files at paths.
+// All the files must have the same format.
+func dumpFilesFormat(paths []string) (string, error) {
+	var format string
+	for _, path := range paths {
+		dr, err := vm.OpenDump(path)
+		if err != nil {
+			return "", err
+		}
+		_ = dr.Close()
+		if format != "" && dr.Format != format {
+			return "", fmt.Errorf("dump file %q has %q format, while the previous files have %q format; "+
+				"files of different formats must be loaded separately", path, dr.Format, format)
+		}
+		format = dr.Format
+	}
+	return format, nil
+}
+
+func (lp *loadProcessor) run(ctx context.Context, silent bool) error {
+	if len(lp.paths) < 1 {
+		return fmt.Errorf("found no dump files to load")
+	}
+	question := fmt.Sprintf("Found %d dump files to load. Continue?", len(lp.paths))
+	if !silent && !prompt(question) {
+		return nil
+	}
+
+	var bar *pb.ProgressBar
+	if !silent {
+		bar = barpool.AddWithTemplate(fmt.Sprintf(barTpl, "Processing files"), len(lp.paths))
+		if err := barpool.Start(); err != nil {
+			return err
+		}
+		defer barpool.Stop()
+	}
+
+	recordsCh := make(chan *vm.DumpRecord)
+	errCh := make(chan error, lp.cc)
+	lp.im.ResetStats()
+
+	var wg sync.WaitGroup
+	wg.Add(lp.cc)
+	for i := 0; i < lp.cc; i++ {
+		go func() {
+			defer wg.Done()
+			for rec := range recordsCh {
+				if err := lp.im.ImportRecord(ctx, rec); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}()
+	}
+	// any error breaks the load, since the records
+	// of dump files mustn't be silently skipped
+	if err := lp.sendRecords(recordsCh, errCh, bar); err != nil {
+		close(recordsCh)
+		wg.Wait()
+		lp.im.Close()
+		return err
+	}
+
+	close(recordsCh)
+	wg.Wait()
+	lp.im.Close()
+	close(errCh)
+	for err := range errCh {
+		return fmt.Errorf("import process failed: %s", err)
+	}
+
+	log.Println("Load finished!")
+	log.Print(lp.im.Stats())
+	return nil
+}
+
+// sendRecords reads the records of dump files and sends them to recordsCh
+// until reading fails or an import error is received from errCh.
+func (lp *loadProcessor) sendRecords(recordsCh chan<- *vm.DumpRecord, errCh <-chan error, bar *pb.ProgressBar) error {
+	for _, path := range lp.paths {
+		dr, err := vm.OpenDump(path)
+		if err != nil {
+			return err
+		}
+		for {
+			rec, err := dr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				_ = dr.Close()
+				return err
+			}
+			select {
+			case importErr := <-errCh:
+				_ = dr.Close()
+				return fmt.Errorf("import process failed: %s", importErr)
+			case recordsCh <- rec:
+			}
+		}
+		_ = dr.Close()
+		if bar != nil {
+			bar.Increment()
+		}
+	}
+	return nil
+}
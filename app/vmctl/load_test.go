@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/vm"
+)
+
+func TestLoadProcessorRun(t *testing.T) {
+	dir := t.TempDir()
+	dumper, err := vm.NewImporter(context.Background(), vm.Config{
+		OutputDir:          dir,
+		OutputFileSize:     100,
+		Concurrency:        1,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	for _, name := range []string{"foo", "bar", "baz"} {
+		ts := &vm.TimeSeries{Name: name, Timestamps: []int64{1000}, Values: []float64{1}}
+		if err := dumper.Import([]*vm.TimeSeries{ts}); err != nil {
+			t.Fatalf("unexpected import error: %s", err)
+		}
+	}
+	dumper.Close()
+
+	var mu sync.Mutex
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(b))
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	paths, err := vm.DumpFiles(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	format, err := dumpFilesFormat(paths)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	im, err := vm.NewImporter(context.Background(), vm.Config{
+		Addr:               srv.URL,
+		ImportFormat:       format,
+		Concurrency:        2,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	lp := &loadProcessor{paths: paths, im: im, cc: 2}
+	if err := lp.run(context.Background(), true); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(bodies) != 3 {
+		t.Fatalf("unexpected number of import requests %d; want 3", len(bodies))
+	}
+	if n := im.StatsSnapshot().Samples; n != 3 {
+		t.Fatalf("unexpected number of loaded samples %d; want 3", n)
+	}
+}
+
+func TestDumpFilesFormatMixed(t *testing.T) {
+	var paths []string
+	for _, format := range []string{vm.ImportFormatJSONL, vm.ImportFormatNative} {
+		dir := t.TempDir()
+		im, err := vm.NewImporter(context.Background(), vm.Config{
+			OutputDir:          dir,
+			ImportFormat:       format,
+			Concurrency:        1,
+			DisableProgressBar: true,
+		})
+		if err != nil {
+			t.Fatalf("cannot create importer: %s", err)
+		}
+		ts := &vm.TimeSeries{Name: "foo", Timestamps: []int64{1000}, Values: []float64{1}}
+		if err := im.Import([]*vm.TimeSeries{ts}); err != nil {
+			t.Fatalf("unexpected import error: %s", err)
+		}
+		im.Close()
+		p, err := vm.DumpFiles(dir)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		paths = append(paths, p...)
+	}
+	_, err := dumpFilesFormat(paths)
+	if err == nil || !strings.Contains(err.Error(), "must be loaded separately") {
+		t.Fatalf("unexpected error %v for dump files of different formats", err)
+	}
+}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -17,6 +21,7 @@ import (
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/native"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/remoteread"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/terminal"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/utils"
 	"github.com/urfave/cli/v2"
 
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/influx"
@@ -32,54 +37,395 @@ func main() {
 	var (
 		err      error
 		importer *vm.Importer
+
+		metricsServer *http.Server
 	)
 
 	ctx, cancelCtx := context.WithCancel(context.Background())
 	start := time.Now()
+	// startMetrics starts metrics server if --metrics-addr is set.
+	// It is called before every command using global flags.
+	startMetrics := func(c *cli.Context) error {
+		addr := c.String(globalMetricsAddr)
+		if addr == "" {
+			return nil
+		}
+		srv, err := startMetricsServer(addr)
+		if err != nil {
+			return err
+		}
+		metricsServer = srv
+		return nil
+	}
 	app := &cli.App{
 		Name:    "vmctl",
 		Usage:   "VictoriaMetrics command-line tool",
 		Version: buildinfo.Version,
 		Commands: []*cli.Command{
 			{
-				Name:  "opentsdb",
-				Usage: "Migrate time series from OpenTSDB",
-				Flags: mergeFlags(globalFlags, otsdbFlags, vmFlags),
+				Name:   "opentsdb",
+				Usage:  "Migrate time series from OpenTSDB",
+				Flags:  mergeFlags(globalFlags, otsdbFlags, vmFlags),
+				Before: startMetrics,
 				Action: func(c *cli.Context) error {
 					fmt.Println("OpenTSDB import mode")
 
+					if path := c.String(otsdbConfigFile); path != "" {
+						if err := applyConfigFile(c, path, "otsdb-"); err != nil {
+							return err
+						}
+					}
+					if !c.IsSet(otsdbAddr) {
+						return fmt.Errorf("%q flag must be set either via command line or via %q", otsdbAddr, otsdbConfigFile)
+					}
+					if len(c.StringSlice(otsdbRetentions)) == 0 && len(c.StringSlice(otsdbAutoRanges)) == 0 {
+						return fmt.Errorf("either %q or %q flag must be set", otsdbRetentions, otsdbAutoRanges)
+					}
+					if c.Bool(otsdbStrict) && c.Bool(otsdbSkipErrors) {
+						return fmt.Errorf("only one of %q and %q flags can be set", otsdbStrict, otsdbSkipErrors)
+					}
+					if c.String(otsdbErrorLogFile) != "" && !c.Bool(otsdbSkipErrors) {
+						return fmt.Errorf("%q flag can be set only together with %q flag", otsdbErrorLogFile, otsdbSkipErrors)
+					}
+					if c.Bool(otsdbNoImport) {
+						for _, f := range []string{otsdbDryRun, otsdbCheckpointFile, otsdbIncremental, otsdbVerify} {
+							if c.IsSet(f) {
+								return fmt.Errorf("%q flag can't be used together with %q flag", f, otsdbNoImport)
+							}
+						}
+					}
+					if c.String(otsdbStateFile) != "" {
+						for _, f := range []string{otsdbIncremental, otsdbCheckpointFile, otsdbNoImport, otsdbRetryFrom} {
+							if c.IsSet(f) {
+								return fmt.Errorf("%q flag can't be used together with %q flag", f, otsdbStateFile)
+							}
+						}
+					}
+					if c.Bool(otsdbFollow) {
+						for _, f := range []string{otsdbDryRun, otsdbCheckpointFile, otsdbIncremental, otsdbNoImport, otsdbRetryFrom, otsdbVerify, otsdbMaxRuntime} {
+							if c.IsSet(f) {
+								return fmt.Errorf("%q flag can't be used together with %q flag", f, otsdbFollow)
+							}
+						}
+						if c.Duration(otsdbFollowInterval) <= 0 {
+							return fmt.Errorf("%q flag must be positive", otsdbFollowInterval)
+						}
+					}
+					if c.String(otsdbRetryFrom) != "" {
+						for _, f := range []string{otsdbCheckpointFile, otsdbIncremental, otsdbVerify, otsdbDryRun, otsdbMetricsFile} {
+							if c.IsSet(f) {
+								return fmt.Errorf("%q flag can't be used together with %q flag", f, otsdbRetryFrom)
+							}
+						}
+					}
+					tagRenames, err := opentsdb.ParseTagRenames(c.StringSlice(otsdbTagRename))
+					if err != nil {
+						return err
+					}
+					valueTransforms, err := opentsdb.ParseValueTransforms(c.StringSlice(otsdbValueTransform))
+					if err != nil {
+						return err
+					}
+					flattenTags, err := opentsdb.ParseFlattenTags(c.StringSlice(otsdbFlattenTags))
+					if err != nil {
+						return err
+					}
+					var metricsList []string
+					if path := c.String(otsdbMetricsFile); path != "" {
+						// the list replaces metric discovery
+						for _, f := range []string{otsdbFilters, otsdbMetricInclude, otsdbMetricExclude, otsdbUseLookup, otsdbDiscovery} {
+							if c.IsSet(f) {
+								return fmt.Errorf("%q flag can't be used together with %q flag", f, otsdbMetricsFile)
+							}
+						}
+						metricsList, err = readMetricsList(path)
+						if err != nil {
+							return err
+						}
+					}
+
+					bearerToken := c.String(otsdbBearerToken)
+					if path := c.String(otsdbBearerTokenFile); path != "" {
+						if bearerToken != "" {
+							return fmt.Errorf("only one of %q and %q flags can be set", otsdbBearerToken, otsdbBearerTokenFile)
+						}
+						data, err := os.ReadFile(path)
+						if err != nil {
+							return fmt.Errorf("cannot read bearer token from %q: %s", path, err)
+						}
+						bearerToken = strings.TrimSpace(string(data))
+					}
+					authCfg, err := auth.Generate(
+						auth.WithBasicAuth(c.String(otsdbUser), c.String(otsdbPassword)),
+						auth.WithBearer(bearerToken))
+					if err != nil {
+						return fmt.Errorf("failed to create auth config for OpenTSDB: %s", err)
+					}
+
+					maxIdleConns := c.Int(otsdbMaxIdleConns)
+					if maxIdleConns <= 0 {
+						// keep a connection per concurrent query to OpenTSDB
+						queryCC := c.Int(otsdbConcurrency)
+						if retentionCC := c.IntSlice(otsdbRetentionConcurrency); len(retentionCC) > 0 {
+							queryCC = 0
+							for _, cc := range retentionCC {
+								queryCC += cc
+							}
+						}
+						maxIdleConns = queryCC * c.Int(otsdbMetricConcurrency)
+					}
+					msecsTime := c.Generic(otsdbMsecsTime).(*msecsTimeValue)
+					hardTS, minTS, err := otsdbTimeBounds(c, msecsTime.msecs)
+					if err != nil {
+						return err
+					}
 					oCfg := opentsdb.Config{
 						Addr:       c.String(otsdbAddr),
 						Limit:      c.Int(otsdbQueryLimit),
 						Offset:     c.Int64(otsdbOffsetDays),
-						HardTS:     c.Int64(otsdbHardTSStart),
+						HardTS:     hardTS,
+						MinTS:      minTS,
+						HardTSEnd:  c.Int64(otsdbHardTSEnd),
 						Retentions: c.StringSlice(otsdbRetentions),
 						Filters:    c.StringSlice(otsdbFilters),
 						Normalize:  c.Bool(otsdbNormalize),
-						MsecsTime:  c.Bool(otsdbMsecsTime),
+						MsecsTime:  msecsTime.msecs,
+
+						NormalizeMetric: c.Bool(otsdbNormalizeMetric),
+						NormalizeTags:   c.Bool(otsdbNormalizeTags),
+
+						Retries:        c.Int(otsdbRetries),
+						RetryInterval:  c.Duration(otsdbRetryInterval),
+						HTTPTimeout:    c.Duration(otsdbHTTPTimeout),
+						UseExpAPI:      c.Bool(otsdbUseExpAPI),
+						FillPolicy:     c.String(otsdbFillPolicy),
+						QueryRateLimit: c.Int64(otsdbQueryRateLimit),
+						AuthCfg:        authCfg,
+
+						TLSCAFile:             c.String(otsdbTLSCAFile),
+						TLSCertFile:           c.String(otsdbTLSCertFile),
+						TLSKeyFile:            c.String(otsdbTLSKeyFile),
+						TLSInsecureSkipVerify: c.Bool(otsdbTLSInsecure),
+
+						MetricIncludeRegex: c.StringSlice(otsdbMetricInclude),
+						MetricExcludeRegex: c.StringSlice(otsdbMetricExclude),
+						// failed queries must be visible for reporting them in both modes
+						Strict: c.Bool(otsdbStrict) || c.Bool(otsdbSkipErrors),
+
+						LookupTags:   c.StringSlice(otsdbLookupTags),
+						UseLookup:    c.Bool(otsdbUseLookup),
+						Discovery:    c.String(otsdbDiscovery),
+						IdentityTags: c.StringSlice(otsdbIdentityTags),
+
+						DatapointsLimit:  c.Int(otsdbDatapointsLimit),
+						MaxQueryDuration: c.Duration(otsdbMaxQueryDuration),
+						MaxIdleConns:     maxIdleConns,
+						IdleConnTimeout:  c.Duration(otsdbIdleConnTimeout),
+
+						AutoRanges: c.StringSlice(otsdbAutoRanges),
+						RowSize:    c.Duration(otsdbRowSize),
+
+						RetentionOverrides: c.StringSlice(otsdbRetentionOverride),
+
+						AlignDownsample: c.Bool(otsdbAlignDownsample),
+						Timezone:        c.String(otsdbTimezone),
+
+						PrintQuery:           c.Bool(otsdbPrintQuery),
+						PrintQuerySampleRate: printQuerySampleRate(c),
+						ImportAnnotations:    c.Bool(otsdbImportAnnotations),
+
+						QueryParams: c.StringSlice(otsdbQueryParam),
+						HTTPHeaders: c.StringSlice(otsdbHTTPHeader),
+						UserAgent:   userAgent(c, otsdbUserAgent, "otsdb-import"),
+						RequestID:   requestID(c),
+
+						BufferResponses: c.Bool(otsdbBufferResponses),
+						AutoMsecsTime:   msecsTime.auto,
 					}
 					otsdbClient, err := opentsdb.NewClient(oCfg)
 					if err != nil {
 						return fmt.Errorf("failed to create opentsdb client: %s", err)
 					}
 
-					vmCfg := initConfigVM(c)
-					// disable progress bars since openTSDB implementation
-					// does not use progress bar pool
-					vmCfg.DisableProgressBar = true
-					importer, err := vm.NewImporter(ctx, vmCfg)
+					dryRun := c.Bool(otsdbDryRun)
+					maxInflight := c.Int64(otsdbMaxInflight)
+					// every importer worker must be able to collect a full batch,
+					// otherwise the import would stall
+					if minInflight := int64(c.Int(vmConcurrency) * c.Int(vmBatchSize)); maxInflight > 0 && maxInflight < minInflight {
+						return fmt.Errorf("--%s=%d must be not lower than --%s * --%s = %d",
+							otsdbMaxInflight, maxInflight, vmConcurrency, vmBatchSize, minInflight)
+					}
+					output, err := otsdbOutputConfig(c)
 					if err != nil {
-						return fmt.Errorf("failed to create VM importer: %s", err)
+						return err
+					}
+					// the progress bars are rendered altogether via the shared pool like in other modes,
+					// but the pool requires a terminal, so the standalone bar is rendered otherwise
+					barPool := !c.Bool(globalQuietProgress) && terminal.IsTerminal(int(os.Stderr.Fd()))
+					// sink stays nil in dry run, since nothing is imported
+					var sink seriesSink
+					var newSink func() (seriesSink, error)
+					var vmQuerier *vm.Querier
+					var vmCfg vm.Config
+					if !dryRun {
+						vmCfg = initConfigVM(c)
+						// in follow mode every run gets a new importer, while the bars
+						// of the previous importers can't be removed from the pool
+						if !barPool || c.Bool(otsdbFollow) {
+							vmCfg.DisableProgressBar = true
+						}
+						vmCfg.NoImport = c.Bool(otsdbNoImport)
+						vmCfg.OutputDir = output.dir
+						vmCfg.OutputFileSize = output.fileSize
+						newSink = func() (seriesSink, error) {
+							if output.remoteWriteURL != "" && !vmCfg.NoImport {
+								return newRemoteWriteSink(ctx, output.remoteWriteURL, vmCfg)
+							}
+							return vm.NewImporter(ctx, vmCfg)
+						}
+						sink, err = newSink()
+						if err != nil {
+							return fmt.Errorf("failed to create importer: %s", err)
+						}
+						if c.Bool(otsdbIncremental) || c.Bool(otsdbVerify) {
+							vmQuerier, err = vm.NewQuerier(vmCfg)
+							if err != nil {
+								return fmt.Errorf("failed to create VM querier: %s", err)
+							}
+						}
+					}
+
+					var progress *opentsdb.Progress
+					if path := c.String(otsdbCheckpointFile); path != "" {
+						checkpoint, err := opentsdb.LoadCheckpoint(path)
+						if err != nil {
+							return fmt.Errorf("failed to load checkpoint: %s", err)
+						}
+						progress = opentsdb.NewProgress(checkpoint, c.Duration(otsdbCheckpointInterval))
 					}
 
-					otsdbProcessor := newOtsdbProcessor(otsdbClient, importer, c.Int(otsdbConcurrency))
-					return otsdbProcessor.run(isNonInteractive(c), c.Bool(globalVerbose))
+					var state *opentsdb.State
+					if path := c.String(otsdbStateFile); path != "" {
+						state, err = opentsdb.LoadState(path)
+						if err != nil {
+							return fmt.Errorf("failed to load state: %s", err)
+						}
+					} else if c.Bool(otsdbFollow) {
+						state = opentsdb.NewState()
+					}
+					var stateTracker *opentsdb.StateTracker
+					if state != nil {
+						stateTracker = opentsdb.NewStateTracker(state, c.Duration(otsdbStateOverlap), otsdbClient.MsecsTime)
+					}
+
+					var retryQueries []opentsdb.RetryQuery
+					if path := c.String(otsdbRetryFrom); path != "" {
+						rm, err := opentsdb.LoadRetryManifest(path)
+						if err != nil {
+							return fmt.Errorf("failed to load retry manifest: %s", err)
+						}
+						retryQueries = rm.Queries
+					}
+					var retryManifest *opentsdb.RetryManifest
+					if path := c.String(otsdbRetryManifest); path != "" {
+						retryManifest = opentsdb.NewRetryManifest(path)
+					}
+
+					var relabelCfg *opentsdb.RelabelConfig
+					if path := c.String(otsdbRelabelConfig); path != "" {
+						relabelCfg, err = opentsdb.LoadRelabelConfig(path)
+						if err != nil {
+							return fmt.Errorf("failed to load relabel config: %s", err)
+						}
+					}
+
+					otsdbProcessor := &otsdbProcessor{
+						oc:          otsdbClient,
+						im:          sink,
+						otsdbcc:     c.Int(otsdbConcurrency),
+						retentionCC: c.IntSlice(otsdbRetentionConcurrency),
+						metricCC:    c.Int(otsdbMetricConcurrency),
+						progress:    progress,
+						dryRun:      dryRun,
+						tags: opentsdb.TagTransform{
+							Flatten:        flattenTags,
+							Keep:           opentsdb.NewTagSet(c.StringSlice(otsdbKeepTags)),
+							Drop:           opentsdb.NewTagSet(c.StringSlice(otsdbDropTags)),
+							Relabel:        relabelCfg,
+							Renames:        tagRenames,
+							SanitizeLabels: c.Bool(otsdbSanitizeLabels),
+						},
+						incremental: c.Bool(otsdbIncremental),
+						vmQuerier:   vmQuerier,
+
+						state: stateTracker,
+
+						valueTransforms: valueTransforms,
+
+						seriesChunk:   c.Int(otsdbSeriesChunk),
+						seriesTimeout: c.Duration(otsdbSeriesTimeout),
+						queryJitter:   c.Duration(otsdbQueryJitter),
+
+						metricsList:     metricsList,
+						listMetricsFile: c.String(otsdbListMetricsFile),
+						sortMetrics:     c.Bool(otsdbSortMetrics),
+						dedup:           c.Bool(otsdbDedup),
+						keepNaN:         c.Bool(otsdbKeepNaN),
+
+						importAnnotations: c.Bool(otsdbImportAnnotations),
+						noImport:          c.Bool(otsdbNoImport),
+
+						maxInflightSamples: maxInflight,
+						strict:             c.Bool(otsdbStrict),
+						skipErrors:         c.Bool(otsdbSkipErrors),
+						failures: opentsdb.Failures{
+							Manifest:     retryManifest,
+							ErrorLogFile: c.String(otsdbErrorLogFile),
+						},
+						retryQueries:     retryQueries,
+						slowestMetrics:   c.Int(otsdbSlowestMetrics),
+						maxRuntime:       c.Duration(otsdbMaxRuntime),
+						confirmUnder:     c.Int(otsdbConfirmUnder),
+						queueLogInterval: c.Duration(otsdbQueueLogInterval),
+						quietProgress:    c.Bool(globalQuietProgress),
+						barPool:          barPool,
+					}
+					if c.Bool(otsdbVerify) {
+						// give VictoriaMetrics time to make
+						// the imported data searchable
+						otsdbProcessor.verifier = opentsdb.NewVerifier(c.Int(otsdbVerifySample), c.Float64(otsdbVerifyTolerance), 5*time.Second)
+					}
+					runStart := time.Now()
+					if c.Bool(otsdbFollow) {
+						err = otsdbProcessor.follow(ctx, c.Duration(otsdbFollowInterval), newSink, isNonInteractive(c), c.Bool(globalVerbose))
+					} else {
+						err = otsdbProcessor.run(ctx, isNonInteractive(c), c.Bool(globalVerbose))
+					}
+					if path := c.String(globalReportFile); path != "" && !dryRun {
+						// the report is written on failures as well,
+						// so it records what was imported before the failure
+						if reportErr := opentsdb.WriteReport(path, otsdbProcessor.buildReport(err, runStart)); reportErr != nil {
+							log.Printf("failed to write report: %s", reportErr)
+						} else {
+							log.Printf("Migration report is written to %q", path)
+						}
+					}
+					var sfe *seriesFailedError
+					if errors.As(err, &sfe) {
+						return cli.Exit(err, strictExitCode)
+					}
+					var mre *maxRuntimeError
+					if errors.As(err, &mre) {
+						return cli.Exit(err, maxRuntimeExitCode)
+					}
+					return err
 				},
 			},
 			{
-				Name:  "influx",
-				Usage: "Migrate time series from InfluxDB",
-				Flags: mergeFlags(globalFlags, influxFlags, vmFlags),
+				Name:   "influx",
+				Usage:  "Migrate time series from InfluxDB",
+				Flags:  mergeFlags(globalFlags, influxFlags, vmFlags),
+				Before: startMetrics,
 				Action: func(c *cli.Context) error {
 					fmt.Println("InfluxDB import mode")
 
@@ -118,9 +464,10 @@ func main() {
 				},
 			},
 			{
-				Name:  "remote-read",
-				Usage: "Migrate time series via Prometheus remote-read protocol",
-				Flags: mergeFlags(globalFlags, remoteReadFlags, vmFlags),
+				Name:   "remote-read",
+				Usage:  "Migrate time series via Prometheus remote-read protocol",
+				Flags:  mergeFlags(globalFlags, remoteReadFlags, vmFlags),
+				Before: startMetrics,
 				Action: func(c *cli.Context) error {
 					rr, err := remoteread.NewClient(remoteread.Config{
 						Addr:               c.String(remoteReadSrcAddr),
@@ -158,9 +505,10 @@ func main() {
 				},
 			},
 			{
-				Name:  "prometheus",
-				Usage: "Migrate time series from Prometheus",
-				Flags: mergeFlags(globalFlags, promFlags, vmFlags),
+				Name:   "prometheus",
+				Usage:  "Migrate time series from Prometheus",
+				Flags:  mergeFlags(globalFlags, promFlags, vmFlags),
+				Before: startMetrics,
 				Action: func(c *cli.Context) error {
 					fmt.Println("Prometheus import mode")
 
@@ -192,9 +540,10 @@ func main() {
 				},
 			},
 			{
-				Name:  "vm-native",
-				Usage: "Migrate time series between VictoriaMetrics installations via native binary format",
-				Flags: mergeFlags(globalFlags, vmNativeFlags),
+				Name:   "vm-native",
+				Usage:  "Migrate time series between VictoriaMetrics installations via native binary format",
+				Flags:  mergeFlags(globalFlags, vmNativeFlags),
+				Before: startMetrics,
 				Action: func(c *cli.Context) error {
 					fmt.Println("VictoriaMetrics Native import mode")
 
@@ -254,6 +603,37 @@ func main() {
 					return p.run(ctx, isNonInteractive(c))
 				},
 			},
+			{
+				Name:   "load",
+				Usage:  "Import dump files written via 'vmctl opentsdb --output=file' into VictoriaMetrics",
+				Flags:  mergeFlags(globalFlags, loadFlags, vmFlags),
+				Before: startMetrics,
+				Action: func(c *cli.Context) error {
+					fmt.Println("Dump files load mode")
+
+					paths, err := vm.DumpFiles(c.String(loadInputDir))
+					if err != nil {
+						return err
+					}
+					format, err := dumpFilesFormat(paths)
+					if err != nil {
+						return err
+					}
+					vmCfg := initConfigVM(c)
+					// the import requests must be in the format of dump files
+					vmCfg.ImportFormat = format
+					importer, err = vm.NewImporter(ctx, vmCfg)
+					if err != nil {
+						return fmt.Errorf("failed to create VM importer: %s", err)
+					}
+					lp := loadProcessor{
+						paths: paths,
+						im:    importer,
+						cc:    c.Int(vmConcurrency),
+					}
+					return lp.run(ctx, isNonInteractive(c))
+				},
+			},
 			{
 				Name:  "verify-block",
 				Usage: "Verifies exported block with VictoriaMetrics Native format",
@@ -298,16 +678,26 @@ func main() {
 		if importer != nil {
 			importer.Close()
 		}
+		stopMetricsServer(metricsServer)
 		cancelCtx()
 	}()
 
 	err = app.Run(os.Args)
+	stopMetricsServer(metricsServer)
 	if err != nil {
 		log.Fatalln(err)
 	}
 	log.Printf("Total time: %v", time.Since(start))
 }
 
+// strictExitCode is the exit code of vmctl when some series
+// failed to be migrated in strict mode
+const strictExitCode = 2
+
+// maxRuntimeExitCode is the exit code of vmctl when the migration
+// was stopped on reaching --otsdb-max-runtime
+const maxRuntimeExitCode = 3
+
 func initConfigVM(c *cli.Context) vm.Config {
 	return vm.Config{
 		Addr:               c.String(vmAddr),
@@ -315,17 +705,177 @@ func initConfigVM(c *cli.Context) vm.Config {
 		Password:           c.String(vmPassword),
 		Concurrency:        uint8(c.Int(vmConcurrency)),
 		Compress:           c.Bool(vmCompress),
+		CompressLevel:      c.Int(vmCompressLevel),
 		AccountID:          c.String(vmAccountID),
+		ProjectID:          c.String(vmProjectID),
+		ImportFormat:       c.String(vmImportFormat),
+		ImportPath:         c.String(vmImportPath),
 		BatchSize:          c.Int(vmBatchSize),
+		FlushInterval:      c.Duration(vmFlushInterval),
 		SignificantFigures: c.Int(vmSignificantFigures),
 		RoundDigits:        c.Int(vmRoundDigits),
+		DedupInterval:      c.Duration(vmMatchDedupInterval),
 		ExtraLabels:        c.StringSlice(vmExtraLabel),
 		RateLimit:          c.Int64(vmRateLimit),
 		DisableProgressBar: c.Bool(vmDisableProgressBar),
+		StatsFormat:        c.String(globalStatsFormat),
+
+		TLSCAFile:             c.String(vmCAFile),
+		TLSCertFile:           c.String(vmCertFile),
+		TLSKeyFile:            c.String(vmKeyFile),
+		TLSInsecureSkipVerify: c.Bool(vmInsecureSkipVerify),
+		Headers:               c.StringSlice(vmHTTPHeader),
+		UserAgent:             userAgent(c, vmUserAgent, "vm-import"),
+		RequestID:             requestID(c),
+
+		LogRequests:   c.Bool(globalVerbose),
+		LogSampleRate: c.Uint64(globalLogSampleRate),
+	}
+}
+
+// otsdbOutputParams contains the destination of the data fetched from OpenTSDB
+// if it mustn't be imported into VictoriaMetrics.
+type otsdbOutputParams struct {
+	// remoteWriteURL is the URL of Prometheus remote write receiver
+	remoteWriteURL string
+	// dir is the directory for dump files
+	dir string
+	// fileSize is the max size of dump file
+	fileSize int64
+}
+
+// otsdbOutputConfig validates --output flags and returns the destination of the data fetched from OpenTSDB.
+func otsdbOutputConfig(c *cli.Context) (otsdbOutputParams, error) {
+	var p otsdbOutputParams
+	output := c.String(otsdbOutput)
+	remoteWriteURL := c.String(otsdbRemoteWriteURL)
+	if remoteWriteURL != "" && output != outputRemoteWrite {
+		return p, fmt.Errorf("--%s requires --%s=%s", otsdbRemoteWriteURL, otsdbOutput, outputRemoteWrite)
 	}
+	dir := c.String(otsdbOutputDir)
+	if dir != "" && output != outputFile {
+		return p, fmt.Errorf("--%s requires --%s=%s", otsdbOutputDir, otsdbOutput, outputFile)
+	}
+	switch output {
+	case outputVM:
+		return p, nil
+	case outputRemoteWrite:
+		if remoteWriteURL == "" {
+			return p, fmt.Errorf("--%s must be set for --%s=%s", otsdbRemoteWriteURL, otsdbOutput, outputRemoteWrite)
+		}
+		if c.Int(otsdbSeriesChunk) > 0 {
+			// remoteWriteSink has no Flush, so the chunks can't be awaited
+			return p, fmt.Errorf("--%s can't be used with --%s=%s", otsdbSeriesChunk, otsdbOutput, outputRemoteWrite)
+		}
+		p.remoteWriteURL = remoteWriteURL
+		return p, nil
+	case outputFile:
+		if dir == "" {
+			return p, fmt.Errorf("--%s must be set for --%s=%s", otsdbOutputDir, otsdbOutput, outputFile)
+		}
+		if c.Bool(otsdbIncremental) || c.Bool(otsdbVerify) {
+			// both of them query the migrated data from VictoriaMetrics
+			return p, fmt.Errorf("--%s and --%s can't be used with --%s=%s", otsdbIncremental, otsdbVerify, otsdbOutput, outputFile)
+		}
+		p.dir = dir
+		p.fileSize = c.Int64(otsdbOutputFileSize)
+		return p, nil
+	default:
+		return p, fmt.Errorf("unsupported --%s=%q; supported values are %q, %q and %q",
+			otsdbOutput, output, outputVM, outputRemoteWrite, outputFile)
+	}
+}
+
+// printQuerySampleRate returns the share of data queries logged via --otsdb-print-query.
+// The global --log-sample-rate is used if --otsdb-print-query-sample-rate isn't set explicitly.
+func printQuerySampleRate(c *cli.Context) float64 {
+	if !c.IsSet(otsdbPrintQuerySampleRate) && c.IsSet(globalLogSampleRate) {
+		n := c.Uint64(globalLogSampleRate)
+		if n == 0 {
+			n = 1
+		}
+		return 1 / float64(n)
+	}
+	return c.Float64(otsdbPrintQuerySampleRate)
+}
+
+// userAgent returns User-Agent header for requests of the given vmctl component.
+// The value of flag takes precedence if set.
+func userAgent(c *cli.Context, flag, component string) string {
+	if ua := c.String(flag); ua != "" {
+		return ua
+	}
+	version := buildinfo.Version
+	if version == "" {
+		version = "unknown"
+	}
+	return fmt.Sprintf("vmctl/%s %s", version, component)
+}
+
+var (
+	runRequestIDOnce sync.Once
+	runRequestID     string
+)
+
+// requestID returns the ID sent in X-Request-Id header with every request of this vmctl run
+// if --request-id is set. The ID is generated and logged once, so all the requests share it.
+func requestID(c *cli.Context) string {
+	if !c.Bool(globalRequestID) {
+		return ""
+	}
+	runRequestIDOnce.Do(func() {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			log.Fatalf("cannot generate request ID: %s", err)
+		}
+		runRequestID = hex.EncodeToString(b)
+		log.Printf("X-Request-Id of this run: %s", runRequestID)
+	})
+	return runRequestID
 }
 
 func isNonInteractive(c *cli.Context) bool {
 	isTerminal := terminal.IsTerminal(int(os.Stdout.Fd()))
 	return c.Bool(globalSilent) || !isTerminal
 }
+
+// otsdbTimeBounds returns the starting and min timestamps for OpenTSDB client
+// in the units of OpenTSDB data. --otsdb-end-ts overrides --otsdb-hard-ts-start,
+// since query ranges are calculated back from the starting timestamp.
+func otsdbTimeBounds(c *cli.Context, msecs bool) (int64, int64, error) {
+	toTS := func(flag string) (int64, error) {
+		t, err := utils.GetTime(c.String(flag))
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse %q flag: %s", flag, err)
+		}
+		if msecs {
+			return t.UnixMilli(), nil
+		}
+		return t.Unix(), nil
+	}
+	hardTS := c.Int64(otsdbHardTSStart)
+	var minTS int64
+	if c.String(otsdbStartTS) != "" {
+		ts, err := toTS(otsdbStartTS)
+		if err != nil {
+			return 0, 0, err
+		}
+		minTS = ts
+	}
+	if c.String(otsdbEndTS) != "" {
+		for _, f := range []string{otsdbHardTSStart, otsdbOffsetDays} {
+			if c.IsSet(f) {
+				return 0, 0, fmt.Errorf("%q flag can't be used together with %q flag", f, otsdbEndTS)
+			}
+		}
+		ts, err := toTS(otsdbEndTS)
+		if err != nil {
+			return 0, 0, err
+		}
+		if minTS != 0 && minTS >= ts {
+			return 0, 0, fmt.Errorf("%q must precede %q", otsdbStartTS, otsdbEndTS)
+		}
+		hardTS = ts
+	}
+	return hardTS, minTS, nil
+}
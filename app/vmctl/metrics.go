@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/opentsdb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/vm"
+)
+
+var (
+	metricsSet = metrics.NewSet()
+
+	// fetchWorkers is the number of running workers fetching data from OpenTSDB
+	fetchWorkers int64
+	// busyFetchWorkers is the number of fetch workers executing a query at the moment
+	busyFetchWorkers int64
+
+	_ = metricsSet.NewGauge(`vmctl_source_workers{source="opentsdb"}`, func() float64 {
+		return float64(atomic.LoadInt64(&fetchWorkers))
+	})
+	_ = metricsSet.NewGauge(`vmctl_source_busy_workers{source="opentsdb"}`, func() float64 {
+		return float64(atomic.LoadInt64(&busyFetchWorkers))
+	})
+)
+
+// startMetricsServer starts HTTP server exposing vmctl metrics
+// in Prometheus text exposition format at /metrics page on the given addr.
+func startMetricsServer(addr string) (*http.Server, error) {
+	// listen synchronously, so invalid or busy addr is detected before the migration starts
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on %q for metrics: %s", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		vm.WriteMetrics(w)
+		opentsdb.WriteMetrics(w)
+		metricsSet.WritePrometheus(w)
+		metrics.WriteProcessMetrics(w)
+	})
+	srv := &http.Server{
+		Addr:              ln.Addr().String(),
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("metrics server at %q stopped with error: %s", addr, err)
+		}
+	}()
+	log.Printf("metrics are exposed at http://%s/metrics", srv.Addr)
+	return srv, nil
+}
+
+// stopMetricsServer gracefully stops srv started via startMetricsServer.
+// It is safe to call it with nil srv.
+func stopMetricsServer(srv *http.Server) {
+	if srv == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("cannot stop metrics server: %s", err)
+	}
+}
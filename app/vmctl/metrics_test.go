@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetricsServer(t *testing.T) {
+	srv, err := startMetricsServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot start metrics server: %s", err)
+	}
+	url := "http://" + srv.Addr + "/metrics"
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("cannot get metrics: %s", err)
+	}
+	data, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatalf("cannot read metrics: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected response code %d", resp.StatusCode)
+	}
+	for _, name := range []string{
+		"vmctl_imported_samples_total",
+		"vmctl_import_errors_total",
+		"vmctl_bytes_sent_total",
+		`vmctl_source_requests_total{source="opentsdb"}`,
+		`vmctl_source_workers{source="opentsdb"}`,
+		`vmctl_source_inflight_requests{source="opentsdb"}`,
+		"vmctl_import_workers",
+	} {
+		if !strings.Contains("\n"+string(data), "\n"+name+" ") {
+			t.Fatalf("missing metric %s in response:\n%s", name, data)
+		}
+	}
+
+	stopMetricsServer(srv)
+	if _, err := http.Get(url); err == nil {
+		t.Fatalf("expecting error after the metrics server is stopped")
+	}
+	// stopping twice must be safe
+	stopMetricsServer(srv)
+	stopMetricsServer(nil)
+
+	if _, err := startMetricsServer("invalid-addr"); err == nil {
+		t.Fatalf("expecting error for invalid addr")
+	}
+}
@@ -1,20 +1,255 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/barpool"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/opentsdb"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/vm"
 	"github.com/cheggaaa/pb/v3"
 )
 
+// seriesSink sends the series fetched from OpenTSDB to the destination.
+// It is implemented by vm.Importer and remoteWriteSink.
+type seriesSink interface {
+	Input(ts *vm.TimeSeries) error
+	Close()
+	Errors() chan *vm.ImportError
+	Stats() string
+}
+
+// sinkFlusher is implemented by sinks, which can wait until the series
+// passed to them are sent. It is required for --otsdb-series-chunk.
+type sinkFlusher interface {
+	Flush() *vm.ImportError
+}
+
+// inflightCounter is implemented by sinks, which track the samples
+// passed to them, but not sent yet. It is required for periodic checkpoints
+// and --otsdb-max-inflight-samples.
+type inflightCounter interface {
+	InflightSamples() int64
+}
+
+// queueReporter is implemented by sinks with the input queue,
+// which state is logged in verbose mode.
+type queueReporter interface {
+	QueueStats() vm.QueueStats
+}
+
+// statsSnapshotter is implemented by sinks, which stats
+// are used in the migration report and warnings.
+type statsSnapshotter interface {
+	StatsSnapshot() vm.ImporterStats
+}
+
+// statsResetter is implemented by sinks, which stats
+// must be reset before the import starts.
+type statsResetter interface {
+	ResetStats()
+}
+
 type otsdbProcessor struct {
+	// samples is the number of samples imported during the run.
+	// It must be the first field for 64-bit alignment on 32-bit platforms
+	samples uint64
+
 	oc      *opentsdb.Client
-	im      *vm.Importer
+	im      seriesSink
 	otsdbcc int
+	// retentionCC contains the number of workers per retention.
+	// If empty, all the retentions share otsdbcc workers
+	retentionCC []int
+	// seriesChunk is the max number of series of a metric processed at once.
+	// Zero means all the series of a metric are processed at once
+	seriesChunk int
+	// queryJitter is the max random delay of the first query of every fetch worker.
+	// Zero means workers start querying immediately
+	queryJitter time.Duration
+	// seriesTimeout limits the duration of every query for a series,
+	// including retries of requests to OpenTSDB. Timed out queries are abandoned,
+	// unless strict is set. Zero means no limit
+	seriesTimeout time.Duration
+	// timedOut is the number of queries abandoned because of seriesTimeout
+	timedOut uint64
+	// malformed is the number of queries skipped in non-strict mode, since
+	// their responses couldn't be parsed even after retries, e.g. because of truncated JSON
+	malformed uint64
+	// metricCC defines how many metrics are processed concurrently
+	metricCC int
+	// progress is optional and is used for
+	// skipping already imported metrics on restart
+	progress *opentsdb.Progress
+	// dryRun defines whether to only discover metrics and series
+	// without fetching the data and importing it
+	dryRun bool
+	// tags defines how metric names and tags are converted before the import
+	tags opentsdb.TagTransform
+	// flattened detects series imported as the same series
+	// because of flattening tags via tags.Flatten
+	flattened opentsdb.FlattenChecker
+	// incremental defines whether to fetch the latest
+	// imported timestamp of every series via vmQuerier,
+	// so only newer data is fetched from OpenTSDB
+	incremental bool
+	// vmQuerier is used for reading the imported data
+	// in incremental mode and for verification
+	vmQuerier *vm.Querier
+	// state is optional and contains per-metric watermarks of recurring syncs,
+	// so only the data newer than the watermark is fetched
+	state *opentsdb.StateTracker
+	// valueTransforms maps OpenTSDB metric names to transforms of their values
+	valueTransforms opentsdb.ValueTransforms
+	// metricsList is an optional list of metrics to import.
+	// If set, metrics aren't discovered via filters
+	metricsList []string
+	// listMetricsFile is optional path for writing
+	// the list of discovered metrics to
+	listMetricsFile string
+	// sortMetrics defines whether to process discovered metrics in sorted order
+	// instead of the order returned by OpenTSDB, which may vary between runs.
+	// The order of metricsList is always preserved
+	sortMetrics bool
+	// dedup defines whether to sort samples by timestamp
+	// and remove samples with duplicate timestamps
+	dedup bool
+	// sortedSeries is the number of series returned by OpenTSDB
+	// with out-of-order timestamps, which were sorted because of dedup
+	sortedSeries uint64
+	// keepNaN defines whether to import NaN values returned by OpenTSDB
+	// for missing data instead of dropping them
+	keepNaN bool
+	// importAnnotations defines whether to import OpenTSDB annotations
+	// returned by data queries as otsdb_annotation series
+	importAnnotations bool
+	// annotations contains the imported annotations
+	annotations opentsdb.AnnotationSet
+	// noImport defines whether to drop the fetched data instead of sending
+	// it to the importer, so only the read speed of OpenTSDB is measured
+	noImport bool
+	// readSeries is the number of non-empty query results in noImport mode
+	readSeries uint64
+	// readStart is the time the fetching of the data was started at
+	readStart time.Time
+	// verifier is optional and is used for comparing
+	// a random sample of imported series with OpenTSDB
+	verifier *opentsdb.Verifier
+	// maxInflightSamples limits the number of samples sent to the importer,
+	// but not yet imported. Zero means no limit
+	maxInflightSamples int64
+	// strict defines whether any failed series must fail the whole run
+	// with seriesFailedError, even if the error was dropped on the way
+	strict bool
+	// skipErrors defines whether series failed to be fetched from OpenTSDB
+	// must be skipped instead of failing the whole run
+	skipErrors bool
+	// failures contains the series and queries failed during the run
+	failures opentsdb.Failures
+	// retryQueries contains the queries to re-process instead of
+	// discovering metrics. It is set via --otsdb-retry-from
+	retryQueries []opentsdb.RetryQuery
+	// slowestMetrics is the number of the slowest metrics
+	// reported at the end of the import in verbose mode
+	slowestMetrics int
+	// maxRuntime limits the duration of the whole run.
+	// Once exceeded, the run is stopped gracefully and maxRuntimeError is returned.
+	// Zero means no limit
+	maxRuntime time.Duration
+	// confirmUnder is the number of discovered metrics starting from which
+	// the import requires confirmation even in silent mode.
+	// Zero means the confirmation depends on silent mode only
+	confirmUnder int
+	// queueLogInterval is the interval for logging
+	// the importer queue state in verbose mode
+	// and the progress in quiet progress mode
+	queueLogInterval time.Duration
+	// quietProgress defines whether to log the progress every queueLogInterval
+	// instead of rendering the live progress bar
+	quietProgress bool
+	// barPool defines whether to render the progress bar via the shared pool
+	// together with the progress bars of importer workers, like other vmctl modes do.
+	// It requires a terminal, so the standalone bar is rendered otherwise
+	barPool bool
+
+	// timings contains the processing stats of the started metrics.
+	// The importer stats on timings.OnDone call are available via im.StatsSnapshot
+	timings opentsdb.Timings
+
+	// emptyMetrics contains the discovered metrics without series
+	emptyMetrics []string
+	// discovered contains the metrics with series to import
+	discovered []metricSeries
+}
+
+// seriesFailedError is returned by otsdbProcessor.run in strict mode
+// if any series failed to be fetched from OpenTSDB or imported into VictoriaMetrics
+type seriesFailedError struct {
+	failed uint64
+	err    error
+}
+
+func (e *seriesFailedError) Error() string {
+	return fmt.Sprintf("strict mode: %d series failed to be migrated: %s", e.failed, e.err)
+}
+
+func (e *seriesFailedError) Unwrap() error { return e.err }
+
+// confirm returns whether the import of the given number of metrics may proceed.
+// If confirmUnder is set, the prompt is skipped for fewer metrics,
+// while for larger numbers the prompt is shown even in silent mode,
+// where the import is refused with an error instead.
+func (op *otsdbProcessor) confirm(question string, metrics int, silent bool) (bool, error) {
+	if op.confirmUnder <= 0 {
+		return silent || prompt(question), nil
+	}
+	if metrics < op.confirmUnder {
+		return true, nil
+	}
+	if silent {
+		return false, fmt.Errorf("refusing to import %d metrics in silent mode: the number of metrics isn't below --%s=%d; "+
+			"check the filters or increase --%s", metrics, otsdbConfirmUnder, op.confirmUnder, otsdbConfirmUnder)
+	}
+	log.Printf("The number of metrics %d isn't below --%s=%d, so the confirmation is required", metrics, otsdbConfirmUnder, op.confirmUnder)
+	return prompt(question), nil
+}
+
+// maxRuntimeError is returned by otsdbProcessor.run
+// if the import was stopped on reaching maxRuntime
+type maxRuntimeError struct {
+	maxRuntime time.Duration
+}
+
+func (e *maxRuntimeError) Error() string {
+	return fmt.Sprintf("max runtime of %s exceeded, so only part of the data was imported", e.maxRuntime)
+}
+
+// isInterrupted returns whether err is caused by the interruption of ctx
+// either via cancellation or on reaching maxRuntime.
+// The errors of OpenTSDB queries exceeding seriesTimeout aren't interruptions,
+// even though they wrap context.DeadlineExceeded.
+func isInterrupted(ctx context.Context, err error) bool {
+	ctxErr := ctx.Err()
+	return ctxErr != nil && errors.Is(err, ctxErr)
+}
+
+// otsdbBarTpl is the template of the progress bar shared between all the metrics
+const otsdbBarTpl = `{{ blue "Processing query ranges:" }} {{ counters . }} {{ bar . "[" "█" (cycle . "█") "▒" "]" }} {{ percent . }} {{ rtime . "ETA %s" "%s" "ETA ?" }} {{ string . "samples" }}`
+
+// metricSeries contains the series discovered for the metric
+type metricSeries struct {
+	metric string
+	series []opentsdb.Meta
 }
 
 type queryObj struct {
@@ -22,152 +257,1502 @@ type queryObj struct {
 	Rt        opentsdb.RetentionMeta
 	Tr        opentsdb.TimeRange
 	StartTime int64
+
+	// cursor is optional and is notified about the processed query
+	// of the series with idx index in the list of metric series
+	cursor *opentsdb.SeriesCursor
+	idx    int
 }
 
-func newOtsdbProcessor(oc *opentsdb.Client, im *vm.Importer, otsdbcc int) *otsdbProcessor {
-	if otsdbcc < 1 {
-		otsdbcc = 1
+func (op *otsdbProcessor) run(ctx context.Context, silent, verbose bool) error {
+	if op.otsdbcc < 1 {
+		op.otsdbcc = 1
 	}
-	return &otsdbProcessor{
-		oc:      oc,
-		im:      im,
-		otsdbcc: otsdbcc,
+	if op.metricCC < 1 {
+		op.metricCC = 1
 	}
-}
-
-func (op *otsdbProcessor) run(silent, verbose bool) error {
-	log.Println("Loading all metrics from OpenTSDB for filters: ", op.oc.Filters)
-	var metrics []string
-	for _, filter := range op.oc.Filters {
-		q := fmt.Sprintf("%s/api/suggest?type=metrics&q=%s&max=%d", op.oc.Addr, filter, op.oc.Limit)
-		m, err := op.oc.FindMetrics(q)
+	if len(op.retentionCC) > 0 {
+		if len(op.oc.RetentionOverrides) > 0 {
+			// lanes are bound to the global retentions
+			return fmt.Errorf("--%s can't be used together with --%s", otsdbRetentionConcurrency, otsdbRetentionOverride)
+		}
+		if len(op.retentionCC) != len(op.oc.Retentions) {
+			return fmt.Errorf("--%s must contain a value per retention; got %d values for %d retentions",
+				otsdbRetentionConcurrency, len(op.retentionCC), len(op.oc.Retentions))
+		}
+		for _, cc := range op.retentionCC {
+			if cc < 1 {
+				return fmt.Errorf("--%s values must be positive; got %d", otsdbRetentionConcurrency, cc)
+			}
+		}
+	}
+	if op.seriesChunk < 0 {
+		return fmt.Errorf("--%s must be non-negative; got %d", otsdbSeriesChunk, op.seriesChunk)
+	}
+	if op.maxRuntime > 0 {
+		// the importer isn't bound to ctx, so the data fetched
+		// before reaching the deadline is still flushed on return
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, op.maxRuntime)
+		defer cancel()
+	}
+	if op.progress != nil && !op.dryRun {
+		// persist the latest progress on any exit from run
+		defer func() {
+			n, ok := op.inflightSamples()
+			op.progress.Finish(op.fetchedSamples, ok && n == 0 && op.failures.Count() == 0)
+		}()
+	}
+	// persist the failed queries on any exit from run
+	defer op.failures.SaveManifest()
+	// the sink must be closed on any exit from run, so its workers
+	// don't leak when run is repeated with a new sink in follow mode
+	defer op.closeSink()
+	if op.retryQueries != nil {
+		return op.runRetry(ctx, silent, verbose)
+	}
+	metrics := op.metricsList
+	if metrics != nil {
+		log.Printf("Using %d metrics from the list instead of discovering them", len(metrics))
+	} else {
+		var err error
+		metrics, err = op.discoverMetrics(ctx)
 		if err != nil {
-			return fmt.Errorf("metric discovery failed for %q: %s", q, err)
+			return err
+		}
+		if op.sortMetrics {
+			// the same order makes logs and checkpoints of different runs comparable
+			sort.Strings(metrics)
 		}
-		metrics = append(metrics, m...)
 	}
-	if len(metrics) < 1 {
-		return fmt.Errorf("found no timeseries to import with filters %q", op.oc.Filters)
+	if op.listMetricsFile != "" {
+		if err := writeMetricsList(op.listMetricsFile, metrics); err != nil {
+			return err
+		}
+		log.Printf("List of discovered metrics is written to %q", op.listMetricsFile)
+		if op.dryRun {
+			return nil
+		}
+	}
+	if op.progress != nil {
+		metrics = op.progress.Pending(metrics)
+		if len(metrics) < 1 {
+			log.Println("All metrics were already imported according to the checkpoint")
+			return nil
+		}
 	}
 
-	question := fmt.Sprintf("Found %d metrics to import. Continue?", len(metrics))
-	if !silent && !prompt(question) {
+	// series are discovered in advance, so the progress bar
+	// could show the total number of query ranges and ETA
+	log.Printf("Discovering series for %d metrics", len(metrics))
+	var totalSeries, totalRanges, filteredOut int
+	discovered := make([]metricSeries, 0, len(metrics))
+	for _, metric := range metrics {
+		if err := ctx.Err(); err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				return &maxRuntimeError{maxRuntime: op.maxRuntime}
+			}
+			return err
+		}
+		serieslist, err := op.oc.FindSeries(ctx, metric)
+		if err != nil {
+			return fmt.Errorf("couldn't retrieve series list for %s : %w", metric, err)
+		}
+		if len(serieslist) == 0 && len(op.oc.TagFilters) > 0 {
+			// metrics discovered via /api/suggest aren't filtered by tags,
+			// so they are expected to have no matching series
+			filteredOut++
+			continue
+		}
+		if len(serieslist) == 0 {
+			// OpenTSDB may return the metric name without series
+			// if filters or permissions hide its data
+			log.Printf("WARN: no series found for metric %q, so it won't be imported", metric)
+			op.emptyMetrics = append(op.emptyMetrics, metric)
+			continue
+		}
+		// series differing only by tags outside identity tags
+		// are fetched as a single aggregated series
+		serieslist = op.oc.IdentitySeries(serieslist)
+		// series order must be the same on restart
+		// for resuming the metric from the recorded series
+		sortSeries(serieslist)
+		totalSeries += len(serieslist)
+		// pre-calculate the number of query ranges we'll be processing
+		totalRanges += len(serieslist) * op.queryRanges(metric)
+		discovered = append(discovered, metricSeries{metric: metric, series: serieslist})
+	}
+	op.discovered = discovered
+	if filteredOut > 0 {
+		log.Printf("Skipped %d metrics without series matching tag filters %v", filteredOut, op.oc.TagFilters)
+	}
+	if op.strict && len(op.emptyMetrics) > 0 {
+		return fmt.Errorf("strict mode: %d metrics have no series: %s", len(op.emptyMetrics), strings.Join(op.emptyMetrics, ", "))
+	}
+	if op.dryRun {
+		op.reportDryRun(len(metrics), totalSeries, totalRanges)
 		return nil
 	}
-	op.im.ResetStats()
+
+	question := fmt.Sprintf("Found %d metrics and %d series to import. Continue?", len(metrics), totalSeries)
+	ok, err := op.confirm(question, len(metrics), silent)
+	if err != nil || !ok {
+		return err
+	}
+	op.resetSinkStats()
+	op.readStart = time.Now()
 	var startTime int64
 	if op.oc.HardTS != 0 {
 		startTime = op.oc.HardTS
+	} else if op.progress != nil && op.progress.StartTime() != 0 {
+		// resumed import must query the same time ranges
+		startTime = op.progress.StartTime()
 	} else {
 		startTime = time.Now().Unix()
 	}
-	queryRanges := 0
-	// pre-calculate the number of query ranges we'll be processing
+	if rs := op.oc.RowSize; rs > 0 && startTime%rs != 0 {
+		// auto ranges are aligned to HBase rows
+		// only if they are counted from the row boundary
+		aligned := startTime + rs - startTime%rs
+		log.Printf("Aligning start timestamp %d to the row boundary %d", startTime, aligned)
+		startTime = aligned
+	}
+	if op.oc.AlignDownsample {
+		// the ranges are aligned by the absolute timestamps,
+		// so they are the same for resumed import with the same start timestamp
+		for i := range op.oc.Retentions {
+			op.oc.Retentions[i].QueryRanges = op.oc.AlignQueryRanges(op.oc.Retentions[i], startTime)
+		}
+		for _, rts := range op.oc.RetentionOverrides {
+			for i := range rts {
+				rts[i].QueryRanges = op.oc.AlignQueryRanges(rts[i], startTime)
+			}
+		}
+	}
+	if op.progress != nil {
+		op.progress.SetStartTime(startTime)
+	}
+	if op.verifier != nil {
+		op.verifier.Reset()
+	}
+	stopProgressSaver := op.startProgressSaver()
+	if verbose {
+		log.Print(op.concurrencyMessage())
+	}
+	if op.state != nil {
+		discoveredMetrics := make([]string, 0, len(discovered))
+		for _, ms := range discovered {
+			discoveredMetrics = append(discoveredMetrics, ms.metric)
+		}
+		op.state.Begin(op.watermarkAt(startTime), discoveredMetrics)
+	}
+	stopQueueLogger := op.startQueueLogger(verbose)
+	err = op.importMetrics(ctx, discovered, startTime, totalRanges, verbose)
+	stopQueueLogger()
+	stopProgressSaver()
+	if err := op.finishImport(ctx, err, startTime, verbose); err != nil {
+		return err
+	}
+	if op.state != nil {
+		// watermarks are persisted only after all the data is flushed,
+		// so the failed run is repeated from the previous watermarks
+		if err := op.state.Save(); err != nil {
+			return fmt.Errorf("failed to save state: %s", err)
+		}
+	}
+	return nil
+}
+
+// follow imports the data from OpenTSDB every interval until ctx is canceled,
+// so new data is forwarded continuously. The first run backfills the data,
+// while the next ones fetch only the data newer than the watermarks in state.
+// Every next run gets a new importer from newImporter, since the importer
+// is closed at the end of the run. Failed runs are repeated from the same watermarks,
+// so the data is delivered at least once.
+func (op *otsdbProcessor) follow(ctx context.Context, interval time.Duration, newImporter func() (seriesSink, error), silent, verbose bool) error {
+	for cycle := 1; ; cycle++ {
+		cycleStart := time.Now()
+		var err error
+		if cycle == 1 {
+			err = op.run(ctx, silent, verbose)
+		} else {
+			var im seriesSink
+			if im, err = newImporter(); err == nil {
+				op.resetRun()
+				op.im = im
+				// the import was confirmed on the first run
+				err = op.run(ctx, true, verbose)
+			}
+		}
+		if ctx.Err() != nil {
+			log.Printf("Stopped following OpenTSDB after %d runs", cycle)
+			return nil
+		}
+		if err != nil {
+			if cycle == 1 {
+				// the backfill must succeed before following the new data
+				return err
+			}
+			log.Printf("WARN: run #%d failed: %s; it will be repeated in %s", cycle, err, interval)
+		}
+		t := time.NewTimer(interval - time.Since(cycleStart))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			log.Printf("Stopped following OpenTSDB after %d runs", cycle)
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// resetRun resets the results of the previous run, so op could run again
+func (op *otsdbProcessor) resetRun() {
+	atomic.StoreUint64(&op.samples, 0)
+	atomic.StoreUint64(&op.readSeries, 0)
+	atomic.StoreUint64(&op.sortedSeries, 0)
+	atomic.StoreUint64(&op.timedOut, 0)
+	atomic.StoreUint64(&op.malformed, 0)
+	op.failures.Reset()
+	op.timings.Reset()
+	if op.progress != nil {
+		op.progress.Reset()
+	}
+	op.emptyMetrics = nil
+	op.discovered = nil
+}
+
+// watermarkAt returns the timestamp in milliseconds up to which
+// the data is fetched by the run started at startTime
+func (op *otsdbProcessor) watermarkAt(startTime int64) int64 {
+	end := startTime
+	if op.oc.HardTSEnd != 0 && op.oc.HardTSEnd < end {
+		end = op.oc.HardTSEnd
+	}
+	ts := op.oc.ToTime(end)
+	if now := time.Now(); ts.After(now) {
+		// the start time may be aligned to the row boundary in the future
+		ts = now
+	}
+	return ts.UnixMilli()
+}
+
+// startProgressSaver periodically persists the progress of metrics in progress
+// and the imported metrics into checkpoint until the returned stop func is called.
+func (op *otsdbProcessor) startProgressSaver() func() {
+	if op.progress == nil {
+		return func() {}
+	}
+	if _, ok := op.inflightSamples(); !ok {
+		// the progress can't be persisted until the end of run,
+		// since the sent samples are unknown
+		return func() {}
+	}
+	return op.progress.StartSaver(op.fetchedSamples, op.sentSamples)
+}
+
+// sentSamples returns the number of samples passed to the importer during the run,
+// which were sent. ok is false if the number is unknown or some data failed to be imported,
+// so the progress of the run can't be trusted.
+func (op *otsdbProcessor) sentSamples() (n int64, ok bool) {
+	fetched := op.fetchedSamples()
+	inflight, ok := op.inflightSamples()
+	if !ok {
+		return 0, false
+	}
+	// errors are read after inflight samples, since the importer
+	// counts the failed samples as sent only after counting the error
+	if ss, ok := op.im.(statsSnapshotter); ok && ss.StatsSnapshot().Errors > 0 {
+		return 0, false
+	}
+	return int64(fetched) - inflight, true
+}
+
+// fetchedSamples returns the number of samples passed to the importer during the run
+func (op *otsdbProcessor) fetchedSamples() uint64 {
+	return atomic.LoadUint64(&op.samples)
+}
+
+// startQueueLogger periodically logs the state of the importer queue in verbose mode
+// until the returned stop func is called, so the backpressure from VictoriaMetrics
+// could be noticed before it slows down the whole migration.
+func (op *otsdbProcessor) startQueueLogger(verbose bool) func() {
+	if !verbose || op.queueLogInterval <= 0 {
+		return func() {}
+	}
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		ticker := time.NewTicker(op.queueLogInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+			}
+			if qr, ok := op.im.(queueReporter); ok {
+				log.Print(queueStatsMessage(qr.QueueStats()))
+			}
+			log.Print(op.workersMessage())
+		}
+	}()
+	return func() {
+		close(stopCh)
+		<-doneCh
+	}
+}
+
+// startProgressBar starts the progress bar for the given number of query ranges.
+// In quiet progress mode the bar isn't rendered, while the progress is logged
+// every queueLogInterval instead, so captured logs aren't cluttered with the bar updates.
+// If barPool is set, the bar is rendered via the shared pool below the bars of importer workers.
+// The returned func finishes the bar.
+func (op *otsdbProcessor) startProgressBar(total int) (*pb.ProgressBar, func(), error) {
+	if op.barPool && !op.quietProgress {
+		bar := barpool.AddWithTemplate(otsdbBarTpl, total)
+		if err := barpool.Start(); err != nil {
+			return nil, nil, err
+		}
+		return bar, func() {
+			bar.Finish()
+			barpool.Stop()
+		}, nil
+	}
+	bar := pb.ProgressBarTemplate(otsdbBarTpl).New(total)
+	if !op.quietProgress {
+		bar.Start()
+		return bar, func() { bar.Finish() }, nil
+	}
+	// the bar still accounts the progress and the import speed
+	bar.SetWriter(io.Discard)
+	bar.Start()
+	logProgress := func() {
+		log.Print(progressMessage(bar.Current(), bar.Total(), atomic.LoadUint64(&op.samples), time.Since(bar.StartTime())))
+	}
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		if op.queueLogInterval <= 0 {
+			<-stopCh
+			return
+		}
+		ticker := time.NewTicker(op.queueLogInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+			}
+			logProgress()
+		}
+	}()
+	return bar, func() {
+		close(stopCh)
+		<-doneCh
+		bar.Finish()
+		logProgress()
+	}, nil
+}
+
+// progressMessage returns the progress of processed query ranges
+// in the form of "42% (123/290 ranges), 1.2M samples, ETA 5m0s"
+func progressMessage(current, total int64, samples uint64, elapsed time.Duration) string {
+	var percent int64
+	if total > 0 {
+		percent = current * 100 / total
+	}
+	eta := "?"
+	if current >= total {
+		eta = "0s"
+	} else if current > 0 {
+		left := time.Duration(float64(elapsed) / float64(current) * float64(total-current))
+		eta = left.Round(time.Second).String()
+	}
+	return fmt.Sprintf("%d%% (%d/%d ranges), %s samples, ETA %s", percent, current, total, formatCount(samples), eta)
+}
+
+// formatCount returns n in human-readable form, e.g. 1.2M
+func formatCount(n uint64) string {
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.1fG", float64(n)/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.1fM", float64(n)/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.1fK", float64(n)/1e3)
+	default:
+		return fmt.Sprintf("%d", n)
+	}
+}
+
+func queueStatsMessage(qs vm.QueueStats) string {
+	msg := fmt.Sprintf("Importer queue: %d/%d series; in-flight samples: %d; busy workers: %d/%d",
+		qs.Queued, qs.Capacity, qs.InflightSamples, qs.BusyWorkers, qs.Workers)
+	if qs.Queued >= qs.Capacity && qs.BusyWorkers >= qs.Workers {
+		msg += "; VictoriaMetrics can't keep up with the import, so fetching from OpenTSDB waits for import requests"
+	}
+	return msg
+}
+
+// concurrencyMessage returns the effective concurrency of the migration,
+// which is the product of concurrency flags rather than any single one of them
+func (op *otsdbProcessor) concurrencyMessage() string {
+	fetch := opentsdb.FetchConcurrency(op.otsdbcc, op.retentionCC)
+	msg := fmt.Sprintf("Effective concurrency: up to %d OpenTSDB fetch workers (%d metrics x %d workers per metric)",
+		op.metricCC*fetch, op.metricCC, fetch)
+	if qr, ok := op.im.(queueReporter); ok {
+		msg += fmt.Sprintf("; %d importer workers", qr.QueueStats().Workers)
+	}
+	return msg
+}
+
+// workersMessage returns the number of fetch workers running at the moment
+// and the number of requests to OpenTSDB in progress
+func (op *otsdbProcessor) workersMessage() string {
+	return fmt.Sprintf("OpenTSDB fetch workers: %d running, %d busy; in-flight requests: %d",
+		atomic.LoadInt64(&fetchWorkers), atomic.LoadInt64(&busyFetchWorkers), op.oc.InflightRequests())
+}
+
+// closeSink closes the sink and counts the import errors, which weren't read yet.
+// It is safe to call closeSink after the sink was closed.
+func (op *otsdbProcessor) closeSink() {
+	if op.im == nil {
+		// nothing is imported in dry run
+		return
+	}
+	// the errors are drained concurrently with Close,
+	// since workers may be blocked on sending them
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for vmErr := range op.im.Errors() {
+			op.countImportError(vmErr)
+		}
+	}()
+	op.im.Close()
+	<-doneCh
+}
+
+// finishImport waits until the data buffered by importer is flushed
+// and reports the import results. err is the error returned by the import loop.
+// startTime is used for verifying the imported data, if enabled.
+func (op *otsdbProcessor) finishImport(ctx context.Context, err error, startTime int64, verbose bool) error {
+	if err != nil {
+		if op.strict {
+			// wait for the buffered data for counting all the failed series
+			op.closeSink()
+			if failed := op.failures.Count(); failed > 0 {
+				return &seriesFailedError{failed: failed, err: err}
+			}
+		}
+		return err
+	}
+	// flush the data buffered by importer
+	// even if the import was interrupted
+	op.im.Close()
+	var importErr error
+	for vmErr := range op.im.Errors() {
+		if vmErr.Err != nil {
+			op.countImportError(vmErr)
+			if importErr == nil {
+				importErr = fmt.Errorf("import process failed: %w", wrapErr(vmErr, verbose))
+			}
+			if !op.strict {
+				return importErr
+			}
+		}
+	}
+	if op.skipErrors {
+		if err := op.failures.Report(); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		log.Print(op.im.Stats())
+		if errors.Is(err, context.DeadlineExceeded) {
+			return &maxRuntimeError{maxRuntime: op.maxRuntime}
+		}
+		return fmt.Errorf("import was interrupted, so only part of the data was imported: %w", err)
+	}
+	if op.strict {
+		// the failed series are checked after all the processing,
+		// so errors dropped on the way can't be missed
+		if failed := op.failures.Count(); failed > 0 {
+			log.Print(op.im.Stats())
+			if importErr == nil {
+				importErr = fmt.Errorf("some series failed during the import")
+			}
+			return &seriesFailedError{failed: failed, err: importErr}
+		}
+	}
+	if op.noImport {
+		log.Println("Read finished!")
+		log.Print(op.readStats())
+	} else {
+		log.Println("Import finished!")
+		log.Print(op.im.Stats())
+	}
+	log.Printf("OpenTSDB requests retries: %d", op.oc.Retries())
+	if n := atomic.LoadUint64(&op.timedOut); n > 0 {
+		log.Printf("%d queries were abandoned after --%s=%s", n, otsdbSeriesTimeout, op.seriesTimeout)
+	}
+	if n := atomic.LoadUint64(&op.malformed); n > 0 {
+		log.Printf("%d queries were skipped because of malformed responses from OpenTSDB", n)
+	}
+	if n := len(op.emptyMetrics); n > 0 {
+		log.Printf("%d metrics were skipped because of no series", n)
+	}
+	op.reportOutOfOrder()
+	if op.importAnnotations {
+		log.Printf("Imported %d annotations as %s series", op.annotations.Count(), annotationMetric)
+	}
+	if verbose {
+		op.timings.LogSlowest(op.slowestMetrics)
+	}
+	if op.verifier != nil {
+		return op.runVerify(ctx, startTime)
+	}
+	return nil
+}
+
+// reportOutOfOrder logs the number of series returned by OpenTSDB
+// with timestamps not sorted in ascending order, if any.
+// VictoriaMetrics accepts such series, but they may indicate issues with the source data.
+func (op *otsdbProcessor) reportOutOfOrder() {
+	if n := atomic.LoadUint64(&op.sortedSeries); n > 0 {
+		log.Printf("%d series with out-of-order timestamps were sorted because of --%s", n, otsdbDedup)
+		return
+	}
+	if op.noImport {
+		return
+	}
+	ss, ok := op.im.(statsSnapshotter)
+	if !ok {
+		return
+	}
+	if n := ss.StatsSnapshot().OutOfOrderSeries; n > 0 {
+		log.Printf("WARN: %d series were imported with out-of-order timestamps; "+
+			"pass --%s for sorting samples by timestamp and removing duplicates", n, otsdbDedup)
+	}
+}
+
+// readStats returns the summary of the data read from OpenTSDB in noImport mode
+func (op *otsdbProcessor) readStats() string {
+	samples := atomic.LoadUint64(&op.samples)
+	elapsed := time.Since(op.readStart)
+	var rate float64
+	if secs := elapsed.Seconds(); secs > 0 {
+		rate = float64(samples) / secs
+	}
+	return fmt.Sprintf("Read stats (--%s):\n"+
+		"  read samples: %d;\n"+
+		"  read series: %d;\n"+
+		"  read speed: %.0f samples/s;\n"+
+		"  elapsed time: %s;\n",
+		otsdbNoImport, samples, atomic.LoadUint64(&op.readSeries), rate, elapsed.Round(time.Millisecond))
+}
+
+// importMetrics processes the discovered metrics sequentially or concurrently
+// according to metricCC. The progress bar is shared between all the metrics
+// and is finished on return.
+func (op *otsdbProcessor) importMetrics(ctx context.Context, discovered []metricSeries, startTime int64, totalRanges int, verbose bool) error {
+	bar, finishBar, err := op.startProgressBar(totalRanges)
+	if err != nil {
+		return err
+	}
+	defer finishBar()
+	if op.metricCC <= 1 {
+		for _, ms := range discovered {
+			if ctx.Err() != nil {
+				break
+			}
+			err := op.processMetric(ctx, ms, startTime, bar, verbose)
+			if err != nil {
+				if isInterrupted(ctx, err) {
+					break
+				}
+				return err
+			}
+			log.Print(op.im.Stats())
+		}
+		return nil
+	}
+
+	// workerCtx stops the rest of workers on the first error
+	workerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	metricCh := make(chan metricSeries)
+	metricErrCh := make(chan error, op.metricCC)
+	var wg sync.WaitGroup
+	wg.Add(op.metricCC)
+	for i := 0; i < op.metricCC; i++ {
+		go func() {
+			defer wg.Done()
+			for ms := range metricCh {
+				err := op.processMetric(workerCtx, ms, startTime, bar, verbose)
+				if err != nil && !isInterrupted(workerCtx, err) {
+					metricErrCh <- err
+					return
+				}
+			}
+		}()
+	}
+loop:
+	for _, ms := range discovered {
+		select {
+		case <-ctx.Done():
+			break loop
+		case err = <-metricErrCh:
+			break loop
+		case metricCh <- ms:
+		}
+	}
+	if err != nil {
+		cancel()
+	}
+	close(metricCh)
+	wg.Wait()
+	close(metricErrCh)
+	if err != nil {
+		return err
+	}
+	for err := range metricErrCh {
+		return err
+	}
+	return nil
+}
+
+// reportDryRun prints the summary of what would be transferred.
+// totalRanges is the number of query ranges of all the series.
+func (op *otsdbProcessor) reportDryRun(metrics, totalSeries, totalRanges int) {
+	var queryRanges int
 	for _, rt := range op.oc.Retentions {
 		queryRanges += len(rt.QueryRanges)
 	}
-	for _, metric := range metrics {
-		log.Printf("Starting work on %s", metric)
-		serieslist, err := op.oc.FindSeries(metric)
+	log.Printf("Dry run finished! Nothing was imported.\n"+
+		"  metrics: %d;\n"+
+		"  series: %d;\n"+
+		"  query ranges per series: %d;\n"+
+		"  metrics with retention overrides: %d;\n"+
+		"  estimated requests to OpenTSDB: %d;\n"+
+		"  metrics without series: %d;",
+		metrics, totalSeries, queryRanges, len(op.oc.RetentionOverrides), totalRanges, len(op.emptyMetrics))
+}
+
+// queryRanges returns the number of query ranges per series of the given metric
+func (op *otsdbProcessor) queryRanges(metric string) int {
+	var n int
+	for _, rt := range op.oc.MetricRetentions(metric) {
+		n += len(rt.QueryRanges)
+	}
+	return n
+}
+
+// processMetric fetches all the discovered series of the metric for all the configured
+// retentions and sends them to the importer.
+// processMetric is safe for concurrent use, since vm.Importer.Input is.
+// On ctx cancellation processMetric stops sending new queries,
+// waits for in-flight queries and returns ctx error.
+func (op *otsdbProcessor) processMetric(ctx context.Context, ms metricSeries, startTime int64, bar *pb.ProgressBar, verbose bool) error {
+	metric, serieslist := ms.metric, ms.series
+	log.Printf("Starting work on %s", metric)
+	// samples are counted per metric instead of using the importer stats,
+	// since the importer is shared between concurrently processed metrics
+	timer := op.timings.Start(metric, len(serieslist))
+	if op.verifier != nil {
+		op.verifier.Add(serieslist)
+	}
+	lanes := op.oc.Lanes(metric, op.otsdbcc, op.retentionCC)
+	var from int
+	var cursor *opentsdb.SeriesCursor
+	if op.progress != nil {
+		cursor, from = op.progress.StartMetric(metric, len(serieslist), len(lanes))
+		if from > 0 {
+			bar.Add(from * op.queryRanges(metric))
+		}
+	} else {
+		cursor = opentsdb.NewSeriesCursor(len(serieslist), 0, len(lanes))
+	}
+
+	chunkSize := len(serieslist)
+	if op.seriesChunk > 0 {
+		chunkSize = op.seriesChunk
+	}
+	var chunks int
+	for chunkFrom := from; chunkFrom < len(serieslist); chunkFrom += chunkSize {
+		chunkTo := chunkFrom + chunkSize
+		if chunkTo > len(serieslist) {
+			chunkTo = len(serieslist)
+		}
+		n, err := op.processSeriesRange(ctx, ms, lanes, chunkFrom, chunkTo, cursor, startTime, bar, verbose)
+		timer.AddSamples(n)
 		if err != nil {
-			return fmt.Errorf("couldn't retrieve series list for %s : %s", metric, err)
-		}
-		/*
-			Create channels for collecting/processing series and errors
-			We'll create them per metric to reduce pressure against OpenTSDB
-
-			Limit the size of seriesCh so we can't get too far ahead of actual processing
-		*/
-		seriesCh := make(chan queryObj, op.otsdbcc)
-		errCh := make(chan error)
-		// we're going to make serieslist * queryRanges queries, so we should represent that in the progress bar
-		bar := pb.StartNew(len(serieslist) * queryRanges)
-		defer func(bar *pb.ProgressBar) {
-			bar.Finish()
-		}(bar)
-		var wg sync.WaitGroup
-		wg.Add(op.otsdbcc)
-		for i := 0; i < op.otsdbcc; i++ {
-			go func() {
-				defer wg.Done()
-				for s := range seriesCh {
-					if err := op.do(s); err != nil {
-						errCh <- fmt.Errorf("couldn't retrieve series for %s : %s", metric, err)
-						return
-					}
+			timer.Incomplete()
+			return err
+		}
+		chunks++
+		if op.seriesChunk > 0 && chunkTo < len(serieslist) {
+			// the data of the chunk is sent before fetching the next one,
+			// so memory usage doesn't depend on the number of series of the metric
+			if vmErr := op.flushSink(); vmErr != nil {
+				op.countImportError(vmErr)
+				timer.Incomplete()
+				return fmt.Errorf("import process failed: %w", wrapErr(vmErr, verbose))
+			}
+		}
+	}
+	if verbose && op.seriesChunk > 0 {
+		log.Printf("%s: %d series were processed in %d chunks of up to %d series", metric, len(serieslist)-from, chunks, op.seriesChunk)
+	}
+	timer.Done()
+	if op.state != nil && op.failures.QueriesCount(metric) == 0 {
+		op.state.DoneMetric(metric)
+	}
+	if op.progress != nil {
+		// the metric is marked as done in checkpoint once its buffered data is sent
+		op.progress.DoneMetric(metric, op.fetchedSamples())
+	}
+	return nil
+}
+
+// processSeriesRange fetches the series of the metric with indexes in the range [from, to)
+// for all the lanes and returns the number of imported samples.
+func (op *otsdbProcessor) processSeriesRange(ctx context.Context, ms metricSeries, lanes []opentsdb.Lane, from, to int,
+	cursor *opentsdb.SeriesCursor, startTime int64, bar *pb.ProgressBar, verbose bool) (uint64, error) {
+	var samples uint64
+	// lanes dispatch queries independently of each other,
+	// so the first failed lane stops the rest via laneCtx
+	laneCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	laneErrs := make(chan error, len(lanes))
+	for _, lane := range lanes {
+		go func(lane opentsdb.Lane) {
+			n, err := op.processLane(laneCtx, ms, lane, from, to, cursor, startTime, bar, verbose)
+			atomic.AddUint64(&samples, n)
+			if err != nil {
+				cancel()
+			}
+			laneErrs <- err
+		}(lane)
+	}
+	var err error
+	for range lanes {
+		// prefer the error which caused the cancellation of other lanes
+		if laneErr := <-laneErrs; laneErr != nil && (err == nil || isInterrupted(laneCtx, err)) {
+			err = laneErr
+		}
+	}
+	return atomic.LoadUint64(&samples), err
+}
+
+// processLane sends queries of the lane retentions for series of ms with indexes in the range [from, to)
+// and returns the number of imported samples.
+func (op *otsdbProcessor) processLane(ctx context.Context, ms metricSeries, lane opentsdb.Lane, from, to int,
+	cursor *opentsdb.SeriesCursor, startTime int64, bar *pb.ProgressBar, verbose bool) (uint64, error) {
+	metric, serieslist := ms.metric, ms.series
+	var samples uint64
+	/*
+		Create channels for collecting/processing series and errors
+		We'll create them per metric to reduce pressure against OpenTSDB
+
+		Limit the size of seriesCh so we can't get too far ahead of actual processing
+	*/
+	seriesCh := make(chan queryObj, lane.Concurrency)
+	// every worker sends at most one error, so errCh must fit all of them
+	// for not blocking the workers while draining
+	errCh := make(chan error, lane.Concurrency)
+	var wg sync.WaitGroup
+	wg.Add(lane.Concurrency)
+	for i := 0; i < lane.Concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			n := op.queryWorker(ctx, metric, bar, seriesCh, errCh)
+			atomic.AddUint64(&samples, n)
+		}()
+	}
+	// stopWorkers must be called on early return for not leaking the workers
+	stopWorkers := func() {
+		close(seriesCh)
+		wg.Wait()
+	}
+	/*
+		Loop through all series for this metric, processing all retentions and time ranges
+		requested. This loop is our primary "collect data from OpenTSDB loop" and should
+		be async, sending data to VictoriaMetrics over time.
+
+		The idea with having the select at the inner-most loop is to ensure quick
+		short-circuiting on error.
+	*/
+	for idx := from; idx < to; idx++ {
+		series := serieslist[idx]
+		var lastTS int64
+		if op.state != nil {
+			lastTS = op.state.LastTimestamp(series.Metric)
+		}
+		if op.incremental {
+			var err error
+			lastTS, err = op.lastImportedTimestamp(ctx, series, startTime)
+			if err != nil {
+				stopWorkers()
+				if ctx.Err() != nil {
+					return samples, ctx.Err()
+				}
+				return samples, fmt.Errorf("couldn't get the latest imported timestamp for %s: %s", series.Metric, err)
+			}
+		}
+		for _, rt := range lane.Retentions {
+			for _, tr := range rt.QueryRanges {
+				tr, ok := op.oc.ClampRange(startTime, tr)
+				if !ok {
+					// the time range is out of the hard end and min timestamps
 					bar.Increment()
+					continue
+				}
+				if err := op.waitInflight(ctx); err != nil {
+					stopWorkers()
+					return samples, err
 				}
-			}()
-		}
-		/*
-			Loop through all series for this metric, processing all retentions and time ranges
-			requested. This loop is our primary "collect data from OpenTSDB loop" and should
-			be async, sending data to VictoriaMetrics over time.
-
-			The idea with having the select at the inner-most loop is to ensure quick
-			short-circuiting on error.
-		*/
-		for _, series := range serieslist {
-			for _, rt := range op.oc.Retentions {
-				for _, tr := range rt.QueryRanges {
-					select {
-					case otsdbErr := <-errCh:
-						return fmt.Errorf("opentsdb error: %s", otsdbErr)
-					case vmErr := <-op.im.Errors():
-						return fmt.Errorf("import process failed: %s", wrapErr(vmErr, verbose))
-					case seriesCh <- queryObj{
-						Tr: tr, StartTime: startTime,
-						Series: series, Rt: opentsdb.RetentionMeta{
-							FirstOrder: rt.FirstOrder, SecondOrder: rt.SecondOrder, AggTime: rt.AggTime}}:
+				if lastTS > 0 {
+					// skip time ranges which were already imported
+					if startTime-tr.End <= lastTS {
+						bar.Increment()
+						continue
+					}
+					if startTime-tr.Start <= lastTS {
+						tr.Start = startTime - lastTS - 1
 					}
 				}
+				// the query is accounted before sending,
+				// since it may be processed before select returns
+				cursor.Add(idx)
+				select {
+				case <-ctx.Done():
+					stopWorkers()
+					return samples, ctx.Err()
+				case otsdbErr := <-errCh:
+					stopWorkers()
+					return samples, fmt.Errorf("opentsdb error: %w", otsdbErr)
+				case vmErr := <-op.im.Errors():
+					stopWorkers()
+					op.countImportError(vmErr)
+					return samples, fmt.Errorf("import process failed: %w", wrapErr(vmErr, verbose))
+				case seriesCh <- queryObj{
+					Tr: tr, StartTime: startTime,
+					Series: series, Rt: opentsdb.RetentionMeta{
+						FirstOrder: rt.FirstOrder, SecondOrder: rt.SecondOrder, AggTime: rt.AggTime},
+					cursor: cursor, idx: idx}:
+				}
 			}
 		}
+		cursor.DispatchedAll(lane.Idx, idx)
+	}
 
-		// Drain channels per metric
+	// Drain channels per metric
+	close(seriesCh)
+	wg.Wait()
+	close(errCh)
+	// check for any lingering errors on the query side
+	for otsdbErr := range errCh {
+		return samples, fmt.Errorf("Import process failed: \n%w", otsdbErr)
+	}
+	if err := ctx.Err(); err != nil {
+		// workers could skip some queries,
+		// so the metric can't be marked as imported
+		return samples, err
+	}
+	return samples, nil
+}
+
+// queryWorker executes queries from seriesCh until it is closed.
+// The first failed query is sent to errCh and stops the worker,
+// unless skipErrors is set or the query timed out or got malformed response in non-strict mode. It returns the number of samples sent to the importer.
+func (op *otsdbProcessor) queryWorker(ctx context.Context, metric string, bar *pb.ProgressBar, seriesCh <-chan queryObj, errCh chan<- error) uint64 {
+	var total uint64
+	atomic.AddInt64(&fetchWorkers, 1)
+	defer atomic.AddInt64(&fetchWorkers, -1)
+	op.waitJitter(ctx)
+	for s := range seriesCh {
+		if ctx.Err() != nil {
+			// skip the buffered queries on interruption
+			continue
+		}
+		atomic.AddInt64(&busyFetchWorkers, 1)
+		samples, timedOut, err := op.doWithTimeout(ctx, s)
+		atomic.AddInt64(&busyFetchWorkers, -1)
+		if err != nil && ctx.Err() != nil {
+			// the in-flight query was aborted on interruption,
+			// so it must be neither skipped nor marked as failed
+			continue
+		}
+		if err != nil {
+			selector := op.markSeriesFailed(opentsdb.RetryQuery{
+				Series:    s.Series,
+				Retention: s.Rt,
+				TimeRange: s.Tr,
+				StartTime: s.StartTime,
+			})
+			skip := op.skipErrors
+			switch {
+			case timedOut && !op.strict:
+				// the stuck series mustn't stall the whole migration
+				skip = true
+				atomic.AddUint64(&op.timedOut, 1)
+				log.Printf("abandoning series %s on time range [%d, %d] after --%s=%s: %s",
+					selector, s.Tr.Start, s.Tr.End, otsdbSeriesTimeout, op.seriesTimeout, err)
+			case opentsdb.IsDecodeError(err) && !op.strict:
+				// the response was already retried by the client,
+				// so the series is left for the retry manifest
+				skip = true
+				atomic.AddUint64(&op.malformed, 1)
+				log.Printf("skipping series %s on time range [%d, %d] because of malformed response: %s",
+					selector, s.Tr.Start, s.Tr.End, err)
+			case skip:
+				log.Printf("skipping series %s on time range [%d, %d]: %s", selector, s.Tr.Start, s.Tr.End, err)
+			}
+			if skip {
+				if s.cursor != nil {
+					s.cursor.Done(s.idx)
+				}
+				bar.Increment()
+				continue
+			}
+			errCh <- fmt.Errorf("couldn't retrieve series for %s : %w", metric, err)
+			return total
+		}
+		total += uint64(samples)
+		op.addSamples(bar, samples)
+		if op.progress != nil {
+			op.progress.SetLast(s.Series, s.Tr)
+		}
+		if s.cursor != nil {
+			s.cursor.Done(s.idx)
+		}
+		bar.Increment()
+	}
+	return total
+}
+
+// waitJitter waits for a random duration up to queryJitter or until ctx is done,
+// so concurrently started workers spread their first queries over time
+func (op *otsdbProcessor) waitJitter(ctx context.Context) {
+	if op.queryJitter <= 0 {
+		return
+	}
+	t := time.NewTimer(time.Duration(rand.Int63n(int64(op.queryJitter))))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// runRetry re-processes the queries loaded from retry manifest
+// without discovering metrics and series in OpenTSDB.
+func (op *otsdbProcessor) runRetry(ctx context.Context, silent, verbose bool) error {
+	if len(op.retryQueries) < 1 {
+		log.Println("Retry manifest contains no queries, nothing to import")
+		return nil
+	}
+	metrics, byMetric := opentsdb.GroupByMetric(op.retryQueries)
+	question := fmt.Sprintf("Found %d queries for %d metrics in retry manifest. Continue?", len(op.retryQueries), len(metrics))
+	if !silent && !prompt(question) {
+		return nil
+	}
+	op.resetSinkStats()
+	op.readStart = time.Now()
+	bar, finishBar, err := op.startProgressBar(len(op.retryQueries))
+	if err != nil {
+		return err
+	}
+	for _, metric := range metrics {
+		if ctx.Err() != nil {
+			break
+		}
+		queries := make([]queryObj, 0, len(byMetric[metric]))
+		for _, q := range byMetric[metric] {
+			queries = append(queries, queryObj{
+				Series:    q.Series,
+				Rt:        q.Retention,
+				Tr:        q.TimeRange,
+				StartTime: q.StartTime,
+			})
+		}
+		if err = op.processQueries(ctx, metric, queries, bar, verbose); err != nil {
+			if isInterrupted(ctx, err) {
+				err = nil
+			}
+			break
+		}
+	}
+	finishBar()
+	return op.finishImport(ctx, err, 0, verbose)
+}
+
+// processQueries executes the given queries of the metric
+// and sends the results to the importer.
+func (op *otsdbProcessor) processQueries(ctx context.Context, metric string, queries []queryObj, bar *pb.ProgressBar, verbose bool) error {
+	log.Printf("Retrying %d queries for %s", len(queries), metric)
+	seriesCh := make(chan queryObj, op.otsdbcc)
+	errCh := make(chan error, op.otsdbcc)
+	var wg sync.WaitGroup
+	wg.Add(op.otsdbcc)
+	for i := 0; i < op.otsdbcc; i++ {
+		go func() {
+			defer wg.Done()
+			op.queryWorker(ctx, metric, bar, seriesCh, errCh)
+		}()
+	}
+	stopWorkers := func() {
 		close(seriesCh)
 		wg.Wait()
-		close(errCh)
-		// check for any lingering errors on the query side
-		for otsdbErr := range errCh {
-			return fmt.Errorf("Import process failed: \n%s", otsdbErr)
-		}
-		bar.Finish()
-		log.Print(op.im.Stats())
 	}
-	op.im.Close()
-	for vmErr := range op.im.Errors() {
-		if vmErr.Err != nil {
-			return fmt.Errorf("import process failed: %s", wrapErr(vmErr, verbose))
+	for _, q := range queries {
+		if err := op.waitInflight(ctx); err != nil {
+			stopWorkers()
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			stopWorkers()
+			return ctx.Err()
+		case otsdbErr := <-errCh:
+			stopWorkers()
+			return fmt.Errorf("opentsdb error: %w", otsdbErr)
+		case vmErr := <-op.im.Errors():
+			stopWorkers()
+			op.countImportError(vmErr)
+			return fmt.Errorf("import process failed: %w", wrapErr(vmErr, verbose))
+		case seriesCh <- q:
 		}
 	}
-	log.Println("Import finished!")
-	log.Print(op.im.Stats())
-	return nil
+	stopWorkers()
+	close(errCh)
+	for otsdbErr := range errCh {
+		return fmt.Errorf("Import process failed: \n%w", otsdbErr)
+	}
+	return ctx.Err()
+}
+
+// doWithTimeout calls do with seriesTimeout deadline if it is set.
+// It returns whether the query was aborted because of the deadline.
+func (op *otsdbProcessor) doWithTimeout(ctx context.Context, s queryObj) (int, bool, error) {
+	if op.seriesTimeout <= 0 {
+		samples, err := op.do(ctx, s)
+		return samples, false, err
+	}
+	queryCtx, cancel := context.WithTimeout(ctx, op.seriesTimeout)
+	defer cancel()
+	samples, err := op.do(queryCtx, s)
+	timedOut := err != nil && ctx.Err() == nil && errors.Is(queryCtx.Err(), context.DeadlineExceeded)
+	return samples, timedOut, err
 }
 
-func (op *otsdbProcessor) do(s queryObj) error {
+// do fetches the data for the given query and sends it to the importer.
+// It returns the number of imported samples.
+func (op *otsdbProcessor) do(ctx context.Context, s queryObj) (int, error) {
 	start := s.StartTime - s.Tr.Start
 	end := s.StartTime - s.Tr.End
-	data, err := op.oc.GetData(s.Series, s.Rt, start, end, op.oc.MsecsTime)
+	data, err := op.oc.GetData(ctx, s.Series, s.Rt, start, end, op.oc.MsecsTime)
 	if err != nil {
-		return fmt.Errorf("failed to collect data for %v in %v:%v :: %v", s.Series, s.Rt, s.Tr, err)
+		return 0, fmt.Errorf("failed to collect data for %v in %v:%v :: %w", s.Series, s.Rt, s.Tr, err)
+	}
+	if op.importAnnotations {
+		if err := op.sendAnnotations(data); err != nil {
+			return 0, err
+		}
 	}
 	if len(data.Timestamps) < 1 || len(data.Values) < 1 {
-		return nil
+		return 0, nil
 	}
-	labels := make([]vm.LabelPair, len(data.Tags))
-	for k, v := range data.Tags {
-		labels = append(labels, vm.LabelPair{Name: k, Value: v})
+	if err := opentsdb.CheckTimestamps(data.Timestamps, time.Now()); err != nil {
+		return 0, fmt.Errorf("unexpected data for %v in %v:%v: %s; check whether --%s flag matches the unit of OpenTSDB timestamps",
+			s.Series, s.Rt, s.Tr, err, otsdbMsecsTime)
+	}
+	// NaN values represent the gaps in data returned for "nan" and "null" fill policies,
+	// so they are dropped before the deduplication for not overriding real values
+	if !op.keepNaN {
+		data.Timestamps, data.Values = opentsdb.DropNaNs(data.Timestamps, data.Values)
+		if len(data.Timestamps) < 1 {
+			return 0, nil
+		}
+	}
+	if op.dedup {
+		if vm.HasOutOfOrderTimestamps(data.Timestamps) {
+			atomic.AddUint64(&op.sortedSeries, 1)
+		}
+		data.Timestamps, data.Values = opentsdb.DedupSamples(data.Timestamps, data.Values)
+	}
+	if vt, ok := op.valueTransforms.Get(s.Series.Metric); ok {
+		vt.Apply(data.Values)
+	}
+	op.tags.Apply(&data)
+	if len(op.tags.Flatten) > 0 {
+		if err := op.flattened.Check(s.Series, data); err != nil {
+			return 0, fmt.Errorf("%s because of --%s; change the list of tags to flatten for avoiding mixing up their data", err, otsdbFlattenTags)
+		}
 	}
 	ts := vm.TimeSeries{
 		Name:       data.Metric,
-		LabelPairs: labels,
+		LabelPairs: tagsToLabels(data.Tags),
 		Timestamps: data.Timestamps,
 		Values:     data.Values,
 	}
+	if op.noImport {
+		atomic.AddUint64(&op.readSeries, 1)
+		return len(ts.Timestamps), nil
+	}
 	if err := op.im.Input(&ts); err != nil {
-		return err
+		return 0, err
+	}
+	return len(ts.Timestamps), nil
+}
+
+// countImportError accounts the series of the batch failed to be imported
+func (op *otsdbProcessor) countImportError(vmErr *vm.ImportError) {
+	if vmErr == nil || vmErr.Err == nil {
+		return
+	}
+	for _, ts := range vmErr.Batch {
+		labels := make(map[string]string, len(ts.LabelPairs)+1)
+		for _, lp := range ts.LabelPairs {
+			labels[lp.Name] = lp.Value
+		}
+		labels["__name__"] = ts.Name
+		op.failures.AddSeries(vm.Selector(labels))
+	}
+}
+
+// markSeriesFailed registers the series of the given query as failed
+// and returns its selector
+func (op *otsdbProcessor) markSeriesFailed(q opentsdb.RetryQuery) string {
+	series := q.Series
+	selector, err := op.seriesSelector(series)
+	if err != nil {
+		// series can't be imported at all, so use its original name
+		labels := make(map[string]string, len(series.Tags)+1)
+		for k, v := range series.Tags {
+			labels[k] = v
+		}
+		labels["__name__"] = series.Metric
+		selector = vm.Selector(labels)
+	}
+	op.failures.AddQuery(selector, q)
+	return selector
+}
+
+// waitInflight blocks until the number of samples in-flight
+// to VictoriaMetrics drops below maxInflightSamples
+func (op *otsdbProcessor) waitInflight(ctx context.Context) error {
+	if op.maxInflightSamples <= 0 {
+		return nil
+	}
+	for {
+		n, ok := op.inflightSamples()
+		if !ok || n < op.maxInflightSamples {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// inflightSamples returns the number of samples passed to the sink,
+// which weren't sent yet. ok is false if the sink doesn't track them.
+func (op *otsdbProcessor) inflightSamples() (n int64, ok bool) {
+	ic, ok := op.im.(inflightCounter)
+	if !ok {
+		return 0, false
+	}
+	return ic.InflightSamples(), true
+}
+
+// flushSink waits until the series passed to the sink are sent.
+// It is no-op for sinks, which can't be flushed.
+func (op *otsdbProcessor) flushSink() *vm.ImportError {
+	f, ok := op.im.(sinkFlusher)
+	if !ok {
+		return nil
+	}
+	return f.Flush()
+}
+
+// resetSinkStats resets the stats of the sink, if it supports that
+func (op *otsdbProcessor) resetSinkStats() {
+	if sr, ok := op.im.(statsResetter); ok {
+		sr.ResetStats()
+	}
+}
+
+// addSamples accounts the given number of imported samples
+// and updates the import speed shown by the progress bar
+func (op *otsdbProcessor) addSamples(bar *pb.ProgressBar, n int) {
+	total := atomic.AddUint64(&op.samples, uint64(n))
+	if elapsed := time.Since(bar.StartTime()).Seconds(); elapsed > 0 {
+		bar.Set("samples", fmt.Sprintf("%.0f samples/s", float64(total)/elapsed))
+	}
+}
+
+// lastImportedTimestamp returns the timestamp of the latest sample
+// of the given series in VictoriaMetrics in OpenTSDB time units.
+// Zero is returned if VictoriaMetrics has no data for the series
+// on the time range covered by the configured retentions.
+func (op *otsdbProcessor) lastImportedTimestamp(ctx context.Context, series opentsdb.Meta, startTime int64) (int64, error) {
+	selector, err := op.seriesSelector(series)
+	if err != nil {
+		return 0, err
+	}
+	var maxStart int64
+	for _, rt := range op.oc.MetricRetentions(series.Metric) {
+		for _, tr := range rt.QueryRanges {
+			if tr.Start > maxStart {
+				maxStart = tr.Start
+			}
+		}
+	}
+	start, end := startTime-maxStart, startTime
+	lastTS, err := op.vmQuerier.LastTimestamp(ctx, selector, op.oc.ToTime(start), op.oc.ToTime(end))
+	if err != nil {
+		return 0, err
+	}
+	if !op.oc.MsecsTime {
+		lastTS /= 1e3
+	}
+	return lastTS, nil
+}
+
+// seriesSelector returns series selector matching
+// the given OpenTSDB series in VictoriaMetrics.
+func (op *otsdbProcessor) seriesSelector(series opentsdb.Meta) (string, error) {
+	labels, err := op.seriesLabels(series)
+	if err != nil {
+		return "", err
+	}
+	return vm.Selector(labels), nil
+}
+
+// seriesLabels returns labels of the given OpenTSDB series
+// the way they are imported into VictoriaMetrics,
+// including metric name in __name__ label.
+func (op *otsdbProcessor) seriesLabels(series opentsdb.Meta) (map[string]string, error) {
+	m, err := op.oc.SanitizeSeries(series)
+	if err != nil {
+		return nil, err
+	}
+	op.tags.Apply(&m)
+	labels := make(map[string]string, len(m.Tags)+1)
+	for k, v := range m.Tags {
+		labels[k] = v
+	}
+	labels["__name__"] = m.Metric
+	return labels, nil
+}
+
+// sortSeries sorts series by metric name and tags,
+// so they are processed in the same order on every run
+func sortSeries(series []opentsdb.Meta) {
+	keys := make([]string, len(series))
+	for i, s := range series {
+		// maps are printed sorted by keys
+		keys[i] = fmt.Sprintf("%s%v", s.Metric, s.Tags)
+	}
+	sort.Sort(seriesByKey{series: series, keys: keys})
+}
+
+type seriesByKey struct {
+	series []opentsdb.Meta
+	keys   []string
+}
+
+func (s seriesByKey) Len() int           { return len(s.series) }
+func (s seriesByKey) Less(i, j int) bool { return s.keys[i] < s.keys[j] }
+func (s seriesByKey) Swap(i, j int) {
+	s.series[i], s.series[j] = s.series[j], s.series[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+// discoverMetrics returns metrics matching the configured filters and regexes.
+// Filters are processed concurrently by otsdbcc workers. Metrics are returned in the order
+// of filters without duplicates, so the order doesn't depend on the order of responses.
+// The first failed filter stops the discovery.
+func (op *otsdbProcessor) discoverMetrics(ctx context.Context) ([]string, error) {
+	log.Println("Loading all metrics from OpenTSDB for filters: ", op.oc.Filters)
+	filters := op.oc.Filters
+	results := make([][]string, len(filters))
+	workers := op.otsdbcc
+	if workers > len(filters) {
+		workers = len(filters)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	// discoveryCtx stops the rest of workers on the first error
+	discoveryCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var errOnce sync.Once
+	var firstErr error
+	filterCh := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for idx := range filterCh {
+				m, err := op.findMetrics(discoveryCtx, filters[idx])
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					continue
+				}
+				results[idx] = m
+			}
+		}()
+	}
+loop:
+	for idx := range filters {
+		select {
+		case <-discoveryCtx.Done():
+			break loop
+		case filterCh <- idx:
+		}
+	}
+	close(filterCh)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var metrics []string
+	var duplicates int
+	seen := make(map[string]struct{})
+	for _, m := range results {
+		for _, metric := range m {
+			if _, ok := seen[metric]; ok {
+				// overlapping filters return the same metrics
+				duplicates++
+				continue
+			}
+			seen[metric] = struct{}{}
+			metrics = append(metrics, metric)
+		}
+	}
+	if duplicates > 0 {
+		log.Printf("Skipped %d duplicate metrics matching multiple filters", duplicates)
+	}
+	if filtered := op.oc.FilterMetrics(metrics); len(filtered) != len(metrics) {
+		log.Printf("Filtered out %d metrics via include/exclude regexes", len(metrics)-len(filtered))
+		metrics = filtered
+	}
+	if len(metrics) < 1 {
+		return nil, fmt.Errorf("found no timeseries to import with filters %q", op.oc.Filters)
+	}
+	return metrics, nil
+}
+
+// findMetrics returns metrics matching the given filter
+func (op *otsdbProcessor) findMetrics(ctx context.Context, filter string) ([]string, error) {
+	if op.oc.UseLookup {
+		m, err := op.oc.FindMetricsLookup(ctx, filter)
+		if err != nil {
+			return nil, fmt.Errorf("metric discovery via lookup failed for %q: %w", filter, err)
+		}
+		return m, nil
+	}
+	if op.oc.Discovery == opentsdb.DiscoveryUIDMeta {
+		m, err := op.oc.FindMetricsUIDMeta(ctx, filter)
+		if err != nil {
+			return nil, fmt.Errorf("metric discovery via uidmeta failed for %q: %w", filter, err)
+		}
+		return m, nil
+	}
+	q := fmt.Sprintf("/api/suggest?type=metrics&q=%s&max=%d", filter, op.oc.Limit)
+	m, err := op.oc.FindMetrics(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("metric discovery failed for %q: %w", q, err)
+	}
+	return m, nil
+}
+
+// readMetricsList reads the list of metrics from the file at path, one metric per line,
+// in the same format as written by writeMetricsList. Empty lines, lines starting with #
+// and duplicate metrics are ignored. The list must contain at least one metric.
+func readMetricsList(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read list of metrics from %q: %s", path, err)
+	}
+	var metrics []string
+	seen := make(map[string]struct{})
+	for _, line := range strings.Split(string(data), "\n") {
+		metric := strings.TrimSpace(line)
+		if metric == "" || strings.HasPrefix(metric, "#") {
+			continue
+		}
+		if _, ok := seen[metric]; ok {
+			continue
+		}
+		seen[metric] = struct{}{}
+		metrics = append(metrics, metric)
+	}
+	if len(metrics) == 0 {
+		return nil, fmt.Errorf("list of metrics at %q contains no metrics", path)
+	}
+	return metrics, nil
+}
+
+// writeMetricsList writes sorted and deduplicated list of metrics
+// to the file at path, one metric per line.
+func writeMetricsList(path string, metrics []string) error {
+	list := make([]string, len(metrics))
+	copy(list, metrics)
+	sort.Strings(list)
+	var sb strings.Builder
+	for i, m := range list {
+		if i > 0 && m == list[i-1] {
+			continue
+		}
+		sb.WriteString(m)
+		sb.WriteString("\n")
+	}
+	if err := os.WriteFile(path, []byte(sb.String()), 0644); err != nil {
+		return fmt.Errorf("cannot write list of metrics to %q: %s", path, err)
 	}
 	return nil
 }
+
+// tagsToLabels converts OpenTSDB tags into VictoriaMetrics labels
+func tagsToLabels(tags map[string]string) []vm.LabelPair {
+	labels := make([]vm.LabelPair, 0, len(tags))
+	for k, v := range tags {
+		labels = append(labels, vm.LabelPair{Name: k, Value: v})
+	}
+	return labels
+}
+
+// runVerify compares the number of samples in OpenTSDB and VictoriaMetrics
+// for the sampled series of the run started at startTime.
+func (op *otsdbProcessor) runVerify(ctx context.Context, startTime int64) error {
+	return op.verifier.Run(ctx, op.oc, startTime, op.keepNaN, func(ctx context.Context, s opentsdb.Meta, start, end time.Time) (string, int, error) {
+		labels, err := op.seriesLabels(s)
+		if err != nil {
+			return "", 0, err
+		}
+		selector := vm.Selector(labels)
+		n, err := op.vmQuerier.CountSamples(ctx, labels, start, end)
+		if err != nil {
+			return "", 0, fmt.Errorf("cannot count samples for %s in VictoriaMetrics: %s", selector, err)
+		}
+		return selector, n, nil
+	})
+}
@@ -0,0 +1,128 @@
+package opentsdb
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// calendarInterval is the aggregation interval
+// aligned to calendar boundaries in the given location
+type calendarInterval struct {
+	// step is the interval for s, m and h units. It evenly divides a day,
+	// so the intervals are counted from the local midnight
+	step time.Duration
+	// days is the number of days for d unit.
+	// The intervals are counted from 1970-01-01 in local time
+	days int64
+}
+
+// parseCalendarInterval parses OpenTSDB aggregation interval, e.g. 1h or 1d,
+// for calendar-aligned downsampling
+func parseCalendarInterval(aggTime string) (calendarInterval, error) {
+	if len(aggTime) < 2 {
+		return calendarInterval{}, fmt.Errorf("invalid aggregation interval %q", aggTime)
+	}
+	n, err := strconv.ParseInt(aggTime[:len(aggTime)-1], 10, 64)
+	if err != nil || n <= 0 {
+		return calendarInterval{}, fmt.Errorf("calendar alignment isn't supported for aggregation interval %q; "+
+			"expecting a positive number of s, m, h or d units", aggTime)
+	}
+	var unit time.Duration
+	switch aggTime[len(aggTime)-1] {
+	case 's':
+		unit = time.Second
+	case 'm':
+		unit = time.Minute
+	case 'h':
+		unit = time.Hour
+	case 'd':
+		return calendarInterval{days: n}, nil
+	default:
+		return calendarInterval{}, fmt.Errorf("calendar alignment isn't supported for aggregation interval %q; "+
+			"supported units are s, m, h and d", aggTime)
+	}
+	step := time.Duration(n) * unit
+	if step > 24*time.Hour || (24*time.Hour)%step != 0 {
+		return calendarInterval{}, fmt.Errorf("aggregation interval %q must evenly divide a day for calendar alignment", aggTime)
+	}
+	return calendarInterval{step: step}, nil
+}
+
+// floor returns the start of the calendar interval containing t in loc
+func (ci calendarInterval) floor(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	y, m, d := t.Date()
+	var start time.Time
+	if ci.days > 0 {
+		// days are counted by the local date, so DST transitions
+		// don't shift the boundaries from the local midnight
+		days := time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / (24 * 3600)
+		rem := days % ci.days
+		if rem < 0 {
+			rem += ci.days
+		}
+		days -= rem
+		y, m, d = time.Unix(days*24*3600, 0).UTC().Date()
+		start = time.Date(y, m, d, 0, 0, 0, 0, loc)
+	} else {
+		// the intervals are counted by the wall clock,
+		// the same way as OpenTSDB does for calendar boundaries
+		h, minute, sec := t.Clock()
+		elapsed := time.Duration(h)*time.Hour + time.Duration(minute)*time.Minute + time.Duration(sec)*time.Second
+		elapsed -= elapsed % ci.step
+		start = time.Date(y, m, d, 0, 0, int(elapsed/time.Second), 0, loc)
+	}
+	if start.After(t) {
+		// the wall clock time is ambiguous on DST transition
+		// and was resolved to the later zone, so use the earlier one
+		_, startOffset := start.Zone()
+		_, offset := t.Zone()
+		start = start.Add(time.Duration(startOffset-offset) * time.Second)
+	}
+	return start
+}
+
+// alignTimestamp returns the start of the calendar-aligned
+// aggregation interval containing ts
+func (c *Client) alignTimestamp(ts int64, aggTime string, mSecs bool) int64 {
+	ci, err := parseCalendarInterval(aggTime)
+	if err != nil {
+		// aggregation intervals are validated in NewClient
+		return ts
+	}
+	if mSecs {
+		return ci.floor(time.UnixMilli(ts), c.location).UnixMilli()
+	}
+	return ci.floor(time.Unix(ts, 0), c.location).Unix()
+}
+
+// AlignQueryRanges returns query ranges of rt for the given start timestamp with
+// boundaries aligned to calendar boundaries of the aggregation interval of rt,
+// so downsampled intervals aren't split between queries.
+// Every returned range starts at the beginning of an interval and ends right before
+// the beginning of the next range, so ranges neither overlap nor leave gaps between them.
+// The incomplete interval at the newest bound of the ranges isn't queried.
+// Query ranges are expected in the order of increasing offsets from the start timestamp.
+func (c *Client) AlignQueryRanges(rt Retention, startTime int64) []TimeRange {
+	if len(rt.QueryRanges) == 0 {
+		return nil
+	}
+	align := func(ts int64) int64 {
+		return c.alignTimestamp(ts, rt.AggTime, c.MsecsTime)
+	}
+	// the newest bound is inclusive, so the interval
+	// starting right after it isn't included
+	next := align(startTime - rt.QueryRanges[0].End + 1)
+	ranges := make([]TimeRange, 0, len(rt.QueryRanges))
+	for _, tr := range rt.QueryRanges {
+		start := align(startTime - tr.Start)
+		if start >= next {
+			// the range is shorter than the aggregation interval
+			continue
+		}
+		ranges = append(ranges, TimeRange{Start: startTime - start, End: startTime - (next - 1)})
+		next = start
+	}
+	return ranges
+}
@@ -0,0 +1,163 @@
+package opentsdb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCalendarIntervalFloor(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("cannot load location: %s", err)
+	}
+	f := func(aggTime, ts, want string) {
+		t.Helper()
+		ci, err := parseCalendarInterval(aggTime)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		tm, err := time.Parse(time.RFC3339, ts)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %s", ts, err)
+		}
+		got := ci.floor(tm, berlin).Format(time.RFC3339)
+		if got != want {
+			t.Fatalf("unexpected start of %s interval for %s; got %s; want %s", aggTime, ts, got, want)
+		}
+	}
+
+	// month boundaries
+	f("1d", "2023-10-31T23:59:59+01:00", "2023-10-31T00:00:00+01:00")
+	f("1d", "2023-11-01T00:30:00+01:00", "2023-11-01T00:00:00+01:00")
+	f("1d", "2023-03-01T00:00:00+01:00", "2023-03-01T00:00:00+01:00")
+	f("1h", "2023-03-31T23:59:59+02:00", "2023-03-31T23:00:00+02:00")
+	// days around DST transitions start at the local midnight,
+	// even though they are 23h and 25h long
+	f("1d", "2023-03-26T23:30:00+02:00", "2023-03-26T00:00:00+01:00")
+	f("1d", "2023-03-27T00:30:00+02:00", "2023-03-27T00:00:00+02:00")
+	f("1d", "2023-10-29T23:30:00+01:00", "2023-10-29T00:00:00+02:00")
+	f("1d", "2023-10-30T00:30:00+01:00", "2023-10-30T00:00:00+01:00")
+	// multi-day intervals are counted by local dates
+	f("2d", "2023-10-29T12:00:00+01:00", "2023-10-28T00:00:00+02:00")
+	// hours of the repeated wall clock hour on DST end
+	f("1h", "2023-10-29T02:30:00+02:00", "2023-10-29T02:00:00+02:00")
+	f("1h", "2023-10-29T02:30:00+01:00", "2023-10-29T02:00:00+01:00")
+	// intervals within a day are counted by the wall clock
+	f("6h", "2023-03-26T03:30:00+02:00", "2023-03-26T00:00:00+01:00")
+	f("6h", "2023-03-26T07:00:00+02:00", "2023-03-26T06:00:00+02:00")
+	f("30m", "2023-03-26T03:45:10+02:00", "2023-03-26T03:30:00+02:00")
+}
+
+func TestParseCalendarIntervalInvalid(t *testing.T) {
+	f := func(aggTime string) {
+		t.Helper()
+		if _, err := parseCalendarInterval(aggTime); err == nil {
+			t.Fatalf("expecting error for %q", aggTime)
+		}
+	}
+
+	f("")
+	f("d")
+	f("0d")
+	f("1w")
+	f("1y")
+	f("7h")
+	f("25h")
+}
+
+func TestClientAlignQueryRanges(t *testing.T) {
+	f := func(cfg Config, startTime string) {
+		t.Helper()
+		c, err := NewClient(cfg)
+		if err != nil {
+			t.Fatalf("cannot create client: %s", err)
+		}
+		st, err := time.Parse(time.RFC3339, startTime)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %s", startTime, err)
+		}
+		start := st.Unix()
+		for _, rt := range c.Retentions {
+			ci, _ := parseCalendarInterval(rt.AggTime)
+			ranges := c.AlignQueryRanges(rt, start)
+			if len(ranges) != len(rt.QueryRanges) {
+				t.Fatalf("unexpected number of aligned ranges %d; want %d", len(ranges), len(rt.QueryRanges))
+			}
+			for i, tr := range ranges {
+				rangeStart := time.Unix(start-tr.Start, 0)
+				if !ci.floor(rangeStart, c.location).Equal(rangeStart) {
+					t.Fatalf("range %d starts at %s, which isn't aligned to %s", i, rangeStart.In(c.location), rt.AggTime)
+				}
+				if tr.Start <= tr.End {
+					t.Fatalf("unexpected empty range %d: %v", i, tr)
+				}
+				if i == 0 {
+					// the newest range ends right before the interval containing the start timestamp
+					if end := start - tr.End + 1; end != c.alignTimestamp(start, rt.AggTime, false) {
+						t.Fatalf("unexpected end of the newest range %s", time.Unix(end, 0).In(c.location))
+					}
+					continue
+				}
+				// the newer range must start right after the end of the older one
+				if newer := ranges[i-1]; newer.Start != tr.End-1 {
+					t.Fatalf("ranges %v and %v must be adjacent", tr, newer)
+				}
+			}
+		}
+	}
+
+	// the ranges cross DST transitions and month boundaries
+	f(Config{
+		Retentions:      []string{"sum-1d-avg:1d:40d", "sum-1h-avg:1h:10d"},
+		AlignDownsample: true,
+		Timezone:        "Europe/Berlin",
+	}, "2023-11-02T15:04:05+01:00")
+	f(Config{
+		AutoRanges:      []string{"sum-1d-avg:60d", "sum-6h-max:20d"},
+		AlignDownsample: true,
+		Timezone:        "America/New_York",
+	}, "2023-11-06T10:00:00-05:00")
+	f(Config{
+		Retentions:      []string{"sum-1d-avg:1d:30d"},
+		AlignDownsample: true,
+	}, "2023-03-01T12:00:00Z")
+}
+
+func TestClientAlignDownsampleQuery(t *testing.T) {
+	var gotQuery, gotTimezone string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.Query().Get("m")
+		gotTimezone = r.URL.Query().Get("timezone")
+		_, _ = w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(Config{Addr: srv.URL, AlignDownsample: true, Timezone: "Europe/Berlin"})
+	if err != nil {
+		t.Fatalf("cannot create client: %s", err)
+	}
+	s := Meta{Metric: "system.load5", Tags: map[string]string{"host": "h1"}}
+	rt := RetentionMeta{FirstOrder: "sum", SecondOrder: "avg", AggTime: "1d"}
+	if _, err := c.GetData(context.Background(), s, rt, 0, 200, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := "sum:1dc-avg-none:system.load5{host=h1}"; gotQuery != want {
+		t.Fatalf("unexpected query %q; want %q", gotQuery, want)
+	}
+	if gotTimezone != "Europe/Berlin" {
+		t.Fatalf("unexpected timezone %q; want %q", gotTimezone, "Europe/Berlin")
+	}
+
+	if _, err := NewClient(Config{AlignDownsample: true, UseExpAPI: true}); err == nil {
+		t.Fatalf("expecting error for expression API")
+	}
+	if _, err := NewClient(Config{AlignDownsample: true, Timezone: "Mars/Olympus"}); err == nil {
+		t.Fatalf("expecting error for unknown timezone")
+	}
+	if _, err := NewClient(Config{AlignDownsample: true, Retentions: []string{"sum-1w-avg:1d:30d"}}); err == nil {
+		t.Fatalf("expecting error for unsupported aggregation interval")
+	}
+}
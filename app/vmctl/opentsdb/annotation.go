@@ -0,0 +1,75 @@
+package opentsdb
+
+import "sync"
+
+// Annotation is an OpenTSDB annotation such as a deploy marker or an incident.
+// Annotations are returned by data queries along with the data:
+// series annotations are attached to the queried series,
+// while global annotations are returned only if requested.
+// See http://opentsdb.net/docs/build/html/api_http/query/index.html#response
+type Annotation struct {
+	TSUID       string            `json:"tsuid"`
+	Description string            `json:"description"`
+	Notes       string            `json:"notes"`
+	Custom      map[string]string `json:"custom"`
+	// StartTime and EndTime are Unix timestamps in seconds.
+	// EndTime is zero for annotations without end.
+	StartTime int64 `json:"startTime"`
+	EndTime   int64 `json:"endTime"`
+}
+
+// StartTimeMillis returns the start time of a in milliseconds
+func (a Annotation) StartTimeMillis() int64 {
+	return a.StartTime * 1000
+}
+
+// mergeAnnotations appends annotations of src to dst, skipping duplicates.
+// Global annotations are returned for every query, so the results
+// of split time ranges may contain the same annotations.
+func mergeAnnotations(dst, src []Annotation) []Annotation {
+	for _, a := range src {
+		if !containsAnnotation(dst, a) {
+			dst = append(dst, a)
+		}
+	}
+	return dst
+}
+
+func containsAnnotation(list []Annotation, a Annotation) bool {
+	for _, b := range list {
+		if b.TSUID == a.TSUID && b.StartTime == a.StartTime && b.Description == a.Description {
+			return true
+		}
+	}
+	return false
+}
+
+// AnnotationSet contains the already imported annotations.
+// Global annotations are returned by every data query in their time range,
+// so they must be imported only once.
+// The zero value is ready to use. AnnotationSet is safe for concurrent use.
+type AnnotationSet struct {
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+// Add returns false if the annotation with the given key was already added
+func (as *AnnotationSet) Add(key string) bool {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if as.seen == nil {
+		as.seen = make(map[string]struct{})
+	}
+	if _, ok := as.seen[key]; ok {
+		return false
+	}
+	as.seen[key] = struct{}{}
+	return true
+}
+
+// Count returns the number of added annotations
+func (as *AnnotationSet) Count() int {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return len(as.seen)
+}
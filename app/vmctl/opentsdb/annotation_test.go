@@ -0,0 +1,85 @@
+package opentsdb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestClientGetDataAnnotations(t *testing.T) {
+	f := func(importAnnotations bool, wantGlobalArg string, want Metric) {
+		t.Helper()
+		var globalArg string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			globalArg = r.URL.Query().Get("global_annotations")
+			_, _ = w.Write([]byte(`[{"metric":"sys.cpu","tags":{"host":"h1"},"aggregateTags":[],"dps":{"100":1},` +
+				`"annotations":[{"tsuid":"000001000001000001","description":"deploy","custom":{"owner":"team-a"},"startTime":100}],` +
+				`"globalAnnotations":[{"description":"outage","startTime":160,"endTime":220}]}]`))
+		}))
+		defer srv.Close()
+
+		c, err := NewClient(Config{Addr: srv.URL, ImportAnnotations: importAnnotations})
+		if err != nil {
+			t.Fatalf("cannot create client: %s", err)
+		}
+		series := Meta{Metric: "sys.cpu", Tags: map[string]string{"host": "h1"}}
+		rt := RetentionMeta{FirstOrder: "sum", SecondOrder: "avg", AggTime: "1m"}
+		m, err := c.GetData(context.Background(), series, rt, 100, 300, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if globalArg != wantGlobalArg {
+			t.Fatalf("unexpected global_annotations query arg %q; want %q", globalArg, wantGlobalArg)
+		}
+		if !reflect.DeepEqual(m.Annotations, want.Annotations) {
+			t.Fatalf("unexpected annotations %+v; want %+v", m.Annotations, want.Annotations)
+		}
+		if !reflect.DeepEqual(m.GlobalAnnotations, want.GlobalAnnotations) {
+			t.Fatalf("unexpected global annotations %+v; want %+v", m.GlobalAnnotations, want.GlobalAnnotations)
+		}
+	}
+
+	// annotations aren't returned unless requested
+	f(false, "", Metric{})
+	f(true, "true", Metric{
+		Annotations: []Annotation{{
+			TSUID:       "000001000001000001",
+			Description: "deploy",
+			Custom:      map[string]string{"owner": "team-a"},
+			StartTime:   100,
+		}},
+		GlobalAnnotations: []Annotation{{Description: "outage", StartTime: 160, EndTime: 220}},
+	})
+
+	if _, err := NewClient(Config{ImportAnnotations: true, UseExpAPI: true}); err == nil {
+		t.Fatalf("expecting error for importing annotations via expression API")
+	}
+}
+
+func TestMergeAnnotations(t *testing.T) {
+	a := Annotation{Description: "outage", StartTime: 100}
+	b := Annotation{TSUID: "000001", Description: "deploy", StartTime: 100}
+	c := Annotation{Description: "outage", StartTime: 200}
+	got := mergeAnnotations([]Annotation{a, b}, []Annotation{a, c, b})
+	if want := []Annotation{a, b, c}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected merged annotations %+v; want %+v", got, want)
+	}
+}
+
+func TestAnnotationSet(t *testing.T) {
+	var as AnnotationSet
+	if !as.Add("deploy@100") {
+		t.Fatalf("the first annotation must be added")
+	}
+	if as.Add("deploy@100") {
+		t.Fatalf("the duplicate annotation must not be added")
+	}
+	if !as.Add("deploy@160") {
+		t.Fatalf("the annotation with another key must be added")
+	}
+	if n := as.Count(); n != 2 {
+		t.Fatalf("unexpected number of annotations %d; want 2", n)
+	}
+}
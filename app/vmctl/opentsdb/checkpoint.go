@@ -0,0 +1,144 @@
+package opentsdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/utils"
+)
+
+// Checkpoint holds the progress of the OpenTSDB import,
+// so interrupted migration could be resumed from
+// the place where it was stopped.
+type Checkpoint struct {
+	// StartTime is the timestamp all the query ranges were calculated from.
+	// It must be preserved between restarts, so resumed import
+	// queries exactly the same time ranges.
+	StartTime int64 `json:"startTime"`
+	// Metrics contains names of the metrics which were completely imported
+	Metrics []string `json:"metrics"`
+	// LastSeries is the latest series processed for the metric in progress
+	LastSeries *Meta `json:"lastSeries,omitempty"`
+	// LastTimeRange is the latest time range processed for LastSeries
+	LastTimeRange *TimeRange `json:"lastTimeRange,omitempty"`
+	// Samples is the total number of samples imported by all the runs
+	Samples uint64 `json:"samples"`
+	// Cursors contains the progress of the metrics in progress
+	Cursors map[string]Cursor `json:"cursors,omitempty"`
+
+	path string
+	// baseSamples is the number of samples imported by previous runs
+	baseSamples uint64
+
+	mu   sync.Mutex
+	done map[string]struct{}
+}
+
+// Cursor is the progress of the metric in progress
+type Cursor struct {
+	// Series is the number of the first series of the metric
+	// which were completely imported
+	Series int `json:"series"`
+	// Total is the number of series discovered for the metric.
+	// The cursor is valid only for the same list of series.
+	Total int `json:"total"`
+}
+
+// LoadCheckpoint reads the checkpoint from the given path.
+// Empty checkpoint is returned if file at path doesn't exist yet.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	cp := &Checkpoint{
+		path: path,
+		done: make(map[string]struct{}),
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cp, nil
+		}
+		return nil, fmt.Errorf("cannot read checkpoint file %q: %s", path, err)
+	}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("cannot parse checkpoint file %q: %s", path, err)
+	}
+	for _, m := range cp.Metrics {
+		cp.done[m] = struct{}{}
+	}
+	cp.baseSamples = cp.Samples
+	return cp, nil
+}
+
+// IsDone returns true if metric was already imported
+func (cp *Checkpoint) IsDone(metric string) bool {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	_, ok := cp.done[metric]
+	return ok
+}
+
+// MarkDone records metric as completely imported
+func (cp *Checkpoint) MarkDone(metric string) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if _, ok := cp.done[metric]; ok {
+		return
+	}
+	cp.done[metric] = struct{}{}
+	cp.Metrics = append(cp.Metrics, metric)
+	cp.LastSeries = nil
+	cp.LastTimeRange = nil
+	delete(cp.Cursors, metric)
+}
+
+// Cursor returns the recorded progress of the metric in progress
+func (cp *Checkpoint) Cursor(metric string) (Cursor, bool) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	c, ok := cp.Cursors[metric]
+	return c, ok
+}
+
+// SetProgress updates cursors of the given metrics in progress and records
+// the number of samples imported by the current run. Cursors of other metrics
+// are kept, so they could be resumed later, while cursors of the metrics
+// which were already marked as done are ignored.
+func (cp *Checkpoint) SetProgress(cursors map[string]Cursor, samples uint64) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.Cursors == nil {
+		cp.Cursors = make(map[string]Cursor, len(cursors))
+	}
+	for metric, c := range cursors {
+		if _, ok := cp.done[metric]; !ok {
+			cp.Cursors[metric] = c
+		}
+	}
+	cp.Samples = cp.baseSamples + samples
+}
+
+// SetLast records the latest processed series and time range
+func (cp *Checkpoint) SetLast(series Meta, tr TimeRange) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.LastSeries = &series
+	cp.LastTimeRange = &tr
+}
+
+// Save atomically writes checkpoint to its path.
+// The data is written into a temporary file first, synced and then renamed,
+// so the crash in the middle of write can't corrupt the existing checkpoint.
+// Save is safe for concurrent use.
+func (cp *Checkpoint) Save() error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return fmt.Errorf("cannot marshal checkpoint: %s", err)
+	}
+	if err := utils.WriteFileAtomic(cp.path, data, 0600); err != nil {
+		return fmt.Errorf("cannot save checkpoint: %s", err)
+	}
+	return nil
+}
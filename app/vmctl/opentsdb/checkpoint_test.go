@@ -0,0 +1,91 @@
+package opentsdb
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+
+	cp, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatalf("unexpected error when loading missing checkpoint: %s", err)
+	}
+	if cp.IsDone("cpu") {
+		t.Fatalf("empty checkpoint must not contain any metrics")
+	}
+
+	cp.StartTime = 1626019200
+	cp.MarkDone("cpu")
+	cp.SetLast(Meta{Metric: "mem", Tags: map[string]string{"host": "host1"}}, TimeRange{Start: 3600, End: 0})
+	if err := cp.Save(); err != nil {
+		t.Fatalf("cannot save checkpoint: %s", err)
+	}
+
+	cp, err = LoadCheckpoint(path)
+	if err != nil {
+		t.Fatalf("cannot load saved checkpoint: %s", err)
+	}
+	if cp.StartTime != 1626019200 {
+		t.Fatalf("unexpected start time %d; want %d", cp.StartTime, 1626019200)
+	}
+	if !cp.IsDone("cpu") {
+		t.Fatalf("metric %q must be marked as done", "cpu")
+	}
+	if cp.IsDone("mem") {
+		t.Fatalf("metric %q must not be marked as done", "mem")
+	}
+	if cp.LastSeries == nil || cp.LastSeries.Metric != "mem" || cp.LastSeries.Tags["host"] != "host1" {
+		t.Fatalf("unexpected last series %v", cp.LastSeries)
+	}
+	if cp.LastTimeRange == nil || cp.LastTimeRange.Start != 3600 {
+		t.Fatalf("unexpected last time range %v", cp.LastTimeRange)
+	}
+
+	// marking metric as done resets the last processed series
+	cp.MarkDone("mem")
+	if cp.LastSeries != nil || cp.LastTimeRange != nil {
+		t.Fatalf("last series must be reset after metric is done")
+	}
+}
+
+func TestCheckpointProgress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	cp, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatalf("unexpected error when loading missing checkpoint: %s", err)
+	}
+	cp.MarkDone("cpu")
+	cp.SetProgress(map[string]Cursor{
+		"cpu": {Series: 1, Total: 2},
+		"mem": {Series: 3, Total: 10},
+	}, 100)
+	if _, ok := cp.Cursor("cpu"); ok {
+		t.Fatalf("cursor of the done metric must be ignored")
+	}
+	if err := cp.Save(); err != nil {
+		t.Fatalf("cannot save checkpoint: %s", err)
+	}
+
+	cp, err = LoadCheckpoint(path)
+	if err != nil {
+		t.Fatalf("cannot load saved checkpoint: %s", err)
+	}
+	if c, ok := cp.Cursor("mem"); !ok || c != (Cursor{Series: 3, Total: 10}) {
+		t.Fatalf("unexpected cursor %v for %q", c, "mem")
+	}
+	// samples of the previous runs are accumulated,
+	// while cursors of other metrics are kept
+	cp.SetProgress(map[string]Cursor{"disk": {Series: 1, Total: 5}}, 50)
+	if cp.Samples != 150 {
+		t.Fatalf("unexpected samples %d; want %d", cp.Samples, 150)
+	}
+	if _, ok := cp.Cursor("mem"); !ok {
+		t.Fatalf("cursor of %q must be kept", "mem")
+	}
+	cp.MarkDone("mem")
+	if _, ok := cp.Cursor("mem"); ok {
+		t.Fatalf("cursor must be reset after metric is done")
+	}
+}
@@ -0,0 +1,182 @@
+package opentsdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// expQuery is a body of the expression query
+// See http://opentsdb.net/docs/build/html/api_http/query/exp.html
+type expQuery struct {
+	Time    expTime     `json:"time"`
+	Filters []expFilter `json:"filters,omitempty"`
+	Metrics []expMetric `json:"metrics"`
+	Outputs []expOutput `json:"outputs"`
+}
+
+type expTime struct {
+	Start       string          `json:"start"`
+	End         string          `json:"end"`
+	Aggregator  string          `json:"aggregator"`
+	Downsampler *expDownsampler `json:"downsampler,omitempty"`
+}
+
+type expDownsampler struct {
+	Interval   string         `json:"interval"`
+	Aggregator string         `json:"aggregator"`
+	FillPolicy *expFillPolicy `json:"fillPolicy,omitempty"`
+}
+
+type expFillPolicy struct {
+	Policy string `json:"policy"`
+}
+
+type expFilter struct {
+	ID   string         `json:"id"`
+	Tags []expTagFilter `json:"tags"`
+}
+
+type expTagFilter struct {
+	Type    string `json:"type"`
+	Tagk    string `json:"tagk"`
+	Filter  string `json:"filter"`
+	GroupBy bool   `json:"groupBy"`
+}
+
+type expMetric struct {
+	ID     string `json:"id"`
+	Metric string `json:"metric"`
+	Filter string `json:"filter,omitempty"`
+}
+
+type expOutput struct {
+	ID string `json:"id"`
+}
+
+// expResponse is a response for the expression query
+type expResponse struct {
+	Outputs []struct {
+		ID      string       `json:"id"`
+		Dps     [][]*dpValue `json:"dps"`
+		DpsMeta struct {
+			Series int `json:"series"`
+		} `json:"dpsMeta"`
+		Meta []struct {
+			Index          int               `json:"index"`
+			Metrics        []string          `json:"metrics"`
+			CommonTags     map[string]string `json:"commonTags"`
+			AggregatedTags []string          `json:"aggregatedTags"`
+		} `json:"meta"`
+	} `json:"outputs"`
+}
+
+const expMetricID = "m"
+
+// newExpQuery builds the expression query equivalent
+// to the classic query built by GetData.
+// tagFilters are applied to the tags, which aren't set in series.
+func newExpQuery(series Meta, rt RetentionMeta, start, end int64, fillPolicy string, tagFilters []TagFilter) expQuery {
+	q := expQuery{
+		Time: expTime{
+			Start:      strconv.FormatInt(start, 10),
+			End:        strconv.FormatInt(end, 10),
+			Aggregator: rt.FirstOrder,
+			Downsampler: &expDownsampler{
+				Interval:   rt.AggTime,
+				Aggregator: rt.SecondOrder,
+				FillPolicy: &expFillPolicy{Policy: fillPolicy},
+			},
+		},
+		Metrics: []expMetric{{ID: expMetricID, Metric: series.Metric}},
+		Outputs: []expOutput{{ID: expMetricID}},
+	}
+	if len(series.Tags) > 0 || len(tagFilters) > 0 {
+		keys := make([]string, 0, len(series.Tags))
+		for k := range series.Tags {
+			keys = append(keys, k)
+		}
+		// keep the query stable for the same series
+		sort.Strings(keys)
+		f := expFilter{ID: "f"}
+		for _, k := range keys {
+			f.Tags = append(f.Tags, expTagFilter{Type: "literal_or", Tagk: k, Filter: series.Tags[k], GroupBy: true})
+		}
+		for _, tf := range tagFilters {
+			f.Tags = append(f.Tags, expTagFilter{Type: tf.Type, Tagk: tf.Key, Filter: tf.Filter})
+		}
+		q.Filters = []expFilter{f}
+		q.Metrics[0].Filter = f.ID
+	}
+	return q
+}
+
+// getDataExp retrieves data for a series at a specified time range
+// via expression API. The returned Metric is the same as for GetData.
+func (c *Client) getDataExp(ctx context.Context, series Meta, rt RetentionMeta, start, end int64) (Metric, error) {
+	reqBody, err := json.Marshal(newExpQuery(series, rt, start, end, c.FillPolicy, c.queryTagFilters(series)))
+	if err != nil {
+		return Metric{}, fmt.Errorf("cannot marshal expression query: %s", err)
+	}
+	q := "/api/query/exp"
+	if len(c.queryParams) > 0 {
+		q += "?" + c.queryParams.Encode()
+	}
+	c.rl.Register(1)
+	var resp expResponse
+	if err := c.postJSON(ctx, q, reqBody, &resp); err != nil {
+		var se *statusError
+		if errors.As(err, &se) && !c.strict && !isQueryTooLarge(err) {
+			log.Printf("bad response code from OpenTSDB query %v for %q with body %s...skipping", se.code, q, reqBody)
+			return Metric{}, nil
+		}
+		var de *decodeError
+		if errors.As(err, &de) {
+			if !de.malformed && !c.strict {
+				log.Printf("couldn't marshall response body from OpenTSDB query (%s)...skipping", de)
+				return Metric{}, nil
+			}
+			// the request body isn't a part of RequestError, so it is added here
+			return Metric{}, fmt.Errorf("cannot parse response body from OpenTSDB query with body %s: %w", reqBody, err)
+		}
+		return Metric{}, err
+	}
+	// the same as for classic queries, responses with no data,
+	// with multiple series or with unexpectedly aggregated tags are skipped
+	if len(resp.Outputs) != 1 {
+		return Metric{}, nil
+	}
+	out := resp.Outputs[0]
+	if out.DpsMeta.Series != 1 || len(out.Dps) < 1 {
+		return Metric{}, nil
+	}
+	data := Metric{Metric: series.Metric}
+	for _, m := range out.Meta {
+		// index 0 describes the timestamp column
+		if m.Index != 1 {
+			continue
+		}
+		if len(m.AggregatedTags) > 0 && !c.hasIdentityTags(series.Metric) {
+			return Metric{}, nil
+		}
+		data.Tags = c.restrictTags(series.Metric, m.CommonTags)
+	}
+	data, err = modifyData(data, c.NormalizeMetric, c.NormalizeTags)
+	if err != nil {
+		return Metric{}, nil
+	}
+	// timestamps are always returned in milliseconds
+	for _, dp := range out.Dps {
+		if len(dp) != 2 || dp[0] == nil || math.IsNaN(float64(*dp[0])) {
+			return Metric{}, nil
+		}
+		data.Timestamps = append(data.Timestamps, int64(*dp[0]))
+		data.Values = append(data.Values, valueOf(dp[1]))
+	}
+	return data, nil
+}
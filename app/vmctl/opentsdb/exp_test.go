@@ -0,0 +1,122 @@
+package opentsdb
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestNewExpQuery(t *testing.T) {
+	series := Meta{Metric: "sys.cpu.user", Tags: map[string]string{"host": "h1", "dc": "eu"}}
+	rt := RetentionMeta{FirstOrder: "sum", SecondOrder: "avg", AggTime: "1m"}
+	data, err := json.Marshal(newExpQuery(series, rt, 100, 200, FillPolicyNone, nil))
+	if err != nil {
+		t.Fatalf("cannot marshal query: %s", err)
+	}
+	want := `{"time":{"start":"100","end":"200","aggregator":"sum","downsampler":{"interval":"1m","aggregator":"avg","fillPolicy":{"policy":"none"}}},` +
+		`"filters":[{"id":"f","tags":[{"type":"literal_or","tagk":"dc","filter":"eu","groupBy":true},` +
+		`{"type":"literal_or","tagk":"host","filter":"h1","groupBy":true}]}],` +
+		`"metrics":[{"id":"m","metric":"sys.cpu.user","filter":"f"}],"outputs":[{"id":"m"}]}`
+	if string(data) != want {
+		t.Fatalf("unexpected query\ngot:  %s\nwant: %s", data, want)
+	}
+
+	// series without tags doesn't need filters
+	data, err = json.Marshal(newExpQuery(Meta{Metric: "sys.cpu.user"}, rt, 100, 200, FillPolicyNaN, nil))
+	if err != nil {
+		t.Fatalf("cannot marshal query: %s", err)
+	}
+	want = `{"time":{"start":"100","end":"200","aggregator":"sum","downsampler":{"interval":"1m","aggregator":"avg","fillPolicy":{"policy":"nan"}}},` +
+		`"metrics":[{"id":"m","metric":"sys.cpu.user"}],"outputs":[{"id":"m"}]}`
+	if string(data) != want {
+		t.Fatalf("unexpected query\ngot:  %s\nwant: %s", data, want)
+	}
+}
+
+func TestClientGetDataExp(t *testing.T) {
+	f := func(response string, want Metric, wantErr bool) {
+		t.Helper()
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || r.URL.Path != "/api/query/exp" {
+				t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			}
+			body, _ := io.ReadAll(r.Body)
+			var q expQuery
+			if err := json.Unmarshal(body, &q); err != nil {
+				t.Errorf("cannot parse query %s: %s", body, err)
+			}
+			_, _ = w.Write([]byte(response))
+		}))
+		defer srv.Close()
+
+		c, err := NewClient(Config{Addr: srv.URL, UseExpAPI: true})
+		if err != nil {
+			t.Fatalf("cannot create client: %s", err)
+		}
+		series := Meta{Metric: "sys.cpu.user", Tags: map[string]string{"host": "h1"}}
+		rt := RetentionMeta{FirstOrder: "sum", SecondOrder: "avg", AggTime: "1m"}
+		got, err := c.GetData(context.Background(), series, rt, 100, 200, false)
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error: %v; wantErr: %v", err, wantErr)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected metric %+v; want %+v", got, want)
+		}
+	}
+
+	f(`{"outputs":[{"id":"m","dps":[[100000,1.5],[160000,2]],"dpsMeta":{"series":1},`+
+		`"meta":[{"index":0,"metrics":["timestamp"]},{"index":1,"metrics":["sys.cpu.user"],"commonTags":{"host":"h1"},"aggregatedTags":[]}]}]}`,
+		Metric{
+			Metric:     "sys_cpu_user",
+			Tags:       map[string]string{"host": "h1"},
+			Timestamps: []int64{100000, 160000},
+			Values:     []float64{1.5, 2},
+		}, false)
+	// no data
+	f(`{"outputs":[{"id":"m","dps":[],"dpsMeta":{"series":0},"meta":[]}]}`, Metric{}, false)
+	// multiple series are skipped
+	f(`{"outputs":[{"id":"m","dps":[[100000,1,2]],"dpsMeta":{"series":2},"meta":[]}]}`, Metric{}, false)
+	// aggregated tags are skipped
+	f(`{"outputs":[{"id":"m","dps":[[100000,1]],"dpsMeta":{"series":1},`+
+		`"meta":[{"index":1,"metrics":["sys.cpu.user"],"commonTags":{},"aggregatedTags":["host"]}]}]}`, Metric{}, false)
+	// response of unexpected format is skipped
+	f(`[]`, Metric{}, false)
+	// malformed response is returned as error after retries
+	f(`foo`, Metric{}, true)
+}
+
+func TestClientGetDataExpMissingValues(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"outputs":[{"id":"m","dps":[[100000,1.5],[160000,NaN],[220000,null],[280000,"NaN"]],"dpsMeta":{"series":1},` +
+			`"meta":[{"index":0,"metrics":["timestamp"]},{"index":1,"metrics":["sys.cpu.user"],"commonTags":{"host":"h1"},"aggregatedTags":[]}]}]}`))
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(Config{Addr: srv.URL, UseExpAPI: true, FillPolicy: FillPolicyNaN})
+	if err != nil {
+		t.Fatalf("cannot create client: %s", err)
+	}
+	series := Meta{Metric: "sys.cpu.user", Tags: map[string]string{"host": "h1"}}
+	rt := RetentionMeta{FirstOrder: "sum", SecondOrder: "avg", AggTime: "1m"}
+	m, err := c.GetData(context.Background(), series, rt, 100, 300, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := []int64{100000, 160000, 220000, 280000}; !reflect.DeepEqual(m.Timestamps, want) {
+		t.Fatalf("unexpected timestamps %v; want %v", m.Timestamps, want)
+	}
+	// all the shapes of missing values are returned as NaN instead of zeros
+	if m.Values[0] != 1.5 {
+		t.Fatalf("unexpected value %v; want 1.5", m.Values[0])
+	}
+	for _, v := range m.Values[1:] {
+		if !math.IsNaN(v) {
+			t.Fatalf("missing values must be returned as NaN; got %v", m.Values)
+		}
+	}
+}
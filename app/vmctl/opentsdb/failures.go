@@ -0,0 +1,114 @@
+package opentsdb
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Failures records the series and queries to OpenTSDB failed during the run,
+// so they could be reported and re-processed later via RetryManifest.
+// The zero value is ready to use. Failures is safe for concurrent use.
+type Failures struct {
+	// Manifest is optional and records the failed queries
+	Manifest *RetryManifest
+	// ErrorLogFile is optional path for writing the list of failed series by Report.
+	// By default, the list is logged.
+	ErrorLogFile string
+
+	mu sync.Mutex
+	// series contains selectors of the series
+	// failed to be fetched or imported
+	series map[string]struct{}
+	// queries contains the number of failed queries per OpenTSDB metric
+	queries map[string]uint64
+}
+
+// AddQuery records the failed query for the series with the given selector
+func (f *Failures) AddQuery(selector string, q RetryQuery) {
+	f.AddSeries(selector)
+	f.mu.Lock()
+	if f.queries == nil {
+		f.queries = make(map[string]uint64)
+	}
+	f.queries[q.Series.Metric]++
+	f.mu.Unlock()
+	if f.Manifest != nil {
+		f.Manifest.Add(q)
+	}
+}
+
+// AddSeries records the series with the given selector as failed
+func (f *Failures) AddSeries(selector string) {
+	f.mu.Lock()
+	if f.series == nil {
+		f.series = make(map[string]struct{})
+	}
+	f.series[selector] = struct{}{}
+	f.mu.Unlock()
+}
+
+// Count returns the number of unique failed series
+func (f *Failures) Count() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return uint64(len(f.series))
+}
+
+// QueriesCount returns the number of failed queries of the metric
+func (f *Failures) QueriesCount(metric string) uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queries[metric]
+}
+
+// Report writes the sorted list of failed series to ErrorLogFile, one selector per line.
+// The list is logged if ErrorLogFile isn't set.
+func (f *Failures) Report() error {
+	f.mu.Lock()
+	list := make([]string, 0, len(f.series))
+	for selector := range f.series {
+		list = append(list, selector)
+	}
+	f.mu.Unlock()
+	if len(list) == 0 {
+		return nil
+	}
+	sort.Strings(list)
+	if f.ErrorLogFile == "" {
+		log.Printf("%d series were skipped because of errors:\n%s", len(list), strings.Join(list, "\n"))
+		return nil
+	}
+	data := strings.Join(list, "\n") + "\n"
+	if err := os.WriteFile(f.ErrorLogFile, []byte(data), 0644); err != nil {
+		return fmt.Errorf("cannot write list of skipped series to %q: %s", f.ErrorLogFile, err)
+	}
+	log.Printf("%d series were skipped because of errors; the list is written to %q", len(list), f.ErrorLogFile)
+	return nil
+}
+
+// SaveManifest persists the failed queries into Manifest if it is set
+func (f *Failures) SaveManifest() {
+	if f.Manifest == nil {
+		return
+	}
+	if err := f.Manifest.Save(); err != nil {
+		log.Printf("failed to save retry manifest: %s", err)
+		return
+	}
+	if n := f.Manifest.Len(); n > 0 {
+		log.Printf("%d failed queries are written to retry manifest", n)
+	}
+}
+
+// Reset forgets the failures of the previous run.
+// The queries recorded in Manifest are kept.
+func (f *Failures) Reset() {
+	f.mu.Lock()
+	f.series = nil
+	f.queries = nil
+	f.mu.Unlock()
+}
@@ -0,0 +1,49 @@
+package opentsdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFailures(t *testing.T) {
+	dir := t.TempDir()
+	f := Failures{
+		Manifest:     NewRetryManifest(filepath.Join(dir, "retry.json")),
+		ErrorLogFile: filepath.Join(dir, "errors.txt"),
+	}
+	q := RetryQuery{Series: Meta{Metric: "cpu"}, TimeRange: TimeRange{Start: 3600, End: 0}}
+	f.AddQuery(`cpu{host="b"}`, q)
+	f.AddQuery(`cpu{host="a"}`, q)
+	f.AddQuery(`cpu{host="a"}`, q)
+	f.AddSeries(`mem{host="a"}`)
+	if n := f.Count(); n != 3 {
+		t.Fatalf("unexpected number of failed series %d; want 3", n)
+	}
+	if n := f.QueriesCount("cpu"); n != 3 {
+		t.Fatalf("unexpected number of failed queries %d; want 3", n)
+	}
+	if n := f.Manifest.Len(); n != 3 {
+		t.Fatalf("unexpected number of queries in manifest %d; want 3", n)
+	}
+
+	if err := f.Report(); err != nil {
+		t.Fatalf("cannot report failed series: %s", err)
+	}
+	data, err := os.ReadFile(f.ErrorLogFile)
+	if err != nil {
+		t.Fatalf("cannot read error log file: %s", err)
+	}
+	if want := "cpu{host=\"a\"}\ncpu{host=\"b\"}\nmem{host=\"a\"}\n"; string(data) != want {
+		t.Fatalf("unexpected error log file content %q; want %q", data, want)
+	}
+
+	// the manifest survives the reset for being saved at the end of run
+	f.Reset()
+	if n := f.Count(); n != 0 {
+		t.Fatalf("unexpected number of failed series after reset %d; want 0", n)
+	}
+	if n := f.Manifest.Len(); n != 3 {
+		t.Fatalf("unexpected number of queries in manifest after reset %d; want 3", n)
+	}
+}
@@ -0,0 +1,97 @@
+package opentsdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Supported fill policies for missing values in downsampled data.
+// See http://opentsdb.net/docs/build/html/user_guide/query/downsampling.html#fill-policies
+const (
+	FillPolicyNone     = "none"
+	FillPolicyNaN      = "nan"
+	FillPolicyNull     = "null"
+	FillPolicyZero     = "zero"
+	FillPolicyPrevious = "previous"
+)
+
+func checkFillPolicy(policy string) error {
+	switch policy {
+	case FillPolicyNone, FillPolicyNaN, FillPolicyNull, FillPolicyZero, FillPolicyPrevious:
+		return nil
+	default:
+		return fmt.Errorf("unsupported fill policy %q; supported values are: %s, %s, %s, %s, %s",
+			policy, FillPolicyNone, FillPolicyNaN, FillPolicyNull, FillPolicyZero, FillPolicyPrevious)
+	}
+}
+
+// dpValue is a datapoint value in OpenTSDB response.
+// Depending on the fill policy and OpenTSDB version, missing values are returned
+// as null, bare NaN or "NaN" string, so all of them are parsed as NaN
+// instead of being turned into zeros or failing the whole response.
+// null values are handled by using *dpValue, since json doesn't call
+// UnmarshalJSON for null pointers.
+type dpValue float64
+
+// UnmarshalJSON implements json.Unmarshaler interface
+func (v *dpValue) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		*v = dpValue(math.NaN())
+		return nil
+	}
+	if len(s) > 0 && s[0] == '"' {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("cannot parse datapoint value %s", data)
+	}
+	*v = dpValue(f)
+	return nil
+}
+
+// valueOf returns the value of dp or NaN if dp is nil
+func valueOf(dp *dpValue) float64 {
+	if dp == nil {
+		return math.NaN()
+	}
+	return float64(*dp)
+}
+
+// replaceNaN replaces NaN tokens outside of strings in OpenTSDB response with null,
+// since OpenTSDB may return NaN values for "nan" fill policy, which aren't valid JSON.
+func replaceNaN(data []byte) []byte {
+	if !bytes.Contains(data, []byte("NaN")) {
+		return data
+	}
+	dst := make([]byte, 0, len(data))
+	inString := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case inString:
+			if c == '\\' && i+1 < len(data) {
+				dst = append(dst, c, data[i+1])
+				i++
+				continue
+			}
+			if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case bytes.HasPrefix(data[i:], []byte("NaN")):
+			dst = append(dst, "null"...)
+			i += len("NaN") - 1
+			continue
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
@@ -0,0 +1,126 @@
+package opentsdb
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReplaceNaN(t *testing.T) {
+	f := func(s, want string) {
+		t.Helper()
+		if got := string(replaceNaN([]byte(s))); got != want {
+			t.Fatalf("unexpected result %q; want %q", got, want)
+		}
+	}
+
+	f(``, ``)
+	f(`{"dps":{"1":1.5}}`, `{"dps":{"1":1.5}}`)
+	f(`{"dps":{"1":NaN,"2":1}}`, `{"dps":{"1":null,"2":1}}`)
+	f(`[[1000,NaN],[2000,NaN]]`, `[[1000,null],[2000,null]]`)
+	// NaN inside strings must be preserved
+	f(`{"tags":{"host":"NaN","dc":"a\"NaN"},"dps":{"1":NaN}}`, `{"tags":{"host":"NaN","dc":"a\"NaN"},"dps":{"1":null}}`)
+}
+
+func TestClientFillPolicy(t *testing.T) {
+	var gotQuery string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.Query().Get("m")
+		_, _ = w.Write([]byte(`[{"metric":"system.load5","tags":{"host":"h1"},"aggregateTags":[],"dps":{"60":1.5,"120":NaN,"180":null}}]`))
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(Config{Addr: srv.URL, FillPolicy: FillPolicyNaN})
+	if err != nil {
+		t.Fatalf("cannot create client: %s", err)
+	}
+	s := Meta{Metric: "system.load5", Tags: map[string]string{"host": "h1"}}
+	rt := RetentionMeta{FirstOrder: "sum", SecondOrder: "avg", AggTime: "1m"}
+	m, err := c.GetData(context.Background(), s, rt, 0, 200, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.HasPrefix(gotQuery, "sum:1m-avg-nan:") {
+		t.Fatalf("fill policy must be passed in query; got %q", gotQuery)
+	}
+	if len(m.Values) != 3 {
+		t.Fatalf("unexpected number of values %d; want 3", len(m.Values))
+	}
+	var nans int
+	for i, v := range m.Values {
+		if math.IsNaN(v) {
+			nans++
+			continue
+		}
+		if m.Timestamps[i] != 60000 || v != 1.5 {
+			t.Fatalf("unexpected sample %d: %v", m.Timestamps[i], v)
+		}
+	}
+	if nans != 2 {
+		t.Fatalf("missing values must be returned as NaN; got %v", m.Values)
+	}
+
+	if _, err := NewClient(Config{FillPolicy: "linear"}); err == nil {
+		t.Fatalf("expecting error for unsupported fill policy")
+	}
+}
+
+func TestOtsdbMetricUnmarshalJSON(t *testing.T) {
+	f := func(dps string, want map[int64]float64) {
+		t.Helper()
+		var om OtsdbMetric
+		data := replaceNaN([]byte(`{"metric":"system.load5","tags":{"host":"h1"},"aggregateTags":[],"dps":` + dps + `}`))
+		if err := json.Unmarshal(data, &om); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(om.Dps) != len(want) {
+			t.Fatalf("unexpected dps %v; want %v", om.Dps, want)
+		}
+		for ts, v := range want {
+			got, ok := om.Dps[ts]
+			if !ok || (got != v && !(math.IsNaN(got) && math.IsNaN(v))) {
+				t.Fatalf("unexpected value for %d: %v; want %v", ts, got, v)
+			}
+		}
+	}
+
+	nan := math.NaN()
+	f(`{}`, map[int64]float64{})
+	f(`{"60":1.5,"120":0,"180":-2e3}`, map[int64]float64{60: 1.5, 120: 0, 180: -2000})
+	// missing values returned for "null" fill policy
+	f(`{"60":1.5,"120":null}`, map[int64]float64{60: 1.5, 120: nan})
+	// missing values returned for "nan" fill policy
+	f(`{"60":NaN,"120":1}`, map[int64]float64{60: nan, 120: 1})
+	// some OpenTSDB versions and proxies return values as strings
+	f(`{"60":"NaN","120":"nan","180":"1.5"}`, map[int64]float64{60: nan, 120: nan, 180: 1.5})
+
+	var om OtsdbMetric
+	if err := json.Unmarshal([]byte(`{"dps":{"60":"foo"}}`), &om); err == nil {
+		t.Fatalf("expecting error for invalid value")
+	}
+	if err := json.Unmarshal([]byte(`{"dps":{"foo":1}}`), &om); err == nil {
+		t.Fatalf("expecting error for invalid timestamp")
+	}
+}
+
+func TestOtsdbMetricUnmarshalJSONOrder(t *testing.T) {
+	var om OtsdbMetric
+	// the order of the response and duplicate timestamps must be preserved,
+	// so out-of-order data returned by OpenTSDB could be detected
+	data := []byte(`{"metric":"sys.cpu","dps":{"180":3,"60":1,"120":2,"60":4}}`)
+	if err := json.Unmarshal(data, &om); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := dataPoints{{180, 3}, {60, 1}, {120, 2}, {60, 4}}
+	if !reflect.DeepEqual(om.points, want) {
+		t.Fatalf("unexpected points %v; want %v", om.points, want)
+	}
+	if len(om.Dps) != 3 || om.Dps[60] != 4 {
+		t.Fatalf("unexpected dps %v", om.Dps)
+	}
+}
@@ -0,0 +1,182 @@
+package opentsdb
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DefaultFilters are the metric name prefixes used for discovering all the metrics
+// via /api/suggest if only tag filters are set
+var DefaultFilters = []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l", "m",
+	"n", "o", "p", "q", "r", "s", "t", "u", "v", "w", "x", "y", "z"}
+
+// Supported types of tag filters.
+// See http://opentsdb.net/docs/build/html/user_guide/query/filters.html
+const (
+	TagFilterLiteralOr = "literal_or"
+	TagFilterWildcard  = "wildcard"
+	TagFilterRegexp    = "regexp"
+)
+
+// TagFilter is a filter on values of the tag of OpenTSDB series.
+// It is applied to series discovery and is passed to data queries,
+// so series aggregated via identity tags contain only the matching data.
+type TagFilter struct {
+	Key    string
+	Type   string
+	Filter string
+
+	// re is used for matching values by wildcard and regexp filters
+	re *regexp.Regexp
+}
+
+// String returns tf in the format of the filter in OpenTSDB queries, e.g. host=wildcard(web*)
+func (tf TagFilter) String() string {
+	return fmt.Sprintf("%s=%s(%s)", tf.Key, tf.Type, tf.Filter)
+}
+
+// match returns whether value matches tf the same way as OpenTSDB does:
+// wildcard filters match the whole value, while regexp filters match any part of it
+func (tf TagFilter) match(value string) bool {
+	if tf.Type == TagFilterLiteralOr {
+		for _, v := range strings.Split(tf.Filter, "|") {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}
+	return tf.re.MatchString(value)
+}
+
+// parseTagFilter parses the tag filter in one of the following formats:
+//
+//	key=value - the tag value must be equal to value
+//	key=v1|v2 - the tag value must be equal to any of the values
+//	key=web*  - the tag value must match the wildcard
+//	key=type(filter) - the filter of the given type, e.g. host=regexp(web-[0-9]+)
+func parseTagFilter(s string) (TagFilter, error) {
+	key, value, ok := strings.Cut(s, "=")
+	key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+	if !ok || key == "" || value == "" {
+		return TagFilter{}, fmt.Errorf("invalid tag filter %q; expecting key=value format", s)
+	}
+	tf := TagFilter{Key: key, Type: TagFilterLiteralOr, Filter: value}
+	if n := strings.IndexByte(value, '('); n > 0 && strings.HasSuffix(value, ")") {
+		tf.Type, tf.Filter = value[:n], value[n+1:len(value)-1]
+	} else if strings.Contains(value, "*") {
+		tf.Type = TagFilterWildcard
+	}
+	if tf.Filter == "" {
+		return TagFilter{}, fmt.Errorf("invalid tag filter %q; filter can't be empty", s)
+	}
+	var expr string
+	switch tf.Type {
+	case TagFilterLiteralOr:
+		for _, v := range strings.Split(tf.Filter, "|") {
+			if v == "" {
+				return TagFilter{}, fmt.Errorf("invalid tag filter %q; literal values can't be empty", s)
+			}
+		}
+		return tf, nil
+	case TagFilterWildcard:
+		parts := strings.Split(tf.Filter, "*")
+		for i := range parts {
+			parts[i] = regexp.QuoteMeta(parts[i])
+		}
+		expr = "^" + strings.Join(parts, ".*") + "$"
+	case TagFilterRegexp:
+		expr = tf.Filter
+	default:
+		return TagFilter{}, fmt.Errorf("invalid tag filter %q; unsupported filter type %q; supported types are %s, %s and %s",
+			s, tf.Type, TagFilterLiteralOr, TagFilterWildcard, TagFilterRegexp)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return TagFilter{}, fmt.Errorf("invalid tag filter %q: %s", s, err)
+	}
+	tf.re = re
+	return tf, nil
+}
+
+// splitFilters splits filters into metric name prefixes and tag filters.
+// Filters containing = are tag filters, see parseTagFilter.
+func splitFilters(filters []string) ([]string, []TagFilter, error) {
+	var prefixes []string
+	var tagFilters []TagFilter
+	seen := make(map[string]struct{})
+	for _, f := range filters {
+		if !strings.Contains(f, "=") {
+			prefixes = append(prefixes, f)
+			continue
+		}
+		tf, err := parseTagFilter(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := seen[tf.Key]; ok {
+			return nil, nil, fmt.Errorf("duplicate tag filter for tag %q", tf.Key)
+		}
+		seen[tf.Key] = struct{}{}
+		tagFilters = append(tagFilters, tf)
+	}
+	// keep the queries stable regardless of the order of filters
+	sort.Slice(tagFilters, func(i, j int) bool {
+		return tagFilters[i].Key < tagFilters[j].Key
+	})
+	return prefixes, tagFilters, nil
+}
+
+// matchTagFilters returns whether tags match all the tag filters of c.
+// Tags missing in the series don't match.
+func (c *Client) matchTagFilters(tags map[string]string) bool {
+	for _, tf := range c.TagFilters {
+		v, ok := tags[tf.Key]
+		if !ok || !tf.match(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterSeries returns series matching all the tag filters of c
+func (c *Client) filterSeries(series []Meta) []Meta {
+	if len(c.TagFilters) == 0 {
+		return series
+	}
+	filtered := series[:0]
+	for _, s := range series {
+		if c.matchTagFilters(s.Tags) {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
+
+// queryTagFilters returns tag filters of c for the data query of the series.
+// Filters on tags of the series are skipped, since the series tags
+// are already queried by the exact values.
+func (c *Client) queryTagFilters(series Meta) []TagFilter {
+	var filters []TagFilter
+	for _, tf := range c.TagFilters {
+		if _, ok := series.Tags[tf.Key]; !ok {
+			filters = append(filters, tf)
+		}
+	}
+	return filters
+}
+
+// lookupFilters returns tag filters which could be applied by /api/search/lookup
+// in key=value format. Lookup doesn't support filters other than the exact value,
+// so the rest of filters are applied to the lookup results.
+func lookupFilters(tagFilters []TagFilter) []string {
+	var tags []string
+	for _, tf := range tagFilters {
+		if tf.Type == TagFilterLiteralOr && !strings.Contains(tf.Filter, "|") {
+			tags = append(tags, tf.Key+"="+tf.Filter)
+		}
+	}
+	return tags
+}
@@ -0,0 +1,152 @@
+package opentsdb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTagFilter(t *testing.T) {
+	f := func(s, wantType, wantFilter string, match, mismatch []string) {
+		t.Helper()
+		tf, err := parseTagFilter(s)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if tf.Type != wantType || tf.Filter != wantFilter {
+			t.Fatalf("unexpected filter %s; want type %q and filter %q", tf, wantType, wantFilter)
+		}
+		for _, v := range match {
+			if !tf.match(v) {
+				t.Fatalf("filter %s must match %q", tf, v)
+			}
+		}
+		for _, v := range mismatch {
+			if tf.match(v) {
+				t.Fatalf("filter %s mustn't match %q", tf, v)
+			}
+		}
+	}
+
+	f("dc=eu", TagFilterLiteralOr, "eu", []string{"eu"}, []string{"eu-west", "us"})
+	f(" dc = eu|us ", TagFilterLiteralOr, "eu|us", []string{"eu", "us"}, []string{"eu|us", "asia"})
+	f("host=web*", TagFilterWildcard, "web*", []string{"web", "web-1"}, []string{"db-web-1", "Web-1"})
+	f("host=*.example.com", TagFilterWildcard, "*.example.com", []string{"web.example.com"}, []string{"web-example.com"})
+	f("host=literal_or(web*)", TagFilterLiteralOr, "web*", []string{"web*"}, []string{"web-1"})
+	f("host=wildcard(web-1)", TagFilterWildcard, "web-1", []string{"web-1"}, []string{"web-10"})
+	// regexp filters match any part of the value the same way as OpenTSDB does
+	f("host=regexp(web-[0-9]+)", TagFilterRegexp, "web-[0-9]+", []string{"web-1", "eu-web-10"}, []string{"web-x"})
+	f("host=regexp(^web$)", TagFilterRegexp, "^web$", []string{"web"}, []string{"web-1"})
+}
+
+func TestParseTagFilterInvalid(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		if _, err := parseTagFilter(s); err == nil {
+			t.Fatalf("expecting error for %q", s)
+		}
+	}
+
+	f("=eu")
+	f("dc=")
+	f("dc=eu||us")
+	f("dc=literal_or()")
+	f("host=regexp(web-[0-9)")
+	f("host=iwildcard(web*)")
+}
+
+func TestSplitFilters(t *testing.T) {
+	f := func(filters, wantPrefixes, wantTagFilters []string) {
+		t.Helper()
+		prefixes, tagFilters, err := splitFilters(filters)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(prefixes, wantPrefixes) {
+			t.Fatalf("unexpected prefixes %q; want %q", prefixes, wantPrefixes)
+		}
+		var got []string
+		for _, tf := range tagFilters {
+			got = append(got, tf.String())
+		}
+		if !reflect.DeepEqual(got, wantTagFilters) {
+			t.Fatalf("unexpected tag filters %q; want %q", got, wantTagFilters)
+		}
+	}
+
+	f(nil, nil, nil)
+	f([]string{"sys", "net"}, []string{"sys", "net"}, nil)
+	// tag filters are sorted by key
+	f([]string{"sys", "host=web*", "dc=eu"}, []string{"sys"},
+		[]string{"dc=literal_or(eu)", "host=wildcard(web*)"})
+
+	if _, _, err := splitFilters([]string{"dc=eu", "dc=us"}); err == nil {
+		t.Fatalf("expecting error for duplicate tag filters")
+	}
+}
+
+func TestClientTagFilters(t *testing.T) {
+	var lookupQuery, dataQuery string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/search/lookup":
+			lookupQuery = r.URL.Query().Get("m")
+			_ = json.NewEncoder(w).Encode(MetaResults{Type: "LOOKUP", Results: []Meta{
+				{Metric: "sys.cpu", Tags: map[string]string{"dc": "eu", "host": "web-1"}},
+				{Metric: "sys.cpu", Tags: map[string]string{"dc": "eu", "host": "db-1"}},
+				{Metric: "sys.cpu", Tags: map[string]string{"dc": "eu"}},
+			}})
+		case "/api/query":
+			dataQuery = r.URL.Query().Get("m")
+			_, _ = w.Write([]byte(`[]`))
+		default:
+			t.Errorf("unexpected request to %q", r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(Config{Addr: srv.URL, Limit: 10, Filters: []string{"dc=eu", "host=web*"}})
+	if err != nil {
+		t.Fatalf("cannot create client: %s", err)
+	}
+	if !reflect.DeepEqual(c.Filters, DefaultFilters) {
+		t.Fatalf("expecting default filters if only tag filters are set; got %q", c.Filters)
+	}
+
+	series, err := c.FindSeries(context.Background(), "sys.cpu")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// only exact filters are applied by lookup
+	if want := "sys.cpu{dc=eu}"; lookupQuery != want {
+		t.Fatalf("unexpected lookup query %q; want %q", lookupQuery, want)
+	}
+	want := []Meta{{Metric: "sys.cpu", Tags: map[string]string{"dc": "eu", "host": "web-1"}}}
+	if !reflect.DeepEqual(series, want) {
+		t.Fatalf("unexpected series %v; want %v", series, want)
+	}
+
+	// filters on the tags of the series aren't passed to the query
+	rt := RetentionMeta{FirstOrder: "sum", SecondOrder: "avg", AggTime: "1m"}
+	s := Meta{Metric: "sys.cpu", Tags: map[string]string{"dc": "eu"}}
+	if _, err := c.GetData(context.Background(), s, rt, 100, 200, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := "sum:1m-avg-none:sys.cpu{dc=eu}{host=wildcard(web*)}"; dataQuery != want {
+		t.Fatalf("unexpected data query %q; want %q", dataQuery, want)
+	}
+
+	data, err := json.Marshal(newExpQuery(s, rt, 100, 200, FillPolicyNone, c.queryTagFilters(s)))
+	if err != nil {
+		t.Fatalf("cannot marshal query: %s", err)
+	}
+	wantFilters := `"filters":[{"id":"f","tags":[{"type":"literal_or","tagk":"dc","filter":"eu","groupBy":true},` +
+		`{"type":"wildcard","tagk":"host","filter":"web*","groupBy":false}]}]`
+	if !strings.Contains(string(data), wantFilters) {
+		t.Fatalf("unexpected expression query %s; want filters %s", data, wantFilters)
+	}
+}
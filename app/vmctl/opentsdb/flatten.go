@@ -0,0 +1,92 @@
+package opentsdb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/promrelabel"
+)
+
+// flattenTags appends values of the given tags to the metric name in the given order
+// and removes these tags, e.g. sys_cpu{host="web1"} becomes sys_cpu_web1 for host tag.
+// Values are sanitized the same way as metric names. Missing tags are ignored.
+func flattenTags(m *Metric, tags []string) {
+	for _, k := range tags {
+		v, ok := m.Tags[k]
+		if !ok {
+			continue
+		}
+		m.Metric += "_" + promrelabel.SanitizeName(v)
+		delete(m.Tags, k)
+	}
+}
+
+// ParseFlattenTags parses the list of tags to flatten into metric names.
+// Tag keys are sanitized the same way as by Client, so they match the tags of fetched series.
+func ParseFlattenTags(tags []string) ([]string, error) {
+	var list []string
+	seen := make(map[string]struct{}, len(tags))
+	for _, k := range tags {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			return nil, fmt.Errorf("tag to flatten can't be empty")
+		}
+		k = promrelabel.SanitizeName(k)
+		if _, ok := seen[k]; ok {
+			return nil, fmt.Errorf("duplicate tag to flatten %q", k)
+		}
+		seen[k] = struct{}{}
+		list = append(list, k)
+	}
+	return list, nil
+}
+
+// FlattenChecker detects OpenTSDB series, which are imported as the same series
+// after flattening tags, since their data would be mixed up.
+// E.g. sys.cpu{host=web1} and sys.cpu.web1 collide if host tag is flattened.
+// The zero value is ready to use. FlattenChecker is safe for concurrent use.
+type FlattenChecker struct {
+	mu sync.Mutex
+	// imported maps the imported series to the original OpenTSDB series
+	imported map[string]string
+}
+
+// Check returns error if another OpenTSDB series was already imported
+// as the same series as m, which is the transformed series.
+func (fc *FlattenChecker) Check(series Meta, m Metric) error {
+	key := seriesString(m.Metric, m.Tags)
+	origKey := seriesString(series.Metric, series.Tags)
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.imported == nil {
+		fc.imported = make(map[string]string)
+	}
+	if prev, ok := fc.imported[key]; ok && prev != origKey {
+		return fmt.Errorf("OpenTSDB series %s and %s are imported as the same series %s", prev, origKey, key)
+	}
+	fc.imported[key] = origKey
+	return nil
+}
+
+// seriesString returns the series in metric{k1=v1,k2=v2} form with tags sorted by keys
+func seriesString(metric string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	sb.WriteString(metric)
+	sb.WriteString("{")
+	for i, k := range keys {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		fmt.Fprintf(&sb, "%s=%s", k, tags[k])
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
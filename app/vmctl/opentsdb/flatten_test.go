@@ -0,0 +1,80 @@
+package opentsdb
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFlattenTags(t *testing.T) {
+	f := func(tags []string, want []string, wantErr bool) {
+		t.Helper()
+		got, err := ParseFlattenTags(tags)
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error: %v; wantErr: %v", err, wantErr)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected tags %v; want %v", got, want)
+		}
+	}
+	f(nil, nil, false)
+	f([]string{" host ", "rack.id"}, []string{"host", "rack_id"}, false)
+	f([]string{""}, nil, true)
+	f([]string{"host", "host"}, nil, true)
+	// keys are compared after sanitizing
+	f([]string{"rack.id", "rack_id"}, nil, true)
+}
+
+func TestFlattenTags(t *testing.T) {
+	f := func(metric string, tags map[string]string, flatten []string, wantMetric string, wantTags map[string]string) {
+		t.Helper()
+		m := Metric{Metric: metric, Tags: tags}
+		flattenTags(&m, flatten)
+		if m.Metric != wantMetric {
+			t.Fatalf("unexpected metric %q; want %q", m.Metric, wantMetric)
+		}
+		if !reflect.DeepEqual(m.Tags, wantTags) {
+			t.Fatalf("unexpected tags %v; want %v", m.Tags, wantTags)
+		}
+	}
+	f("sys_cpu", map[string]string{"host": "web1", "dc": "eu"}, nil,
+		"sys_cpu", map[string]string{"host": "web1", "dc": "eu"})
+	f("sys_cpu", map[string]string{"host": "web1", "dc": "eu"}, []string{"host"},
+		"sys_cpu_web1", map[string]string{"dc": "eu"})
+	// values are appended in the given order
+	f("sys_cpu", map[string]string{"host": "web1", "dc": "eu"}, []string{"dc", "host"},
+		"sys_cpu_eu_web1", map[string]string{})
+	// missing tags are ignored
+	f("sys_cpu", map[string]string{"host": "web1"}, []string{"dc", "host"},
+		"sys_cpu_web1", map[string]string{})
+	// illegal characters are sanitized
+	f("sys_cpu", map[string]string{"host": "web1.example-com/8080"}, []string{"host"},
+		"sys_cpu_web1_example_com_8080", map[string]string{})
+}
+
+func TestFlattenChecker(t *testing.T) {
+	tt := &TagTransform{Flatten: []string{"host"}}
+	var fc FlattenChecker
+	f := func(series Meta, wantErr bool) {
+		t.Helper()
+		m := Metric{Metric: strings.ReplaceAll(series.Metric, ".", "_"), Tags: make(map[string]string)}
+		for k, v := range series.Tags {
+			m.Tags[k] = v
+		}
+		tt.Apply(&m)
+		err := fc.Check(series, m)
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error: %v; wantErr: %v", err, wantErr)
+		}
+	}
+	f(Meta{Metric: "sys.cpu", Tags: map[string]string{"host": "web1"}}, false)
+	// the same series may be fetched multiple times, e.g. for different time ranges
+	f(Meta{Metric: "sys.cpu", Tags: map[string]string{"host": "web1"}}, false)
+	f(Meta{Metric: "sys.cpu", Tags: map[string]string{"host": "web2"}}, false)
+	f(Meta{Metric: "sys.cpu.web1", Tags: map[string]string{"dc": "eu"}}, false)
+	// sys.cpu.web1 is imported as sys_cpu_web1 as well
+	f(Meta{Metric: "sys.cpu.web1"}, true)
+	// sanitized values may collide as well
+	f(Meta{Metric: "sys.cpu", Tags: map[string]string{"host": "web.2"}}, false)
+	f(Meta{Metric: "sys.cpu.web", Tags: map[string]string{"host": "2"}}, true)
+}
@@ -0,0 +1,42 @@
+package opentsdb
+
+// Lane is a group of retentions which queries
+// are processed by a dedicated pool of workers
+type Lane struct {
+	// Idx is the index of the lane in SeriesCursor
+	Idx         int
+	Retentions  []Retention
+	Concurrency int
+}
+
+// Lanes returns lanes for processing the retentions of the given metric.
+// By default, all the retentions share a single pool of concurrency workers.
+// If retentionCC is set, every retention gets its own pool of retentionCC[i] workers,
+// so slow queries of one retention don't delay the queries of others.
+func (c *Client) Lanes(metric string, concurrency int, retentionCC []int) []Lane {
+	if len(retentionCC) == 0 {
+		return []Lane{{Retentions: c.MetricRetentions(metric), Concurrency: concurrency}}
+	}
+	lanes := make([]Lane, 0, len(c.Retentions))
+	for i, rt := range c.Retentions {
+		lanes = append(lanes, Lane{
+			Idx:         i,
+			Retentions:  []Retention{rt},
+			Concurrency: retentionCC[i],
+		})
+	}
+	return lanes
+}
+
+// FetchConcurrency returns the number of workers fetching a single metric
+// for the lanes returned by Lanes with the same args
+func FetchConcurrency(concurrency int, retentionCC []int) int {
+	if len(retentionCC) == 0 {
+		return concurrency
+	}
+	n := 0
+	for _, cc := range retentionCC {
+		n += cc
+	}
+	return n
+}
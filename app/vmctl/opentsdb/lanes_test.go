@@ -0,0 +1,31 @@
+package opentsdb
+
+import (
+	"testing"
+)
+
+func TestClientLanes(t *testing.T) {
+	c := &Client{Retentions: []Retention{{FirstOrder: "sum"}, {FirstOrder: "max"}}}
+
+	lanes := c.Lanes("sys.cpu", 4, nil)
+	if len(lanes) != 1 || lanes[0].Concurrency != 4 || len(lanes[0].Retentions) != 2 {
+		t.Fatalf("unexpected lanes %+v; want a single lane for all the retentions", lanes)
+	}
+	if n := FetchConcurrency(4, nil); n != 4 {
+		t.Fatalf("unexpected fetch concurrency %d; want 4", n)
+	}
+
+	// every retention gets its own lane
+	lanes = c.Lanes("sys.cpu", 4, []int{1, 2})
+	if len(lanes) != 2 {
+		t.Fatalf("unexpected number of lanes %d; want 2", len(lanes))
+	}
+	for i, lane := range lanes {
+		if lane.Idx != i || lane.Concurrency != i+1 || len(lane.Retentions) != 1 || lane.Retentions[0].FirstOrder != c.Retentions[i].FirstOrder {
+			t.Fatalf("unexpected lane #%d: %+v", i, lane)
+		}
+	}
+	if n := FetchConcurrency(4, []int{1, 2}); n != 3 {
+		t.Fatalf("unexpected fetch concurrency %d; want 3", n)
+	}
+}
@@ -1,13 +1,28 @@
 package opentsdb
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/auth"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/backoff"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/limiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/utils"
+	"github.com/VictoriaMetrics/metrics"
 )
 
 // Retention objects contain meta data about what to query for our run
@@ -43,10 +58,94 @@ type Client struct {
 	// The meta query limit for series returned
 	Limit      int
 	Retentions []Retention
-	Filters    []string
-	Normalize  bool
+	// RetentionOverrides contains retentions per metric name used instead of Retentions.
+	// See MetricRetentions
+	RetentionOverrides map[string][]Retention
+	// Filters contains metric name prefixes for discovering metrics
+	Filters []string
+	// TagFilters contains filters on tag values applied
+	// to series discovery and data queries
+	TagFilters []TagFilter
 	HardTS     int64
 	MsecsTime  bool
+	// NormalizeMetric defines whether to lowercase metric names
+	NormalizeMetric bool
+	// NormalizeTags defines whether to lowercase tag keys and values
+	NormalizeTags bool
+	// HardTSEnd is optional upper bound for timestamps of the collected data.
+	// Zero means the data isn't bounded.
+	HardTSEnd int64
+	// MinTS is optional lower bound for timestamps of the collected data.
+	// Zero means the data isn't bounded.
+	MinTS int64
+	// FillPolicy defines how missing values are filled in downsampled data
+	FillPolicy string
+	// UseLookup defines whether metrics are discovered via FindMetricsLookup
+	UseLookup bool
+	// Discovery is the strategy of metrics discovery, see DiscoverySuggest and DiscoveryUIDMeta
+	Discovery string
+	// DatapointsLimit is the maximum number of datapoints per data query.
+	// Zero means no limit
+	DatapointsLimit int
+	// RowSize is the size of HBase rows in timestamp units the query ranges are aligned to.
+	// Zero means the query ranges aren't aligned
+	RowSize int64
+	// AlignDownsample defines whether downsampled intervals are aligned
+	// to calendar boundaries in location, see AlignQueryRanges
+	AlignDownsample bool
+	// MaxQueryDuration is the maximum time range of a single data query.
+	// Longer time ranges are subdivided by GetData. Zero means no limit
+	MaxQueryDuration time.Duration
+
+	// c is shared between all the requests to OpenTSDB for connections reuse
+	c       *http.Client
+	authCfg *auth.Config
+	backoff *backoff.Backoff
+	// useExpAPI defines whether to fetch data via /api/query/exp
+	useExpAPI bool
+	// rl limits the rate of data queries.
+	// It is shared between all the goroutines using the client.
+	rl *limiter.Limiter
+	// retries is the total number of retried requests
+	retries uint64
+	// inflight is the number of requests to OpenTSDB in progress
+	inflight int64
+	// strict defines whether failed data queries return an error
+	// instead of being skipped
+	strict bool
+	// lookupTags contains tag filters in {key=value,...} format
+	// appended to lookup queries
+	lookupTags string
+	// identityTags contains allow-listed tags per metric name
+	identityTags map[string][]string
+	// autoMsecsTime defines whether to detect the unit
+	// of returned timestamps by their magnitude
+	autoMsecsTime bool
+	// addrs contains OpenTSDB addresses from comma-separated Addr
+	addrs []string
+	// next is the index of the address for the next request
+	next uint32
+	// location is the timezone of calendar boundaries for AlignDownsample
+	location *time.Location
+	// printQueries defines whether to log queries sent to OpenTSDB, see printQuery
+	printQueries bool
+	// printQuerySampler samples data queries printed by printQuery
+	printQuerySampler *utils.LogSampler
+	// importAnnotations defines whether to return annotations
+	// of the queried series along with the data
+	importAnnotations bool
+	// queryParams are added to every data query
+	queryParams url.Values
+	// headers are sent with every request to OpenTSDB
+	headers http.Header
+	// bufferResponses defines whether to read the whole response of data queries before decoding it
+	bufferResponses bool
+	// userAgent and requestID are sent with every request to OpenTSDB if set
+	userAgent string
+	requestID string
+
+	metricInclude []*regexp.Regexp
+	metricExclude []*regexp.Regexp
 }
 
 // Config contains fields required
@@ -57,9 +156,140 @@ type Config struct {
 	Offset     int64
 	HardTS     int64
 	Retentions []string
-	Filters    []string
-	Normalize  bool
-	MsecsTime  bool
+	// Filters contains metric name prefixes for discovering metrics
+	// and tag filters in key=value format, see parseTagFilter.
+	// DefaultFilters are used for discovering metrics if only tag filters are set
+	Filters   []string
+	MsecsTime bool
+	// Normalize lowercases metric names, tag keys and tag values.
+	// It is the same as setting both NormalizeMetric and NormalizeTags.
+	Normalize bool
+	// NormalizeMetric defines whether to lowercase metric names
+	NormalizeMetric bool
+	// NormalizeTags defines whether to lowercase tag keys and values
+	NormalizeTags bool
+	// HardTSEnd is optional upper bound for timestamps of the collected data
+	HardTSEnd int64
+	// MinTS is optional lower bound for timestamps of the collected data.
+	// Query ranges are still calculated back from the starting timestamp,
+	// but the data older than MinTS isn't collected.
+	MinTS int64
+	// Retries is the number of retries for failed requests.
+	// Only network errors and 5xx responses are retried.
+	Retries int
+	// RetryInterval is the minimal interval between retries.
+	// It grows exponentially with each subsequent retry.
+	RetryInterval time.Duration
+	// FillPolicy defines how missing values are filled in downsampled data.
+	// Empty value means "none".
+	FillPolicy string
+	// UseExpAPI defines whether to fetch data via expression API /api/query/exp
+	// instead of the classic /api/query
+	UseExpAPI bool
+	// HTTPTimeout limits the duration of every request to OpenTSDB,
+	// including reading the response body. Timed out requests are retried.
+	// Zero value means no timeout.
+	HTTPTimeout time.Duration
+	// AuthCfg is an optional auth config applied to all requests to OpenTSDB
+	AuthCfg *auth.Config
+	// TLSCAFile, TLSCertFile and TLSKeyFile are optional paths to the TLS files
+	// used for connecting to OpenTSDB via https
+	TLSCAFile   string
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSInsecureSkipVerify defines whether to skip TLS certificate verification
+	TLSInsecureSkipVerify bool
+	// QueryRateLimit limits the number of data queries per second sent to OpenTSDB.
+	// Zero value means no limit.
+	QueryRateLimit int64
+	// MetricIncludeRegex is an optional list of regexes.
+	// If set, only discovered metrics matching at least one of them are imported.
+	MetricIncludeRegex []string
+	// MetricExcludeRegex is an optional list of regexes.
+	// Discovered metrics matching at least one of them are not imported.
+	MetricExcludeRegex []string
+	// Strict defines whether failed data queries must return an error
+	// instead of being logged and skipped
+	Strict bool
+	// LookupTags is an optional list of tag filters in key=value format
+	// applied to series discovery via /api/search/lookup.
+	// Value may be set to * for matching any value of the tag.
+	LookupTags []string
+	// UseLookup defines whether to discover metrics via /api/search/lookup
+	// with LookupTags instead of /api/suggest. It requires LookupTags to be set.
+	UseLookup bool
+	// DatapointsLimit is the maximum number of datapoints OpenTSDB returns per data query.
+	// Responses reaching the limit are considered truncated, so their time range
+	// is split in half and re-queried. Zero value disables the check.
+	DatapointsLimit int
+	// MaxIdleConns is the maximum number of idle keep-alive connections to OpenTSDB.
+	// It should be not lower than the number of concurrent requests,
+	// otherwise connections are closed and re-created on every request.
+	// Zero value means the default of http.Transport.
+	MaxIdleConns int
+	// IdleConnTimeout is the maximum amount of time an idle keep-alive connection
+	// remains open. Zero value means the default of http.Transport.
+	IdleConnTimeout time.Duration
+	// AutoRanges is an optional list of aggregations with the total lookback,
+	// e.g. sum-1m-avg:30d, for deriving query ranges aligned to RowSize automatically.
+	// It can't be set together with Retentions.
+	AutoRanges []string
+	// RowSize is the size of HBase rows used for AutoRanges. Default is 1h.
+	RowSize time.Duration
+	// IdentityTags is an optional list of per-metric tag allow-lists in metric=tag1,tag2 format.
+	// Series of such metrics are identified only by the allow-listed tags,
+	// while the rest of tags are aggregated via the first order aggregation of retentions.
+	IdentityTags []string
+	// AutoMsecsTime defines whether to detect the unit of timestamps returned by OpenTSDB
+	// by their magnitude instead of relying on MsecsTime. Query time ranges are sent
+	// in seconds then, so MsecsTime must be false.
+	AutoMsecsTime bool
+	// AlignDownsample defines whether to align downsampled intervals to calendar boundaries.
+	// The calendar modifier is added to the downsample spec of data queries
+	// and query ranges are aligned to the aggregation intervals via AlignQueryRanges.
+	// It can't be used together with UseExpAPI.
+	AlignDownsample bool
+	// Timezone is the timezone of calendar boundaries for AlignDownsample. Default is UTC.
+	Timezone string
+	// PrintQuery defines whether to log queries sent to OpenTSDB as curl commands
+	// with redacted credentials. Discovery queries are always logged,
+	// while data queries are sampled according to PrintQuerySampleRate.
+	PrintQuery bool
+	// PrintQuerySampleRate is the share of data queries logged if PrintQuery is set,
+	// e.g. 0.01 logs every 100th data query. Zero value means logging every data query.
+	PrintQuerySampleRate float64
+	// ImportAnnotations defines whether to return series and global annotations
+	// in the time ranges of data queries. It can't be used together with UseExpAPI,
+	// since expression API doesn't return annotations.
+	ImportAnnotations bool
+	// Discovery is the strategy of metrics discovery. Default is DiscoverySuggest.
+	// It can't be set to DiscoveryUIDMeta together with UseLookup.
+	Discovery string
+	// RetentionOverrides is an optional list of per-metric retentions in metric=pattern format.
+	// The pattern has the format of Retentions, or of AutoRanges if they are set.
+	// Multiple patterns for the same metric are collected in the given order.
+	RetentionOverrides []string
+	// MaxQueryDuration is the maximum time range of a single data query.
+	// Longer time ranges are subdivided into queries of MaxQueryDuration,
+	// so a misconfigured retention can't produce a query for years of data.
+	// Zero value disables the check.
+	MaxQueryDuration time.Duration
+	// QueryParams is an optional list of query args in key=value format,
+	// which are added to every data query, e.g. for a caching proxy in front of OpenTSDB
+	QueryParams []string
+	// HTTPHeaders is an optional list of HTTP headers in "Name: value" format
+	// sent with every request to OpenTSDB. Auth headers take precedence over them.
+	HTTPHeaders []string
+	// BufferResponses defines whether to read the whole response of data queries
+	// into memory before decoding it. By default, responses of /api/query are decoded
+	// while they are being read, so wide series need less memory.
+	// Responses of /api/query/exp are always buffered
+	BufferResponses bool
+	// UserAgent is sent in User-Agent header with every request to OpenTSDB.
+	// Go's default User-Agent is sent if it is empty
+	UserAgent string
+	// RequestID is an optional ID sent in X-Request-Id header with every request to OpenTSDB
+	RequestID string
 }
 
 // TimeRange contains data about time ranges to query
@@ -94,6 +324,90 @@ type OtsdbMetric struct {
 	Tags          map[string]string
 	AggregateTags []string
 	Dps           map[int64]float64
+	// Annotations are annotations of the series in the queried time range
+	Annotations []Annotation
+	// GlobalAnnotations are returned only if global_annotations query arg is set
+	GlobalAnnotations []Annotation
+
+	// points contains dps in the order of the response, including duplicate timestamps.
+	// It is set only on unmarshaling, since Dps loses the order of the response.
+	points dataPoints
+}
+
+// UnmarshalJSON implements json.Unmarshaler interface.
+// Missing values in dps are converted to NaN, so they could be
+// distinguished from real zero values. See dpValue.
+func (om *OtsdbMetric) UnmarshalJSON(data []byte) error {
+	type plain OtsdbMetric
+	var v struct {
+		plain
+		Dps dataPoints
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*om = OtsdbMetric(v.plain)
+	om.points = v.Dps
+	om.Dps = make(map[int64]float64, len(v.Dps))
+	for _, p := range v.Dps {
+		om.Dps[p.ts] = p.value
+	}
+	return nil
+}
+
+// dataPoint is a single sample of OtsdbMetric
+type dataPoint struct {
+	ts    int64
+	value float64
+}
+
+// dataPoints is dps object of OpenTSDB response decoded in the original order,
+// so out-of-order and duplicate timestamps returned by OpenTSDB could be detected
+type dataPoints []dataPoint
+
+// UnmarshalJSON implements json.Unmarshaler interface
+func (dps *dataPoints) UnmarshalJSON(data []byte) error {
+	*dps = make(dataPoints, 0, bytes.Count(data, []byte(":")))
+	return dps.decode(json.NewDecoder(bytes.NewReader(data)))
+}
+
+// decode reads dps object from dec token by token and appends its points to dps,
+// so the object isn't held in memory as a whole
+func (dps *dataPoints) decode(dec *json.Decoder) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		*dps = nil
+		return nil
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return fmt.Errorf("cannot parse dps: expecting object; got %v", tok)
+	}
+	points := *dps
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := tok.(string)
+		ts, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			return fmt.Errorf("cannot parse dps timestamp %q: %s", key, err)
+		}
+		var val *dpValue
+		if err := dec.Decode(&val); err != nil {
+			return err
+		}
+		points = append(points, dataPoint{ts: ts, value: valueOf(val)})
+	}
+	// the closing brace
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	*dps = points
+	return nil
 }
 
 // Metric holds the time series data in VictoriaMetrics format
@@ -102,22 +416,18 @@ type Metric struct {
 	Tags       map[string]string
 	Timestamps []int64
 	Values     []float64
+	// Annotations and GlobalAnnotations are set only if Config.ImportAnnotations is set
+	Annotations       []Annotation
+	GlobalAnnotations []Annotation
 }
 
 // FindMetrics discovers all metrics that OpenTSDB knows about (given a filter)
 // e.g. /api/suggest?type=metrics&q=system&max=100000
-func (c Client) FindMetrics(q string) ([]string, error) {
-	resp, err := http.Get(q)
+// q must be the request path without OpenTSDB address.
+func (c *Client) FindMetrics(ctx context.Context, q string) ([]string, error) {
+	body, err := c.get(ctx, q)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send GET request to %q: %s", q, err)
-	}
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("Bad return from OpenTSDB: %q: %v", resp.StatusCode, resp)
-	}
-	defer func() { _ = resp.Body.Close() }()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("could not retrieve metric data from %q: %s", q, err)
+		return nil, err
 	}
 	var metriclist []string
 	err = json.Unmarshal(body, &metriclist)
@@ -129,31 +439,815 @@ func (c Client) FindMetrics(q string) ([]string, error) {
 
 // FindSeries discovers all series associated with a metric
 // e.g. /api/search/lookup?m=system.load5&limit=1000000
-func (c Client) FindSeries(metric string) ([]Meta, error) {
-	q := fmt.Sprintf("%s/api/search/lookup?m=%s&limit=%d", c.Addr, metric, c.Limit)
-	resp, err := http.Get(q)
+func (c *Client) FindSeries(ctx context.Context, metric string) ([]Meta, error) {
+	q := fmt.Sprintf("/api/search/lookup?m=%s&limit=%d", url.QueryEscape(metric+c.lookupTags), c.Limit)
+	body, err := c.get(ctx, q)
 	if err != nil {
-		return nil, fmt.Errorf("failed to set GET request to %q: %s", q, err)
+		return nil, err
 	}
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("Bad return from OpenTSDB: %q: %v", resp.StatusCode, resp)
+	var results MetaResults
+	err = json.Unmarshal(body, &results)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from %q: %s", q, err)
 	}
-	defer func() { _ = resp.Body.Close() }()
-	body, err := io.ReadAll(resp.Body)
+	return c.filterSeries(results.Results), nil
+}
+
+// FindMetricsLookup discovers metrics with the given prefix having series
+// matching the lookup tags via /api/search/lookup.
+// Please note, Limit applies to the number of series returned by OpenTSDB.
+func (c *Client) FindMetricsLookup(ctx context.Context, prefix string) ([]string, error) {
+	q := fmt.Sprintf("/api/search/lookup?m=%s&limit=%d", url.QueryEscape("*"+c.lookupTags), c.Limit)
+	body, err := c.get(ctx, q)
 	if err != nil {
-		return nil, fmt.Errorf("could not retrieve series data from %q: %s", q, err)
+		return nil, err
 	}
 	var results MetaResults
-	err = json.Unmarshal(body, &results)
-	if err != nil {
+	if err := json.Unmarshal(body, &results); err != nil {
 		return nil, fmt.Errorf("failed to read response from %q: %s", q, err)
 	}
-	return results.Results, nil
+	seen := make(map[string]struct{})
+	var metrics []string
+	for _, m := range c.filterSeries(results.Results) {
+		if !strings.HasPrefix(m.Metric, prefix) {
+			continue
+		}
+		if _, ok := seen[m.Metric]; ok {
+			continue
+		}
+		seen[m.Metric] = struct{}{}
+		metrics = append(metrics, m.Metric)
+	}
+	sort.Strings(metrics)
+	return metrics, nil
+}
+
+// parseLookupTags converts tag filters in key=value format
+// to {key=value,...} string accepted by /api/search/lookup.
+// Empty string is returned if tags are empty.
+func parseLookupTags(tags []string) (string, error) {
+	if len(tags) == 0 {
+		return "", nil
+	}
+	pairs := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok || k == "" || v == "" {
+			return "", fmt.Errorf("invalid lookup tag %q; expecting key=value format", tag)
+		}
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}", nil
+}
+
+// parseIdentityTags parses per-metric tag allow-lists in metric=tag1,tag2 format.
+// Values without = are appended to the allow-list of the previous metric,
+// since list flags split values by comma.
+func parseIdentityTags(list []string) (map[string][]string, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	m := make(map[string][]string)
+	var metric string
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		name, tags, ok := strings.Cut(item, "=")
+		if !ok {
+			if metric == "" {
+				return nil, fmt.Errorf("invalid identity tags %q; expecting metric=tag1,tag2 format", item)
+			}
+			tags = item
+		} else {
+			if name == "" {
+				return nil, fmt.Errorf("invalid identity tags %q; metric name can't be empty", item)
+			}
+			if _, ok := m[name]; ok {
+				return nil, fmt.Errorf("duplicate identity tags for metric %q", name)
+			}
+			metric = name
+			m[metric] = []string{}
+		}
+		for _, tag := range strings.Split(tags, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				m[metric] = append(m[metric], tag)
+			}
+		}
+	}
+	return m, nil
+}
+
+func (c *Client) hasIdentityTags(metric string) bool {
+	_, ok := c.identityTags[metric]
+	return ok
+}
+
+// restrictTags returns tags allow-listed for the metric via identity tags.
+// tags are returned as is if identity tags aren't set for the metric.
+func (c *Client) restrictTags(metric string, tags map[string]string) map[string]string {
+	allowed, ok := c.identityTags[metric]
+	if !ok {
+		return tags
+	}
+	restricted := make(map[string]string, len(allowed))
+	for _, k := range allowed {
+		if v, ok := tags[k]; ok {
+			restricted[k] = v
+		}
+	}
+	return restricted
+}
+
+// MetricRetentions returns retentions for querying the given metric.
+// Retentions of RetentionOverrides take precedence over Retentions,
+// which are used for metrics without overrides.
+func (c *Client) MetricRetentions(metric string) []Retention {
+	if rts, ok := c.RetentionOverrides[metric]; ok {
+		return rts
+	}
+	return c.Retentions
+}
+
+// IdentitySeries restricts tags of the given series to identity tags of their metrics.
+// Series which become identical are deduplicated, so every resulting series
+// is fetched once with the rest of tags aggregated by OpenTSDB.
+func (c *Client) IdentitySeries(series []Meta) []Meta {
+	if len(c.identityTags) == 0 {
+		return series
+	}
+	seen := make(map[string]struct{}, len(series))
+	result := make([]Meta, 0, len(series))
+	for _, s := range series {
+		if !c.hasIdentityTags(s.Metric) {
+			result = append(result, s)
+			continue
+		}
+		tags := c.restrictTags(s.Metric, s.Tags)
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var sb strings.Builder
+		sb.WriteString(s.Metric)
+		for _, k := range keys {
+			fmt.Fprintf(&sb, ",%s=%s", k, tags[k])
+		}
+		if _, ok := seen[sb.String()]; ok {
+			continue
+		}
+		seen[sb.String()] = struct{}{}
+		result = append(result, Meta{Metric: s.Metric, Tags: tags})
+	}
+	return result
+}
+
+// FilterMetrics returns metrics matching configured include regexes
+// and not matching any of configured exclude regexes.
+// All metrics are returned if no regexes were configured.
+func (c *Client) FilterMetrics(metrics []string) []string {
+	if len(c.metricInclude) == 0 && len(c.metricExclude) == 0 {
+		return metrics
+	}
+	var result []string
+	for _, m := range metrics {
+		if len(c.metricInclude) > 0 && !matchAny(c.metricInclude, m) {
+			continue
+		}
+		if matchAny(c.metricExclude, m) {
+			continue
+		}
+		result = append(result, m)
+	}
+	return result
+}
+
+func matchAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func compileRegexes(exprs []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse regex %q: %s", expr, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// Retries returns the total number of retried requests to OpenTSDB
+func (c *Client) Retries() uint64 {
+	return atomic.LoadUint64(&c.retries)
+}
+
+// RequestError is returned when the request to OpenTSDB fails after all the retries.
+// It contains the details needed for reproducing the failed query.
+type RequestError struct {
+	// Method is the HTTP method of the request
+	Method string
+	// URL is the URL of the last attempt with redacted credentials
+	URL string
+	// StatusCode is the HTTP status code of the last response.
+	// It is zero if no response was received.
+	StatusCode int
+
+	err error
+}
+
+func (e *RequestError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("%s %s: %s", e.Method, e.URL, e.err)
+	}
+	return fmt.Sprintf("%s %s (status code %d): %s", e.Method, e.URL, e.StatusCode, e.err)
+}
+
+// Unwrap returns the error of the last attempt
+func (e *RequestError) Unwrap() error {
+	return e.err
+}
+
+// newRequestError wraps err of the request to addr+path into RequestError.
+// Credentials are removed from the URL, while auth headers aren't included at all,
+// so the error is safe for logging.
+func newRequestError(method, addr, path string, err error) *RequestError {
+	re := &RequestError{
+		Method: method,
+		URL:    redactURL(addr + path),
+		err:    err,
+	}
+	var se *statusError
+	var de *decodeError
+	switch {
+	case errors.As(err, &se):
+		re.StatusCode = se.code
+	case errors.As(err, &de):
+		// only successful responses are decoded
+		re.StatusCode = http.StatusOK
+	}
+	return re
+}
+
+// redactURL returns u with redacted password
+func redactURL(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil {
+		// the URL can't contain parsable credentials
+		return u
+	}
+	return pu.Redacted()
+}
+
+// statusError is returned when OpenTSDB responds with unexpected status code
+type statusError struct {
+	code int
+	body string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("bad return from OpenTSDB: %d: %s", e.code, e.body)
+}
+
+// Unwrap makes client errors (4xx) non-retryable,
+// since repeating the same request won't help.
+func (e *statusError) Unwrap() error {
+	if e.code < 500 {
+		return backoff.ErrBadRequest
+	}
+	return nil
+}
+
+// decodeError is returned when the response body can't be parsed
+type decodeError struct {
+	err error
+	// malformed is set if the body isn't valid JSON, e.g. because it was truncated
+	// by a flaky connection or a proxy in front of OpenTSDB, so the next attempt
+	// may return the full response. Valid JSON of unexpected format isn't retried.
+	malformed bool
+}
+
+func (e *decodeError) Error() string {
+	if e.malformed {
+		return fmt.Sprintf("malformed response body: %s", e.err)
+	}
+	return fmt.Sprintf("unexpected response body: %s", e.err)
+}
+
+// Unwrap makes malformed bodies retryable the same way as network errors
+func (e *decodeError) Unwrap() error {
+	if !e.malformed {
+		return backoff.ErrBadRequest
+	}
+	return e.err
+}
+
+// IsDecodeError returns whether err is caused by the malformed response body,
+// which couldn't be parsed even after retries
+func IsDecodeError(err error) bool {
+	var de *decodeError
+	return errors.As(err, &de) && de.malformed
+}
+
+// parseResponse parses the JSON body of data query response into dst
+func parseResponse(body []byte, dst interface{}) error {
+	if err := json.Unmarshal(replaceNaN(body), dst); err != nil {
+		var se *json.SyntaxError
+		return &decodeError{err: err, malformed: errors.As(err, &se)}
+	}
+	return nil
+}
+
+// get performs GET request to the given path and returns the response body.
+// Network errors and 5xx responses are retried according to the configured backoff policy.
+// Cancelling ctx aborts the in-flight request and the pending retries.
+func (c *Client) get(ctx context.Context, path string) ([]byte, error) {
+	return c.request(ctx, http.MethodGet, path, nil, nil)
+}
+
+// getJSON performs GET request to the given path and parses the response into dst.
+// Responses which can't be parsed are retried the same way as network errors.
+func (c *Client) getJSON(ctx context.Context, path string, dst interface{}) error {
+	_, err := c.request(ctx, http.MethodGet, path, nil, func(body []byte) error {
+		return parseResponse(body, dst)
+	})
+	return err
+}
+
+// post performs POST request with the given JSON body to the given path
+// and returns the response body. Failed requests are retried the same way as for get.
+func (c *Client) post(ctx context.Context, path string, reqBody []byte) ([]byte, error) {
+	return c.request(ctx, http.MethodPost, path, reqBody, nil)
+}
+
+// postJSON is the same as getJSON, but performs POST request with the given JSON body
+func (c *Client) postJSON(ctx context.Context, path string, reqBody []byte, dst interface{}) error {
+	_, err := c.request(ctx, http.MethodPost, path, reqBody, func(body []byte) error {
+		return parseResponse(body, dst)
+	})
+	return err
+}
+
+// request performs the request with retries. If parse isn't nil,
+// it is called for every received body and its errors are retried as well.
+func (c *Client) request(ctx context.Context, method, path string, reqBody []byte, parse func(body []byte) error) ([]byte, error) {
+	var body []byte
+	err := c.retry(ctx, method, path, reqBody, func(addr string) error {
+		var err error
+		body, err = c.doRequest(ctx, method, addr+path, reqBody, nil)
+		if err == nil && parse != nil {
+			err = parse(body)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// getStream performs GET request to the given path and passes the response body
+// to decode while it is being read, so the body isn't held in memory.
+// decode is called on every attempt and its errors are retried the same way as for getJSON.
+func (c *Client) getStream(ctx context.Context, path string, decode func(r io.Reader) error) error {
+	return c.retry(ctx, http.MethodGet, path, nil, func(addr string) error {
+		_, err := c.doRequest(ctx, http.MethodGet, addr+path, nil, decode)
+		return err
+	})
+}
+
+// retry calls attempt with the next OpenTSDB address until it succeeds
+// or the configured retries are exhausted. The last error of attempt is returned as RequestError.
+func (c *Client) retry(ctx context.Context, method, path string, reqBody []byte, attempt func(addr string) error) error {
+	var lastErr error
+	var lastAddr string
+	printed := false
+	retryableFunc := func() error {
+		// every attempt is sent to the next address,
+		// so retries of failed requests target other OpenTSDB nodes
+		addr := c.nextAddr()
+		if !printed {
+			// retries aren't printed, since they repeat the same query
+			c.printQuery(method, addr, path, reqBody)
+			printed = true
+		}
+		lastAddr = addr
+		lastErr = attempt(addr)
+		return lastErr
+	}
+	attempts, err := c.backoff.Retry(ctx, retryableFunc)
+	atomic.AddUint64(&c.retries, attempts)
+	sourceRequestRetries.Add(int(attempts))
+	if err != nil {
+		if lastErr != nil {
+			return newRequestError(method, lastAddr, path, lastErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// nextAddr returns the OpenTSDB address for the next request.
+// Addresses are chosen in round-robin manner, the same way
+// as VictoriaMetrics endpoints are chosen by vm.Importer.
+func (c *Client) nextAddr() string {
+	if len(c.addrs) == 0 {
+		return c.Addr
+	}
+	n := atomic.AddUint32(&c.next, 1)
+	return c.addrs[int(n-1)%len(c.addrs)]
+}
+
+// splitAddrs returns the list of comma-separated addresses
+func splitAddrs(s string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(s, ",") {
+		addr = strings.TrimRight(strings.TrimSpace(addr), "/")
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// Source metrics exposed by vmctl at /metrics page
+var (
+	metricsSet = metrics.NewSet()
+
+	sourceRequests       = metricsSet.NewCounter(`vmctl_source_requests_total{source="opentsdb"}`)
+	sourceRequestErrors  = metricsSet.NewCounter(`vmctl_source_request_errors_total{source="opentsdb"}`)
+	sourceRequestRetries = metricsSet.NewCounter(`vmctl_source_request_retries_total{source="opentsdb"}`)
+
+	// inflightRequests is the number of requests in progress of all the clients
+	inflightRequests int64
+	_                = metricsSet.NewGauge(`vmctl_source_inflight_requests{source="opentsdb"}`, func() float64 {
+		return float64(atomic.LoadInt64(&inflightRequests))
+	})
+)
+
+// WriteMetrics writes OpenTSDB client metrics to w in Prometheus text exposition format
+func WriteMetrics(w io.Writer) {
+	metricsSet.WritePrometheus(w)
+}
+
+// InflightRequests returns the number of requests to OpenTSDB in progress
+func (c *Client) InflightRequests() int64 {
+	return atomic.LoadInt64(&c.inflight)
+}
+
+// doRequest performs a single request to q. If decode isn't nil, the successful
+// response body is passed to it instead of being returned.
+func (c *Client) doRequest(ctx context.Context, method, q string, reqBody []byte, decode func(r io.Reader) error) ([]byte, error) {
+	sourceRequests.Inc()
+	atomic.AddInt64(&c.inflight, 1)
+	atomic.AddInt64(&inflightRequests, 1)
+	defer func() {
+		atomic.AddInt64(&c.inflight, -1)
+		atomic.AddInt64(&inflightRequests, -1)
+	}()
+	body, err := c.doRequestInternal(ctx, method, q, reqBody, decode)
+	if err != nil {
+		sourceRequestErrors.Inc()
+	}
+	return body, err
+}
+
+func (c *Client) doRequestInternal(ctx context.Context, method, q string, reqBody []byte, decode func(r io.Reader) error) ([]byte, error) {
+	var r io.Reader
+	if reqBody != nil {
+		r = bytes.NewReader(reqBody)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, q, r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request: %s", err)
+	}
+	if reqBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	// the encoding is requested explicitly, so the response is decompressed
+	// by readResponseBody instead of http.Transport
+	req.Header.Set("Accept-Encoding", "gzip")
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	if c.requestID != "" {
+		req.Header.Set("X-Request-Id", c.requestID)
+	}
+	// custom headers are set before auth, so auth headers take precedence.
+	// They may override User-Agent and X-Request-Id as well
+	for name, values := range c.headers {
+		req.Header[name] = values
+	}
+	if c.authCfg != nil {
+		c.authCfg.SetHeaders(req, true)
+	}
+	resp, err := c.c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode == http.StatusOK && decode != nil {
+		return nil, decodeResponseBody(resp, decode)
+	}
+	body, err := readResponseBody(resp)
+	if err != nil {
+		return nil, fmt.Errorf("could not read response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{code: resp.StatusCode, body: string(body)}
+	}
+	return body, nil
+}
+
+// readResponseBody reads the body of resp and decompresses it
+// if OpenTSDB or a proxy in front of it responded with gzip.
+func readResponseBody(resp *http.Response) ([]byte, error) {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return io.ReadAll(resp.Body)
+	}
+	r, err := responseReader(resp)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = r.Close() }()
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress gzipped response: %s", err)
+	}
+	return body, nil
+}
+
+// decodeResponseBody passes the decompressed body of resp to decode
+// and drains the rest of the body, so the connection could be re-used.
+func decodeResponseBody(resp *http.Response, decode func(r io.Reader) error) error {
+	r, err := responseReader(resp)
+	if err != nil {
+		return fmt.Errorf("could not read response body: %w", err)
+	}
+	defer func() { _ = r.Close() }()
+	if err := decode(r); err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, r)
+	return nil
+}
+
+// responseReader returns the reader of resp body,
+// which decompresses it if OpenTSDB or a proxy in front of it responded with gzip.
+func responseReader(resp *http.Response) (io.ReadCloser, error) {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return resp.Body, nil
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		if err == io.EOF {
+			// empty body can't contain gzip header
+			return io.NopCloser(strings.NewReader("")), nil
+		}
+		return nil, fmt.Errorf("cannot read gzipped response: %s", err)
+	}
+	return zr, nil
+}
+
+// SanitizeSeries returns the metric name and tags of the series
+// the same way as they are returned by GetData.
+func (c *Client) SanitizeSeries(series Meta) (Metric, error) {
+	return modifyData(Metric{Metric: series.Metric, Tags: series.Tags}, c.NormalizeMetric, c.NormalizeTags)
+}
+
+// ClampRange limits tr of the run started at startTime by HardTSEnd and MinTS if they are set.
+// It returns false if tr starts after HardTSEnd or ends before MinTS.
+func (c *Client) ClampRange(startTime int64, tr TimeRange) (TimeRange, bool) {
+	if c.HardTSEnd != 0 {
+		if startTime-tr.Start >= c.HardTSEnd {
+			return tr, false
+		}
+		if startTime-tr.End > c.HardTSEnd {
+			tr.End = startTime - c.HardTSEnd
+		}
+	}
+	if c.MinTS != 0 {
+		if startTime-tr.End < c.MinTS {
+			return tr, false
+		}
+		if startTime-tr.Start < c.MinTS {
+			tr.Start = startTime - c.MinTS
+		}
+	}
+	return tr, true
+}
+
+// ToTime converts OpenTSDB timestamp to time.Time
+func (c *Client) ToTime(ts int64) time.Time {
+	if c.MsecsTime {
+		return time.UnixMilli(ts)
+	}
+	return time.Unix(ts, 0)
+}
+
+// GetData retrieves data for a series at a specified time range.
+// Time ranges longer than MaxQueryDuration are subdivided into multiple queries.
+// If the response reaches DatapointsLimit, it is considered truncated by OpenTSDB,
+// so the time range is split in half and both halves are fetched recursively
+// until the results fit the limit. Queries rejected by OpenTSDB as too large
+// are split the same way, see isQueryTooLarge.
+// Cancelling ctx aborts the in-flight request.
+func (c *Client) GetData(ctx context.Context, series Meta, rt RetentionMeta, start int64, end int64, mSecs bool) (Metric, error) {
+	if ranges := c.subdivideTimeRange(start, end, rt.AggTime, mSecs); len(ranges) > 1 {
+		log.Printf("WARN: %s%v on time range [%d, %d]: the time range exceeds max query duration %s; subdividing it into %d queries",
+			series.Metric, series.Tags, start, end, c.MaxQueryDuration, len(ranges))
+		var data Metric
+		for _, tr := range ranges {
+			part, err := c.getDataSplit(ctx, series, rt, tr.Start, tr.End, mSecs)
+			if err != nil {
+				return Metric{}, err
+			}
+			data = mergeData(data, part)
+		}
+		return data, nil
+	}
+	return c.getDataSplit(ctx, series, rt, start, end, mSecs)
 }
 
-// GetData actually retrieves data for a series at a specified time range
+// getDataSplit retrieves data for a series at a specified time range,
+// splitting the time range in half if the response is truncated or rejected as too large
+func (c *Client) getDataSplit(ctx context.Context, series Meta, rt RetentionMeta, start int64, end int64, mSecs bool) (Metric, error) {
+	data, err := c.getData(ctx, series, rt, start, end, mSecs)
+	var reason string
+	switch {
+	case isQueryTooLarge(err):
+		reason = "query was rejected by OpenTSDB as too large"
+	case err != nil || c.DatapointsLimit <= 0 || len(data.Timestamps) < c.DatapointsLimit:
+		return data, err
+	default:
+		reason = fmt.Sprintf("response may be truncated: got %d datapoints with limit %d", len(data.Timestamps), c.DatapointsLimit)
+	}
+	mid, ok := splitTimeRange(start, end, rt.AggTime, mSecs)
+	if ok && c.AlignDownsample {
+		mid = c.alignTimestamp(mid, rt.AggTime, mSecs)
+		ok = mid > start
+	}
+	if !ok {
+		if err != nil {
+			if c.strict {
+				return Metric{}, err
+			}
+			log.Printf("WARN: %s%v on time range [%d, %d]: %s, but the time range can't be split further...skipping",
+				series.Metric, series.Tags, start, end, reason)
+			return Metric{}, nil
+		}
+		log.Printf("WARN: %s%v on time range [%d, %d]: %s, but the time range can't be split further",
+			series.Metric, series.Tags, start, end, reason)
+		return data, nil
+	}
+	log.Printf("WARN: %s%v on time range [%d, %d]: %s; splitting the time range into [%d, %d] and [%d, %d]",
+		series.Metric, series.Tags, start, end, reason, start, mid-1, mid, end)
+	first, err := c.getDataSplit(ctx, series, rt, start, mid-1, mSecs)
+	if err != nil {
+		return Metric{}, err
+	}
+	second, err := c.getDataSplit(ctx, series, rt, mid, end, mSecs)
+	if err != nil {
+		return Metric{}, err
+	}
+	return mergeData(first, second), nil
+}
+
+// mergeData appends the data of the later time range to the data of the earlier one
+func mergeData(first, second Metric) Metric {
+	if len(first.Timestamps) == 0 && len(first.Annotations) == 0 && len(first.GlobalAnnotations) == 0 {
+		return second
+	}
+	first.Timestamps = append(first.Timestamps, second.Timestamps...)
+	first.Values = append(first.Values, second.Values...)
+	first.Annotations = mergeAnnotations(first.Annotations, second.Annotations)
+	first.GlobalAnnotations = mergeAnnotations(first.GlobalAnnotations, second.GlobalAnnotations)
+	return first
+}
+
+// subdivideTimeRange returns consecutive time ranges of up to MaxQueryDuration covering [start, end].
+// The boundaries are aligned to the aggregation interval, so downsampled intervals aren't split between queries.
+// A single time range is returned if MaxQueryDuration isn't set or isn't exceeded.
+func (c *Client) subdivideTimeRange(start, end int64, aggTime string, mSecs bool) []TimeRange {
+	if c.MaxQueryDuration <= 0 {
+		return []TimeRange{{Start: start, End: end}}
+	}
+	size := int64(c.MaxQueryDuration / time.Second)
+	if mSecs {
+		size = c.MaxQueryDuration.Milliseconds()
+	}
+	step := aggStep(aggTime, mSecs)
+	if size -= size % step; size < step {
+		// the query can't be shorter than the aggregation interval
+		size = step
+	}
+	if end-start < size {
+		return []TimeRange{{Start: start, End: end}}
+	}
+	var ranges []TimeRange
+	for from := start; from <= end; {
+		next := from + size
+		next -= next % step
+		if c.AlignDownsample {
+			next = c.alignTimestamp(next, aggTime, mSecs)
+		}
+		if next <= from {
+			next = from + size
+		}
+		if next > end {
+			next = end + 1
+		}
+		ranges = append(ranges, TimeRange{Start: from, End: next - 1})
+		from = next
+	}
+	return ranges
+}
+
+// queryLimitMessage is the prefix of errors returned by OpenTSDB
+// for queries exceeding the configured query limits
+const queryLimitMessage = "Sorry, you have attempted to fetch more than our"
+
+// isQueryTooLarge returns whether err is returned for the query rejected by OpenTSDB
+// or a proxy in front of it because of its size, so the query could succeed
+// for a smaller time range.
+func isQueryTooLarge(err error) bool {
+	var se *statusError
+	if !errors.As(err, &se) {
+		return false
+	}
+	return se.code == http.StatusRequestEntityTooLarge || strings.Contains(se.body, queryLimitMessage)
+}
+
+// logAutoRanges prints the query ranges derived for the auto range spec,
+// so they could be checked before the import.
+func logAutoRanges(spec string, rowSize time.Duration, ret Retention, msecTime bool) {
+	unit := time.Second
+	if msecTime {
+		unit = time.Millisecond
+	}
+	format := func(tr TimeRange) string {
+		// the newer bound is exclusive, see convertAutoRange
+		return fmt.Sprintf("[start-%s, start-%s)", time.Duration(tr.Start)*unit, time.Duration(tr.End-1)*unit)
+	}
+	ranges := ret.QueryRanges
+	querySize := time.Duration(ranges[0].Start-ranges[0].End+1) * unit
+	var list []string
+	for i, tr := range ranges {
+		if len(ranges) > 6 && i == 3 {
+			list = append(list, "...")
+		}
+		if len(ranges) > 6 && i >= 3 && i < len(ranges)-3 {
+			continue
+		}
+		list = append(list, format(tr))
+	}
+	log.Printf("Derived %d query ranges of %s for %q aligned to %s rows: %s",
+		len(ranges), querySize, spec, rowSize, strings.Join(list, ", "))
+}
+
+// splitTimeRange returns the middle of the time range [start, end] aligned
+// to the aggregation interval, so downsampled intervals aren't split between queries.
+// false is returned if the time range can't be split.
+func splitTimeRange(start, end int64, aggTime string, mSecs bool) (int64, bool) {
+	step := aggStep(aggTime, mSecs)
+	mid := start + (end-start)/2
+	mid -= mid % step
+	if mid <= start || mid > end {
+		return 0, false
+	}
+	return mid, true
+}
+
+// aggStep returns the aggregation interval in timestamp units.
+// It is a second if aggTime can't be parsed.
+func aggStep(aggTime string, mSecs bool) int64 {
+	step := int64(1)
+	if d, err := convertDuration(aggTime); err == nil && d > 0 {
+		step = int64(d / time.Second)
+		if mSecs {
+			step = d.Milliseconds()
+		}
+	} else if mSecs {
+		step = 1000
+	}
+	if step < 1 {
+		step = 1
+	}
+	return step
+}
+
+// getData retrieves data for a series at a specified time range with a single query
 // e.g. /api/query?start=1&end=200&m=sum:1m-avg-none:system.load5{host=host1}
-func (c Client) GetData(series Meta, rt RetentionMeta, start int64, end int64, mSecs bool) (Metric, error) {
+func (c *Client) getData(ctx context.Context, series Meta, rt RetentionMeta, start int64, end int64, mSecs bool) (Metric, error) {
+	if c.useExpAPI {
+		return c.getDataExp(ctx, series, rt, start, end)
+	}
 	/*
 		First, build our tag string.
 		It's literally just key=value,key=value,...
@@ -170,10 +1264,16 @@ func (c Client) GetData(series Meta, rt RetentionMeta, start int64, end int64, m
 		FirstOrder (e.g. sum/avg/max/etc.)
 		SecondOrder (e.g. sum/avg/max/etc.)
 		AggTime	(e.g. 1m/10m/1d/etc.)
-		This will build into m=<FirstOrder>:<AggTime>-<SecondOrder>-none:
+		FillPolicy (e.g. none/nan/zero/etc.)
+		This will build into m=<FirstOrder>:<AggTime>-<SecondOrder>-<FillPolicy>:
 		Or an example: m=sum:1m-avg-none
+		With calendar alignment the interval gets the c modifier: m=sum:1dc-avg-none
 	*/
-	aggPol := fmt.Sprintf("%s:%s-%s-none", rt.FirstOrder, rt.AggTime, rt.SecondOrder)
+	aggTime := rt.AggTime
+	if c.AlignDownsample {
+		aggTime += "c"
+	}
+	aggPol := fmt.Sprintf("%s:%s-%s-%s", rt.FirstOrder, aggTime, rt.SecondOrder, c.FillPolicy)
 
 	/*
 		Our actual query string:
@@ -182,34 +1282,70 @@ func (c Client) GetData(series Meta, rt RetentionMeta, start int64, end int64, m
 	*/
 	queryStr := fmt.Sprintf("start=%v&end=%v&m=%s:%s{%s}", start, end, aggPol,
 		series.Metric, tagStr)
+	if filters := c.queryTagFilters(series); len(filters) > 0 {
+		// the second group contains filters which don't affect grouping,
+		// e.g. m=sum:1m-avg-none:sys.cpu{host=h1}{dc=literal_or(eu)}
+		filterStrs := make([]string, 0, len(filters))
+		for _, tf := range filters {
+			filterStrs = append(filterStrs, tf.String())
+		}
+		queryStr += url.QueryEscape("{" + strings.Join(filterStrs, ",") + "}")
+	}
+	if c.AlignDownsample {
+		queryStr += "&timezone=" + url.QueryEscape(c.location.String())
+	}
+	if c.importAnnotations {
+		queryStr += "&global_annotations=true"
+	}
+	if len(c.queryParams) > 0 {
+		queryStr += "&" + c.queryParams.Encode()
+	}
 
-	q := fmt.Sprintf("%s/api/query?%s", c.Addr, queryStr)
-	resp, err := http.Get(q)
-	if err != nil {
-		return Metric{}, fmt.Errorf("failed to send GET request to %q: %s", q, err)
+	q := fmt.Sprintf("/api/query?%s", queryStr)
+	c.rl.Register(1)
+	var output []OtsdbMetric
+	var err error
+	if c.bufferResponses {
+		err = c.getJSON(ctx, q, &output)
+	} else {
+		err = c.getStream(ctx, q, func(r io.Reader) error {
+			// the series of the previous attempt are dropped on retry
+			output = output[:0]
+			return decodeSeries(r, func(om *OtsdbMetric) {
+				if len(output) > 0 {
+					// responses with multiple series are skipped below,
+					// so the points of the rest of series aren't kept
+					om.points = nil
+				}
+				output = append(output, *om)
+			})
+		})
 	}
 	/*
 		There are three potential failures here, none of which should kill the entire
 		migration run:
-		1. bad response code
+		1. bad response code (after all the retries for 5xx)
 		2. failure to read response body
-		3. bad format of response body
+		3. bad format of response body (after all the retries, since it may be truncated)
 	*/
-	if resp.StatusCode != 200 {
-		log.Printf("bad response code from OpenTSDB query %v for %q...skipping", resp.StatusCode, q)
-		return Metric{}, nil
-	}
-	defer func() { _ = resp.Body.Close() }()
-	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Println("couldn't read response body from OpenTSDB query...skipping")
-		return Metric{}, nil
-	}
-	var output []OtsdbMetric
-	err = json.Unmarshal(body, &output)
-	if err != nil {
-		log.Printf("couldn't marshall response body from OpenTSDB query (%s)...skipping", body)
-		return Metric{}, nil
+		var se *statusError
+		// too large queries are split by GetData
+		if errors.As(err, &se) && !c.strict && !isQueryTooLarge(err) {
+			log.Printf("bad response code from OpenTSDB query %v for %q...skipping", se.code, q)
+			return Metric{}, nil
+		}
+		var de *decodeError
+		if errors.As(err, &de) {
+			if !de.malformed && !c.strict {
+				log.Printf("couldn't marshall response body from OpenTSDB query (%s)...skipping", de)
+				return Metric{}, nil
+			}
+			// malformed responses aren't skipped here, so the caller
+			// could mark the series as failed and retry it later
+			return Metric{}, fmt.Errorf("cannot parse response body from OpenTSDB query: %w", err)
+		}
+		return Metric{}, err
 	}
 	/*
 		We expect results to look like:
@@ -249,18 +1385,18 @@ func (c Client) GetData(series Meta, rt RetentionMeta, start int64, end int64, m
 		// multiple series returned for a single query. We can't process this right, so...
 		return Metric{}, nil
 	}
-	if len(output[0].AggregateTags) > 0 {
+	if len(output[0].AggregateTags) > 0 && !c.hasIdentityTags(series.Metric) {
 		// This failure means we've suppressed potential series somehow...
 		return Metric{}, nil
 	}
 	data := Metric{}
 	data.Metric = output[0].Metric
-	data.Tags = output[0].Tags
+	data.Tags = c.restrictTags(series.Metric, output[0].Tags)
 	/*
 		We evaluate data for correctness before formatting the actual values
 		to skip a little bit of time if the series has invalid formatting
 	*/
-	data, err = modifyData(data, c.Normalize)
+	data, err = modifyData(data, c.NormalizeMetric, c.NormalizeTags)
 	if err != nil {
 		return Metric{}, nil
 	}
@@ -272,20 +1408,41 @@ func (c Client) GetData(series Meta, rt RetentionMeta, start int64, end int64, m
 		can be a float64, we have to initially cast _all_ objects that way
 		then convert the timestamp back to something reasonable.
 	*/
-	for ts, val := range output[0].Dps {
-		if !mSecs {
-			data.Timestamps = append(data.Timestamps, ts*1000)
-		} else {
-			data.Timestamps = append(data.Timestamps, ts)
-		}
-		data.Values = append(data.Values, val)
+	for _, p := range output[0].points {
+		data.Timestamps = append(data.Timestamps, c.toMillis(p.ts, mSecs))
+		data.Values = append(data.Values, p.value)
+	}
+	if c.importAnnotations {
+		data.Annotations = output[0].Annotations
+		data.GlobalAnnotations = output[0].GlobalAnnotations
 	}
 	return data, nil
 }
 
+// minMsecsTimestamp is the lowest timestamp treated as milliseconds
+// on detecting the unit of timestamps. It is 1973-03-03 in milliseconds,
+// while in seconds it is far beyond any plausible date.
+const minMsecsTimestamp = 1e11
+
+// toMillis converts the timestamp returned by OpenTSDB to milliseconds.
+// mSecs defines whether ts is already in milliseconds,
+// unless the unit is detected automatically.
+func (c *Client) toMillis(ts int64, mSecs bool) int64 {
+	if c.autoMsecsTime {
+		mSecs = ts >= minMsecsTimestamp
+	}
+	if mSecs {
+		return ts
+	}
+	return ts * 1000
+}
+
 // NewClient creates and returns OpenTSDB client
 // configured with passed Config
 func NewClient(cfg Config) (*Client, error) {
+	if cfg.AutoMsecsTime && cfg.MsecsTime {
+		return nil, fmt.Errorf("timestamps unit can't be detected automatically if milliseconds are set explicitly")
+	}
 	var retentions []Retention
 	offsetPrint := int64(time.Now().Unix())
 	// convert a number of days to seconds
@@ -317,14 +1474,221 @@ func NewClient(cfg Config) (*Client, error) {
 		}
 		retentions = append(retentions, ret)
 	}
+	identityTags, err := parseIdentityTags(cfg.IdentityTags)
+	if err != nil {
+		return nil, err
+	}
+	queryParams, err := parseQueryParams(cfg.QueryParams)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := parseHeaders(cfg.HTTPHeaders)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxQueryDuration < 0 {
+		return nil, fmt.Errorf("max query duration can't be negative; got %s", cfg.MaxQueryDuration)
+	}
+	var rowSize int64
+	var rowSizeDuration time.Duration
+	if len(cfg.AutoRanges) > 0 {
+		if len(cfg.Retentions) > 0 {
+			return nil, fmt.Errorf("retentions and auto ranges can't be set together")
+		}
+		rowSizeDuration = cfg.RowSize
+		if rowSizeDuration <= 0 {
+			rowSizeDuration = time.Hour
+		}
+		for _, spec := range cfg.AutoRanges {
+			ret, err := convertAutoRange(spec, rowSizeDuration, offsetSecs, cfg.MsecsTime)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't parse auto range %q: %s", spec, err)
+			}
+			logAutoRanges(spec, rowSizeDuration, ret, cfg.MsecsTime)
+			retentions = append(retentions, ret)
+		}
+		rowSize = int64(rowSizeDuration / time.Second)
+		if cfg.MsecsTime {
+			rowSize = rowSizeDuration.Milliseconds()
+		}
+	}
+	retentionOverrides, err := parseRetentionOverrides(cfg.RetentionOverrides, func(pattern string) (Retention, error) {
+		if rowSizeDuration > 0 {
+			return convertAutoRange(pattern, rowSizeDuration, offsetSecs, cfg.MsecsTime)
+		}
+		return convertRetention(pattern, offsetSecs, cfg.MsecsTime)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(identityTags) > 0 {
+		check := func(list []Retention) error {
+			for _, rt := range list {
+				// dropped tags must be aggregated into a single series
+				if rt.FirstOrder == "none" {
+					return fmt.Errorf("identity tags require first order aggregation other than %q in retentions", rt.FirstOrder)
+				}
+			}
+			return nil
+		}
+		if err := check(retentions); err != nil {
+			return nil, err
+		}
+		for _, list := range retentionOverrides {
+			if err := check(list); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if cfg.HardTSEnd != 0 || cfg.MinTS != 0 {
+		// query ranges are offsets back from the starting point
+		startTS := offsetPrint + offsetSecs
+		if cfg.HardTS > 0 {
+			startTS = cfg.HardTS
+		}
+		earliest := startTS
+		for _, rt := range retentions {
+			for _, tr := range rt.QueryRanges {
+				if ts := startTS - tr.Start; ts < earliest {
+					earliest = ts
+				}
+			}
+		}
+		if cfg.HardTSEnd != 0 && cfg.HardTSEnd <= earliest {
+			return nil, fmt.Errorf("hard end timestamp %d must be greater than the earliest timestamp %d of the collected time range", cfg.HardTSEnd, earliest)
+		}
+		if cfg.MinTS != 0 {
+			if cfg.MinTS >= startTS {
+				return nil, fmt.Errorf("min timestamp %d must be lower than the starting timestamp %d", cfg.MinTS, startTS)
+			}
+			if cfg.MinTS < earliest {
+				log.Printf("WARN: min timestamp %d is lower than the earliest timestamp %d of the collected time range, "+
+					"so the data between them isn't collected", cfg.MinTS, earliest)
+			}
+		}
+	}
+	tr, err := utils.TransportWithCerts(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSCAFile, cfg.TLSInsecureSkipVerify)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TLS config: %s", err)
+	}
+	if cfg.MaxIdleConns > 0 {
+		// all the requests are sent to the same host
+		tr.MaxIdleConnsPerHost = cfg.MaxIdleConns
+		if tr.MaxIdleConns < cfg.MaxIdleConns {
+			tr.MaxIdleConns = cfg.MaxIdleConns
+		}
+	}
+	if cfg.IdleConnTimeout > 0 {
+		tr.IdleConnTimeout = cfg.IdleConnTimeout
+	}
+	metricInclude, err := compileRegexes(cfg.MetricIncludeRegex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metric include regex: %s", err)
+	}
+	metricExclude, err := compileRegexes(cfg.MetricExcludeRegex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metric exclude regex: %s", err)
+	}
+	fillPolicy := cfg.FillPolicy
+	if fillPolicy == "" {
+		fillPolicy = FillPolicyNone
+	}
+	if err := checkFillPolicy(fillPolicy); err != nil {
+		return nil, err
+	}
+	filters, tagFilters, err := splitFilters(cfg.Filters)
+	if err != nil {
+		return nil, err
+	}
+	if len(filters) == 0 && len(tagFilters) > 0 {
+		filters = DefaultFilters
+	}
+	// exact tag filters narrow the lookup, while the rest
+	// of filters are applied to the lookup results
+	lookupTags, err := parseLookupTags(append(lookupFilters(tagFilters), cfg.LookupTags...))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.UseLookup && lookupTags == "" {
+		return nil, fmt.Errorf("lookup tags must be set for discovering metrics via lookup")
+	}
+	discovery := cfg.Discovery
+	if discovery == "" {
+		discovery = DiscoverySuggest
+	}
+	if err := checkDiscovery(discovery); err != nil {
+		return nil, err
+	}
+	if cfg.UseLookup && discovery != DiscoverySuggest {
+		return nil, fmt.Errorf("metrics can't be discovered via lookup together with %s discovery", discovery)
+	}
+	if cfg.ImportAnnotations && cfg.UseExpAPI {
+		return nil, fmt.Errorf("annotations can't be imported via expression API")
+	}
+	printQueryEvery, err := printQuerySampleEvery(cfg.PrintQuerySampleRate)
+	if err != nil {
+		return nil, err
+	}
+	location := time.UTC
+	if cfg.AlignDownsample {
+		if cfg.UseExpAPI {
+			return nil, fmt.Errorf("calendar-aligned downsampling isn't supported for expression API")
+		}
+		if cfg.Timezone != "" {
+			location, err = time.LoadLocation(cfg.Timezone)
+			if err != nil {
+				return nil, fmt.Errorf("cannot load timezone %q: %s", cfg.Timezone, err)
+			}
+		}
+		for _, rt := range retentions {
+			if _, err := parseCalendarInterval(rt.AggTime); err != nil {
+				return nil, err
+			}
+		}
+	}
 	client := &Client{
-		Addr:       strings.Trim(cfg.Addr, "/"),
-		Retentions: retentions,
-		Limit:      cfg.Limit,
-		Filters:    cfg.Filters,
-		Normalize:  cfg.Normalize,
-		HardTS:     cfg.HardTS,
-		MsecsTime:  cfg.MsecsTime,
+		Addr:            strings.Trim(cfg.Addr, "/"),
+		addrs:           splitAddrs(cfg.Addr),
+		Retentions:      retentions,
+		Limit:           cfg.Limit,
+		Filters:         filters,
+		TagFilters:      tagFilters,
+		NormalizeMetric: cfg.Normalize || cfg.NormalizeMetric,
+		NormalizeTags:   cfg.Normalize || cfg.NormalizeTags,
+		HardTS:          cfg.HardTS,
+		HardTSEnd:       cfg.HardTSEnd,
+		MinTS:           cfg.MinTS,
+		MsecsTime:       cfg.MsecsTime,
+		FillPolicy:      fillPolicy,
+		c:               &http.Client{Transport: tr, Timeout: cfg.HTTPTimeout},
+		authCfg:         cfg.AuthCfg,
+		backoff:         backoff.NewWithParams(cfg.Retries+1, cfg.RetryInterval),
+		rl:              limiter.NewLimiter(cfg.QueryRateLimit),
+		useExpAPI:       cfg.UseExpAPI,
+		strict:          cfg.Strict,
+		UseLookup:       cfg.UseLookup,
+		Discovery:       discovery,
+		DatapointsLimit: cfg.DatapointsLimit,
+		RowSize:         rowSize,
+		lookupTags:      lookupTags,
+		identityTags:    identityTags,
+		autoMsecsTime:   cfg.AutoMsecsTime,
+		AlignDownsample: cfg.AlignDownsample,
+		location:        location,
+		printQueries:    cfg.PrintQuery,
+
+		metricInclude:     metricInclude,
+		metricExclude:     metricExclude,
+		printQuerySampler: utils.NewLogSampler(printQueryEvery),
+		importAnnotations: cfg.ImportAnnotations,
+		queryParams:       queryParams,
+		headers:           headers,
+		bufferResponses:   cfg.BufferResponses,
+		userAgent:         cfg.UserAgent,
+		requestID:         cfg.RequestID,
+
+		RetentionOverrides: retentionOverrides,
+		MaxQueryDuration:   cfg.MaxQueryDuration,
 	}
 	return client, nil
 }
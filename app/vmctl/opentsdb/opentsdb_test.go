@@ -0,0 +1,1051 @@
+package opentsdb
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/auth"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/backoff"
+)
+
+func TestClientRetries(t *testing.T) {
+	f := func(codes []int, retries int, wantErr bool, wantRequests uint64) {
+		t.Helper()
+		var requests uint64
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddUint64(&requests, 1)
+			code := codes[len(codes)-1]
+			if int(n) <= len(codes) {
+				code = codes[n-1]
+			}
+			w.WriteHeader(code)
+			_, _ = w.Write([]byte(`["system.load5"]`))
+		}))
+		defer srv.Close()
+
+		c, err := NewClient(Config{
+			Addr:          srv.URL,
+			Retries:       retries,
+			RetryInterval: time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("cannot create client: %s", err)
+		}
+		_, err = c.FindMetrics(context.Background(), "/api/suggest?type=metrics&q=system")
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error: %v; wantErr: %v", err, wantErr)
+		}
+		if got := atomic.LoadUint64(&requests); got != wantRequests {
+			t.Fatalf("unexpected number of requests %d; want %d", got, wantRequests)
+		}
+	}
+
+	// successful request isn't retried
+	f([]int{200}, 3, false, 1)
+	// 5xx responses are retried until success
+	f([]int{500, 503, 200}, 3, false, 3)
+	// 5xx responses are retried until retries are exhausted
+	f([]int{500}, 2, true, 3)
+	// 4xx responses fail fast
+	f([]int{400, 200}, 3, true, 1)
+	f([]int{404, 200}, 3, true, 1)
+	// zero retries means a single attempt
+	f([]int{500, 200}, 0, true, 1)
+}
+
+func TestParseResponse(t *testing.T) {
+	f := func(body string, wantErr, wantRetry bool) {
+		t.Helper()
+		var output []OtsdbMetric
+		err := parseResponse([]byte(body), &output)
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error: %v; wantErr: %v", err, wantErr)
+		}
+		if err == nil {
+			return
+		}
+		// only malformed responses must be retried
+		if IsDecodeError(err) != wantRetry || errors.Is(err, backoff.ErrBadRequest) == wantRetry {
+			t.Fatalf("unexpected retryable error %v; want retry: %v", err, wantRetry)
+		}
+	}
+
+	f(`[{"metric":"cpu","tags":{"host":"h1"},"dps":{"1626019200":1,"1626019260":NaN}}]`, false, false)
+	f(`[]`, false, false)
+	// valid JSON of unexpected format
+	f(`{"error":{"code":400}}`, true, false)
+	// truncated bodies
+	f(`[{"metric":"cpu","tags":{"host":"h1"},"dps":{"1626019200":1,"16260`, true, true)
+	f(`[{"metric":"cpu"`, true, true)
+	f(``, true, true)
+}
+
+func TestClientGetDataRetriesMalformedResponses(t *testing.T) {
+	f := func(truncated int, strict bool, wantPoints int, wantRetries uint64, wantErr bool) {
+		t.Helper()
+		var requests uint64
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body := `[{"metric":"cpu","tags":{"host":"h1"},"dps":{"1626019200":1,"1626019260":2}}]`
+			if n := atomic.AddUint64(&requests, 1); int(n) <= truncated {
+				// imitate the connection dropped in the middle of the response
+				body = body[:len(body)/2]
+			}
+			_, _ = w.Write([]byte(body))
+		}))
+		defer srv.Close()
+
+		c, err := NewClient(Config{
+			Addr:          srv.URL,
+			Retries:       2,
+			RetryInterval: time.Millisecond,
+			Strict:        strict,
+		})
+		if err != nil {
+			t.Fatalf("cannot create client: %s", err)
+		}
+		rt := RetentionMeta{FirstOrder: "sum", SecondOrder: "avg", AggTime: "1m"}
+		data, err := c.GetData(context.Background(), Meta{Metric: "cpu", Tags: map[string]string{"host": "h1"}}, rt, 1626019200, 1626019300, false)
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error: %v; wantErr: %v", err, wantErr)
+		}
+		if wantErr && !IsDecodeError(err) {
+			t.Fatalf("expecting decode error; got %v", err)
+		}
+		if len(data.Timestamps) != wantPoints {
+			t.Fatalf("unexpected number of datapoints %d; want %d", len(data.Timestamps), wantPoints)
+		}
+		if got := c.Retries(); got != wantRetries {
+			t.Fatalf("unexpected number of retries %d; want %d", got, wantRetries)
+		}
+	}
+
+	f(0, false, 2, 0, false)
+	// truncated responses are retried until success
+	f(2, false, 2, 2, false)
+	// the error is returned after all the retries even in non-strict mode,
+	// so the series could be marked as failed
+	f(3, false, 0, 3, true)
+	f(3, true, 0, 3, true)
+}
+
+func TestClientGetDataRequestError(t *testing.T) {
+	f := func(code int, body string, wantStatus int) {
+		t.Helper()
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+			_, _ = w.Write([]byte(body))
+		}))
+		defer srv.Close()
+
+		authCfg, err := auth.Generate(auth.WithBearer("secret-token"))
+		if err != nil {
+			t.Fatalf("cannot create auth config: %s", err)
+		}
+		c, err := NewClient(Config{
+			Addr:          strings.Replace(srv.URL, "http://", "http://user:password@", 1),
+			AuthCfg:       authCfg,
+			HTTPHeaders:   []string{"X-Api-Key: secret-key"},
+			RetryInterval: time.Millisecond,
+			Strict:        true,
+		})
+		if err != nil {
+			t.Fatalf("cannot create client: %s", err)
+		}
+		rt := RetentionMeta{FirstOrder: "sum", SecondOrder: "avg", AggTime: "1m"}
+		_, err = c.GetData(context.Background(), Meta{Metric: "cpu", Tags: map[string]string{"host": "h1"}}, rt, 1626019200, 1626019300, false)
+		var re *RequestError
+		if !errors.As(err, &re) {
+			t.Fatalf("expecting RequestError; got %v", err)
+		}
+		if re.Method != http.MethodGet || re.StatusCode != wantStatus {
+			t.Fatalf("unexpected method %q and status code %d; want %q and %d", re.Method, re.StatusCode, http.MethodGet, wantStatus)
+		}
+		wantURL := strings.Replace(srv.URL, "http://", "http://user:xxxxx@", 1) + "/api/query?start=1626019200&end=1626019300&m=sum:1m-avg-none:cpu{host=h1}"
+		if re.URL != wantURL {
+			t.Fatalf("unexpected URL %q; want %q", re.URL, wantURL)
+		}
+		for _, secret := range []string{"password", "secret-token", "secret-key"} {
+			if strings.Contains(err.Error(), secret) {
+				t.Fatalf("error %q mustn't contain credentials", err)
+			}
+		}
+	}
+
+	f(http.StatusBadRequest, `{"error":{"message":"No such name for 'metrics': 'cpu'"}}`, http.StatusBadRequest)
+	f(http.StatusOK, `{"error":{"code":400}}`, http.StatusOK)
+}
+
+func TestClientRetriesRotateAddrs(t *testing.T) {
+	newServer := func(code int, requests *uint64) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddUint64(requests, 1)
+			w.WriteHeader(code)
+			_, _ = w.Write([]byte(`["system.load5"]`))
+		}))
+	}
+	var badRequests, goodRequests uint64
+	bad := newServer(http.StatusServiceUnavailable, &badRequests)
+	defer bad.Close()
+	good := newServer(http.StatusOK, &goodRequests)
+	defer good.Close()
+
+	c, err := NewClient(Config{
+		Addr:          bad.URL + "/, " + good.URL,
+		Retries:       3,
+		RetryInterval: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("cannot create client: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := c.FindMetrics(context.Background(), "/api/suggest?type=metrics&q=system"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	// attempts alternate between addresses, so every request
+	// sent to the failing address is retried on the other one
+	if n := atomic.LoadUint64(&badRequests); n != 3 {
+		t.Fatalf("unexpected number of requests to failing address %d; want 3", n)
+	}
+	if n := atomic.LoadUint64(&goodRequests); n != 3 {
+		t.Fatalf("unexpected number of requests to healthy address %d; want 3", n)
+	}
+	if n := c.Retries(); n != 3 {
+		t.Fatalf("unexpected number of retries %d; want 3", n)
+	}
+}
+
+func TestSplitAddrs(t *testing.T) {
+	f := func(s string, want []string) {
+		t.Helper()
+		if got := splitAddrs(s); !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected addrs for %q: %q; want %q", s, got, want)
+		}
+	}
+	f("", nil)
+	f("http://localhost:4242/", []string{"http://localhost:4242"})
+	f("http://a:4242, http://b:4242/,,", []string{"http://a:4242", "http://b:4242"})
+}
+
+func TestClientFilterMetrics(t *testing.T) {
+	f := func(include, exclude []string, metrics, want []string) {
+		t.Helper()
+		c, err := NewClient(Config{
+			MetricIncludeRegex: include,
+			MetricExcludeRegex: exclude,
+		})
+		if err != nil {
+			t.Fatalf("cannot create client: %s", err)
+		}
+		got := c.FilterMetrics(metrics)
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Fatalf("unexpected metrics %q; want %q", got, want)
+		}
+	}
+
+	metrics := []string{"sys.cpu.user", "sys.cpu.system", "sys.mem.free", "tsd.rpc.received"}
+	f(nil, nil, metrics, metrics)
+	f([]string{"^sys\\.cpu"}, nil, metrics, []string{"sys.cpu.user", "sys.cpu.system"})
+	f([]string{"^sys\\.cpu", "mem"}, nil, metrics, []string{"sys.cpu.user", "sys.cpu.system", "sys.mem.free"})
+	f(nil, []string{"^tsd\\."}, metrics, []string{"sys.cpu.user", "sys.cpu.system", "sys.mem.free"})
+	f([]string{"^sys\\."}, []string{"system$", "mem"}, metrics, []string{"sys.cpu.user"})
+	f([]string{"^foo"}, nil, metrics, nil)
+}
+
+func TestNewClientInvalidRegex(t *testing.T) {
+	if _, err := NewClient(Config{MetricIncludeRegex: []string{"["}}); err == nil {
+		t.Fatalf("expecting error for invalid include regex")
+	}
+	if _, err := NewClient(Config{MetricExcludeRegex: []string{"("}}); err == nil {
+		t.Fatalf("expecting error for invalid exclude regex")
+	}
+}
+
+func TestNewClientHardTSEnd(t *testing.T) {
+	f := func(hardTS, hardTSEnd int64, wantErr bool) {
+		t.Helper()
+		_, err := NewClient(Config{
+			HardTS:     hardTS,
+			HardTSEnd:  hardTSEnd,
+			Retentions: []string{"sum-1m-avg:1h:1d"},
+		})
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error: %v; wantErr: %v", err, wantErr)
+		}
+	}
+
+	const day = 24 * 3600
+	f(10*day, 0, false)
+	f(10*day, 10*day, false)
+	f(10*day, 9*day+1, false)
+	// hard end is before the collected time range
+	f(10*day, 9*day-4*3600, true)
+	f(10*day, 1, true)
+	// hard end is relative to the current time if hard start isn't set
+	f(0, 10*day, true)
+}
+
+func TestNewClientMinTS(t *testing.T) {
+	f := func(hardTS, minTS int64, wantErr bool) {
+		t.Helper()
+		_, err := NewClient(Config{
+			HardTS:     hardTS,
+			MinTS:      minTS,
+			Retentions: []string{"sum-1m-avg:1h:1d"},
+		})
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error: %v; wantErr: %v", err, wantErr)
+		}
+	}
+
+	const day = 24 * 3600
+	f(10*day, 0, false)
+	f(10*day, 9*day+1, false)
+	// older data isn't covered by retentions, but it isn't an error
+	f(10*day, 1, false)
+	// min timestamp isn't before the starting timestamp
+	f(10*day, 10*day, true)
+	f(10*day, 11*day, true)
+}
+
+func TestClientAuth(t *testing.T) {
+	f := func(opts []auth.ConfigOptions, wantHeader string) {
+		t.Helper()
+		var gotHeader string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotHeader = r.Header.Get("Authorization")
+			_, _ = w.Write([]byte(`{"type":"LOOKUP","results":[]}`))
+		}))
+		defer srv.Close()
+
+		authCfg, err := auth.Generate(opts...)
+		if err != nil {
+			t.Fatalf("cannot create auth config: %s", err)
+		}
+		c, err := NewClient(Config{Addr: srv.URL, AuthCfg: authCfg})
+		if err != nil {
+			t.Fatalf("cannot create client: %s", err)
+		}
+		if _, err := c.FindSeries(context.Background(), "system.load5"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if gotHeader != wantHeader {
+			t.Fatalf("unexpected Authorization header %q; want %q", gotHeader, wantHeader)
+		}
+	}
+
+	f(nil, "")
+	f([]auth.ConfigOptions{auth.WithBasicAuth("foo", "bar")}, "Basic Zm9vOmJhcg==")
+	f([]auth.ConfigOptions{auth.WithBearer("token")}, "Bearer token")
+}
+
+func TestClientTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`["system.load5"]`))
+	}))
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatalf("cannot write CA file: %s", err)
+	}
+
+	f := func(cfg Config, wantErr bool) {
+		t.Helper()
+		cfg.Addr = srv.URL
+		c, err := NewClient(cfg)
+		if err != nil {
+			t.Fatalf("cannot create client: %s", err)
+		}
+		_, err = c.FindMetrics(context.Background(), "/api/suggest?type=metrics&q=system")
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error: %v; wantErr: %v", err, wantErr)
+		}
+	}
+
+	// unknown CA
+	f(Config{}, true)
+	f(Config{TLSCAFile: caFile}, false)
+	f(Config{TLSInsecureSkipVerify: true}, false)
+
+	// missing files must be detected at client creation
+	if _, err := NewClient(Config{TLSCAFile: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Fatalf("expecting error for missing CA file")
+	}
+	if _, err := NewClient(Config{TLSCertFile: caFile}); err == nil {
+		t.Fatalf("expecting error for cert file without key file")
+	}
+}
+
+func TestClientQueryRateLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(Config{Addr: srv.URL, QueryRateLimit: 2})
+	if err != nil {
+		t.Fatalf("cannot create client: %s", err)
+	}
+	s := Meta{Metric: "system.load5"}
+	rt := RetentionMeta{FirstOrder: "sum", SecondOrder: "avg", AggTime: "1m"}
+	start := time.Now()
+	// the first 2 queries fit into the initial budget,
+	// while the rest must wait for the next second
+	for i := 0; i < 4; i++ {
+		if _, err := c.GetData(context.Background(), s, rt, 0, 60, false); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Fatalf("expecting rate limit to slow down queries; took %s", d)
+	}
+}
+
+func TestClientContextCancel(t *testing.T) {
+	var requests uint64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&requests, 1)
+		// hang until the client aborts the request
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(Config{Addr: srv.URL})
+	if err != nil {
+		t.Fatalf("cannot create client: %s", err)
+	}
+	s := Meta{Metric: "system.load5"}
+	rt := RetentionMeta{FirstOrder: "sum", SecondOrder: "avg", AggTime: "1m"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := c.GetData(ctx, s, rt, 0, 60, false); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expecting context.Canceled error; got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("cancelled request must be aborted promptly; took %s", d)
+	}
+	if n := atomic.LoadUint64(&requests); n != 1 {
+		t.Fatalf("cancelled request must not be retried; got %d requests", n)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.FindMetrics(ctx, "/api/suggest?type=metrics&q=system"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expecting context.DeadlineExceeded error; got %v", err)
+	}
+}
+
+func TestClientHTTPTimeout(t *testing.T) {
+	f := func(slowRequests uint64, retries int, wantErr bool) {
+		t.Helper()
+		var requests uint64
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddUint64(&requests, 1) <= slowRequests {
+				time.Sleep(200 * time.Millisecond)
+			}
+			_, _ = w.Write([]byte(`["system.load5"]`))
+		}))
+		defer srv.Close()
+
+		c, err := NewClient(Config{
+			Addr:          srv.URL,
+			Retries:       retries,
+			RetryInterval: time.Millisecond,
+			HTTPTimeout:   20 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("cannot create client: %s", err)
+		}
+		_, err = c.FindMetrics(context.Background(), "/api/suggest?type=metrics&q=system")
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error: %v; wantErr: %v", err, wantErr)
+		}
+	}
+
+	f(0, 0, false)
+	// timed out request is retried
+	f(1, 1, false)
+	// retries are exhausted
+	f(2, 1, true)
+}
+
+func TestNewClientLookupTags(t *testing.T) {
+	f := func(cfg Config, wantErr bool) {
+		t.Helper()
+		_, err := NewClient(cfg)
+		if err != nil && !wantErr {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err == nil && wantErr {
+			t.Fatalf("expecting error")
+		}
+	}
+	f(Config{LookupTags: []string{"host=host1", "dc=*"}}, false)
+	f(Config{LookupTags: []string{"host=host1"}, UseLookup: true}, false)
+	// lookup without tags scans all the series in OpenTSDB
+	f(Config{UseLookup: true}, true)
+	f(Config{LookupTags: []string{"host"}}, true)
+	f(Config{LookupTags: []string{"=host1"}}, true)
+	f(Config{LookupTags: []string{"host="}}, true)
+}
+
+func TestClientMetricRetentions(t *testing.T) {
+	c, err := NewClient(Config{
+		Retentions: []string{"sum-1m-avg:1h:1d"},
+		RetentionOverrides: []string{
+			"sys.cpu=sum-10s-avg:1h:2h",
+			"net.bytes=sum-1h-avg:1d:7d",
+			"net.bytes=sum-1d-avg:7d:28d",
+		},
+	})
+	if err != nil {
+		t.Fatalf("cannot create client: %s", err)
+	}
+	f := func(metric string, wantAggTimes []string, wantPatterns ...string) {
+		t.Helper()
+		var wantRanges int
+		for _, p := range wantPatterns {
+			rt, err := convertRetention(p, 0, false)
+			if err != nil {
+				t.Fatalf("cannot parse retention %q: %s", p, err)
+			}
+			wantRanges += len(rt.QueryRanges)
+		}
+		rts := c.MetricRetentions(metric)
+		var aggTimes []string
+		var ranges int
+		for _, rt := range rts {
+			aggTimes = append(aggTimes, rt.AggTime)
+			ranges += len(rt.QueryRanges)
+		}
+		if !reflect.DeepEqual(aggTimes, wantAggTimes) {
+			t.Fatalf("unexpected retentions for %q: %q; want %q", metric, aggTimes, wantAggTimes)
+		}
+		if ranges != wantRanges {
+			t.Fatalf("unexpected number of query ranges for %q: %d; want %d", metric, ranges, wantRanges)
+		}
+	}
+
+	// the override takes precedence over the global retentions
+	f("sys.cpu", []string{"10s"}, "sum-10s-avg:1h:2h")
+	// multiple overrides of the same metric are kept in order
+	f("net.bytes", []string{"1h", "1d"}, "sum-1h-avg:1d:7d", "sum-1d-avg:7d:28d")
+	// metrics without overrides use the global retentions,
+	// even if their names share a prefix with overridden metrics
+	f("sys.cpu.user", []string{"1m"}, "sum-1m-avg:1h:1d")
+	f("sys.mem", []string{"1m"}, "sum-1m-avg:1h:1d")
+}
+
+func TestNewClientRetentionOverridesInvalid(t *testing.T) {
+	f := func(cfg Config) {
+		t.Helper()
+		if _, err := NewClient(cfg); err == nil {
+			t.Fatalf("expecting error for %q", cfg.RetentionOverrides)
+		}
+	}
+
+	f(Config{Retentions: []string{"sum-1m-avg:1h:1d"}, RetentionOverrides: []string{"sys.cpu"}})
+	f(Config{Retentions: []string{"sum-1m-avg:1h:1d"}, RetentionOverrides: []string{"=sum-1m-avg:1h:1d"}})
+	f(Config{Retentions: []string{"sum-1m-avg:1h:1d"}, RetentionOverrides: []string{"sys.cpu=sum-1m-avg:1h"}})
+	// overrides have the format of auto ranges if they are set
+	f(Config{AutoRanges: []string{"sum-1m-avg:1d"}, RetentionOverrides: []string{"sys.cpu=sum-1m-avg:1h:1d"}})
+	// overrides must aggregate series dropped by identity tags as well
+	f(Config{
+		Retentions:         []string{"sum-1m-avg:1h:1d"},
+		IdentityTags:       []string{"sys.cpu=host"},
+		RetentionOverrides: []string{"sys.cpu=none-1m-avg:1h:1d"},
+	})
+}
+
+func TestClientLookup(t *testing.T) {
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query().Get("m"))
+		_, _ = w.Write([]byte(`{"type":"LOOKUP","results":[
+			{"metric":"sys.mem","tags":{"host":"host1","dc":"us"}},
+			{"metric":"sys.cpu","tags":{"host":"host1","dc":"us"}},
+			{"metric":"sys.cpu","tags":{"host":"host2","dc":"us"}},
+			{"metric":"app.rps","tags":{"host":"host1","dc":"us"}}
+		]}`))
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(Config{
+		Addr:       srv.URL,
+		Limit:      100,
+		LookupTags: []string{"host=*", "dc=us"},
+		UseLookup:  true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create client: %s", err)
+	}
+	metrics, err := c.FindMetricsLookup(context.Background(), "sys")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if strings.Join(metrics, ",") != "sys.cpu,sys.mem" {
+		t.Fatalf("unexpected metrics %q", metrics)
+	}
+	series, err := c.FindSeries(context.Background(), "sys.cpu")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(series) != 4 || series[0].Tags["dc"] != "us" {
+		t.Fatalf("unexpected series %v", series)
+	}
+	want := []string{"*{dc=us,host=*}", "sys.cpu{dc=us,host=*}"}
+	if strings.Join(queries, " ") != strings.Join(want, " ") {
+		t.Fatalf("unexpected lookup queries %q; want %q", queries, want)
+	}
+}
+
+func TestClientGetDataSplitsTruncatedResponses(t *testing.T) {
+	const limit = 10
+	var queries uint64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&queries, 1)
+		start, _ := strconv.ParseInt(r.URL.Query().Get("start"), 10, 64)
+		end, _ := strconv.ParseInt(r.URL.Query().Get("end"), 10, 64)
+		// imitate OpenTSDB silently dropping datapoints beyond its limit
+		dps := make(map[string]float64)
+		for ts := start - start%60; ts <= end && len(dps) < limit; ts += 60 {
+			if ts >= start {
+				dps[strconv.FormatInt(ts, 10)] = float64(ts)
+			}
+		}
+		data, _ := json.Marshal([]map[string]interface{}{{
+			"metric": "cpu",
+			"tags":   map[string]string{"host": "host1"},
+			"dps":    dps,
+		}})
+		_, _ = w.Write(data)
+	}))
+	defer srv.Close()
+
+	f := func(datapointsLimit int, wantPoints int, wantSplit bool) {
+		t.Helper()
+		atomic.StoreUint64(&queries, 0)
+		c, err := NewClient(Config{Addr: srv.URL, DatapointsLimit: datapointsLimit})
+		if err != nil {
+			t.Fatalf("cannot create client: %s", err)
+		}
+		rt := RetentionMeta{FirstOrder: "sum", SecondOrder: "avg", AggTime: "1m"}
+		data, err := c.GetData(context.Background(), Meta{Metric: "cpu", Tags: map[string]string{"host": "host1"}}, rt, 0, 3599, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(data.Timestamps) != wantPoints || len(data.Values) != wantPoints {
+			t.Fatalf("unexpected number of datapoints %d; want %d", len(data.Timestamps), wantPoints)
+		}
+		seen := make(map[int64]bool)
+		for i, ts := range data.Timestamps {
+			if seen[ts] {
+				t.Fatalf("duplicate timestamp %d", ts)
+			}
+			seen[ts] = true
+			if ts%60000 != 0 || data.Values[i] != float64(ts/1000) {
+				t.Fatalf("unexpected datapoint %d=%v", ts, data.Values[i])
+			}
+		}
+		if split := atomic.LoadUint64(&queries) > 1; split != wantSplit {
+			t.Fatalf("unexpected split %v; want %v", split, wantSplit)
+		}
+	}
+	// the truncated response is returned as is without the limit
+	f(0, limit, false)
+	f(limit, 60, true)
+	// responses lower than the limit aren't split
+	f(100, limit, false)
+}
+
+func TestClientGetDataSplitsTooLargeQueries(t *testing.T) {
+	f := func(maxRange int64, code int, body string, strict bool, wantPoints int, wantErr bool) {
+		t.Helper()
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start, _ := strconv.ParseInt(r.URL.Query().Get("start"), 10, 64)
+			end, _ := strconv.ParseInt(r.URL.Query().Get("end"), 10, 64)
+			// imitate OpenTSDB query limits rejecting wide queries
+			if end-start > maxRange {
+				http.Error(w, body, code)
+				return
+			}
+			dps := make(map[string]float64)
+			for ts := start - start%60; ts <= end; ts += 60 {
+				if ts >= start {
+					dps[strconv.FormatInt(ts, 10)] = float64(ts)
+				}
+			}
+			data, _ := json.Marshal([]map[string]interface{}{{
+				"metric": "cpu",
+				"tags":   map[string]string{"host": "host1"},
+				"dps":    dps,
+			}})
+			_, _ = w.Write(data)
+		}))
+		defer srv.Close()
+
+		c, err := NewClient(Config{Addr: srv.URL, Strict: strict})
+		if err != nil {
+			t.Fatalf("cannot create client: %s", err)
+		}
+		rt := RetentionMeta{FirstOrder: "sum", SecondOrder: "avg", AggTime: "1m"}
+		data, err := c.GetData(context.Background(), Meta{Metric: "cpu", Tags: map[string]string{"host": "host1"}}, rt, 0, 3599, false)
+		if wantErr {
+			if err == nil {
+				t.Fatalf("expecting error")
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(data.Timestamps) != wantPoints {
+			t.Fatalf("unexpected number of datapoints %d; want %d", len(data.Timestamps), wantPoints)
+		}
+		seen := make(map[int64]bool)
+		for _, ts := range data.Timestamps {
+			if seen[ts] {
+				t.Fatalf("duplicate timestamp %d", ts)
+			}
+			seen[ts] = true
+		}
+	}
+
+	// too large queries are split until they are accepted
+	f(1000, http.StatusRequestEntityTooLarge, "too large", true, 60, false)
+	f(1000, http.StatusBadRequest, queryLimitMessage+" limit of 100 data points", true, 60, false)
+	// other client errors aren't split
+	f(1000, http.StatusBadRequest, "unknown metric", true, 0, true)
+	// queries which can't be split any further fail in strict mode and are skipped otherwise
+	f(30, http.StatusRequestEntityTooLarge, "too large", true, 0, true)
+	f(30, http.StatusRequestEntityTooLarge, "too large", false, 0, false)
+}
+
+func TestClientGetDataMaxQueryDuration(t *testing.T) {
+	var mu sync.Mutex
+	var ranges []TimeRange
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start, _ := strconv.ParseInt(r.URL.Query().Get("start"), 10, 64)
+		end, _ := strconv.ParseInt(r.URL.Query().Get("end"), 10, 64)
+		mu.Lock()
+		ranges = append(ranges, TimeRange{Start: start, End: end})
+		mu.Unlock()
+		dps := make(map[string]float64)
+		for ts := start - start%60; ts <= end; ts += 60 {
+			if ts >= start {
+				dps[strconv.FormatInt(ts, 10)] = float64(ts)
+			}
+		}
+		data, _ := json.Marshal([]map[string]interface{}{{
+			"metric": "cpu",
+			"tags":   map[string]string{"host": "host1"},
+			"dps":    dps,
+		}})
+		_, _ = w.Write(data)
+	}))
+	defer srv.Close()
+
+	f := func(maxQueryDuration time.Duration, aggTime string, wantRanges []TimeRange) {
+		t.Helper()
+		ranges = nil
+		c, err := NewClient(Config{Addr: srv.URL, MaxQueryDuration: maxQueryDuration})
+		if err != nil {
+			t.Fatalf("cannot create client: %s", err)
+		}
+		rt := RetentionMeta{FirstOrder: "sum", SecondOrder: "avg", AggTime: aggTime}
+		data, err := c.GetData(context.Background(), Meta{Metric: "cpu", Tags: map[string]string{"host": "host1"}}, rt, 0, 3599, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(ranges, wantRanges) {
+			t.Fatalf("unexpected queried time ranges\ngot:  %v\nwant: %v", ranges, wantRanges)
+		}
+		if len(data.Timestamps) != 60 {
+			t.Fatalf("unexpected number of datapoints %d; want 60", len(data.Timestamps))
+		}
+		seen := make(map[int64]bool)
+		for _, ts := range data.Timestamps {
+			if seen[ts] {
+				t.Fatalf("duplicate timestamp %d", ts)
+			}
+			seen[ts] = true
+		}
+	}
+	// the check is disabled by default
+	f(0, "1m", []TimeRange{{0, 3599}})
+	// time ranges within the limit aren't subdivided
+	f(time.Hour, "1m", []TimeRange{{0, 3599}})
+	f(20*time.Minute, "1m", []TimeRange{{0, 1199}, {1200, 2399}, {2400, 3599}})
+	// the remainder of the time range is queried separately
+	f(25*time.Minute, "1m", []TimeRange{{0, 1499}, {1500, 2999}, {3000, 3599}})
+	// the subdivided queries are aligned to the aggregation interval
+	f(25*time.Minute, "10m", []TimeRange{{0, 1199}, {1200, 2399}, {2400, 3599}})
+	// the query can't be shorter than the aggregation interval
+	f(time.Minute, "30m", []TimeRange{{0, 1799}, {1800, 3599}})
+}
+
+func TestClientConnectionsReuse(t *testing.T) {
+	const concurrency = 8
+	var newConns uint64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[]`))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddUint64(&newConns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	c, err := NewClient(Config{Addr: srv.URL, MaxIdleConns: concurrency})
+	if err != nil {
+		t.Fatalf("cannot create client: %s", err)
+	}
+	for i := 0; i < 5; i++ {
+		var wg sync.WaitGroup
+		for j := 0; j < concurrency; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := c.FindMetrics(context.Background(), "/api/suggest?type=metrics&q=sys"); err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	// idle connections must be reused
+	// instead of opening a new connection per request
+	if n := atomic.LoadUint64(&newConns); n > concurrency {
+		t.Fatalf("too many connections opened: %d; want at most %d", n, concurrency)
+	}
+}
+
+func TestParseIdentityTags(t *testing.T) {
+	f := func(list []string, want map[string][]string, wantErr bool) {
+		t.Helper()
+		got, err := parseIdentityTags(list)
+		if err != nil {
+			if !wantErr {
+				t.Fatalf("unexpected error for %q: %s", list, err)
+			}
+			return
+		}
+		if wantErr {
+			t.Fatalf("expecting error for %q", list)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected identity tags for %q: %v; want %v", list, got, want)
+		}
+	}
+	f(nil, nil, false)
+	f([]string{"cpu=host,core"}, map[string][]string{"cpu": {"host", "core"}}, false)
+	// list flags split values by comma
+	f([]string{"cpu=host", "core", "mem=host"}, map[string][]string{"cpu": {"host", "core"}, "mem": {"host"}}, false)
+	// empty allow-list aggregates all the series of the metric
+	f([]string{"cpu="}, map[string][]string{"cpu": {}}, false)
+	f([]string{"host"}, nil, true)
+	f([]string{"=host"}, nil, true)
+	f([]string{"cpu=host", "cpu=core"}, nil, true)
+}
+
+func TestClientIdentityTags(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := r.URL.Query().Get("m")
+		if !strings.HasSuffix(m, "cpu{host=host1}") {
+			t.Errorf("unexpected query %q", m)
+		}
+		// dc is common for all the aggregated series, so OpenTSDB returns it
+		_, _ = w.Write([]byte(`[{"metric":"cpu","tags":{"host":"host1","dc":"us"},"aggregateTags":["core"],"dps":{"1":1}}]`))
+	}))
+	defer srv.Close()
+
+	if _, err := NewClient(Config{Retentions: []string{"none-1m-avg:1h:1d"}, IdentityTags: []string{"cpu=host"}}); err == nil {
+		t.Fatalf("expecting error for retention without first order aggregation")
+	}
+	c, err := NewClient(Config{Addr: srv.URL, IdentityTags: []string{"cpu=host"}})
+	if err != nil {
+		t.Fatalf("cannot create client: %s", err)
+	}
+	series := c.IdentitySeries([]Meta{
+		{Metric: "cpu", Tags: map[string]string{"host": "host1", "core": "0", "dc": "us"}},
+		{Metric: "cpu", Tags: map[string]string{"host": "host1", "core": "1", "dc": "us"}},
+		{Metric: "mem", Tags: map[string]string{"host": "host1", "core": "0"}},
+	})
+	want := []Meta{
+		{Metric: "cpu", Tags: map[string]string{"host": "host1"}},
+		{Metric: "mem", Tags: map[string]string{"host": "host1", "core": "0"}},
+	}
+	if !reflect.DeepEqual(series, want) {
+		t.Fatalf("unexpected identity series %v; want %v", series, want)
+	}
+	rt := RetentionMeta{FirstOrder: "sum", SecondOrder: "avg", AggTime: "1m"}
+	data, err := c.GetData(context.Background(), series[0], rt, 0, 3600, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(data.Tags, map[string]string{"host": "host1"}) || len(data.Values) != 1 {
+		t.Fatalf("unexpected data %v", data)
+	}
+}
+
+func TestClientAutoMsecsTime(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the same series may contain timestamps both in seconds and milliseconds
+		_, _ = w.Write([]byte(`[{"metric":"cpu","tags":{"host":"host1"},"dps":{"1626019200":1,"1626019260500":2}}]`))
+	}))
+	defer srv.Close()
+
+	if _, err := NewClient(Config{MsecsTime: true, AutoMsecsTime: true}); err == nil {
+		t.Fatalf("expecting error for both explicit and automatic milliseconds")
+	}
+	c, err := NewClient(Config{Addr: srv.URL, AutoMsecsTime: true})
+	if err != nil {
+		t.Fatalf("cannot create client: %s", err)
+	}
+	rt := RetentionMeta{FirstOrder: "sum", SecondOrder: "avg", AggTime: "1m"}
+	data, err := c.GetData(context.Background(), Meta{Metric: "cpu", Tags: map[string]string{"host": "host1"}}, rt, 0, 3600, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	sort.Slice(data.Timestamps, func(i, j int) bool { return data.Timestamps[i] < data.Timestamps[j] })
+	if want := []int64{1626019200000, 1626019260500}; !reflect.DeepEqual(data.Timestamps, want) {
+		t.Fatalf("unexpected timestamps %v; want %v", data.Timestamps, want)
+	}
+}
+
+func TestClientGzipResponses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("gzip encoding must be requested; got Accept-Encoding %q", r.Header.Get("Accept-Encoding"))
+		}
+		var resp string
+		code := http.StatusOK
+		switch r.URL.Path {
+		case "/api/suggest":
+			resp = `["system.load5"]`
+		case "/api/query":
+			resp = `[{"metric":"system.load5","tags":{"host":"host1"},"dps":{"1626019200":1,"1626019260":2}}]`
+		default:
+			code = http.StatusBadRequest
+			resp = "unsupported path"
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(code)
+		zw := gzip.NewWriter(w)
+		_, _ = zw.Write([]byte(resp))
+		_ = zw.Close()
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(Config{Addr: srv.URL})
+	if err != nil {
+		t.Fatalf("cannot create client: %s", err)
+	}
+	metrics, err := c.FindMetrics(context.Background(), "/api/suggest?type=metrics&q=system")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := []string{"system.load5"}; !reflect.DeepEqual(metrics, want) {
+		t.Fatalf("unexpected metrics %q; want %q", metrics, want)
+	}
+	rt := RetentionMeta{FirstOrder: "sum", SecondOrder: "avg", AggTime: "1m"}
+	data, err := c.GetData(context.Background(), Meta{Metric: "system.load5", Tags: map[string]string{"host": "host1"}}, rt, 0, 3600, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(data.Timestamps) != 2 {
+		t.Fatalf("unexpected number of timestamps %d; want 2", len(data.Timestamps))
+	}
+	// error responses are decompressed as well
+	_, err = c.get(context.Background(), "/api/unknown")
+	if err == nil || !strings.Contains(err.Error(), "unsupported path") {
+		t.Fatalf("expecting decompressed error response; got %v", err)
+	}
+}
+
+func TestReadResponseBody(t *testing.T) {
+	f := func(encoding, body, want string, wantErr bool) {
+		t.Helper()
+		resp := &http.Response{
+			Header: http.Header{},
+			Body:   io.NopCloser(strings.NewReader(body)),
+		}
+		if encoding != "" {
+			resp.Header.Set("Content-Encoding", encoding)
+		}
+		got, err := readResponseBody(resp)
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error: %v; wantErr: %v", err, wantErr)
+		}
+		if string(got) != want {
+			t.Fatalf("unexpected body %q; want %q", got, want)
+		}
+	}
+	var buf strings.Builder
+	zw := gzip.NewWriter(&buf)
+	_, _ = zw.Write([]byte("[]"))
+	_ = zw.Close()
+
+	f("", "[]", "[]", false)
+	f("gzip", buf.String(), "[]", false)
+	f("GZIP", buf.String(), "[]", false)
+	f("gzip", "", "", false)
+	// the body doesn't match the encoding
+	f("gzip", "[]", "", true)
+}
+
+func TestClientClampRange(t *testing.T) {
+	f := func(hardTSEnd, minTS int64, tr, want TimeRange, wantOK bool) {
+		t.Helper()
+		c := &Client{HardTSEnd: hardTSEnd, MinTS: minTS}
+		got, ok := c.ClampRange(1000, tr)
+		if ok != wantOK {
+			t.Fatalf("unexpected ok %v; want %v", ok, wantOK)
+		}
+		if ok && got != want {
+			t.Fatalf("unexpected time range %+v; want %+v", got, want)
+		}
+	}
+
+	// no hard end
+	f(0, 0, TimeRange{Start: 100, End: 0}, TimeRange{Start: 100, End: 0}, true)
+	// time range before the hard end
+	f(950, 0, TimeRange{Start: 200, End: 100}, TimeRange{Start: 200, End: 100}, true)
+	f(900, 0, TimeRange{Start: 200, End: 100}, TimeRange{Start: 200, End: 100}, true)
+	// time range crossing the hard end
+	f(950, 0, TimeRange{Start: 100, End: 0}, TimeRange{Start: 100, End: 50}, true)
+	// time range after the hard end
+	f(900, 0, TimeRange{Start: 100, End: 0}, TimeRange{}, false)
+	f(850, 0, TimeRange{Start: 100, End: 0}, TimeRange{}, false)
+	// time range after the min timestamp
+	f(0, 800, TimeRange{Start: 200, End: 100}, TimeRange{Start: 200, End: 100}, true)
+	// time range crossing the min timestamp
+	f(0, 850, TimeRange{Start: 200, End: 100}, TimeRange{Start: 150, End: 100}, true)
+	// time range before the min timestamp
+	f(0, 950, TimeRange{Start: 200, End: 100}, TimeRange{}, false)
+	// both bounds
+	f(950, 850, TimeRange{Start: 200, End: 0}, TimeRange{Start: 150, End: 50}, true)
+}
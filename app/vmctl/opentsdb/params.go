@@ -0,0 +1,49 @@
+package opentsdb
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// parseQueryParams parses query args in key=value format,
+// which are added to every data query, e.g. for bypassing a caching proxy
+func parseQueryParams(params []string) (url.Values, error) {
+	if len(params) == 0 {
+		return nil, nil
+	}
+	v := make(url.Values, len(params))
+	for _, s := range params {
+		key, value, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("missing '=' in query param %q; expecting key=value format", s)
+		}
+		if key == "" {
+			return nil, fmt.Errorf("empty key in query param %q", s)
+		}
+		v.Add(key, value)
+	}
+	return v, nil
+}
+
+// parseHeaders parses HTTP headers in "Name: value" format
+// the same way as for requests to VictoriaMetrics
+func parseHeaders(headers []string) (http.Header, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	h := make(http.Header, len(headers))
+	for _, s := range headers {
+		name, value, ok := strings.Cut(s, ":")
+		if !ok {
+			return nil, fmt.Errorf("missing ':' in header %q; expecting \"Name: value\" format", s)
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("empty name in header %q", s)
+		}
+		h.Add(name, strings.TrimSpace(value))
+	}
+	return h, nil
+}
@@ -0,0 +1,137 @@
+package opentsdb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseQueryParams(t *testing.T) {
+	f := func(params []string, want url.Values, wantErr bool) {
+		t.Helper()
+		got, err := parseQueryParams(params)
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error for %q: %v", params, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected query params for %q: %v; want %v", params, got, want)
+		}
+	}
+
+	f(nil, nil, false)
+	f([]string{"cache=bypass"}, url.Values{"cache": {"bypass"}}, false)
+	f([]string{"a=1", "a=2", "b="}, url.Values{"a": {"1", "2"}, "b": {""}}, false)
+	// the value may contain '='
+	f([]string{"token=a=b"}, url.Values{"token": {"a=b"}}, false)
+	f([]string{"cache"}, nil, true)
+	f([]string{"=bypass"}, nil, true)
+}
+
+func TestParseHeaders(t *testing.T) {
+	f := func(headers []string, want http.Header, wantErr bool) {
+		t.Helper()
+		got, err := parseHeaders(headers)
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error for %q: %v", headers, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected headers for %q: %v; want %v", headers, got, want)
+		}
+	}
+
+	f(nil, nil, false)
+	f([]string{"X-Cache-Bypass: 1"}, http.Header{"X-Cache-Bypass": {"1"}}, false)
+	f([]string{"x-tenant:foo", "X-Tenant: bar"}, http.Header{"X-Tenant": {"foo", "bar"}}, false)
+	f([]string{"X-Cache-Bypass"}, nil, true)
+	f([]string{" : 1"}, nil, true)
+}
+
+func TestClientQueryParamsAndHeaders(t *testing.T) {
+	var dataQuery, suggestQuery *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/suggest":
+			suggestQuery = r
+			_, _ = w.Write([]byte(`["sys.cpu"]`))
+		default:
+			dataQuery = r
+			_, _ = w.Write([]byte(`[]`))
+		}
+	}))
+	defer srv.Close()
+
+	f := func(useExpAPI bool) {
+		t.Helper()
+		c, err := NewClient(Config{
+			Addr:        srv.URL,
+			UseExpAPI:   useExpAPI,
+			QueryParams: []string{"cache=bypass"},
+			HTTPHeaders: []string{"X-Cache-Bypass: 1"},
+			UserAgent:   "vmctl/test otsdb-import",
+			RequestID:   "run-1",
+		})
+		if err != nil {
+			t.Fatalf("cannot create client: %s", err)
+		}
+		if _, err := c.FindMetrics(context.Background(), "/api/suggest?type=metrics&q=sys&max=10"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		series := Meta{Metric: "sys.cpu", Tags: map[string]string{"host": "h1"}}
+		rt := RetentionMeta{FirstOrder: "sum", SecondOrder: "avg", AggTime: "1m"}
+		if _, err := c.GetData(context.Background(), series, rt, 100, 200, false); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if dataQuery == nil || suggestQuery == nil {
+			t.Fatalf("expecting both discovery and data queries")
+		}
+		if v := dataQuery.URL.Query().Get("cache"); v != "bypass" {
+			t.Fatalf("unexpected query param of data query %q; want %q", v, "bypass")
+		}
+		// the params are added to data queries only
+		if suggestQuery.URL.Query().Has("cache") {
+			t.Fatalf("unexpected query param of discovery query %q", suggestQuery.URL)
+		}
+		for _, r := range []*http.Request{dataQuery, suggestQuery} {
+			if v := r.Header.Get("X-Cache-Bypass"); v != "1" {
+				t.Fatalf("unexpected header of %q: %q; want %q", r.URL.Path, v, "1")
+			}
+			if v := r.Header.Get("User-Agent"); v != "vmctl/test otsdb-import" {
+				t.Fatalf("unexpected User-Agent of %q: %q", r.URL.Path, v)
+			}
+			if v := r.Header.Get("X-Request-Id"); v != "run-1" {
+				t.Fatalf("unexpected X-Request-Id of %q: %q", r.URL.Path, v)
+			}
+		}
+	}
+
+	f(false)
+	f(true)
+}
+
+func TestClientUserAgentOverride(t *testing.T) {
+	var userAgent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+		_, _ = w.Write([]byte(`["sys.cpu"]`))
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(Config{
+		Addr:        srv.URL,
+		UserAgent:   "vmctl/test otsdb-import",
+		HTTPHeaders: []string{"User-Agent: custom"},
+	})
+	if err != nil {
+		t.Fatalf("cannot create client: %s", err)
+	}
+	if _, err := c.FindMetrics(context.Background(), "/api/suggest?type=metrics&q=sys&max=10"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// the explicitly set header takes precedence
+	if userAgent != "custom" {
+		t.Fatalf("unexpected User-Agent %q; want %q", userAgent, "custom")
+	}
+}
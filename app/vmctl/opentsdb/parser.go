@@ -72,7 +72,9 @@ func convertDuration(duration string) (time.Duration, error) {
 	return actualDuration, nil
 }
 
-// Convert an incoming retention "string" into the component parts
+// Convert an incoming retention "string" into the component parts.
+// The retention is validated before calculating the query ranges,
+// so the returned error names the malformed part of the retention.
 func convertRetention(retention string, offset int64, msecTime bool) (Retention, error) {
 	/*
 		A retention string coming in looks like
@@ -84,12 +86,25 @@ func convertRetention(retention string, offset int64, msecTime bool) (Retention,
 	*/
 	chunks := strings.Split(retention, ":")
 	if len(chunks) != 3 {
-		return Retention{}, fmt.Errorf("invalid retention string: %q", retention)
+		return Retention{}, fmt.Errorf("invalid retention string: %q; expecting <aggregation>:<row size>:<time range> format, e.g. sum-1m-avg:1h:30d", retention)
 	}
-	queryLengthDuration, err := convertDuration(chunks[2])
+	// first/second order aggregations for queries defined in chunk 0...
+	agg, err := parseAggregation(chunks[0])
+	if err != nil {
+		return Retention{}, err
+	}
+	rowLengthDuration, err := parsePositiveDuration("row size", chunks[1])
 	if err != nil {
-		return Retention{}, fmt.Errorf("invalid ttl (second order) duration string: %q: %s", chunks[2], err)
+		return Retention{}, err
 	}
+	queryLengthDuration, err := parsePositiveDuration("time range", chunks[2])
+	if err != nil {
+		return Retention{}, err
+	}
+	if queryLengthDuration%rowLengthDuration != 0 {
+		return Retention{}, fmt.Errorf("time range %q must be a multiple of row size %q, so each query lands on unique rows", chunks[2], chunks[1])
+	}
+
 	// set ttl in milliseconds, unless we aren't using millisecond time in OpenTSDB...then use seconds
 	queryLength := queryLengthDuration.Milliseconds()
 	if !msecTime {
@@ -99,25 +114,10 @@ func convertRetention(retention string, offset int64, msecTime bool) (Retention,
 	// bump by the offset so we don't look at empty ranges any time offset > ttl
 	queryLength += offset
 
-	// first/second order aggregations for queries defined in chunk 0...
-	aggregates := strings.Split(chunks[0], "-")
-	if len(aggregates) != 3 {
-		return Retention{}, fmt.Errorf("invalid aggregation string: %q", chunks[0])
-	}
-
-	aggTimeDuration, err := convertDuration(aggregates[1])
-	if err != nil {
-		return Retention{}, fmt.Errorf("invalid aggregation time duration string: %q: %s", aggregates[1], err)
-	}
-	aggTime := aggTimeDuration.Milliseconds()
+	aggTime := agg.interval.Milliseconds()
 	if !msecTime {
 		aggTime = aggTime / 1000
 	}
-
-	rowLengthDuration, err := convertDuration(chunks[1])
-	if err != nil {
-		return Retention{}, fmt.Errorf("invalid row length (first order) duration string: %q: %s", chunks[1], err)
-	}
 	// set length of each row in milliseconds, unless we aren't using millisecond time in OpenTSDB...then use seconds
 	rowLength := rowLengthDuration.Milliseconds()
 	if !msecTime {
@@ -138,14 +138,14 @@ func convertRetention(retention string, offset int64, msecTime bool) (Retention,
 			2. we discover the actual size of each "chunk"
 			   This is second division step
 		*/
-		querySize = int64(queryRange / (queryRange / (rowLength * 4)))
+		querySize = splitQueryRange(queryRange, rowLength*4)
 	} else {
 		/*
 			Unless the aggTime (how long a range of data we're requesting per individual point)
 			is greater than the row size. Then we'll need to use that to determine
 			how big each individual query should be
 		*/
-		querySize = int64(queryRange / (queryRange / (aggTime * 4)))
+		querySize = splitQueryRange(queryRange, aggTime*4)
 	}
 
 	var timeChunks []TimeRange
@@ -154,16 +154,147 @@ func convertRetention(retention string, offset int64, msecTime bool) (Retention,
 		timeChunks = append(timeChunks, TimeRange{Start: i + querySize, End: i})
 	}
 
-	ret := Retention{FirstOrder: aggregates[0],
-		SecondOrder: aggregates[2],
-		AggTime:     aggregates[1],
+	ret := Retention{FirstOrder: agg.firstOrder,
+		SecondOrder: agg.secondOrder,
+		AggTime:     agg.aggTime,
 		QueryRanges: timeChunks}
 	return ret, nil
 }
 
+// splitQueryRange returns the size of a single query for splitting queryRange into
+// chunks of approximately chunkSize. The whole queryRange is returned if it is smaller than chunkSize.
+func splitQueryRange(queryRange, chunkSize int64) int64 {
+	n := queryRange / chunkSize
+	if n < 1 {
+		return queryRange
+	}
+	return queryRange / n
+}
+
+type aggregation struct {
+	firstOrder  string
+	aggTime     string
+	secondOrder string
+	interval    time.Duration
+}
+
+// parseAggregation parses aggregation string like sum-1m-avg
+func parseAggregation(s string) (aggregation, error) {
+	aggregates := strings.Split(s, "-")
+	if len(aggregates) != 3 || aggregates[0] == "" || aggregates[2] == "" {
+		return aggregation{}, fmt.Errorf("invalid aggregation string: %q; expecting <first order>-<interval>-<second order> format, e.g. sum-1m-avg", s)
+	}
+	interval, err := parsePositiveDuration("aggregation interval", aggregates[1])
+	if err != nil {
+		return aggregation{}, err
+	}
+	return aggregation{
+		firstOrder:  aggregates[0],
+		aggTime:     aggregates[1],
+		secondOrder: aggregates[2],
+		interval:    interval,
+	}, nil
+}
+
+// parsePositiveDuration parses the duration of the retention part with the given name
+func parsePositiveDuration(name, s string) (time.Duration, error) {
+	d, err := convertDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %s", name, s, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s %q must be positive", name, s)
+	}
+	return d, nil
+}
+
+// convertAutoRange converts an aggregation with the total lookback, e.g. sum-1m-avg:30d,
+// into retention with query ranges aligned to HBase rows of the given size.
+// Every query spans at least 4 rows (or 4 aggregation intervals if they are bigger than a row)
+// and is a multiple of both the row size and the aggregation interval,
+// so neither rows nor downsampled intervals are split between queries.
+// Query ranges don't overlap: the older bound of every range is inclusive,
+// while the newer bound is exclusive.
+func convertAutoRange(spec string, rowSize time.Duration, offset int64, msecTime bool) (Retention, error) {
+	chunks := strings.Split(spec, ":")
+	if len(chunks) != 2 {
+		return Retention{}, fmt.Errorf("invalid auto range string: %q; expecting <aggregation>:<lookback>, e.g. sum-1m-avg:30d", spec)
+	}
+	agg, err := parseAggregation(chunks[0])
+	if err != nil {
+		return Retention{}, err
+	}
+	lookbackDuration, err := parsePositiveDuration("lookback", chunks[1])
+	if err != nil {
+		return Retention{}, err
+	}
+	toUnits := func(d time.Duration) int64 {
+		if msecTime {
+			return d.Milliseconds()
+		}
+		return int64(d / time.Second)
+	}
+	aggTime, rowLength, lookback := toUnits(agg.interval), toUnits(rowSize), toUnits(lookbackDuration)
+	if aggTime <= 0 || rowLength <= 0 || lookback <= 0 {
+		return Retention{}, fmt.Errorf("aggregation interval, row size and lookback must be positive in %q with row size %s", spec, rowSize)
+	}
+
+	step := lcm(rowLength, aggTime)
+	minSize := 4 * rowLength
+	if aggTime > rowLength {
+		minSize = 4 * aggTime
+	}
+	querySize := (minSize + step - 1) / step * step
+
+	var timeChunks []TimeRange
+	for i := offset; i < offset+lookback; i += querySize {
+		timeChunks = append(timeChunks, TimeRange{Start: i + querySize, End: i + 1})
+	}
+	return Retention{
+		FirstOrder:  agg.firstOrder,
+		SecondOrder: agg.secondOrder,
+		AggTime:     agg.aggTime,
+		QueryRanges: timeChunks,
+	}, nil
+}
+
+// parseRetentionOverrides parses per-metric retentions in metric=pattern format.
+// Patterns are converted into retentions via convert. Multiple patterns
+// for the same metric are collected in the given order.
+func parseRetentionOverrides(list []string, convert func(pattern string) (Retention, error)) (map[string][]Retention, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	m := make(map[string][]Retention)
+	for _, s := range list {
+		metric, pattern, ok := strings.Cut(s, "=")
+		metric, pattern = strings.TrimSpace(metric), strings.TrimSpace(pattern)
+		if !ok || metric == "" || pattern == "" {
+			return nil, fmt.Errorf("cannot parse retention override %q: it must be in metric=pattern format", s)
+		}
+		rt, err := convert(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse retention override %q: %s", s, err)
+		}
+		m[metric] = append(m[metric], rt)
+	}
+	return m, nil
+}
+
+func lcm(a, b int64) int64 {
+	x, y := a, b
+	for y != 0 {
+		x, y = y, x%y
+	}
+	return a / x * b
+}
+
 // This ensures any incoming data from OpenTSDB matches the Prometheus data model
 // https://prometheus.io/docs/concepts/data_model
-func modifyData(msg Metric, normalize bool) (Metric, error) {
+// If normalizeMetric is set, the metric name is lowercased.
+// If normalizeTags is set, tag keys and tag values are lowercased.
+// Lowercasing is applied before replacing unsupported characters.
+func modifyData(msg Metric, normalizeMetric, normalizeTags bool) (Metric, error) {
 	finalMsg := Metric{
 		Metric: "", Tags: make(map[string]string),
 		Timestamps: msg.Timestamps, Values: msg.Values,
@@ -174,7 +305,7 @@ func modifyData(msg Metric, normalize bool) (Metric, error) {
 	}
 	name := msg.Metric
 	// if normalization requested, lowercase the name
-	if normalize {
+	if normalizeMetric {
 		name = strings.ToLower(name)
 	}
 	/*
@@ -184,7 +315,7 @@ func modifyData(msg Metric, normalize bool) (Metric, error) {
 	// replace bad characters in tag keys with _ per the data model
 	for key, value := range msg.Tags {
 		// if normalization requested, lowercase the key and value
-		if normalize {
+		if normalizeTags {
 			key = strings.ToLower(key)
 			value = strings.ToLower(value)
 		}
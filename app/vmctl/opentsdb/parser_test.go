@@ -1,7 +1,10 @@
 package opentsdb
 
 import (
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestConvertRetention(t *testing.T) {
@@ -45,6 +48,91 @@ func TestConvertRetention(t *testing.T) {
 	}
 }
 
+func TestConvertRetentionInvalid(t *testing.T) {
+	f := func(retention, wantErr string) {
+		t.Helper()
+		_, err := convertRetention(retention, 0, false)
+		if err == nil {
+			t.Fatalf("expecting error for retention %q", retention)
+		}
+		if !strings.Contains(err.Error(), wantErr) {
+			t.Fatalf("unexpected error for retention %q: %q; want it to contain %q", retention, err, wantErr)
+		}
+	}
+	// shape
+	f("", `invalid retention string: ""`)
+	f("sum-1m-avg:1h3d", `invalid retention string: "sum-1m-avg:1h3d"`)
+	f("sum-1m-avg:1h:3d:1d", `invalid retention string: "sum-1m-avg:1h:3d:1d"`)
+	// aggregation
+	f("sum-1m:1h:3d", `invalid aggregation string: "sum-1m"`)
+	f("-1m-avg:1h:3d", `invalid aggregation string: "-1m-avg"`)
+	f("sum-1m-:1h:3d", `invalid aggregation string: "sum-1m-"`)
+	f("sum-1x-avg:1h:3d", `invalid aggregation interval "1x"`)
+	f("sum--avg:1h:3d", `invalid aggregation interval ""`)
+	f("sum-0m-avg:1h:3d", `aggregation interval "0m" must be positive`)
+	// row size
+	f("sum-1m-avg:1x:3d", `invalid row size "1x"`)
+	f("sum-1m-avg::3d", `invalid row size ""`)
+	f("sum-1m-avg:0h:3d", `row size "0h" must be positive`)
+	// time range
+	f("sum-1m-avg:1h:3x", `invalid time range "3x"`)
+	f("sum-1m-avg:1h:", `invalid time range ""`)
+	f("sum-1m-avg:1h:0d", `time range "0d" must be positive`)
+	f("sum-1m-avg:2h:5h", `time range "5h" must be a multiple of row size "2h"`)
+	f("sum-1m-avg:1w:1y", `time range "1y" must be a multiple of row size "1w"`)
+}
+
+func TestConvertRetentionShortTimeRange(t *testing.T) {
+	// time range shorter than the query size is fetched with a single query
+	res, err := convertRetention("sum-1m-avg:1h:3h", 0, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(res.QueryRanges) < 1 || res.QueryRanges[0] != (TimeRange{Start: 3 * 3600, End: 0}) {
+		t.Fatalf("unexpected query ranges %v", res.QueryRanges)
+	}
+}
+
+func TestConvertAutoRange(t *testing.T) {
+	f := func(spec string, rowSize time.Duration, offset int64, msecTime bool, wantSize int64, wantRanges int) {
+		t.Helper()
+		res, err := convertAutoRange(spec, rowSize, offset, msecTime)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", spec, err)
+		}
+		if len(res.QueryRanges) != wantRanges {
+			t.Fatalf("unexpected number of query ranges for %q: %d; want %d", spec, len(res.QueryRanges), wantRanges)
+		}
+		next := offset
+		for _, tr := range res.QueryRanges {
+			// ranges must be contiguous, non-overlapping and of the same size
+			if tr.End != next+1 || tr.Start-tr.End+1 != wantSize {
+				t.Fatalf("unexpected query range %v for %q; want [%d, %d]", tr, spec, next+wantSize, next+1)
+			}
+			next = tr.Start
+		}
+	}
+	// 4 rows per query
+	f("sum-1m-avg:30d", time.Hour, 0, false, 4*3600, 180)
+	f("sum-1m-avg:3d", 4*time.Hour, 0, false, 16*3600, 5)
+	// 4 aggregation intervals per query, rounded up to rows
+	f("sum-90m-avg:1d", time.Hour, 0, false, 6*3600, 4)
+	// query size must be a multiple of both the row size and the aggregation interval
+	f("sum-7m-avg:1d", time.Hour, 0, false, 7*3600, 4)
+	// offset and milliseconds
+	f("sum-1m-avg:1d", time.Hour, 86400, false, 4*3600, 6)
+	f("sum-1m-avg:1d", time.Hour, 0, true, 4*3600*1000, 6)
+
+	for _, spec := range []string{"sum-1m-avg:1h:30d", "sum-1m:30d", "sum-1m-avg:30x", "sum-0s-avg:1d"} {
+		if _, err := convertAutoRange(spec, time.Hour, 0, false); err == nil {
+			t.Fatalf("expecting error for %q", spec)
+		}
+	}
+	if _, err := convertAutoRange("sum-1m-avg:1d", 0, 0, false); err == nil {
+		t.Fatalf("expecting error for zero row size")
+	}
+}
+
 func TestModifyData(t *testing.T) {
 	/*
 		Good metric metadata
@@ -61,7 +149,7 @@ func TestModifyData(t *testing.T) {
 			0,
 		},
 	}
-	res, err := modifyData(m, false)
+	res, err := modifyData(m, false, false)
 	if err != nil {
 		t.Fatalf("Valid metric %v failed to parse: %v", m, err)
 	}
@@ -96,7 +184,7 @@ func TestModifyData(t *testing.T) {
 			0,
 		},
 	}
-	res, err = modifyData(m, false)
+	res, err = modifyData(m, false, false)
 	if err == nil {
 		t.Fatalf("Invalid metric %v parsed?", m)
 	}
@@ -118,7 +206,7 @@ func TestModifyData(t *testing.T) {
 			0,
 		},
 	}
-	res, err = modifyData(m, false)
+	res, err = modifyData(m, false, false)
 	if err != nil {
 		t.Fatalf("Valid metric failed to parse? %v", err)
 	}
@@ -144,7 +232,7 @@ func TestModifyData(t *testing.T) {
 			0,
 		},
 	}
-	res, err = modifyData(m, false)
+	res, err = modifyData(m, false, false)
 	if err != nil {
 		t.Fatalf("Valid metric failed to parse? %v", err)
 	}
@@ -176,7 +264,7 @@ func TestModifyData(t *testing.T) {
 			0,
 		},
 	}
-	res, err = modifyData(m, false)
+	res, err = modifyData(m, false, false)
 	if err != nil {
 		t.Fatalf("Valid metric failed to parse? %v", err)
 	}
@@ -207,7 +295,7 @@ func TestModifyData(t *testing.T) {
 			0,
 		},
 	}
-	res, err = modifyData(m, true)
+	res, err = modifyData(m, true, true)
 	if err != nil {
 		t.Fatalf("Valid metric failed to parse? %v", err)
 	}
@@ -215,3 +303,40 @@ func TestModifyData(t *testing.T) {
 		t.Fatalf("Normalization of metric name didn't happen!")
 	}
 }
+
+func TestModifyDataNormalize(t *testing.T) {
+	f := func(normalizeMetric, normalizeTags bool, want Metric) {
+		t.Helper()
+		m := Metric{
+			Metric: "Sys.CPU",
+			Tags:   map[string]string{"Host": "Web-01", "dc": "EU"},
+		}
+		res, err := modifyData(m, normalizeMetric, normalizeTags)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if res.Metric != want.Metric {
+			t.Fatalf("unexpected metric name %q; want %q", res.Metric, want.Metric)
+		}
+		if !reflect.DeepEqual(res.Tags, want.Tags) {
+			t.Fatalf("unexpected tags %v; want %v", res.Tags, want.Tags)
+		}
+	}
+
+	f(false, false, Metric{
+		Metric: "Sys_CPU",
+		Tags:   map[string]string{"Host": "Web-01", "dc": "EU"},
+	})
+	f(true, false, Metric{
+		Metric: "sys_cpu",
+		Tags:   map[string]string{"Host": "Web-01", "dc": "EU"},
+	})
+	f(false, true, Metric{
+		Metric: "Sys_CPU",
+		Tags:   map[string]string{"host": "web-01", "dc": "eu"},
+	})
+	f(true, true, Metric{
+		Metric: "sys_cpu",
+		Tags:   map[string]string{"host": "web-01", "dc": "eu"},
+	})
+}
@@ -0,0 +1,66 @@
+package opentsdb
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+)
+
+// printQuerySampleEvery returns how often data queries are printed for the given sample rate.
+// For example, 0.01 means every 100th data query is printed.
+// Zero rate means printing every data query.
+func printQuerySampleEvery(rate float64) (uint64, error) {
+	if rate < 0 || rate > 1 || math.IsNaN(rate) {
+		return 0, fmt.Errorf("print query sample rate must be in range [0..1]; got %v", rate)
+	}
+	if rate == 0 {
+		return 1, nil
+	}
+	return uint64(math.Round(1 / rate)), nil
+}
+
+// isDataQuery returns whether the request path is a data query
+// rather than a discovery query via /api/suggest or /api/search/lookup
+func isDataQuery(path string) bool {
+	return strings.HasPrefix(path, "/api/query")
+}
+
+// printQuery logs the request to OpenTSDB as curl command if PrintQuery is set,
+// so the query could be reproduced manually. Discovery queries are always printed,
+// while data queries are sampled, since there may be millions of them.
+// Credentials from the URL and auth headers are redacted.
+func (c *Client) printQuery(method, addr, path string, reqBody []byte) {
+	if !c.printQueries {
+		return
+	}
+	if isDataQuery(path) && !c.printQuerySampler.Sample() {
+		return
+	}
+	addr = redactURL(addr)
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "curl -X %s", method)
+	if c.authCfg != nil {
+		sb.WriteString(" -H 'Authorization: <redacted>'")
+	}
+	// custom headers may contain credentials as well
+	names := make([]string, 0, len(c.headers))
+	for name := range c.headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&sb, " -H %s", shellQuote(name+": <redacted>"))
+	}
+	if reqBody != nil {
+		fmt.Fprintf(&sb, " -H 'Content-Type: application/json' -d %s", shellQuote(string(reqBody)))
+	}
+	fmt.Fprintf(&sb, " %s", shellQuote(addr+path))
+	log.Printf("DEBUG: OpenTSDB query: %s", sb.String())
+}
+
+// shellQuote quotes s for passing it as a single argument in shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,113 @@
+package opentsdb
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/auth"
+)
+
+func TestPrintQuerySampleEvery(t *testing.T) {
+	f := func(rate float64, want uint64, wantErr bool) {
+		t.Helper()
+		got, err := printQuerySampleEvery(rate)
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error for rate %v: %v", rate, err)
+		}
+		if got != want {
+			t.Fatalf("unexpected sample interval for rate %v: %d; want %d", rate, got, want)
+		}
+	}
+
+	f(0, 1, false)
+	f(1, 1, false)
+	f(0.5, 2, false)
+	f(0.001, 1000, false)
+	f(-0.1, 0, true)
+	f(1.5, 0, true)
+}
+
+func TestClientPrintQuery(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/suggest":
+			_, _ = w.Write([]byte(`["sys.cpu"]`))
+		default:
+			_, _ = w.Write([]byte(`[]`))
+		}
+	}))
+	defer srv.Close()
+
+	f := func(printQuery bool, sampleRate float64, useExpAPI bool, wantDataQueries int) {
+		t.Helper()
+		authCfg, err := auth.Generate(auth.WithBasicAuth("foo", "secret"))
+		if err != nil {
+			t.Fatalf("cannot create auth config: %s", err)
+		}
+		addr := strings.Replace(srv.URL, "http://", "http://user:password@", 1)
+		c, err := NewClient(Config{
+			Addr:                 addr,
+			AuthCfg:              authCfg,
+			UseExpAPI:            useExpAPI,
+			PrintQuery:           printQuery,
+			PrintQuerySampleRate: sampleRate,
+		})
+		if err != nil {
+			t.Fatalf("cannot create client: %s", err)
+		}
+
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		defer log.SetOutput(os.Stderr)
+
+		if _, err := c.FindMetrics(context.Background(), "/api/suggest?type=metrics&q=sys&max=10"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		series := Meta{Metric: "sys.cpu", Tags: map[string]string{"host": "h1"}}
+		rt := RetentionMeta{FirstOrder: "sum", SecondOrder: "avg", AggTime: "1m"}
+		for i := 0; i < 10; i++ {
+			if _, err := c.GetData(context.Background(), series, rt, 100, 200, false); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+
+		out := logs.String()
+		if strings.Contains(out, "password") || strings.Contains(out, "secret") {
+			t.Fatalf("credentials must be redacted in logs:\n%s", out)
+		}
+		discoveryQueries := strings.Count(out, "/api/suggest?type=metrics&q=sys&max=10'")
+		dataQueries := strings.Count(out, "/api/query")
+		if !printQuery {
+			if discoveryQueries != 0 || dataQueries != 0 {
+				t.Fatalf("queries mustn't be logged if print query is disabled:\n%s", out)
+			}
+			return
+		}
+		if discoveryQueries != 1 {
+			t.Fatalf("discovery query must be logged once; got %d times:\n%s", discoveryQueries, out)
+		}
+		if dataQueries != wantDataQueries {
+			t.Fatalf("unexpected number of logged data queries %d; want %d:\n%s", dataQueries, wantDataQueries, out)
+		}
+		if !strings.Contains(out, "-H 'Authorization: <redacted>'") {
+			t.Fatalf("expecting redacted auth header in logs:\n%s", out)
+		}
+		if useExpAPI && !strings.Contains(out, "curl -X POST -H 'Authorization: <redacted>' -H 'Content-Type: application/json' -d '{") {
+			t.Fatalf("expecting request body of expression query in logs:\n%s", out)
+		}
+	}
+
+	f(false, 0, false, 0)
+	// every data query is logged
+	f(true, 1, false, 10)
+	f(true, 0, true, 10)
+	// the first query of every 5 is logged
+	f(true, 0.2, false, 2)
+	f(true, 0.001, false, 1)
+}
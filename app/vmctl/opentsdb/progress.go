@@ -0,0 +1,288 @@
+package opentsdb
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// SeriesCursor tracks the number of the first series of the metric
+// which queries were all processed, so the metric could be resumed from it.
+// SeriesCursor is safe for concurrent use.
+type SeriesCursor struct {
+	mu sync.Mutex
+	// pending is the number of unfinished queries per series index
+	pending []int
+	// dispatched is the number of series with all queries sent to workers
+	// per retention lane
+	dispatched []int
+	// next is the index of the first series with unfinished queries
+	next int
+}
+
+// NewSeriesCursor returns cursor for total series dispatched by the given number of lanes,
+// where the first from series were already processed
+func NewSeriesCursor(total, from, lanes int) *SeriesCursor {
+	dispatched := make([]int, lanes)
+	for i := range dispatched {
+		dispatched[i] = from
+	}
+	return &SeriesCursor{
+		pending:    make([]int, total),
+		dispatched: dispatched,
+		next:       from,
+	}
+}
+
+// Add accounts the query sent for the series with idx index
+func (sc *SeriesCursor) Add(idx int) {
+	sc.mu.Lock()
+	sc.pending[idx]++
+	sc.mu.Unlock()
+}
+
+// Done accounts the processed query of the series with idx index
+func (sc *SeriesCursor) Done(idx int) {
+	sc.mu.Lock()
+	sc.pending[idx]--
+	sc.advance()
+	sc.mu.Unlock()
+}
+
+// DispatchedAll records that all queries of the series with idx index were sent by the lane
+func (sc *SeriesCursor) DispatchedAll(lane, idx int) {
+	sc.mu.Lock()
+	sc.dispatched[lane] = idx + 1
+	sc.advance()
+	sc.mu.Unlock()
+}
+
+func (sc *SeriesCursor) advance() {
+	// the series is dispatched only when all the lanes sent its queries
+	dispatched := sc.dispatched[0]
+	for _, n := range sc.dispatched[1:] {
+		if n < dispatched {
+			dispatched = n
+		}
+	}
+	for sc.next < dispatched && sc.pending[sc.next] == 0 {
+		sc.next++
+	}
+}
+
+// Get returns the cursor position and the total number of series
+func (sc *SeriesCursor) Get() Cursor {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return Cursor{Series: sc.next, Total: len(sc.pending)}
+}
+
+// completedCheckInterval defines how often the metrics completed by fetch workers
+// are checked for being sent by the importer, so they could be marked as done
+const completedCheckInterval = time.Second
+
+// Progress persists the progress of the import into Checkpoint:
+// completed metrics are marked as done once their data is sent by the importer,
+// while the metrics in progress are tracked via their cursors and are persisted periodically.
+// Progress is safe for concurrent use.
+type Progress struct {
+	cp *Checkpoint
+	// interval defines how often the cursors of metrics in progress
+	// are persisted. Zero means only completed metrics are persisted
+	interval time.Duration
+
+	mu      sync.Mutex
+	cursors map[string]*SeriesCursor
+	// completed contains the metrics which series were all fetched,
+	// but which data may be still buffered by the importer.
+	// Every metric is mapped to the number of samples fetched by the run on its completion
+	completed map[string]uint64
+}
+
+// NewProgress returns Progress persisted into cp every interval
+func NewProgress(cp *Checkpoint, interval time.Duration) *Progress {
+	return &Progress{cp: cp, interval: interval}
+}
+
+// Pending returns the metrics which weren't imported yet according to the checkpoint
+func (p *Progress) Pending(metrics []string) []string {
+	var pending []string
+	for _, metric := range metrics {
+		if !p.cp.IsDone(metric) {
+			pending = append(pending, metric)
+		}
+	}
+	if skipped := len(metrics) - len(pending); skipped > 0 {
+		log.Printf("Skipping %d metrics already imported according to the checkpoint", skipped)
+	}
+	return pending
+}
+
+// StartTime returns the timestamp the query ranges of the resumed import
+// were calculated from. Zero is returned if the import wasn't started yet.
+func (p *Progress) StartTime() int64 {
+	return p.cp.StartTime
+}
+
+// SetStartTime records the timestamp the query ranges are calculated from
+func (p *Progress) SetStartTime(startTime int64) {
+	p.cp.StartTime = startTime
+}
+
+// StartMetric registers the metric with total series fetched by the given number of lanes.
+// It returns the cursor of the metric and the number of the first series to skip,
+// since they were imported according to the checkpoint.
+func (p *Progress) StartMetric(metric string, total, lanes int) (*SeriesCursor, int) {
+	var from int
+	if c, ok := p.cp.Cursor(metric); ok && c.Series > 0 {
+		if c.Total == total {
+			log.Printf("Resuming %s from series #%d out of %d according to the checkpoint", metric, c.Series+1, c.Total)
+			from = c.Series
+		} else {
+			log.Printf("The number of series for %s changed from %d to %d since the checkpoint, so it is imported from the beginning",
+				metric, c.Total, total)
+		}
+	}
+	sc := NewSeriesCursor(total, from, lanes)
+	p.mu.Lock()
+	if p.cursors == nil {
+		p.cursors = make(map[string]*SeriesCursor)
+	}
+	p.cursors[metric] = sc
+	p.mu.Unlock()
+	return sc, from
+}
+
+// SetLast records the latest processed series and time range
+func (p *Progress) SetLast(series Meta, tr TimeRange) {
+	p.cp.SetLast(series, tr)
+}
+
+// DoneMetric records that all the series of the metric were fetched.
+// fetched is the number of samples passed to the importer by the run at the moment.
+// The metric is marked as done in the checkpoint only after the importer sends
+// these samples, so the metric isn't skipped on restart if its data is lost.
+func (p *Progress) DoneMetric(metric string, fetched uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.cursors, metric)
+	if p.completed == nil {
+		p.completed = make(map[string]uint64)
+	}
+	p.completed[metric] = fetched
+}
+
+// StartSaver periodically persists the progress until the returned stop func is called.
+// fetched must return the number of samples passed to the importer, while sent must return
+// the number of them which were sent. sent must return false if the number is unknown,
+// e.g. because some data failed to be imported, so no progress is persisted then.
+// The progress taken on the previous tick is persisted only if the importer has already
+// sent at least the number of samples fetched after taking it, so the persisted cursors
+// and completed metrics don't point beyond the data which could be still buffered by the importer.
+func (p *Progress) StartSaver(fetched func() uint64, sent func() (int64, bool)) func() {
+	period := completedCheckInterval
+	if p.interval > 0 && p.interval < period {
+		period = p.interval
+	}
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		var prevCursors map[string]Cursor
+		var prevSamples uint64
+		var lastTake time.Time
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+			}
+			n, ok := sent()
+			if !ok {
+				continue
+			}
+			changed := p.markSent(n)
+			if p.interval > 0 && time.Since(lastTake) >= p.interval {
+				if prevCursors != nil && n >= int64(prevSamples) {
+					p.cp.SetProgress(prevCursors, prevSamples)
+					changed = true
+				}
+				prevCursors, _, prevSamples = p.take(fetched)
+				lastTake = time.Now()
+			}
+			if changed {
+				if err := p.cp.Save(); err != nil {
+					log.Printf("failed to save checkpoint: %s", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stopCh)
+		<-doneCh
+	}
+}
+
+// Finish saves the checkpoint on exit from the run.
+// The cursors of metrics in progress and the completed metrics are persisted
+// only if all the fetched data was imported, otherwise the latest periodically
+// saved progress is kept.
+func (p *Progress) Finish(fetched func() uint64, imported bool) {
+	if imported {
+		cursors, completed, samples := p.take(fetched)
+		p.cp.SetProgress(cursors, samples)
+		for _, metric := range completed {
+			p.cp.MarkDone(metric)
+		}
+	}
+	p.mu.Lock()
+	p.completed = nil
+	p.mu.Unlock()
+	if err := p.cp.Save(); err != nil {
+		log.Printf("failed to save checkpoint: %s", err)
+	}
+}
+
+// Reset forgets the metrics in progress, so the next run starts tracking them from scratch
+func (p *Progress) Reset() {
+	p.mu.Lock()
+	p.cursors = nil
+	p.completed = nil
+	p.mu.Unlock()
+}
+
+// markSent marks the completed metrics as done if their samples were sent.
+// It returns whether any metric was marked.
+func (p *Progress) markSent(sent int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var marked bool
+	for metric, fetched := range p.completed {
+		if sent >= int64(fetched) {
+			p.cp.MarkDone(metric)
+			delete(p.completed, metric)
+			marked = true
+		}
+	}
+	return marked
+}
+
+// take returns the cursors of metrics in progress, the completed metrics
+// and the number of samples fetched after taking them
+func (p *Progress) take(fetched func() uint64) (map[string]Cursor, []string, uint64) {
+	p.mu.Lock()
+	cursors := make(map[string]Cursor, len(p.cursors))
+	for metric, sc := range p.cursors {
+		cursors[metric] = sc.Get()
+	}
+	completed := make([]string, 0, len(p.completed))
+	for metric := range p.completed {
+		completed = append(completed, metric)
+	}
+	p.mu.Unlock()
+	// samples are read after the cursors, since the samples of the processed
+	// series are counted before advancing cursors
+	return cursors, completed, fetched()
+}
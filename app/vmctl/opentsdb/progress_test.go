@@ -0,0 +1,118 @@
+package opentsdb
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSeriesCursor(t *testing.T) {
+	sc := NewSeriesCursor(3, 1, 1)
+	sc.Add(1)
+	sc.Add(1)
+	sc.DispatchedAll(0, 1)
+	sc.Add(2)
+	sc.Done(2)
+	if c := sc.Get(); c.Series != 1 || c.Total != 3 {
+		t.Fatalf("unexpected cursor %v; want series 1", c)
+	}
+	sc.Done(1)
+	if c := sc.Get(); c.Series != 1 {
+		t.Fatalf("unexpected cursor %v; want series 1 until all its queries are processed", c)
+	}
+	sc.Done(1)
+	if c := sc.Get(); c.Series != 2 {
+		t.Fatalf("unexpected cursor %v; want series 2 until all its queries are dispatched", c)
+	}
+	sc.DispatchedAll(0, 2)
+	if c := sc.Get(); c.Series != 3 {
+		t.Fatalf("unexpected cursor %v; want series 3", c)
+	}
+
+	// the series is dispatched only after all the lanes sent its queries
+	sc = NewSeriesCursor(2, 0, 2)
+	sc.DispatchedAll(0, 0)
+	sc.DispatchedAll(0, 1)
+	if c := sc.Get(); c.Series != 0 {
+		t.Fatalf("unexpected cursor %v; want series 0 until all the lanes dispatch it", c)
+	}
+	sc.DispatchedAll(1, 0)
+	if c := sc.Get(); c.Series != 1 {
+		t.Fatalf("unexpected cursor %v; want series 1", c)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	cp, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatalf("cannot load checkpoint: %s", err)
+	}
+	p := NewProgress(cp, 0)
+	if pending := p.Pending([]string{"cpu", "mem"}); len(pending) != 2 {
+		t.Fatalf("unexpected pending metrics %v", pending)
+	}
+	p.SetStartTime(1000)
+	sc, from := p.StartMetric("cpu", 3, 1)
+	if from != 0 {
+		t.Fatalf("unexpected first series %d; want 0", from)
+	}
+	sc.Add(0)
+	sc.DispatchedAll(0, 0)
+	sc.Done(0)
+	p.Finish(func() uint64 { return 10 }, true)
+
+	// the metric is resumed from the persisted cursor
+	cp, err = LoadCheckpoint(path)
+	if err != nil {
+		t.Fatalf("cannot load checkpoint: %s", err)
+	}
+	p = NewProgress(cp, 0)
+	if p.StartTime() != 1000 {
+		t.Fatalf("unexpected start time %d; want 1000", p.StartTime())
+	}
+	if _, from := p.StartMetric("cpu", 3, 1); from != 1 {
+		t.Fatalf("unexpected first series %d; want 1", from)
+	}
+	// the changed number of series restarts the metric
+	if _, from := p.StartMetric("cpu", 4, 1); from != 0 {
+		t.Fatalf("unexpected first series %d; want 0", from)
+	}
+	// the completed metric isn't marked as done until its data is sent
+	p.DoneMetric("cpu", 20)
+	if pending := p.Pending([]string{"cpu", "mem"}); len(pending) != 2 {
+		t.Fatalf("unexpected pending metrics %v", pending)
+	}
+	p.Finish(func() uint64 { return 20 }, false)
+	if pending := p.Pending([]string{"cpu", "mem"}); len(pending) != 2 {
+		t.Fatalf("unexpected pending metrics %v after failed import", pending)
+	}
+
+	// the completed metric is marked as done once its samples are sent
+	p = NewProgress(cp, 10*time.Millisecond)
+	p.DoneMetric("cpu", 20)
+	var sent int64
+	var mu sync.Mutex
+	stop := p.StartSaver(func() uint64 { return 30 }, func() (int64, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		return sent, true
+	})
+	time.Sleep(100 * time.Millisecond)
+	if pending := p.Pending([]string{"cpu", "mem"}); len(pending) != 2 {
+		t.Fatalf("unexpected pending metrics %v before sending samples", pending)
+	}
+	mu.Lock()
+	sent = 20
+	mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	stop()
+	cp, err = LoadCheckpoint(path)
+	if err != nil {
+		t.Fatalf("cannot load checkpoint: %s", err)
+	}
+	if !cp.IsDone("cpu") || cp.IsDone("mem") {
+		t.Fatalf("only cpu metric must be persisted as done")
+	}
+}
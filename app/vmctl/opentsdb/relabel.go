@@ -0,0 +1,98 @@
+package opentsdb
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	"gopkg.in/yaml.v2"
+)
+
+// RelabelConfig contains rules for rewriting metric names
+// and tag keys of the data fetched from OpenTSDB.
+// The rules are applied to already sanitized names.
+//
+// Example config:
+//
+//	metric_rules:
+//	  - regex: "sys_cpu_(.+)"
+//	    replacement: "node_cpu_$1"
+//	tag_renames:
+//	  host: instance
+type RelabelConfig struct {
+	// MetricRules are applied to the metric name in the given order.
+	// Only the first matching rule is applied.
+	MetricRules []MetricRule `yaml:"metric_rules,omitempty"`
+	// TagRenames maps OpenTSDB tag keys to the label names in VictoriaMetrics
+	TagRenames map[string]string `yaml:"tag_renames,omitempty"`
+}
+
+// MetricRule rewrites the metric name matching Regex
+// according to Replacement template.
+type MetricRule struct {
+	// Regex must match the whole metric name.
+	Regex string `yaml:"regex"`
+	// Replacement may refer to Regex capture groups via $1, $2, etc.
+	Replacement string `yaml:"replacement"`
+
+	re *regexp.Regexp
+}
+
+// LoadRelabelConfig reads and validates RelabelConfig from the given path.
+func LoadRelabelConfig(path string) (*RelabelConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read relabel config %q: %s", path, err)
+	}
+	var rc RelabelConfig
+	if err := yaml.UnmarshalStrict(data, &rc); err != nil {
+		return nil, fmt.Errorf("cannot parse relabel config %q: %s", path, err)
+	}
+	for i := range rc.MetricRules {
+		r := &rc.MetricRules[i]
+		if r.Regex == "" {
+			return nil, fmt.Errorf("missing `regex` in metric rule #%d", i+1)
+		}
+		if r.Replacement == "" {
+			return nil, fmt.Errorf("missing `replacement` in metric rule #%d", i+1)
+		}
+		re, err := regexp.Compile("^(?:" + r.Regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse `regex` %q in metric rule #%d: %s", r.Regex, i+1, err)
+		}
+		r.re = re
+	}
+	for k, v := range rc.TagRenames {
+		if k == "" || v == "" {
+			return nil, fmt.Errorf("tag rename %q: %q must have non-empty source and target names", k, v)
+		}
+	}
+	return &rc, nil
+}
+
+// Apply rewrites the metric name and tag keys of m in place.
+// Apply is no-op for nil RelabelConfig.
+func (rc *RelabelConfig) Apply(m *Metric) {
+	if rc == nil {
+		return
+	}
+	for _, r := range rc.MetricRules {
+		match := r.re.FindStringSubmatchIndex(m.Metric)
+		if match == nil {
+			continue
+		}
+		m.Metric = string(r.re.ExpandString(nil, r.Replacement, m.Metric, match))
+		break
+	}
+	if len(rc.TagRenames) == 0 || len(m.Tags) == 0 {
+		return
+	}
+	tags := make(map[string]string, len(m.Tags))
+	for k, v := range m.Tags {
+		if name, ok := rc.TagRenames[k]; ok {
+			k = name
+		}
+		tags[k] = v
+	}
+	m.Tags = tags
+}
@@ -0,0 +1,101 @@
+package opentsdb
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadRelabelConfig(t *testing.T) {
+	f := func(data string, wantErr bool) {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "relabel.yml")
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatalf("cannot write config: %s", err)
+		}
+		_, err := LoadRelabelConfig(path)
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error: %v; wantErr: %v", err, wantErr)
+		}
+	}
+
+	f(``, false)
+	f(`
+metric_rules:
+  - regex: "sys_cpu_(.+)"
+    replacement: "node_cpu_$1"
+tag_renames:
+  host: instance
+`, false)
+	// unknown field
+	f(`foo: bar`, true)
+	// missing regex
+	f(`
+metric_rules:
+  - replacement: "foo"
+`, true)
+	// missing replacement
+	f(`
+metric_rules:
+  - regex: "foo"
+`, true)
+	// invalid regex
+	f(`
+metric_rules:
+  - regex: "("
+    replacement: "foo"
+`, true)
+	// empty tag rename target
+	f(`
+tag_renames:
+  host: ""
+`, true)
+
+	if _, err := LoadRelabelConfig(filepath.Join(t.TempDir(), "missing.yml")); err == nil {
+		t.Fatalf("expecting error for missing file")
+	}
+}
+
+func TestRelabelConfigApply(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relabel.yml")
+	data := `
+metric_rules:
+  - regex: "sys_cpu_(.+)"
+    replacement: "node_cpu_$1"
+  - regex: "sys_.+"
+    replacement: "node_other"
+tag_renames:
+  host: instance
+`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("cannot write config: %s", err)
+	}
+	rc, err := LoadRelabelConfig(path)
+	if err != nil {
+		t.Fatalf("cannot load config: %s", err)
+	}
+
+	f := func(rc *RelabelConfig, m, want Metric) {
+		t.Helper()
+		rc.Apply(&m)
+		if !reflect.DeepEqual(m, want) {
+			t.Fatalf("unexpected metric %+v; want %+v", m, want)
+		}
+	}
+
+	// the first matching rule wins
+	f(rc, Metric{Metric: "sys_cpu_user"}, Metric{Metric: "node_cpu_user"})
+	f(rc, Metric{Metric: "sys_mem_free"}, Metric{Metric: "node_other"})
+	// regex must match the whole name
+	f(rc, Metric{Metric: "tsd_sys_cpu_user"}, Metric{Metric: "tsd_sys_cpu_user"})
+	f(rc,
+		Metric{Metric: "tsd_rpc", Tags: map[string]string{"host": "h1", "type": "put"}},
+		Metric{Metric: "tsd_rpc", Tags: map[string]string{"instance": "h1", "type": "put"}},
+	)
+	// nil config leaves metric unchanged
+	f(nil,
+		Metric{Metric: "sys_cpu_user", Tags: map[string]string{"host": "h1"}},
+		Metric{Metric: "sys_cpu_user", Tags: map[string]string{"host": "h1"}},
+	)
+}
@@ -0,0 +1,297 @@
+package opentsdb
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/utils"
+)
+
+// MetricStats contains the processing stats of a single metric
+type MetricStats struct {
+	Metric   string
+	Duration time.Duration
+	Series   int
+	// Samples is the number of samples sent to the importer
+	// by the workers of the metric
+	Samples uint64
+}
+
+// Timings collects the processing stats of metrics.
+// The zero value is ready to use. Timings is safe for concurrent use.
+type Timings struct {
+	// OnDone is an optional callback called with the processing stats
+	// of every successfully imported metric. It is called concurrently
+	// if metrics are processed concurrently, so it must be safe for concurrent use.
+	OnDone func(ms MetricStats)
+
+	mu   sync.Mutex
+	done []MetricStats
+	// incomplete contains the processing stats of the metrics
+	// which were started, but weren't imported completely
+	incomplete []MetricStats
+}
+
+// Add records the processing stats of the imported metric
+// and passes them to OnDone if it is set.
+func (t *Timings) Add(ms MetricStats) {
+	t.mu.Lock()
+	t.done = append(t.done, ms)
+	t.mu.Unlock()
+	if t.OnDone != nil {
+		t.OnDone(ms)
+	}
+}
+
+// AddIncomplete records the processing stats of the metric
+// which wasn't imported completely because of error or interruption.
+func (t *Timings) AddIncomplete(ms MetricStats) {
+	t.mu.Lock()
+	t.incomplete = append(t.incomplete, ms)
+	t.mu.Unlock()
+}
+
+// Done returns the processing stats of the imported metrics
+func (t *Timings) Done() []MetricStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]MetricStats(nil), t.done...)
+}
+
+// Reset forgets the stats of the previous run
+func (t *Timings) Reset() {
+	t.mu.Lock()
+	t.done = nil
+	t.incomplete = nil
+	t.mu.Unlock()
+}
+
+// MetricTimer collects the processing stats of a single metric
+// until it is recorded into Timings via Done or Incomplete.
+// MetricTimer is safe for concurrent use.
+type MetricTimer struct {
+	t      *Timings
+	metric string
+	series int
+	start  time.Time
+	// samples is the number of samples sent to the importer for the metric
+	samples uint64
+}
+
+// Start starts collecting the processing stats of the metric with the given number of series
+func (t *Timings) Start(metric string, series int) *MetricTimer {
+	return &MetricTimer{
+		t:      t,
+		metric: metric,
+		series: series,
+		start:  time.Now(),
+	}
+}
+
+// AddSamples accounts the given number of samples sent to the importer for the metric
+func (mt *MetricTimer) AddSamples(n uint64) {
+	atomic.AddUint64(&mt.samples, n)
+}
+
+// Done records the stats of the imported metric via Timings.Add
+func (mt *MetricTimer) Done() {
+	mt.t.Add(mt.stats())
+}
+
+// Incomplete records the stats of the metric, which wasn't imported
+// completely, via Timings.AddIncomplete
+func (mt *MetricTimer) Incomplete() {
+	mt.t.AddIncomplete(mt.stats())
+}
+
+func (mt *MetricTimer) stats() MetricStats {
+	return MetricStats{
+		Metric:   mt.metric,
+		Duration: time.Since(mt.start),
+		Series:   mt.series,
+		Samples:  atomic.LoadUint64(&mt.samples),
+	}
+}
+
+// LogSlowest logs up to n imported metrics
+// sorted by processing duration in descending order
+func (t *Timings) LogSlowest(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n < 1 || len(t.done) < 1 {
+		return
+	}
+	sort.SliceStable(t.done, func(i, j int) bool {
+		return t.done[i].Duration > t.done[j].Duration
+	})
+	if n > len(t.done) {
+		n = len(t.done)
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Top %d slowest metrics of %d:", n, len(t.done))
+	for i, ms := range t.done[:n] {
+		var samplesPerS float64
+		if d := ms.Duration.Seconds(); d > 0 {
+			samplesPerS = float64(ms.Samples) / d
+		}
+		fmt.Fprintf(&sb, "\n  %d. %s: duration: %v; series: %d; samples: %d; samples/s: %.2f;",
+			i+1, ms.Metric, ms.Duration.Truncate(time.Millisecond), ms.Series, ms.Samples, samplesPerS)
+	}
+	log.Print(sb.String())
+}
+
+// ReportVersion is the version of the migration report schema.
+// It must be increased on incompatible changes of the report fields,
+// so the tools parsing reports could detect them.
+const ReportVersion = 1
+
+// Statuses of the whole run in the migration report
+const (
+	RunStatusSuccess     = "success"
+	RunStatusFailed      = "failed"
+	RunStatusInterrupted = "interrupted"
+)
+
+// Statuses of metrics in the migration report
+const (
+	// MetricStatusDone means all the series of the metric were processed.
+	// Some of them may still fail, see MetricReport.Errors
+	MetricStatusDone = "done"
+	// MetricStatusIncomplete means the metric processing was started,
+	// but was stopped because of error or interruption
+	MetricStatusIncomplete = "incomplete"
+	// MetricStatusPending means the metric processing wasn't started
+	MetricStatusPending = "pending"
+	// MetricStatusEmpty means the metric has no series in OpenTSDB
+	MetricStatusEmpty = "empty"
+)
+
+// Report is the summary of the migration written to --report-file
+type Report struct {
+	Version    int       `json:"version"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	StartTime  time.Time `json:"startTime"`
+	FinishTime time.Time `json:"finishTime"`
+
+	// the totals are taken from the importer stats
+	Samples   uint64 `json:"samples"`
+	Series    uint64 `json:"series"`
+	Bytes     uint64 `json:"bytes"`
+	SentBytes uint64 `json:"sentBytes"`
+	// ImportErrors is the number of import requests failed after all the retries
+	ImportErrors uint64 `json:"importErrors"`
+
+	Metrics []MetricReport `json:"metrics"`
+}
+
+// MetricReport is the summary of a single metric in Report
+type MetricReport struct {
+	Metric string `json:"metric"`
+	Status string `json:"status"`
+	Series int    `json:"series"`
+	// Samples is the number of samples sent to the importer
+	Samples uint64 `json:"samples"`
+	// Bytes is the estimated size of the imported data. The importer batches
+	// series of different metrics together, so the size is derived
+	// from the average size of the samples of the whole run
+	Bytes           uint64  `json:"bytes"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	// Errors is the number of queries to OpenTSDB failed for the metric
+	Errors uint64 `json:"errors"`
+}
+
+// AddMetrics adds the reports of the processed metrics from t, the discovered metrics
+// which processing wasn't started and the metrics without series to r.
+// The totals of r must be already set for estimating the size of metrics data.
+func (r *Report) AddMetrics(t *Timings, f *Failures, discovered []MetricStats, empty []string) {
+	var bytesPerSample float64
+	if r.Samples > 0 {
+		bytesPerSample = float64(r.Bytes) / float64(r.Samples)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	seen := make(map[string]struct{})
+	add := func(ms MetricStats, status string) {
+		seen[ms.Metric] = struct{}{}
+		r.Metrics = append(r.Metrics, MetricReport{
+			Metric:          ms.Metric,
+			Status:          status,
+			Series:          ms.Series,
+			Samples:         ms.Samples,
+			Bytes:           uint64(float64(ms.Samples) * bytesPerSample),
+			DurationSeconds: ms.Duration.Seconds(),
+			Errors:          f.QueriesCount(ms.Metric),
+		})
+	}
+	for _, ms := range t.done {
+		add(ms, MetricStatusDone)
+	}
+	for _, ms := range t.incomplete {
+		add(ms, MetricStatusIncomplete)
+	}
+	for _, ms := range discovered {
+		if _, ok := seen[ms.Metric]; !ok {
+			add(ms, MetricStatusPending)
+		}
+	}
+	for _, metric := range empty {
+		add(MetricStats{Metric: metric}, MetricStatusEmpty)
+	}
+	sort.SliceStable(r.Metrics, func(i, j int) bool {
+		return r.Metrics[i].Metric < r.Metrics[j].Metric
+	})
+}
+
+// reportCSVHeader is the header of the migration report in CSV format.
+// Every row contains the report version and the status of the whole run,
+// so rows could be processed independently of each other.
+var reportCSVHeader = []string{"version", "run_status", "metric", "status", "series", "samples", "bytes", "duration_seconds", "errors"}
+
+// WriteReport atomically writes the report to path in CSV format
+// if path has .csv extension and in JSON format otherwise.
+func WriteReport(path string, r Report) error {
+	var data []byte
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		var sb strings.Builder
+		w := csv.NewWriter(&sb)
+		_ = w.Write(reportCSVHeader)
+		for _, m := range r.Metrics {
+			_ = w.Write([]string{
+				strconv.Itoa(r.Version),
+				r.Status,
+				m.Metric,
+				m.Status,
+				strconv.Itoa(m.Series),
+				strconv.FormatUint(m.Samples, 10),
+				strconv.FormatUint(m.Bytes, 10),
+				strconv.FormatFloat(m.DurationSeconds, 'f', 3, 64),
+				strconv.FormatUint(m.Errors, 10),
+			})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return fmt.Errorf("cannot marshal report: %s", err)
+		}
+		data = []byte(sb.String())
+	} else {
+		var err error
+		data, err = json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return fmt.Errorf("cannot marshal report: %s", err)
+		}
+	}
+	if err := utils.WriteFileAtomic(path, data, 0644); err != nil {
+		return fmt.Errorf("cannot save report: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package opentsdb
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTimingsLogSlowest(t *testing.T) {
+	var tm Timings
+	for i, metric := range []string{"cpu", "mem", "disk"} {
+		tm.Add(MetricStats{Metric: metric, Duration: time.Duration(i+1) * time.Second})
+	}
+	tm.LogSlowest(2)
+	done := tm.Done()
+	for i := 1; i < len(done); i++ {
+		if done[i].Duration > done[i-1].Duration {
+			t.Fatalf("metric timings aren't sorted by duration: %v", done)
+		}
+	}
+}
+
+func TestMetricTimer(t *testing.T) {
+	var done []MetricStats
+	tm := Timings{OnDone: func(ms MetricStats) { done = append(done, ms) }}
+
+	mt := tm.Start("cpu", 2)
+	mt.AddSamples(3)
+	mt.AddSamples(4)
+	mt.Done()
+	if len(done) != 1 || done[0].Metric != "cpu" || done[0].Series != 2 || done[0].Samples != 7 {
+		t.Fatalf("unexpected stats passed to OnDone: %+v", done)
+	}
+
+	// incomplete metrics aren't passed to OnDone
+	mt = tm.Start("mem", 1)
+	mt.AddSamples(1)
+	mt.Incomplete()
+	if len(done) != 1 {
+		t.Fatalf("incomplete metric must not be passed to OnDone; got %+v", done)
+	}
+	var r Report
+	r.AddMetrics(&tm, &Failures{}, nil, nil)
+	if len(r.Metrics) != 2 || r.Metrics[1].Metric != "mem" || r.Metrics[1].Status != MetricStatusIncomplete || r.Metrics[1].Samples != 1 {
+		t.Fatalf("unexpected metrics in report: %+v", r.Metrics)
+	}
+}
+
+func TestReportAddMetrics(t *testing.T) {
+	var tm Timings
+	tm.Add(MetricStats{Metric: "cpu", Series: 2, Samples: 10})
+	tm.AddIncomplete(MetricStats{Metric: "mem", Series: 1, Samples: 5})
+	var f Failures
+	f.AddQuery(`mem{host="a"}`, RetryQuery{Series: Meta{Metric: "mem"}})
+	discovered := []MetricStats{{Metric: "cpu", Series: 2}, {Metric: "mem", Series: 1}, {Metric: "disk", Series: 3}}
+
+	r := Report{Samples: 15, Bytes: 150}
+	r.AddMetrics(&tm, &f, discovered, []string{"empty"})
+	want := []MetricReport{
+		{Metric: "cpu", Status: MetricStatusDone, Series: 2, Samples: 10, Bytes: 100},
+		{Metric: "disk", Status: MetricStatusPending, Series: 3},
+		{Metric: "empty", Status: MetricStatusEmpty},
+		{Metric: "mem", Status: MetricStatusIncomplete, Series: 1, Samples: 5, Bytes: 50, Errors: 1},
+	}
+	if len(r.Metrics) != len(want) {
+		t.Fatalf("unexpected metrics %+v; want %+v", r.Metrics, want)
+	}
+	for i := range want {
+		if r.Metrics[i] != want[i] {
+			t.Fatalf("unexpected report for %q: %+v; want %+v", want[i].Metric, r.Metrics[i], want[i])
+		}
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	r := Report{
+		Version: ReportVersion,
+		Status:  RunStatusFailed,
+		Error:   "some error",
+		Metrics: []MetricReport{
+			{Metric: "cpu", Status: MetricStatusDone, Series: 2, Samples: 10},
+			{Metric: "mem", Status: MetricStatusIncomplete, Series: 1, Errors: 1},
+		},
+	}
+	dir := t.TempDir()
+
+	// the written report must be readable back in both formats
+	jsonPath := filepath.Join(dir, "report.json")
+	if err := WriteReport(jsonPath, r); err != nil {
+		t.Fatalf("cannot write report: %s", err)
+	}
+	data, err := os.ReadFile(jsonPath)
+	if err != nil {
+		t.Fatalf("cannot read report: %s", err)
+	}
+	var parsed Report
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		t.Fatalf("cannot parse report: %s", err)
+	}
+	if parsed.Version != ReportVersion || parsed.Status != r.Status || parsed.Error != r.Error || len(parsed.Metrics) != len(r.Metrics) {
+		t.Fatalf("unexpected parsed report %+v", parsed)
+	}
+
+	csvPath := filepath.Join(dir, "report.csv")
+	if err := WriteReport(csvPath, r); err != nil {
+		t.Fatalf("cannot write report: %s", err)
+	}
+	fd, err := os.Open(csvPath)
+	if err != nil {
+		t.Fatalf("cannot open report: %s", err)
+	}
+	defer fd.Close()
+	rows, err := csv.NewReader(fd).ReadAll()
+	if err != nil {
+		t.Fatalf("cannot parse report: %s", err)
+	}
+	if len(rows) != len(r.Metrics)+1 {
+		t.Fatalf("unexpected number of CSV rows %d; want %d", len(rows), len(r.Metrics)+1)
+	}
+	for _, row := range rows[1:] {
+		if row[0] != "1" || row[1] != RunStatusFailed {
+			t.Fatalf("unexpected CSV row %v", row)
+		}
+	}
+}
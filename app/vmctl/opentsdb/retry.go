@@ -0,0 +1,106 @@
+package opentsdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/utils"
+)
+
+// RetryQuery is a single query to OpenTSDB which failed during the import.
+// The queried time range is [StartTime-TimeRange.Start, StartTime-TimeRange.End].
+type RetryQuery struct {
+	Series    Meta          `json:"series"`
+	Retention RetentionMeta `json:"retention"`
+	TimeRange TimeRange     `json:"timeRange"`
+	StartTime int64         `json:"startTime"`
+}
+
+// RetryManifest holds the list of failed queries to OpenTSDB,
+// so they could be re-processed by a separate run
+// without discovering all the metrics again.
+type RetryManifest struct {
+	Queries []RetryQuery `json:"queries"`
+
+	path string
+	mu   sync.Mutex
+}
+
+// NewRetryManifest returns an empty manifest which is written to path on Save
+func NewRetryManifest(path string) *RetryManifest {
+	return &RetryManifest{
+		// empty list is written instead of null if no queries failed
+		Queries: []RetryQuery{},
+		path:    path,
+	}
+}
+
+// LoadRetryManifest reads the manifest from the given path
+func LoadRetryManifest(path string) (*RetryManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read retry manifest %q: %s", path, err)
+	}
+	rm := &RetryManifest{path: path}
+	if err := json.Unmarshal(data, rm); err != nil {
+		return nil, fmt.Errorf("cannot parse retry manifest %q: %s", path, err)
+	}
+	if rm.Queries == nil {
+		// distinguish empty manifest from missing one
+		rm.Queries = []RetryQuery{}
+	}
+	for i, q := range rm.Queries {
+		if q.Series.Metric == "" {
+			return nil, fmt.Errorf("query #%d in retry manifest %q has empty metric name", i+1, path)
+		}
+	}
+	return rm, nil
+}
+
+// Add records the failed query. Add is safe for concurrent use.
+func (rm *RetryManifest) Add(q RetryQuery) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.Queries = append(rm.Queries, q)
+}
+
+// Len returns the number of recorded queries
+func (rm *RetryManifest) Len() int {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	return len(rm.Queries)
+}
+
+// Save atomically writes manifest to its path
+// in the same way as Checkpoint.Save does.
+// Save is safe for concurrent use.
+func (rm *RetryManifest) Save() error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	data, err := json.MarshalIndent(rm, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot marshal retry manifest: %s", err)
+	}
+	if err := utils.WriteFileAtomic(rm.path, data, 0600); err != nil {
+		return fmt.Errorf("cannot save retry manifest: %s", err)
+	}
+	return nil
+}
+
+// GroupByMetric groups queries by metric, so they could be processed
+// the same way as during the import. Metrics are returned in the order
+// of their first queries.
+func GroupByMetric(queries []RetryQuery) ([]string, map[string][]RetryQuery) {
+	var metrics []string
+	byMetric := make(map[string][]RetryQuery)
+	for _, q := range queries {
+		metric := q.Series.Metric
+		if _, ok := byMetric[metric]; !ok {
+			metrics = append(metrics, metric)
+		}
+		byMetric[metric] = append(byMetric[metric], q)
+	}
+	return metrics, byMetric
+}
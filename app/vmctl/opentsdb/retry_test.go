@@ -0,0 +1,64 @@
+package opentsdb
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRetryManifest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "retry.json")
+
+	if _, err := LoadRetryManifest(path); err == nil {
+		t.Fatalf("expecting error when loading missing manifest")
+	}
+
+	rm := NewRetryManifest(path)
+	if err := rm.Save(); err != nil {
+		t.Fatalf("cannot save empty manifest: %s", err)
+	}
+	rm, err := LoadRetryManifest(path)
+	if err != nil {
+		t.Fatalf("cannot load empty manifest: %s", err)
+	}
+	if rm.Len() != 0 {
+		t.Fatalf("unexpected number of queries in empty manifest: %d", rm.Len())
+	}
+
+	want := []RetryQuery{
+		{
+			Series:    Meta{Metric: "cpu", Tags: map[string]string{"host": "host1"}},
+			Retention: RetentionMeta{FirstOrder: "sum", SecondOrder: "avg", AggTime: "1m"},
+			TimeRange: TimeRange{Start: 3600, End: 0},
+			StartTime: 1626019200,
+		},
+		{
+			Series:    Meta{Metric: "mem", Tags: map[string]string{"host": "host2"}},
+			Retention: RetentionMeta{FirstOrder: "sum", SecondOrder: "max", AggTime: "1h"},
+			TimeRange: TimeRange{Start: 86400, End: 3600},
+			StartTime: 1626019200,
+		},
+	}
+	for _, q := range want {
+		rm.Add(q)
+	}
+	if err := rm.Save(); err != nil {
+		t.Fatalf("cannot save manifest: %s", err)
+	}
+	rm, err = LoadRetryManifest(path)
+	if err != nil {
+		t.Fatalf("cannot load saved manifest: %s", err)
+	}
+	if !reflect.DeepEqual(rm.Queries, want) {
+		t.Fatalf("unexpected queries;\ngot\n%v\nwant\n%v", rm.Queries, want)
+	}
+
+	// queries without metric name can't be retried
+	if err := os.WriteFile(path, []byte(`{"queries":[{"series":{"tags":{"host":"host1"}}}]}`), 0600); err != nil {
+		t.Fatalf("cannot write manifest: %s", err)
+	}
+	if _, err := LoadRetryManifest(path); err == nil {
+		t.Fatalf("expecting error for query without metric name")
+	}
+}
@@ -0,0 +1,69 @@
+package opentsdb
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// minPlausibleTimestamp is the lowest expected timestamp of OpenTSDB data in milliseconds.
+// Timestamps in seconds treated as milliseconds are in January 1970, so they are below it.
+var minPlausibleTimestamp = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+
+// maxFutureOffset limits how far in the future timestamps of OpenTSDB data may be.
+// Timestamps in milliseconds treated as seconds are tens of thousands years ahead.
+const maxFutureOffset = 365 * 24 * time.Hour
+
+// CheckTimestamps returns an error if any of the given timestamps in milliseconds
+// is outside the plausible range, which is likely caused by the wrong timestamps unit
+func CheckTimestamps(timestamps []int64, now time.Time) error {
+	maxTS := now.Add(maxFutureOffset).UnixMilli()
+	for _, ts := range timestamps {
+		if ts < minPlausibleTimestamp || ts > maxTS {
+			return fmt.Errorf("timestamp %d (%s) is out of the plausible range [%s, %s]", ts,
+				time.UnixMilli(ts).UTC().Format(time.RFC3339),
+				time.UnixMilli(minPlausibleTimestamp).UTC().Format(time.RFC3339),
+				time.UnixMilli(maxTS).UTC().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// DropNaNs removes samples with NaN values
+func DropNaNs(timestamps []int64, values []float64) ([]int64, []float64) {
+	n := 0
+	for i, v := range values {
+		if math.IsNaN(v) {
+			continue
+		}
+		timestamps[n] = timestamps[i]
+		values[n] = v
+		n++
+	}
+	return timestamps[:n], values[:n]
+}
+
+// DedupSamples sorts samples by timestamp in ascending order
+// and leaves only the last sample for duplicate timestamps.
+func DedupSamples(timestamps []int64, values []float64) ([]int64, []float64) {
+	idx := make([]int, len(timestamps))
+	for i := range idx {
+		idx[i] = i
+	}
+	// stable sort preserves the order of samples with equal timestamps
+	sort.SliceStable(idx, func(i, j int) bool {
+		return timestamps[idx[i]] < timestamps[idx[j]]
+	})
+	dstTimestamps := make([]int64, 0, len(timestamps))
+	dstValues := make([]float64, 0, len(values))
+	for _, i := range idx {
+		if n := len(dstTimestamps); n > 0 && dstTimestamps[n-1] == timestamps[i] {
+			dstValues[n-1] = values[i]
+			continue
+		}
+		dstTimestamps = append(dstTimestamps, timestamps[i])
+		dstValues = append(dstValues, values[i])
+	}
+	return dstTimestamps, dstValues
+}
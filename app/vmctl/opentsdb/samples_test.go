@@ -0,0 +1,69 @@
+package opentsdb
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDedupSamples(t *testing.T) {
+	f := func(timestamps []int64, values []float64, wantTimestamps []int64, wantValues []float64) {
+		t.Helper()
+		gotTimestamps, gotValues := DedupSamples(timestamps, values)
+		for i := 1; i < len(gotTimestamps); i++ {
+			if gotTimestamps[i-1] >= gotTimestamps[i] {
+				t.Fatalf("timestamps must strictly increase; got %v", gotTimestamps)
+			}
+		}
+		if !reflect.DeepEqual(gotTimestamps, wantTimestamps) {
+			t.Fatalf("unexpected timestamps %v; want %v", gotTimestamps, wantTimestamps)
+		}
+		if !reflect.DeepEqual(gotValues, wantValues) {
+			t.Fatalf("unexpected values %v; want %v", gotValues, wantValues)
+		}
+	}
+
+	f([]int64{}, []float64{}, []int64{}, []float64{})
+	f([]int64{1, 2, 3}, []float64{1, 2, 3}, []int64{1, 2, 3}, []float64{1, 2, 3})
+	f([]int64{3, 1, 2}, []float64{3, 1, 2}, []int64{1, 2, 3}, []float64{1, 2, 3})
+	// the last written value wins
+	f([]int64{2, 1, 2, 3, 1, 2}, []float64{20, 10, 21, 30, 11, 22}, []int64{1, 2, 3}, []float64{11, 22, 30})
+}
+
+func TestDropNaNs(t *testing.T) {
+	f := func(timestamps []int64, values []float64, wantTimestamps []int64, wantValues []float64) {
+		t.Helper()
+		gotTimestamps, gotValues := DropNaNs(timestamps, values)
+		if !reflect.DeepEqual(gotTimestamps, wantTimestamps) {
+			t.Fatalf("unexpected timestamps %v; want %v", gotTimestamps, wantTimestamps)
+		}
+		if !reflect.DeepEqual(gotValues, wantValues) {
+			t.Fatalf("unexpected values %v; want %v", gotValues, wantValues)
+		}
+	}
+
+	nan := math.NaN()
+	f([]int64{}, []float64{}, []int64{}, []float64{})
+	f([]int64{1, 2}, []float64{1, 2}, []int64{1, 2}, []float64{1, 2})
+	f([]int64{1, 2, 3, 4}, []float64{nan, 2, nan, 4}, []int64{2, 4}, []float64{2, 4})
+	f([]int64{1, 2}, []float64{nan, nan}, []int64{}, []float64{})
+}
+
+func TestCheckTimestamps(t *testing.T) {
+	const ts = 1700000000
+	now := time.Unix(ts, 0)
+	f := func(timestamps []int64, wantErr bool) {
+		t.Helper()
+		err := CheckTimestamps(timestamps, now)
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error for %v: %v; want error: %v", timestamps, err, wantErr)
+		}
+	}
+	f(nil, false)
+	f([]int64{ts * 1e3, (ts + 60) * 1e3}, false)
+	// seconds treated as milliseconds
+	f([]int64{ts * 1e3, ts}, true)
+	// milliseconds treated as seconds
+	f([]int64{ts * 1e6}, true)
+}
@@ -0,0 +1,149 @@
+package opentsdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/utils"
+)
+
+// State holds per-metric watermarks of recurring syncs from OpenTSDB,
+// so every scheduled run fetches only the data newer than the previous one.
+// Unlike Checkpoint, it isn't bound to the start time of a single migration.
+type State struct {
+	// Watermarks contains the timestamp in milliseconds per OpenTSDB metric,
+	// up to which the data of the metric was successfully imported
+	Watermarks map[string]int64 `json:"watermarks"`
+
+	path string
+	mu   sync.Mutex
+}
+
+// NewState returns empty state, which is kept in memory only
+func NewState() *State {
+	return &State{Watermarks: make(map[string]int64)}
+}
+
+// LoadState reads the state from the given path.
+// Empty state is returned if file at path doesn't exist yet.
+func LoadState(path string) (*State, error) {
+	st := &State{
+		Watermarks: make(map[string]int64),
+		path:       path,
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+		return nil, fmt.Errorf("cannot read state file %q: %s", path, err)
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("cannot parse state file %q: %s", path, err)
+	}
+	if st.Watermarks == nil {
+		st.Watermarks = make(map[string]int64)
+	}
+	return st, nil
+}
+
+// Watermark returns the timestamp in milliseconds up to which
+// the data of metric was imported by the previous runs
+func (st *State) Watermark(metric string) (int64, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	ts, ok := st.Watermarks[metric]
+	return ts, ok
+}
+
+// SetWatermark records the timestamp in milliseconds up to which
+// the data of metric was imported. Watermarks never move backwards.
+func (st *State) SetWatermark(metric string, ts int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if ts > st.Watermarks[metric] {
+		st.Watermarks[metric] = ts
+	}
+}
+
+// Save atomically writes state to its path the same way as Checkpoint.Save.
+// It is no-op for the state returned by NewState.
+// Save is safe for concurrent use.
+func (st *State) Save() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("cannot marshal state: %s", err)
+	}
+	if err := utils.WriteFileAtomic(st.path, data, 0600); err != nil {
+		return fmt.Errorf("cannot save state: %s", err)
+	}
+	return nil
+}
+
+// StateTracker applies State to a single run: the data of every metric
+// is fetched starting from its watermark minus overlap, while the completely
+// imported metrics get the watermark of the run.
+type StateTracker struct {
+	state *State
+	// overlap is the duration of the data before the watermark
+	// which is re-fetched, since it could be written to OpenTSDB with a delay
+	overlap   time.Duration
+	msecsTime bool
+	// watermark is the timestamp in milliseconds up to which
+	// the data is fetched by the current run
+	watermark int64
+}
+
+// NewStateTracker returns tracker for state.
+// msecsTime defines whether OpenTSDB timestamps are in milliseconds.
+func NewStateTracker(state *State, overlap time.Duration, msecsTime bool) *StateTracker {
+	return &StateTracker{state: state, overlap: overlap, msecsTime: msecsTime}
+}
+
+// Begin starts the run fetching the data up to watermark in milliseconds
+// and logs the number of the given metrics fetched starting from their watermarks.
+func (st *StateTracker) Begin(watermark int64, metrics []string) {
+	st.watermark = watermark
+	var resumed int
+	for _, metric := range metrics {
+		if _, ok := st.state.Watermark(metric); ok {
+			resumed++
+		}
+	}
+	log.Printf("%d metrics are fetched starting from their watermarks in the state file", resumed)
+}
+
+// LastTimestamp returns the OpenTSDB timestamp preceding the data
+// to fetch for the metric according to its watermark.
+// Zero is returned if the metric has no watermark yet.
+func (st *StateTracker) LastTimestamp(metric string) int64 {
+	wm, ok := st.state.Watermark(metric)
+	if !ok {
+		return 0
+	}
+	from := wm - st.overlap.Milliseconds()
+	if !st.msecsTime {
+		from /= 1e3
+	}
+	return from - 1
+}
+
+// DoneMetric records the watermark of the run for the completely imported metric
+func (st *StateTracker) DoneMetric(metric string) {
+	st.state.SetWatermark(metric, st.watermark)
+}
+
+// Save persists the watermarks. It must be called only after all the data
+// is flushed, so the failed run is repeated from the previous watermarks.
+func (st *StateTracker) Save() error {
+	return st.state.Save()
+}
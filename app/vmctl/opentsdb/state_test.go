@@ -0,0 +1,44 @@
+package opentsdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	st, err := LoadState(path)
+	if err != nil {
+		t.Fatalf("unexpected error when loading missing state: %s", err)
+	}
+	if _, ok := st.Watermark("cpu"); ok {
+		t.Fatalf("empty state must not contain any watermarks")
+	}
+
+	st.SetWatermark("cpu", 1626019200000)
+	st.SetWatermark("mem", 1626019200000)
+	// watermarks never move backwards
+	st.SetWatermark("mem", 1626015600000)
+	if err := st.Save(); err != nil {
+		t.Fatalf("cannot save state: %s", err)
+	}
+
+	st, err = LoadState(path)
+	if err != nil {
+		t.Fatalf("cannot load saved state: %s", err)
+	}
+	for _, metric := range []string{"cpu", "mem"} {
+		if ts, ok := st.Watermark(metric); !ok || ts != 1626019200000 {
+			t.Fatalf("unexpected watermark of %q: %d; want %d", metric, ts, 1626019200000)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatalf("cannot write state: %s", err)
+	}
+	if _, err := LoadState(path); err == nil {
+		t.Fatalf("expecting error for corrupted state file")
+	}
+}
@@ -0,0 +1,163 @@
+package opentsdb
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// nanReader replaces NaN tokens outside of strings with null
+// the same way as replaceNaN, but while the data is being read,
+// so the response doesn't need to be buffered for decoding it.
+type nanReader struct {
+	r *bufio.Reader
+	// err is the first error returned by r
+	err error
+
+	inString bool
+	escaped  bool
+	// pending contains the rest of the replacement, which didn't fit the previous Read
+	pending string
+}
+
+func newNaNReader(r io.Reader) *nanReader {
+	return &nanReader{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// Read implements io.Reader interface
+func (nr *nanReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if nr.pending != "" {
+			m := copy(p[n:], nr.pending)
+			nr.pending = nr.pending[m:]
+			n += m
+			continue
+		}
+		if nr.err != nil {
+			break
+		}
+		c, err := nr.r.ReadByte()
+		if err != nil {
+			// the error is remembered, since bufio.Reader returns it only once
+			nr.err = err
+			break
+		}
+		switch {
+		case nr.escaped:
+			nr.escaped = false
+		case nr.inString:
+			if c == '\\' {
+				nr.escaped = true
+			} else if c == '"' {
+				nr.inString = false
+			}
+		case c == '"':
+			nr.inString = true
+		case c == 'N':
+			if next, _ := nr.r.Peek(2); string(next) == "aN" {
+				_, _ = nr.r.Discard(2)
+				nr.pending = "null"
+				continue
+			}
+		}
+		p[n] = c
+		n++
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return 0, nr.err
+}
+
+// decodeSeries decodes the response of /api/query from r while it is being read
+// and calls fn for every series in it. Unlike parseResponse, neither the response body
+// nor the whole dps object are held in memory, so wide series need less memory.
+// OtsdbMetric.Dps isn't set for the series passed to fn, since the order of points is used instead.
+func decodeSeries(r io.Reader, fn func(om *OtsdbMetric)) error {
+	nr := newNaNReader(r)
+	err := decodeSeriesInternal(json.NewDecoder(nr), fn)
+	if err == nil {
+		return nil
+	}
+	var de *decodeError
+	if errors.As(err, &de) {
+		return err
+	}
+	// the same as for parseResponse, only broken or incomplete bodies are retried
+	var se *json.SyntaxError
+	malformed := errors.As(err, &se) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		(nr.err != nil && nr.err != io.EOF)
+	return &decodeError{err: err, malformed: malformed}
+}
+
+func decodeSeriesInternal(dec *json.Decoder, fn func(om *OtsdbMetric)) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '[' {
+		return &decodeError{err: fmt.Errorf("expecting array of series; got %v", tok)}
+	}
+	for dec.More() {
+		var om OtsdbMetric
+		if err := decodeMetric(dec, &om); err != nil {
+			return err
+		}
+		fn(&om)
+	}
+	// the closing bracket
+	_, err = dec.Token()
+	return err
+}
+
+// decodeMetric decodes a single series of /api/query response from dec.
+// Fields are matched case-insensitively the same way as by json.Unmarshal.
+func decodeMetric(dec *json.Decoder, om *OtsdbMetric) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return &decodeError{err: fmt.Errorf("expecting series object; got %v", tok)}
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := tok.(string)
+		switch {
+		case strings.EqualFold(key, "dps"):
+			err = om.points.decode(dec)
+		case strings.EqualFold(key, "metric"):
+			err = dec.Decode(&om.Metric)
+		case strings.EqualFold(key, "tags"):
+			err = dec.Decode(&om.Tags)
+		case strings.EqualFold(key, "aggregateTags"):
+			err = dec.Decode(&om.AggregateTags)
+		case strings.EqualFold(key, "annotations"):
+			err = dec.Decode(&om.Annotations)
+		case strings.EqualFold(key, "globalAnnotations"):
+			err = dec.Decode(&om.GlobalAnnotations)
+		default:
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// the closing brace
+	_, err = dec.Token()
+	return err
+}
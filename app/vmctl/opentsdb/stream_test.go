@@ -0,0 +1,161 @@
+package opentsdb
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestNaNReader(t *testing.T) {
+	f := func(s string) {
+		t.Helper()
+		// read by one byte for checking NaN split between reads
+		got, err := io.ReadAll(iotest.OneByteReader(newNaNReader(strings.NewReader(s))))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if want := string(replaceNaN([]byte(s))); string(got) != want {
+			t.Fatalf("unexpected result %q; want %q", got, want)
+		}
+	}
+
+	f(``)
+	f(`{"1":1,"2":2}`)
+	f(`{"1":NaN,"2":NaN}`)
+	f(`{"1":"NaN","2":NaN}`)
+	f(`{"NaN\"NaN":NaN}`)
+	f(`{"a\\":NaN}`)
+	f(`[Na`)
+	f(`N`)
+}
+
+func TestDecodeSeries(t *testing.T) {
+	f := func(body string) {
+		t.Helper()
+		var want []OtsdbMetric
+		if err := parseResponse([]byte(body), &want); err != nil {
+			t.Fatalf("cannot parse response: %s", err)
+		}
+		var got []OtsdbMetric
+		err := decodeSeries(iotest.HalfReader(strings.NewReader(body)), func(om *OtsdbMetric) {
+			got = append(got, *om)
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("unexpected number of series %d; want %d", len(got), len(want))
+		}
+		for i := range want {
+			// Dps map isn't built by streaming decoding
+			want[i].Dps = nil
+			if !equalPoints(got[i].points, want[i].points) {
+				t.Fatalf("unexpected points %v; want %v", got[i].points, want[i].points)
+			}
+			got[i].points, want[i].points = nil, nil
+			if !reflect.DeepEqual(got[i], want[i]) {
+				t.Fatalf("unexpected series %+v; want %+v", got[i], want[i])
+			}
+		}
+	}
+
+	f(`[]`)
+	f(`null`)
+	f(`[{"metric":"cpu","tags":{"host":"h1"},"aggregateTags":[],"dps":{"1626019200":1.5,"1626019260":NaN,"1626019320":null,"1626019380":"NaN"}}]`)
+	// the order of points and fields is preserved, unknown fields are skipped
+	f(`[{"dps":{"3":3,"1":1,"1":2},"Metric":"cpu","query":{"index":0},"tags":{}}]`)
+	f(`[{"metric":"cpu","tags":{"host":"h1"},"dps":{}},{"metric":"cpu","tags":{"host":"h2"},"aggregateTags":["dc"],"dps":{"1":1}}]`)
+	f(`[{"metric":"cpu","dps":{"1":1},"annotations":[{"tsuid":"01","description":"deploy","startTime":1}],` +
+		`"globalAnnotations":[{"description":"outage","startTime":2,"endTime":3}]}]`)
+}
+
+func TestDecodeSeriesFailure(t *testing.T) {
+	f := func(body string, wantRetry bool) {
+		t.Helper()
+		err := decodeSeries(strings.NewReader(body), func(om *OtsdbMetric) {})
+		if err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		// the same as for parseResponse, only malformed responses must be retried
+		if IsDecodeError(err) != wantRetry {
+			t.Fatalf("unexpected retryable error %v; want retry: %v", err, wantRetry)
+		}
+	}
+
+	// truncated bodies
+	f(``, true)
+	f(`[`, true)
+	f(`[{"metric":"cpu","dps":{"1626019200":1,"16260`, true)
+	f(`[{"metric":"cpu"}`, true)
+	f(`[{"metric":"cpu","dps":{"1":1}}, foo]`, true)
+	// valid JSON of unexpected format
+	f(`{"error":{"code":400}}`, false)
+	f(`[1]`, false)
+	f(`[{"metric":1}]`, false)
+	f(`[{"dps":{"foo":1}}]`, false)
+}
+
+func TestClientGetDataBufferResponses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"metric":"cpu","tags":{"host":"h1"},"aggregateTags":[],` +
+			`"dps":{"1626019260":2,"1626019200":1,"1626019320":NaN}}]`))
+	}))
+	defer srv.Close()
+
+	var results []Metric
+	for _, buffer := range []bool{false, true} {
+		c, err := NewClient(Config{
+			Addr:            srv.URL,
+			RetryInterval:   time.Millisecond,
+			BufferResponses: buffer,
+		})
+		if err != nil {
+			t.Fatalf("cannot create client: %s", err)
+		}
+		rt := RetentionMeta{FirstOrder: "sum", SecondOrder: "avg", AggTime: "1m"}
+		data, err := c.GetData(context.Background(), Meta{Metric: "cpu", Tags: map[string]string{"host": "h1"}}, rt, 1626019200, 1626019400, false)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		results = append(results, data)
+	}
+	if !reflect.DeepEqual(results[0].Timestamps, []int64{1626019260000, 1626019200000, 1626019320000}) {
+		t.Fatalf("unexpected timestamps %v", results[0].Timestamps)
+	}
+	// streamed and buffered responses must be decoded the same way
+	if !reflect.DeepEqual(results[0].Timestamps, results[1].Timestamps) || !equalValues(results[0].Values, results[1].Values) {
+		t.Fatalf("streamed result %+v doesn't match buffered result %+v", results[0], results[1])
+	}
+}
+
+func equalPoints(a, b dataPoints) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].ts != b[i].ts || !equalValues([]float64{a[i].value}, []float64{b[i].value}) {
+			return false
+		}
+	}
+	return true
+}
+
+// equalValues compares values treating NaNs as equal
+func equalValues(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] && !(math.IsNaN(a[i]) && math.IsNaN(b[i])) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,216 @@
+package opentsdb
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/promrelabel"
+)
+
+// TagTransform defines how the metric name and tags of OpenTSDB series
+// are converted before the import. The zero value leaves series untouched.
+type TagTransform struct {
+	// Flatten contains tags, values of which are appended
+	// to the metric name in the given order instead of importing them as labels
+	Flatten []string
+	// Keep contains the only tags to import if non-empty
+	Keep map[string]struct{}
+	// Drop contains tags to remove before the import
+	Drop map[string]struct{}
+	// Relabel is optional and is used for rewriting metric names and tag keys
+	Relabel *RelabelConfig
+	// Renames maps OpenTSDB tag keys to VictoriaMetrics label names
+	Renames map[string]string
+	// SanitizeLabels defines whether to replace chars of tag keys
+	// which aren't allowed in Prometheus label names
+	SanitizeLabels bool
+}
+
+// Apply modifies m the way it is imported into VictoriaMetrics.
+// Tags are flattened, filtered, relabeled, renamed and sanitized in this order.
+func (tt *TagTransform) Apply(m *Metric) {
+	flattenTags(m, tt.Flatten)
+	tt.filterTags(m.Tags)
+	tt.Relabel.Apply(m)
+	m.Tags = renameTags(m.Tags, tt.Renames)
+	if tt.SanitizeLabels {
+		m.Tags = sanitizeLabelNames(m.Tags)
+	}
+}
+
+// filterTags removes tags from the given map according to
+// Keep and Drop sets. Empty Keep means all tags are kept.
+func (tt *TagTransform) filterTags(tags map[string]string) {
+	for k := range tags {
+		if _, ok := tt.Drop[k]; ok {
+			delete(tags, k)
+			continue
+		}
+		if len(tt.Keep) == 0 {
+			continue
+		}
+		if _, ok := tt.Keep[k]; !ok {
+			delete(tags, k)
+		}
+	}
+}
+
+// NewTagSet returns the set of the given tags or nil if tags are empty
+func NewTagSet(tags []string) map[string]struct{} {
+	if len(tags) == 0 {
+		return nil
+	}
+	m := make(map[string]struct{}, len(tags))
+	for _, t := range tags {
+		m[t] = struct{}{}
+	}
+	return m
+}
+
+// ParseTagRenames parses the list of renames in old=new format
+func ParseTagRenames(renames []string) (map[string]string, error) {
+	if len(renames) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]string, len(renames))
+	for _, r := range renames {
+		from, to, ok := strings.Cut(r, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("cannot parse tag rename %q: it must be in old=new format", r)
+		}
+		if _, ok := m[from]; ok {
+			return nil, fmt.Errorf("duplicate rename for tag %q", from)
+		}
+		m[from] = to
+	}
+	return m, nil
+}
+
+// renameTags renames tag keys according to renames.
+// The renamed tag overrides the tag which already has the new name.
+func renameTags(tags, renames map[string]string) map[string]string {
+	if len(renames) == 0 {
+		return tags
+	}
+	result := make(map[string]string, len(tags))
+	for k, v := range tags {
+		if _, ok := renames[k]; ok {
+			continue
+		}
+		result[k] = v
+	}
+	for k, v := range tags {
+		if to, ok := renames[k]; ok {
+			result[to] = v
+		}
+	}
+	return result
+}
+
+// sanitizeLabelNames replaces chars of tag keys which aren't allowed
+// in Prometheus label names with underscores.
+// If the sanitized key clashes with another key, the tag with valid key is kept,
+// otherwise the tag which key is the first in lexicographical order.
+func sanitizeLabelNames(tags map[string]string) map[string]string {
+	var invalid []string
+	for k := range tags {
+		if SanitizeLabelName(k) != k {
+			invalid = append(invalid, k)
+		}
+	}
+	if len(invalid) == 0 {
+		return tags
+	}
+	sort.Strings(invalid)
+	for _, k := range invalid {
+		v := tags[k]
+		delete(tags, k)
+		name := SanitizeLabelName(k)
+		if _, ok := tags[name]; ok {
+			continue
+		}
+		tags[name] = v
+	}
+	return tags
+}
+
+// SanitizeLabelName returns valid Prometheus label name for name.
+// Tag keys returned by Client are already sanitized the same way as metric names,
+// while label names additionally can't contain colons and start with a digit.
+func SanitizeLabelName(name string) string {
+	name = strings.ReplaceAll(promrelabel.SanitizeName(name), ":", "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// ValueTransform converts values via value*Scale+Offset
+type ValueTransform struct {
+	Scale  float64
+	Offset float64
+}
+
+// Apply transforms values in place. NaN and Inf values are left untouched
+func (vt ValueTransform) Apply(values []float64) {
+	for i, v := range values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		values[i] = v*vt.Scale + vt.Offset
+	}
+}
+
+// ValueTransforms maps OpenTSDB metric names to transforms of their values.
+// The transform for * key is applied to the rest of metrics
+type ValueTransforms map[string]ValueTransform
+
+// Get returns the transform for the values of the given OpenTSDB metric
+func (vts ValueTransforms) Get(metric string) (ValueTransform, bool) {
+	if len(vts) == 0 {
+		return ValueTransform{}, false
+	}
+	if vt, ok := vts[metric]; ok {
+		return vt, true
+	}
+	vt, ok := vts["*"]
+	return vt, ok
+}
+
+// ParseValueTransforms parses the list of value transforms in metric=scale[,offset] format.
+// The metric may be set to * for transforming values of the rest of metrics.
+func ParseValueTransforms(list []string) (ValueTransforms, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	m := make(ValueTransforms, len(list))
+	for _, s := range list {
+		metric, spec, ok := strings.Cut(s, "=")
+		metric, spec = strings.TrimSpace(metric), strings.TrimSpace(spec)
+		if !ok || metric == "" || spec == "" {
+			return nil, fmt.Errorf("cannot parse value transform %q: it must be in metric=scale[,offset] format", s)
+		}
+		scaleStr, offsetStr, hasOffset := strings.Cut(spec, ",")
+		vt := ValueTransform{}
+		var err error
+		vt.Scale, err = strconv.ParseFloat(strings.TrimSpace(scaleStr), 64)
+		if err != nil || math.IsNaN(vt.Scale) || math.IsInf(vt.Scale, 0) || vt.Scale == 0 {
+			return nil, fmt.Errorf("cannot parse value transform %q: scale must be a non-zero number", s)
+		}
+		if hasOffset {
+			vt.Offset, err = strconv.ParseFloat(strings.TrimSpace(offsetStr), 64)
+			if err != nil || math.IsNaN(vt.Offset) || math.IsInf(vt.Offset, 0) {
+				return nil, fmt.Errorf("cannot parse value transform %q: offset must be a number", s)
+			}
+		}
+		if _, ok := m[metric]; ok {
+			return nil, fmt.Errorf("duplicate value transform for metric %q", metric)
+		}
+		m[metric] = vt
+	}
+	return m, nil
+}
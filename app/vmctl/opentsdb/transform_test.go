@@ -0,0 +1,146 @@
+package opentsdb
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestTagTransformFilterTags(t *testing.T) {
+	f := func(keep, drop []string, tags, want map[string]string) {
+		t.Helper()
+		tt := &TagTransform{
+			Keep: NewTagSet(keep),
+			Drop: NewTagSet(drop),
+		}
+		tt.filterTags(tags)
+		if !reflect.DeepEqual(tags, want) {
+			t.Fatalf("unexpected tags %v; want %v", tags, want)
+		}
+	}
+
+	tags := func() map[string]string {
+		return map[string]string{"host": "h1", "dc": "eu", "type": "user"}
+	}
+	// no filters
+	f(nil, nil, tags(), tags())
+	f(nil, []string{"host"}, tags(), map[string]string{"dc": "eu", "type": "user"})
+	f([]string{"host", "type"}, nil, tags(), map[string]string{"host": "h1", "type": "user"})
+	// drop wins over keep
+	f([]string{"host", "type"}, []string{"host"}, tags(), map[string]string{"type": "user"})
+	// missing tags are ignored
+	f([]string{"foo"}, []string{"bar"}, tags(), map[string]string{})
+}
+
+func TestParseTagRenames(t *testing.T) {
+	f := func(renames []string, want map[string]string, wantErr bool) {
+		t.Helper()
+		got, err := ParseTagRenames(renames)
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error: %v; wantErr: %v", err, wantErr)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected renames %v; want %v", got, want)
+		}
+	}
+	f(nil, nil, false)
+	f([]string{"fqdn=instance", " dc = region "}, map[string]string{"fqdn": "instance", "dc": "region"}, false)
+	f([]string{"fqdn"}, nil, true)
+	f([]string{"=instance"}, nil, true)
+	f([]string{"fqdn="}, nil, true)
+	f([]string{"fqdn=instance", "fqdn=host"}, nil, true)
+}
+
+func TestRenameTags(t *testing.T) {
+	f := func(tags, renames, want map[string]string) {
+		t.Helper()
+		if got := renameTags(tags, renames); !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected tags %v; want %v", got, want)
+		}
+	}
+	f(map[string]string{"host": "h1"}, nil, map[string]string{"host": "h1"})
+	f(map[string]string{"fqdn": "h1", "dc": "eu"}, map[string]string{"fqdn": "instance"},
+		map[string]string{"instance": "h1", "dc": "eu"})
+	// the renamed tag overrides the existing one
+	f(map[string]string{"fqdn": "h1", "instance": "i1"}, map[string]string{"fqdn": "instance"},
+		map[string]string{"instance": "h1"})
+	// tags can be swapped
+	f(map[string]string{"a": "1", "b": "2"}, map[string]string{"a": "b", "b": "a"},
+		map[string]string{"a": "2", "b": "1"})
+}
+
+func TestSanitizeLabelNames(t *testing.T) {
+	f := func(tags, want map[string]string) {
+		t.Helper()
+		if got := sanitizeLabelNames(tags); !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected tags %v; want %v", got, want)
+		}
+	}
+	f(map[string]string{"host": "h1", "_dc": "eu"}, map[string]string{"host": "h1", "_dc": "eu"})
+	// illegal chars
+	f(map[string]string{"rack:id": "r1", "dc-name": "eu", "a.b/c": "v"},
+		map[string]string{"rack_id": "r1", "dc_name": "eu", "a_b_c": "v"})
+	// leading digit
+	f(map[string]string{"1host": "h1"}, map[string]string{"_1host": "h1"})
+	// unicode chars are replaced one by one, while values are kept as is
+	f(map[string]string{"höst": "wörld", "日本": "v"}, map[string]string{"h_st": "wörld", "__": "v"})
+	// valid key wins the clash with sanitized key
+	f(map[string]string{"dc_name": "valid", "dc-name": "invalid"}, map[string]string{"dc_name": "valid"})
+	// the first key in lexicographical order wins the clash between sanitized keys
+	f(map[string]string{"dc:name": "colon", "dc-name": "dash"}, map[string]string{"dc_name": "dash"})
+}
+
+func TestParseValueTransforms(t *testing.T) {
+	f := func(list []string, want ValueTransforms, wantErr bool) {
+		t.Helper()
+		got, err := ParseValueTransforms(list)
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error: %v; wantErr: %v", err, wantErr)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected transforms %v; want %v", got, want)
+		}
+	}
+	f(nil, nil, false)
+	f([]string{"sys.temp=0.5,-10", " * = 1e-3 "}, ValueTransforms{
+		"sys.temp": {Scale: 0.5, Offset: -10},
+		"*":        {Scale: 1e-3},
+	}, false)
+	f([]string{"sys.temp"}, nil, true)
+	f([]string{"=2"}, nil, true)
+	f([]string{"sys.temp="}, nil, true)
+	f([]string{"sys.temp=foo"}, nil, true)
+	f([]string{"sys.temp=0"}, nil, true)
+	f([]string{"sys.temp=NaN"}, nil, true)
+	f([]string{"sys.temp=2,"}, nil, true)
+	f([]string{"sys.temp=2,Inf"}, nil, true)
+	f([]string{"sys.temp=2", "sys.temp=3"}, nil, true)
+}
+
+func TestValueTransformsGet(t *testing.T) {
+	vts := ValueTransforms{
+		"sys.temp": {Scale: 2, Offset: 1},
+		"*":        {Scale: 10},
+	}
+	f := func(metric string, values, want []float64) {
+		t.Helper()
+		if vt, ok := vts.Get(metric); ok {
+			vt.Apply(values)
+		}
+		for i := range values {
+			if values[i] != want[i] && !(math.IsNaN(values[i]) && math.IsNaN(want[i])) {
+				t.Fatalf("unexpected values %v; want %v", values, want)
+			}
+		}
+	}
+
+	nan, inf := math.NaN(), math.Inf(1)
+	f("sys.temp", []float64{0, 1.5, -2}, []float64{1, 4, -3})
+	// NaN and Inf values are left untouched
+	f("sys.temp", []float64{nan, inf, -inf, 1}, []float64{nan, inf, -inf, 3})
+	// the rest of metrics are transformed with *
+	f("sys.load", []float64{1, 2}, []float64{10, 20})
+
+	vts = ValueTransforms{"sys.temp": {Scale: 2}}
+	f("sys.load", []float64{1, 2}, []float64{1, 2})
+}
@@ -0,0 +1,91 @@
+package opentsdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Supported strategies of metrics discovery.
+const (
+	// DiscoverySuggest discovers metrics via /api/suggest.
+	// It is fast, but OpenTSDB truncates the results to tsd.core.suggest.max_results
+	// and the Limit, so metrics may be missed on huge installs
+	DiscoverySuggest = "suggest"
+	// DiscoveryUIDMeta discovers metrics via /api/search/uidmeta, which enumerates
+	// UID meta of metrics page by page. It requires a search plugin in OpenTSDB
+	DiscoveryUIDMeta = "uidmeta"
+)
+
+func checkDiscovery(discovery string) error {
+	switch discovery {
+	case DiscoverySuggest, DiscoveryUIDMeta:
+		return nil
+	default:
+		return fmt.Errorf("unsupported discovery %q; supported values are: %s, %s",
+			discovery, DiscoverySuggest, DiscoveryUIDMeta)
+	}
+}
+
+// uidMetaPageSize is the number of UID meta objects requested per page.
+// Search plugins usually limit the size of a single page, e.g. Elasticsearch
+// doesn't return more than 10000 results, so the default Limit can't be used
+const uidMetaPageSize = 1000
+
+// uidMetaResults is the response of /api/search/uidmeta.
+// See http://opentsdb.net/docs/build/html/api_http/search/index.html
+type uidMetaResults struct {
+	StartIndex   int       `json:"startIndex"`
+	TotalResults int       `json:"totalResults"`
+	Results      []uidMeta `json:"results"`
+}
+
+// uidMeta is UID meta object of a metric, tag key or tag value.
+// See http://opentsdb.net/docs/build/html/user_guide/metadata.html
+type uidMeta struct {
+	UID  string `json:"uid"`
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// FindMetricsUIDMeta discovers all the metrics with the given prefix via /api/search/uidmeta.
+// Unlike FindMetrics, the results aren't truncated, since they are requested
+// page by page until all of them are fetched.
+func (c *Client) FindMetricsUIDMeta(ctx context.Context, prefix string) ([]string, error) {
+	seen := make(map[string]struct{})
+	var metrics []string
+	startIndex := 0
+	for {
+		q := fmt.Sprintf("/api/search/uidmeta?query=%s&limit=%d&start_index=%d",
+			url.QueryEscape("name:"+prefix+"*"), uidMetaPageSize, startIndex)
+		body, err := c.get(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		var results uidMetaResults
+		if err := json.Unmarshal(body, &results); err != nil {
+			return nil, fmt.Errorf("failed to read response from %q: %s", q, err)
+		}
+		for _, m := range results.Results {
+			// the query matches tag keys and values as well,
+			// while the search plugin may match the prefix loosely
+			if !strings.EqualFold(m.Type, "METRIC") || !strings.HasPrefix(m.Name, prefix) {
+				continue
+			}
+			if _, ok := seen[m.Name]; ok {
+				continue
+			}
+			seen[m.Name] = struct{}{}
+			metrics = append(metrics, m.Name)
+		}
+		startIndex += len(results.Results)
+		if len(results.Results) == 0 || startIndex >= results.TotalResults {
+			break
+		}
+	}
+	sort.Strings(metrics)
+	return metrics, nil
+}
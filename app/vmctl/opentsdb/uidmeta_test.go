@@ -0,0 +1,84 @@
+package opentsdb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestClientFindMetricsUIDMeta(t *testing.T) {
+	// more metrics than a single page for checking the pagination
+	var all []uidMeta
+	for i := 0; i < uidMetaPageSize+10; i++ {
+		all = append(all, uidMeta{Type: "METRIC", Name: "sys.m" + strconv.Itoa(i)})
+	}
+	all = append(all,
+		uidMeta{Type: "TAGK", Name: "sys.host"},
+		uidMeta{Type: "METRIC", Name: "net.bytes"},
+		// the same metric may be returned on different pages
+		uidMeta{Type: "METRIC", Name: "sys.m0"},
+	)
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/search/uidmeta" {
+			t.Errorf("unexpected request to %q", r.URL.Path)
+			return
+		}
+		requests++
+		if q := r.URL.Query().Get("query"); q != "name:sys*" {
+			t.Errorf("unexpected query %q", q)
+		}
+		start, _ := strconv.Atoi(r.URL.Query().Get("start_index"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		end := start + limit
+		if end > len(all) {
+			end = len(all)
+		}
+		_ = json.NewEncoder(w).Encode(uidMetaResults{
+			StartIndex:   start,
+			TotalResults: len(all),
+			Results:      all[start:end],
+		})
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(Config{Addr: srv.URL, Discovery: DiscoveryUIDMeta})
+	if err != nil {
+		t.Fatalf("cannot create client: %s", err)
+	}
+	metrics, err := c.FindMetricsUIDMeta(context.Background(), "sys")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if requests != 2 {
+		t.Fatalf("unexpected number of requests %d; want 2", requests)
+	}
+	if len(metrics) != uidMetaPageSize+10 {
+		t.Fatalf("unexpected number of metrics %d; want %d", len(metrics), uidMetaPageSize+10)
+	}
+	if !reflect.DeepEqual(metrics[:3], []string{"sys.m0", "sys.m1", "sys.m10"}) {
+		t.Fatalf("metrics must be sorted; got %q", metrics[:3])
+	}
+}
+
+func TestNewClientDiscovery(t *testing.T) {
+	f := func(cfg Config, want string, wantErr bool) {
+		t.Helper()
+		c, err := NewClient(cfg)
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err == nil && c.Discovery != want {
+			t.Fatalf("unexpected discovery %q; want %q", c.Discovery, want)
+		}
+	}
+
+	f(Config{}, DiscoverySuggest, false)
+	f(Config{Discovery: DiscoveryUIDMeta}, DiscoveryUIDMeta, false)
+	f(Config{Discovery: "tsmeta"}, "", true)
+	f(Config{Discovery: DiscoveryUIDMeta, UseLookup: true, LookupTags: []string{"dc=eu"}}, "", true)
+}
@@ -0,0 +1,173 @@
+package opentsdb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Verifier compares the number of samples of a random sample
+// of the imported series in OpenTSDB and in the destination.
+// Series are sampled uniformly from all the added series via reservoir sampling.
+// Verifier is safe for concurrent use.
+type Verifier struct {
+	// sample is the number of series to verify
+	sample int
+	// tolerance is the allowed relative difference
+	// between the number of samples
+	tolerance float64
+	// delay is the time to wait before verification
+	// for the imported data becoming searchable
+	delay time.Duration
+
+	mu     sync.Mutex
+	seen   int
+	rnd    *rand.Rand
+	series []Meta
+}
+
+// NewVerifier returns Verifier for the given number of series
+func NewVerifier(sample int, tolerance float64, delay time.Duration) *Verifier {
+	return &Verifier{
+		sample:    sample,
+		tolerance: tolerance,
+		delay:     delay,
+		rnd:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Add offers series to the sample
+func (v *Verifier) Add(series []Meta) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, s := range series {
+		v.seen++
+		if len(v.series) < v.sample {
+			v.series = append(v.series, s)
+			continue
+		}
+		if i := v.rnd.Intn(v.seen); i < v.sample {
+			v.series[i] = s
+		}
+	}
+}
+
+// Series returns the sampled series
+func (v *Verifier) Series() []Meta {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return append([]Meta(nil), v.series...)
+}
+
+// Reset drops the sampled series, so the next run is sampled from scratch
+func (v *Verifier) Reset() {
+	v.mu.Lock()
+	v.seen = 0
+	v.series = nil
+	v.mu.Unlock()
+}
+
+// CountFunc returns the selector of the given series in the destination
+// and the number of its samples there on the time range [start, end]
+type CountFunc func(ctx context.Context, series Meta, start, end time.Time) (string, int, error)
+
+// Run compares the number of samples in OpenTSDB and the destination
+// for the sampled series on the first query range of the first retention
+// of the run started at startTime. keepNaN defines whether NaN values
+// returned by OpenTSDB were imported.
+// An error is returned if mismatches beyond the configured tolerance are found.
+func (v *Verifier) Run(ctx context.Context, c *Client, startTime int64, keepNaN bool, count CountFunc) error {
+	series := v.Series()
+	if len(series) < 1 || len(c.Retentions) < 1 || len(c.Retentions[0].QueryRanges) < 1 {
+		log.Println("Nothing to verify")
+		return nil
+	}
+	if v.delay > 0 {
+		log.Printf("Waiting %s before verification for the imported data becoming searchable", v.delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(v.delay):
+		}
+	}
+	tr, ok := c.ClampRange(startTime, c.Retentions[0].QueryRanges[0])
+	if !ok {
+		log.Println("Nothing to verify: the first query range is after the hard end timestamp")
+		return nil
+	}
+	start, end := startTime-tr.Start, startTime-tr.End
+	log.Printf("Verifying %d series on time range [%s, %s]",
+		len(series), c.ToTime(start).UTC().Format(time.RFC3339), c.ToTime(end).UTC().Format(time.RFC3339))
+	var mismatches int
+	for _, s := range series {
+		otsdbCount, err := c.CountSamples(ctx, s, startTime, start, end, keepNaN)
+		if err != nil {
+			return fmt.Errorf("verification failed: %s", err)
+		}
+		selector, vmCount, err := count(ctx, s, c.ToTime(start), c.ToTime(end))
+		if err != nil {
+			return fmt.Errorf("verification failed: %s", err)
+		}
+		if math.Abs(float64(vmCount-otsdbCount)) > v.tolerance*float64(otsdbCount) {
+			mismatches++
+			log.Printf("Verification mismatch for %s: OpenTSDB samples: %d; VictoriaMetrics samples: %d",
+				selector, otsdbCount, vmCount)
+		}
+	}
+	if mismatches > 0 {
+		return fmt.Errorf("verification failed for %d out of %d series", mismatches, len(series))
+	}
+	log.Printf("Verification finished! All %d series match", len(series))
+	return nil
+}
+
+// CountSamples returns the number of unique timestamps of the given series
+// returned by OpenTSDB for all the retentions on the time range [start, end]
+// of the run started at startTime. NaN values are counted only if keepNaN is set,
+// the same way they are imported.
+func (c *Client) CountSamples(ctx context.Context, series Meta, startTime, start, end int64, keepNaN bool) (int, error) {
+	timestamps := make(map[int64]struct{})
+	for _, rt := range c.MetricRetentions(series.Metric) {
+		if len(rt.QueryRanges) < 1 {
+			continue
+		}
+		// retentions may cover different time ranges,
+		// so the window is limited by the time range imported for rt
+		rtStart, rtEnd := start, end
+		covStart, covEnd := startTime-rt.QueryRanges[0].Start, startTime-rt.QueryRanges[0].End
+		for _, tr := range rt.QueryRanges[1:] {
+			if s := startTime - tr.Start; s < covStart {
+				covStart = s
+			}
+			if e := startTime - tr.End; e > covEnd {
+				covEnd = e
+			}
+		}
+		if covStart > rtStart {
+			rtStart = covStart
+		}
+		if covEnd < rtEnd {
+			rtEnd = covEnd
+		}
+		if rtStart > rtEnd {
+			continue
+		}
+		data, err := c.GetData(ctx, series, RetentionMeta{
+			FirstOrder: rt.FirstOrder, SecondOrder: rt.SecondOrder, AggTime: rt.AggTime,
+		}, rtStart, rtEnd, c.MsecsTime)
+		if err != nil {
+			return 0, fmt.Errorf("cannot fetch data for %v from OpenTSDB: %w", series, err)
+		}
+		for i, ts := range data.Timestamps {
+			if !keepNaN && math.IsNaN(data.Values[i]) {
+				continue
+			}
+			timestamps[ts] = struct{}{}
+		}
+	}
+	return len(timestamps), nil
+}
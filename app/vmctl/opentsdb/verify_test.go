@@ -0,0 +1,20 @@
+package opentsdb
+
+import (
+	"testing"
+)
+
+func TestVerifierSample(t *testing.T) {
+	v := NewVerifier(3, 0, 0)
+	for i := 0; i < 10; i++ {
+		v.Add([]Meta{{Metric: "foo"}, {Metric: "bar"}})
+	}
+	if n := len(v.Series()); n != 3 {
+		t.Fatalf("unexpected number of sampled series %d; want %d", n, 3)
+	}
+	v.Reset()
+	v.Add([]Meta{{Metric: "foo"}})
+	if n := len(v.Series()); n != 1 {
+		t.Fatalf("unexpected number of sampled series %d; want %d", n, 1)
+	}
+}
@@ -0,0 +1,2598 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/opentsdb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/vm"
+	"github.com/urfave/cli/v2"
+)
+
+// fakeOtsdbServer imitates OpenTSDB metric and series discovery APIs
+// and returns the same datapoints for every data query.
+type fakeOtsdbServer struct {
+	*httptest.Server
+	// series contains the list of series per metric
+	series map[string][]opentsdb.Meta
+	// dps contains datapoints returned for every series
+	dps map[int64]float64
+
+	queries uint64
+	// onQuery is optional and is called on every data query
+	onQuery func(r *http.Request)
+	// failMetrics contains metrics, data queries for which fail with 400 status code
+	failMetrics map[string]bool
+	// truncateMetrics contains metrics, responses to data queries for which are truncated
+	truncateMetrics map[string]bool
+	// annotations are returned for every series
+	annotations []opentsdb.Annotation
+	// globalAnnotations are returned if global_annotations query arg is set
+	globalAnnotations []opentsdb.Annotation
+}
+
+// testTS is the timestamp in seconds of the data returned by fakeOtsdbServer
+const testTS = 1626019200
+
+func newFakeOtsdbServer(t *testing.T, series map[string][]opentsdb.Meta, dps map[int64]float64) *fakeOtsdbServer {
+	t.Helper()
+	fs := &fakeOtsdbServer{series: series, dps: dps}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/suggest", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query().Get("q")
+		metrics := make([]string, 0)
+		for m := range fs.series {
+			if strings.HasPrefix(m, q) {
+				metrics = append(metrics, m)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(metrics)
+	})
+	mux.HandleFunc("/api/search/lookup", func(w http.ResponseWriter, r *http.Request) {
+		m := r.URL.Query().Get("m")
+		_ = json.NewEncoder(w).Encode(opentsdb.MetaResults{Type: "LOOKUP", Results: fs.series[m]})
+	})
+	mux.HandleFunc("/api/query", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&fs.queries, 1)
+		if fs.onQuery != nil {
+			fs.onQuery(r)
+		}
+		// m=sum:1m-avg-none:metric{tag=value,...}
+		m := r.URL.Query().Get("m")
+		n := strings.LastIndex(m, ":")
+		name, tagStr := m[n+1:], ""
+		if i := strings.IndexByte(name, '{'); i >= 0 {
+			name, tagStr = name[:i], strings.Trim(name[i:], "{}")
+		}
+		if fs.failMetrics[name] {
+			http.Error(w, "cannot serve the query", http.StatusBadRequest)
+			return
+		}
+		tags := make(map[string]string)
+		for _, kv := range strings.Split(tagStr, ",") {
+			if k, v, ok := strings.Cut(kv, "="); ok {
+				tags[k] = v
+			}
+		}
+		om := opentsdb.OtsdbMetric{Metric: name, Tags: tags, Dps: fs.dps, Annotations: fs.annotations}
+		if r.URL.Query().Get("global_annotations") == "true" {
+			om.GlobalAnnotations = fs.globalAnnotations
+		}
+		data, _ := json.Marshal([]opentsdb.OtsdbMetric{om})
+		if fs.truncateMetrics[name] {
+			data = data[:len(data)/2]
+		}
+		_, _ = w.Write(data)
+	})
+	fs.Server = httptest.NewServer(mux)
+	return fs
+}
+
+func (fs *fakeOtsdbServer) queriesCount() uint64 {
+	return atomic.LoadUint64(&fs.queries)
+}
+
+// fakeVMServer imitates VictoriaMetrics import and export APIs
+// and counts the number of imported series.
+type fakeVMServer struct {
+	*httptest.Server
+
+	series uint64
+	// exportTimestamps contains timestamps returned
+	// for every series matching export query
+	exportTimestamps []int64
+	// failImport defines whether import requests fail with 400 status code
+	failImport bool
+}
+
+func newFakeVMServer(t *testing.T) *fakeVMServer {
+	t.Helper()
+	fs := &fakeVMServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/api/v1/import", func(w http.ResponseWriter, r *http.Request) {
+		if fs.failImport {
+			http.Error(w, "cannot parse the data", http.StatusBadRequest)
+			return
+		}
+		sc := bufio.NewScanner(r.Body)
+		for sc.Scan() {
+			if len(sc.Bytes()) > 0 {
+				atomic.AddUint64(&fs.series, 1)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/api/v1/export", func(w http.ResponseWriter, r *http.Request) {
+		// {k1="v1",k2="v2",...}
+		match := strings.Trim(r.URL.Query().Get("match[]"), "{}")
+		metric := make(map[string]string)
+		for _, kv := range strings.Split(match, ",") {
+			if k, v, ok := strings.Cut(kv, "="); ok {
+				metric[k] = strings.Trim(v, `"`)
+			}
+		}
+		values := make([]float64, len(fs.exportTimestamps))
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"metric":     metric,
+			"values":     values,
+			"timestamps": fs.exportTimestamps,
+		})
+	})
+	fs.Server = httptest.NewServer(mux)
+	return fs
+}
+
+func (fs *fakeVMServer) seriesCount() uint64 {
+	return atomic.LoadUint64(&fs.series)
+}
+
+func TestOtsdbProcessorDryRun(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.cpu": {
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host1"}},
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host2"}},
+		},
+		"sys.mem": {
+			{Metric: "sys.mem", Tags: map[string]string{"host": "host1"}},
+		},
+	}
+	srv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+	defer srv.Close()
+
+	oc, err := opentsdb.NewClient(opentsdb.Config{
+		Addr:       srv.URL,
+		Limit:      100,
+		Retentions: []string{"sum-1m-avg:1h:1d"},
+		Filters:    []string{"sys"},
+	})
+	if err != nil {
+		t.Fatalf("cannot create OpenTSDB client: %s", err)
+	}
+	op := &otsdbProcessor{
+		oc:     oc,
+		dryRun: true,
+	}
+	// importer isn't set, so any attempt to import data would panic
+	if err := op.run(context.Background(), true, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := srv.queriesCount(); n > 0 {
+		t.Fatalf("dry run must not perform data queries; got %d queries", n)
+	}
+}
+
+func TestOtsdbProcessorNoImport(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.cpu": {
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host1"}},
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host2"}},
+		},
+	}
+	otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1, testTS + 60: 2})
+	defer otsdbSrv.Close()
+	vmSrv := newFakeVMServer(t)
+	defer vmSrv.Close()
+
+	oc, err := opentsdb.NewClient(opentsdb.Config{
+		Addr:       otsdbSrv.URL,
+		Limit:      100,
+		Retentions: []string{"sum-1m-avg:1h:1d"},
+		Filters:    []string{"sys"},
+	})
+	if err != nil {
+		t.Fatalf("cannot create OpenTSDB client: %s", err)
+	}
+	// VictoriaMetrics isn't required to be available
+	if _, err := vm.NewImporter(context.Background(), vm.Config{
+		Addr:        "http://127.0.0.1:1",
+		Concurrency: 1,
+		NoImport:    true,
+	}); err != nil {
+		t.Fatalf("unexpected error for unavailable VictoriaMetrics: %s", err)
+	}
+	im, err := vm.NewImporter(context.Background(), vm.Config{
+		Addr:               vmSrv.URL,
+		Concurrency:        1,
+		DisableProgressBar: true,
+		NoImport:           true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	op := &otsdbProcessor{oc: oc, im: im, noImport: true}
+	if err := op.run(context.Background(), true, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	queries := uint64(len(series["sys.cpu"]) * len(oc.Retentions[0].QueryRanges))
+	if n := otsdbSrv.queriesCount(); n != queries {
+		t.Fatalf("unexpected number of data queries %d; want %d", n, queries)
+	}
+	if n := atomic.LoadUint64(&op.samples); n != 2*queries {
+		t.Fatalf("unexpected number of read samples %d; want %d", n, 2*queries)
+	}
+	if n := atomic.LoadUint64(&op.readSeries); n != queries {
+		t.Fatalf("unexpected number of read series %d; want %d", n, queries)
+	}
+	if n := vmSrv.seriesCount(); n > 0 {
+		t.Fatalf("no data must be imported; got %d series", n)
+	}
+	if r := op.buildReport(nil, time.Now()); r.Samples != 2*queries || r.Series != queries {
+		t.Fatalf("unexpected report totals: %d samples, %d series", r.Samples, r.Series)
+	}
+}
+
+func TestOtsdbProcessorStateFile(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.cpu": {
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host1"}},
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host2"}},
+		},
+		"sys.mem": {
+			{Metric: "sys.mem", Tags: map[string]string{"host": "host1"}},
+		},
+	}
+	otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+	defer otsdbSrv.Close()
+	var mu sync.Mutex
+	var starts []string
+	otsdbSrv.onQuery = func(r *http.Request) {
+		mu.Lock()
+		starts = append(starts, r.URL.Query().Get("start"))
+		mu.Unlock()
+	}
+	vmSrv := newFakeVMServer(t)
+	defer vmSrv.Close()
+
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	// the start timestamp is fixed for predictable query ranges
+	hardTS := int64(testTS + 3600)
+	run := func() int {
+		t.Helper()
+		oc, err := opentsdb.NewClient(opentsdb.Config{
+			Addr:       otsdbSrv.URL,
+			Limit:      100,
+			Retentions: []string{"sum-1m-avg:1h:1d"},
+			Filters:    []string{"sys"},
+			HardTS:     hardTS,
+			Strict:     true,
+		})
+		if err != nil {
+			t.Fatalf("cannot create OpenTSDB client: %s", err)
+		}
+		im, err := vm.NewImporter(context.Background(), vm.Config{
+			Addr:               vmSrv.URL,
+			Concurrency:        1,
+			DisableProgressBar: true,
+		})
+		if err != nil {
+			t.Fatalf("cannot create importer: %s", err)
+		}
+		state, err := opentsdb.LoadState(statePath)
+		if err != nil {
+			t.Fatalf("cannot load state: %s", err)
+		}
+		op := &otsdbProcessor{oc: oc, im: im, state: opentsdb.NewStateTracker(state, 5*time.Minute, oc.MsecsTime), skipErrors: true}
+		if err := op.run(context.Background(), true, false); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return len(oc.Retentions[0].QueryRanges)
+	}
+
+	// queries of sys.mem fail, so its watermark mustn't be recorded
+	otsdbSrv.failMetrics = map[string]bool{"sys.mem": true}
+	ranges := run()
+	if n, want := len(starts), 3*ranges; n != want {
+		t.Fatalf("unexpected number of queries on the first run %d; want %d", n, want)
+	}
+	state, err := opentsdb.LoadState(statePath)
+	if err != nil {
+		t.Fatalf("cannot load state: %s", err)
+	}
+	if wm, ok := state.Watermark("sys.cpu"); !ok || wm != hardTS*1e3 {
+		t.Fatalf("unexpected watermark of sys.cpu %d; want %d", wm, hardTS*1e3)
+	}
+	if _, ok := state.Watermark("sys.mem"); ok {
+		t.Fatalf("watermark of sys.mem with failed queries mustn't be recorded")
+	}
+
+	// the next run fetches sys.cpu starting from the watermark minus overlap
+	// and the whole time range of sys.mem
+	otsdbSrv.failMetrics = nil
+	starts = nil
+	run()
+	if n, want := len(starts), 2+ranges; n != want {
+		t.Fatalf("unexpected number of queries on the second run %d; want %d", n, want)
+	}
+	var overlapped int
+	for _, start := range starts {
+		if start == strconv.FormatInt(hardTS-300, 10) {
+			overlapped++
+		}
+	}
+	if overlapped != 2 {
+		t.Fatalf("expecting 2 queries starting at the watermark minus overlap; got %d in %q", overlapped, starts)
+	}
+	state, err = opentsdb.LoadState(statePath)
+	if err != nil {
+		t.Fatalf("cannot load state: %s", err)
+	}
+	if _, ok := state.Watermark("sys.mem"); !ok {
+		t.Fatalf("watermark of sys.mem must be recorded after the successful run")
+	}
+}
+
+func TestOtsdbProcessorFollow(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.cpu": {
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host1"}},
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host2"}},
+		},
+	}
+	otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+	defer otsdbSrv.Close()
+	vmSrv := newFakeVMServer(t)
+	defer vmSrv.Close()
+
+	oc, err := opentsdb.NewClient(opentsdb.Config{
+		Addr:       otsdbSrv.URL,
+		Limit:      100,
+		Retentions: []string{"sum-1m-avg:1h:1d"},
+		Filters:    []string{"sys"},
+		// the start timestamp is fixed for predictable query ranges
+		HardTS: testTS + 3600,
+	})
+	if err != nil {
+		t.Fatalf("cannot create OpenTSDB client: %s", err)
+	}
+	vmCfg := vm.Config{
+		Addr:               vmSrv.URL,
+		Concurrency:        1,
+		DisableProgressBar: true,
+	}
+	im, err := vm.NewImporter(context.Background(), vmCfg)
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var importers int
+	newImporter := func() (seriesSink, error) {
+		importers++
+		if importers == 3 {
+			// stop following after the backfill and two runs for new data
+			cancel()
+		}
+		return vm.NewImporter(context.Background(), vmCfg)
+	}
+	op := &otsdbProcessor{oc: oc, im: im, state: opentsdb.NewStateTracker(opentsdb.NewState(), 5*time.Minute, oc.MsecsTime)}
+	if err := op.follow(ctx, 10*time.Millisecond, newImporter, true, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// the runs for new data fetch only the latest query range of every series
+	backfill := uint64(len(series["sys.cpu"]) * len(oc.Retentions[0].QueryRanges))
+	if n, want := otsdbSrv.queriesCount(), backfill+2*uint64(len(series["sys.cpu"])); n != want {
+		t.Fatalf("unexpected number of data queries %d; want %d", n, want)
+	}
+	if n := vmSrv.seriesCount(); n < backfill {
+		t.Fatalf("unexpected number of imported series %d; want at least %d", n, backfill)
+	}
+}
+
+func TestOtsdbProcessorFollowFailedRun(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.cpu": {
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host1"}},
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host2"}},
+		},
+	}
+	otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+	defer otsdbSrv.Close()
+	// failQueries makes data queries of the run fail
+	var failQueries uint32
+	failingSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/query" && atomic.LoadUint32(&failQueries) == 1 {
+			http.Error(w, "cannot serve the query", http.StatusBadRequest)
+			return
+		}
+		otsdbSrv.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer failingSrv.Close()
+	vmSrv := newFakeVMServer(t)
+	defer vmSrv.Close()
+
+	oc, err := opentsdb.NewClient(opentsdb.Config{
+		Addr:       failingSrv.URL,
+		Limit:      100,
+		Retentions: []string{"sum-1m-avg:1h:1d"},
+		Filters:    []string{"sys"},
+		HardTS:     testTS + 3600,
+	})
+	if err != nil {
+		t.Fatalf("cannot create OpenTSDB client: %s", err)
+	}
+	vmCfg := vm.Config{
+		Addr:               vmSrv.URL,
+		Concurrency:        2,
+		BatchSize:          1e6,
+		DisableProgressBar: true,
+	}
+	goroutines := runtime.NumGoroutine()
+	workers := importWorkers(t)
+	im, err := vm.NewImporter(context.Background(), vmCfg)
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var importers int
+	newImporter := func() (seriesSink, error) {
+		importers++
+		switch importers {
+		case 1:
+			// the first run for new data fails
+			atomic.StoreUint32(&failQueries, 1)
+		case 2:
+			atomic.StoreUint32(&failQueries, 0)
+			cancel()
+		}
+		return vm.NewImporter(context.Background(), vmCfg)
+	}
+	op := &otsdbProcessor{oc: oc, im: im, state: opentsdb.NewStateTracker(opentsdb.NewState(), 5*time.Minute, oc.MsecsTime)}
+	if err := op.follow(ctx, 10*time.Millisecond, newImporter, true, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if importers != 2 {
+		t.Fatalf("unexpected number of importers %d; want 2", importers)
+	}
+	// the importers of all the runs, including the failed one, must be closed
+	if n := importWorkers(t); n != workers {
+		t.Fatalf("importers leak: %d import workers on start; %d import workers on finish", workers, n)
+	}
+	otsdbSrv.CloseClientConnections()
+	failingSrv.CloseClientConnections()
+	vmSrv.CloseClientConnections()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines leak: %d goroutines on start; %d goroutines on finish", goroutines, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// importWorkers returns the number of workers of the registered importers
+func importWorkers(t *testing.T) int {
+	t.Helper()
+	var bb bytes.Buffer
+	vm.WriteMetrics(&bb)
+	for _, line := range strings.Split(bb.String(), "\n") {
+		if strings.HasPrefix(line, "vmctl_import_workers ") {
+			n, err := strconv.Atoi(strings.TrimPrefix(line, "vmctl_import_workers "))
+			if err != nil {
+				t.Fatalf("cannot parse %q: %s", line, err)
+			}
+			return n
+		}
+	}
+	t.Fatalf("vmctl_import_workers metric is missing")
+	return 0
+}
+
+func TestOtsdbProcessorRetentionOverrides(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.cpu": {
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host1"}},
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host2"}},
+		},
+		"sys.mem": {
+			{Metric: "sys.mem", Tags: map[string]string{"host": "host1"}},
+		},
+	}
+	otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+	var mu sync.Mutex
+	// the number of data queries per downsampling of every metric
+	queries := make(map[string]int)
+	otsdbSrv.onQuery = func(r *http.Request) {
+		// e.g. sum:5m-avg-none:sys.cpu{host=host1}
+		m := r.URL.Query().Get("m")
+		downsample, _, _ := strings.Cut(m, "-")
+		metric, _, _ := strings.Cut(m[strings.LastIndex(m, ":")+1:], "{")
+		mu.Lock()
+		queries[downsample+" "+metric]++
+		mu.Unlock()
+	}
+	defer otsdbSrv.Close()
+	vmSrv := newFakeVMServer(t)
+	defer vmSrv.Close()
+
+	oc, err := opentsdb.NewClient(opentsdb.Config{
+		Addr:               otsdbSrv.URL,
+		Limit:              100,
+		Retentions:         []string{"sum-1m-avg:1h:1d"},
+		RetentionOverrides: []string{"sys.cpu=sum-5m-avg:1h:2h"},
+		Filters:            []string{"sys"},
+	})
+	if err != nil {
+		t.Fatalf("cannot create OpenTSDB client: %s", err)
+	}
+	im, err := vm.NewImporter(context.Background(), vm.Config{
+		Addr:               vmSrv.URL,
+		Concurrency:        1,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	op := &otsdbProcessor{oc: oc, im: im}
+	if err := op.run(context.Background(), true, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	overrideRanges := len(oc.RetentionOverrides["sys.cpu"][0].QueryRanges)
+	globalRanges := len(oc.Retentions[0].QueryRanges)
+	want := map[string]int{
+		// the override takes precedence over the global retentions
+		"sum:5m sys.cpu": len(series["sys.cpu"]) * overrideRanges,
+		// the metric without override falls back to the global retentions
+		"sum:1m sys.mem": len(series["sys.mem"]) * globalRanges,
+	}
+	if !reflect.DeepEqual(queries, want) {
+		t.Fatalf("unexpected data queries %v; want %v", queries, want)
+	}
+
+	// retention lanes are bound to the global retentions
+	op = &otsdbProcessor{oc: oc, im: im, retentionCC: []int{1}}
+	if err := op.run(context.Background(), true, false); err == nil {
+		t.Fatalf("expecting error for retention concurrency with retention overrides")
+	}
+}
+
+func TestTagsToLabels(t *testing.T) {
+	f := func(tags map[string]string, want []vm.LabelPair) {
+		t.Helper()
+		got := tagsToLabels(tags)
+		if len(got) != len(tags) {
+			t.Fatalf("unexpected number of labels %d; want %d", len(got), len(tags))
+		}
+		for _, l := range got {
+			if l.Name == "" {
+				t.Fatalf("unexpected label with empty name in %v", got)
+			}
+		}
+		sort.Slice(got, func(i, j int) bool { return got[i].Name < got[j].Name })
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected labels %v; want %v", got, want)
+		}
+	}
+
+	f(nil, []vm.LabelPair{})
+	f(map[string]string{"host": "h1"}, []vm.LabelPair{{Name: "host", Value: "h1"}})
+	f(map[string]string{"host": "h1", "dc": "eu", "type": "user"}, []vm.LabelPair{
+		{Name: "dc", Value: "eu"},
+		{Name: "host", Value: "h1"},
+		{Name: "type", Value: "user"},
+	})
+}
+
+func TestOtsdbProcessorSeriesSelector(t *testing.T) {
+	oc, err := opentsdb.NewClient(opentsdb.Config{})
+	if err != nil {
+		t.Fatalf("cannot create OpenTSDB client: %s", err)
+	}
+	f := func(op *otsdbProcessor, series opentsdb.Meta, want string) {
+		t.Helper()
+		op.oc = oc
+		got, err := op.seriesSelector(series)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got != want {
+			t.Fatalf("unexpected selector %s; want %s", got, want)
+		}
+	}
+
+	f(&otsdbProcessor{}, opentsdb.Meta{Metric: "sys.cpu.user"}, `{__name__="sys_cpu_user"}`)
+	f(&otsdbProcessor{},
+		opentsdb.Meta{Metric: "sys.cpu.user", Tags: map[string]string{"host": "h1", "dc": `e"u`}},
+		`{__name__="sys_cpu_user",dc="e\"u",host="h1"}`)
+	// selector must match the series the way they are imported
+	f(&otsdbProcessor{tags: opentsdb.TagTransform{Drop: opentsdb.NewTagSet([]string{"dc"})}},
+		opentsdb.Meta{Metric: "sys.cpu.user", Tags: map[string]string{"host": "h1", "dc": "eu"}},
+		`{__name__="sys_cpu_user",host="h1"}`)
+	f(&otsdbProcessor{tags: opentsdb.TagTransform{Renames: map[string]string{"fqdn": "instance"}, SanitizeLabels: true}},
+		opentsdb.Meta{Metric: "sys.cpu.user", Tags: map[string]string{"fqdn": "h1.example.com", "rack:id": "r1"}},
+		`{__name__="sys_cpu_user",instance="h1.example.com",rack_id="r1"}`)
+}
+
+func TestOtsdbProcessorListMetricsFile(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.mem":  {{Metric: "sys.mem", Tags: map[string]string{"host": "host1"}}},
+		"sys.cpu":  {{Metric: "sys.cpu", Tags: map[string]string{"host": "host1"}}},
+		"sys.disk": {{Metric: "sys.disk", Tags: map[string]string{"host": "host1"}}},
+	}
+	srv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+	defer srv.Close()
+
+	oc, err := opentsdb.NewClient(opentsdb.Config{
+		Addr:       srv.URL,
+		Limit:      100,
+		Retentions: []string{"sum-1m-avg:1h:1d"},
+		// overlapping filters return the same metrics twice
+		Filters: []string{"sys", "sys.cpu"},
+	})
+	if err != nil {
+		t.Fatalf("cannot create OpenTSDB client: %s", err)
+	}
+	path := filepath.Join(t.TempDir(), "metrics.txt")
+	op := &otsdbProcessor{
+		oc:              oc,
+		dryRun:          true,
+		listMetricsFile: path,
+	}
+	if err := op.run(context.Background(), true, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("cannot read list of metrics: %s", err)
+	}
+	if want := "sys.cpu\nsys.disk\nsys.mem\n"; string(data) != want {
+		t.Fatalf("unexpected list of metrics %q; want %q", data, want)
+	}
+	if n := srv.queriesCount(); n > 0 {
+		t.Fatalf("dry run must not perform data queries; got %d queries", n)
+	}
+}
+
+func TestOtsdbProcessorMetricsList(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.mem":  {{Metric: "sys.mem", Tags: map[string]string{"host": "host1"}}},
+		"sys.cpu":  {{Metric: "sys.cpu", Tags: map[string]string{"host": "host1"}}},
+		"sys.disk": {{Metric: "sys.disk", Tags: map[string]string{"host": "host1"}}},
+	}
+	srv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+	defer srv.Close()
+
+	oc, err := opentsdb.NewClient(opentsdb.Config{
+		Addr:       srv.URL,
+		Limit:      100,
+		Retentions: []string{"sum-1m-avg:1h:1d"},
+		// discovery via filters would find no metrics
+		Filters: []string{"unknown"},
+	})
+	if err != nil {
+		t.Fatalf("cannot create OpenTSDB client: %s", err)
+	}
+	dir := t.TempDir()
+	metricsPath := filepath.Join(dir, "metrics.txt")
+	if err := os.WriteFile(metricsPath, []byte("# curated list\nsys.mem\n\n  sys.cpu  \nsys.mem\n"), 0600); err != nil {
+		t.Fatalf("cannot write list of metrics: %s", err)
+	}
+	metrics, err := readMetricsList(metricsPath)
+	if err != nil {
+		t.Fatalf("cannot read list of metrics: %s", err)
+	}
+	if want := []string{"sys.mem", "sys.cpu"}; !reflect.DeepEqual(metrics, want) {
+		t.Fatalf("unexpected list of metrics %q; want %q", metrics, want)
+	}
+	listPath := filepath.Join(dir, "list.txt")
+	op := &otsdbProcessor{
+		oc:              oc,
+		dryRun:          true,
+		metricsList:     metrics,
+		listMetricsFile: listPath,
+	}
+	if err := op.run(context.Background(), true, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	data, err := os.ReadFile(listPath)
+	if err != nil {
+		t.Fatalf("cannot read list of metrics: %s", err)
+	}
+	if want := "sys.cpu\nsys.mem\n"; string(data) != want {
+		t.Fatalf("unexpected list of metrics %q; want %q", data, want)
+	}
+
+	// the written list can be read back
+	if metrics, err := readMetricsList(listPath); err != nil || len(metrics) != 2 {
+		t.Fatalf("cannot read back the written list: %v, %q", err, metrics)
+	}
+	// the list must contain metrics
+	emptyPath := filepath.Join(dir, "empty.txt")
+	if err := os.WriteFile(emptyPath, []byte("\n# nothing\n"), 0600); err != nil {
+		t.Fatalf("cannot write list of metrics: %s", err)
+	}
+	if _, err := readMetricsList(emptyPath); err == nil {
+		t.Fatalf("expecting error for empty list of metrics")
+	}
+	if _, err := readMetricsList(filepath.Join(dir, "missing.txt")); err == nil {
+		t.Fatalf("expecting error for missing list of metrics")
+	}
+}
+
+func TestOtsdbProcessorInterrupted(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.cpu": {
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host1"}},
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host2"}},
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+	// interrupt the import on the second data query,
+	// so the data of the first query is buffered by the importer
+	var dataQueries int32
+	otsdbSrv.onQuery = func(_ *http.Request) {
+		if atomic.AddInt32(&dataQueries, 1) == 2 {
+			cancel()
+		}
+	}
+	defer otsdbSrv.Close()
+	vmSrv := newFakeVMServer(t)
+	defer vmSrv.Close()
+
+	oc, err := opentsdb.NewClient(opentsdb.Config{
+		Addr:       otsdbSrv.URL,
+		Limit:      100,
+		Retentions: []string{"sum-1m-avg:1h:1d"},
+		Filters:    []string{"sys"},
+	})
+	if err != nil {
+		t.Fatalf("cannot create OpenTSDB client: %s", err)
+	}
+	im, err := vm.NewImporter(context.Background(), vm.Config{
+		Addr:               vmSrv.URL,
+		Concurrency:        1,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	cpPath := filepath.Join(t.TempDir(), "checkpoint.json")
+	cp, err := opentsdb.LoadCheckpoint(cpPath)
+	if err != nil {
+		t.Fatalf("cannot load checkpoint: %s", err)
+	}
+	op := &otsdbProcessor{
+		oc:       oc,
+		im:       im,
+		progress: opentsdb.NewProgress(cp, 0),
+	}
+	if err := op.run(ctx, true, false); err == nil {
+		t.Fatalf("expecting error for interrupted import")
+	}
+	queries := otsdbSrv.queriesCount()
+	if want := uint64(len(series["sys.cpu"]) * len(oc.Retentions[0].QueryRanges)); queries >= want {
+		t.Fatalf("interrupted import must stop sending queries; got %d queries out of %d", queries, want)
+	}
+	// the data fetched before interruption must be flushed
+	if n := vmSrv.seriesCount(); n < 1 {
+		t.Fatalf("expecting buffered data to be imported on interruption")
+	}
+	cp, err = opentsdb.LoadCheckpoint(cpPath)
+	if err != nil {
+		t.Fatalf("cannot load checkpoint: %s", err)
+	}
+	if cp.IsDone("sys.cpu") {
+		t.Fatalf("interrupted metric must not be marked as imported")
+	}
+	if cp.StartTime == 0 {
+		t.Fatalf("checkpoint must be saved on interruption")
+	}
+}
+
+func TestOtsdbProcessorMaxRuntime(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.cpu": {
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host1"}},
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host2"}},
+		},
+	}
+	otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+	// slow down queries for reaching max runtime in the middle of the import
+	otsdbSrv.onQuery = func(_ *http.Request) { time.Sleep(20 * time.Millisecond) }
+	defer otsdbSrv.Close()
+	vmSrv := newFakeVMServer(t)
+	defer vmSrv.Close()
+
+	oc, err := opentsdb.NewClient(opentsdb.Config{
+		Addr:       otsdbSrv.URL,
+		Limit:      100,
+		Retentions: []string{"sum-1m-avg:1h:1d"},
+		Filters:    []string{"sys"},
+	})
+	if err != nil {
+		t.Fatalf("cannot create OpenTSDB client: %s", err)
+	}
+	im, err := vm.NewImporter(context.Background(), vm.Config{
+		Addr:               vmSrv.URL,
+		Concurrency:        1,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	cpPath := filepath.Join(t.TempDir(), "checkpoint.json")
+	cp, err := opentsdb.LoadCheckpoint(cpPath)
+	if err != nil {
+		t.Fatalf("cannot load checkpoint: %s", err)
+	}
+	op := &otsdbProcessor{
+		oc:         oc,
+		im:         im,
+		progress:   opentsdb.NewProgress(cp, 0),
+		maxRuntime: 200 * time.Millisecond,
+	}
+	err = op.run(context.Background(), true, false)
+	var mre *maxRuntimeError
+	if !errors.As(err, &mre) {
+		t.Fatalf("expecting maxRuntimeError; got %v", err)
+	}
+	queries := otsdbSrv.queriesCount()
+	if want := uint64(len(series["sys.cpu"]) * len(oc.Retentions[0].QueryRanges)); queries >= want {
+		t.Fatalf("import must be stopped on reaching max runtime; got %d queries out of %d", queries, want)
+	}
+	// the data fetched before reaching max runtime must be flushed
+	if n := vmSrv.seriesCount(); n < 1 {
+		t.Fatalf("expecting buffered data to be imported on reaching max runtime")
+	}
+	cp, err = opentsdb.LoadCheckpoint(cpPath)
+	if err != nil {
+		t.Fatalf("cannot load checkpoint: %s", err)
+	}
+	if cp.IsDone("sys.cpu") || cp.StartTime == 0 {
+		t.Fatalf("checkpoint must be saved on reaching max runtime without marking the metric as imported")
+	}
+}
+
+func TestOtsdbProcessorConfirmUnder(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.cpu":  {{Metric: "sys.cpu", Tags: map[string]string{"host": "host1"}}},
+		"sys.load": {{Metric: "sys.load", Tags: map[string]string{"host": "host1"}}},
+	}
+	f := func(confirmUnder int, wantErr bool) {
+		t.Helper()
+		otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+		defer otsdbSrv.Close()
+		vmSrv := newFakeVMServer(t)
+		defer vmSrv.Close()
+
+		oc, err := opentsdb.NewClient(opentsdb.Config{
+			Addr:       otsdbSrv.URL,
+			Limit:      100,
+			Retentions: []string{"sum-1m-avg:1h:1h"},
+			Filters:    []string{"sys"},
+		})
+		if err != nil {
+			t.Fatalf("cannot create OpenTSDB client: %s", err)
+		}
+		im, err := vm.NewImporter(context.Background(), vm.Config{
+			Addr:               vmSrv.URL,
+			Concurrency:        1,
+			DisableProgressBar: true,
+		})
+		if err != nil {
+			t.Fatalf("cannot create importer: %s", err)
+		}
+		op := &otsdbProcessor{
+			oc:           oc,
+			im:           im,
+			confirmUnder: confirmUnder,
+		}
+		err = op.run(context.Background(), true, false)
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error: %v; wantErr: %v", err, wantErr)
+		}
+		if wantErr {
+			if n := otsdbSrv.queriesCount(); n != 0 {
+				t.Fatalf("refused import mustn't query data; got %d queries", n)
+			}
+			if n := vmSrv.seriesCount(); n != 0 {
+				t.Fatalf("refused import mustn't import data; got %d series", n)
+			}
+			return
+		}
+		if n := vmSrv.seriesCount(); n == 0 {
+			t.Fatalf("expecting data to be imported")
+		}
+	}
+
+	// the threshold is disabled
+	f(0, false)
+	// fewer metrics than the threshold
+	f(3, false)
+	// the number of metrics reaches the threshold in silent mode
+	f(2, true)
+	f(1, true)
+}
+
+func TestOtsdbProcessorResumeFromCursor(t *testing.T) {
+	series := map[string][]opentsdb.Meta{"sys.cpu": {}}
+	for i := 0; i < 10; i++ {
+		series["sys.cpu"] = append(series["sys.cpu"], opentsdb.Meta{Metric: "sys.cpu", Tags: map[string]string{"host": fmt.Sprintf("host%d", i)}})
+	}
+	otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+	// slow down queries for reaching max runtime in the middle of the metric
+	otsdbSrv.onQuery = func(_ *http.Request) { time.Sleep(20 * time.Millisecond) }
+	defer otsdbSrv.Close()
+	vmSrv := newFakeVMServer(t)
+	defer vmSrv.Close()
+
+	oc, err := opentsdb.NewClient(opentsdb.Config{
+		Addr:       otsdbSrv.URL,
+		Limit:      100,
+		Retentions: []string{"sum-1m-avg:1h:2h"},
+		Filters:    []string{"sys"},
+	})
+	if err != nil {
+		t.Fatalf("cannot create OpenTSDB client: %s", err)
+	}
+	cpPath := filepath.Join(t.TempDir(), "checkpoint.json")
+	newProcessor := func(maxRuntime time.Duration) *otsdbProcessor {
+		t.Helper()
+		im, err := vm.NewImporter(context.Background(), vm.Config{
+			Addr:               vmSrv.URL,
+			Concurrency:        1,
+			DisableProgressBar: true,
+		})
+		if err != nil {
+			t.Fatalf("cannot create importer: %s", err)
+		}
+		cp, err := opentsdb.LoadCheckpoint(cpPath)
+		if err != nil {
+			t.Fatalf("cannot load checkpoint: %s", err)
+		}
+		return &otsdbProcessor{
+			oc:         oc,
+			im:         im,
+			progress:   opentsdb.NewProgress(cp, 10*time.Millisecond),
+			maxRuntime: maxRuntime,
+		}
+	}
+
+	op := newProcessor(200 * time.Millisecond)
+	var mre *maxRuntimeError
+	if err := op.run(context.Background(), true, false); !errors.As(err, &mre) {
+		t.Fatalf("expecting maxRuntimeError; got %v", err)
+	}
+	cp, err := opentsdb.LoadCheckpoint(cpPath)
+	if err != nil {
+		t.Fatalf("cannot load checkpoint: %s", err)
+	}
+	c, ok := cp.Cursor("sys.cpu")
+	if !ok || c.Series < 1 || c.Series >= len(series["sys.cpu"]) || c.Total != len(series["sys.cpu"]) {
+		t.Fatalf("unexpected cursor %v for the interrupted metric", c)
+	}
+	if cp.Samples != op.samples {
+		t.Fatalf("unexpected samples in checkpoint %d; want %d", cp.Samples, op.samples)
+	}
+
+	// the resumed metric must be fetched starting from the cursor
+	queries := otsdbSrv.queriesCount()
+	op = newProcessor(0)
+	if err := op.run(context.Background(), true, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	queryRanges := len(oc.Retentions[0].QueryRanges)
+	if got, want := otsdbSrv.queriesCount()-queries, uint64((len(series["sys.cpu"])-c.Series)*queryRanges); got != want {
+		t.Fatalf("unexpected number of queries for the resumed metric %d; want %d", got, want)
+	}
+	cp, err = opentsdb.LoadCheckpoint(cpPath)
+	if err != nil {
+		t.Fatalf("cannot load checkpoint: %s", err)
+	}
+	if !cp.IsDone("sys.cpu") {
+		t.Fatalf("resumed metric must be marked as imported")
+	}
+	if _, ok := cp.Cursor("sys.cpu"); ok {
+		t.Fatalf("cursor must be removed for the imported metric")
+	}
+}
+
+func TestOtsdbProcessorCheckpointImportError(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.cpu": {
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host1"}},
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host2"}},
+		},
+	}
+	otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+	defer otsdbSrv.Close()
+	vmSrv := newFakeVMServer(t)
+	vmSrv.failImport = true
+	defer vmSrv.Close()
+
+	oc, err := opentsdb.NewClient(opentsdb.Config{
+		Addr:       otsdbSrv.URL,
+		Limit:      100,
+		Retentions: []string{"sum-1m-avg:1h:2h"},
+		Filters:    []string{"sys"},
+	})
+	if err != nil {
+		t.Fatalf("cannot create OpenTSDB client: %s", err)
+	}
+	// the fetched data stays buffered in the importer until it is closed
+	im, err := vm.NewImporter(context.Background(), vm.Config{
+		Addr:               vmSrv.URL,
+		Concurrency:        1,
+		BatchSize:          1e6,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	cpPath := filepath.Join(t.TempDir(), "checkpoint.json")
+	cp, err := opentsdb.LoadCheckpoint(cpPath)
+	if err != nil {
+		t.Fatalf("cannot load checkpoint: %s", err)
+	}
+	op := &otsdbProcessor{
+		oc:       oc,
+		im:       im,
+		progress: opentsdb.NewProgress(cp, 10*time.Millisecond),
+	}
+	if err := op.run(context.Background(), true, false); err == nil {
+		t.Fatalf("expecting import error")
+	}
+	if op.samples == 0 {
+		t.Fatalf("expecting the metric to be fetched before the import error")
+	}
+	cp, err = opentsdb.LoadCheckpoint(cpPath)
+	if err != nil {
+		t.Fatalf("cannot load checkpoint: %s", err)
+	}
+	if cp.IsDone("sys.cpu") {
+		t.Fatalf("the metric must not be marked as imported if its data failed to be imported")
+	}
+}
+
+func TestOtsdbProcessorRetentionConcurrency(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.cpu": {
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host1"}},
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host2"}},
+		},
+	}
+	otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+	defer otsdbSrv.Close()
+	vmSrv := newFakeVMServer(t)
+	defer vmSrv.Close()
+
+	// 2 series * 2 query ranges of the rollup retention
+	const rollupQueries = 4
+	var rollups uint64
+	rollupsDone := make(chan struct{})
+	otsdbSrv.onQuery = func(r *http.Request) {
+		if strings.Contains(r.URL.Query().Get("m"), ":1h-") {
+			if atomic.AddUint64(&rollups, 1) == rollupQueries {
+				close(rollupsDone)
+			}
+			return
+		}
+		// raw queries are stuck until all the rollup queries are processed,
+		// which is possible only if they don't share workers
+		select {
+		case <-rollupsDone:
+		case <-time.After(5 * time.Second):
+			t.Errorf("rollup queries are blocked by raw queries")
+		}
+	}
+
+	oc, err := opentsdb.NewClient(opentsdb.Config{
+		Addr:       otsdbSrv.URL,
+		Limit:      100,
+		Retentions: []string{"sum-1m-avg:1h:2h", "sum-1h-avg:1h:2h"},
+		Filters:    []string{"sys"},
+	})
+	if err != nil {
+		t.Fatalf("cannot create OpenTSDB client: %s", err)
+	}
+	im, err := vm.NewImporter(context.Background(), vm.Config{
+		Addr:               vmSrv.URL,
+		Concurrency:        1,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	op := &otsdbProcessor{
+		oc:          oc,
+		im:          im,
+		otsdbcc:     1,
+		retentionCC: []int{1, 1},
+	}
+	if err := op.run(context.Background(), true, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := atomic.LoadUint64(&rollups); n != rollupQueries {
+		t.Fatalf("unexpected number of rollup queries %d; want %d", n, rollupQueries)
+	}
+	if n := otsdbSrv.queriesCount(); n != 2*rollupQueries {
+		t.Fatalf("unexpected number of queries %d; want %d", n, 2*rollupQueries)
+	}
+
+	// the number of values must match the number of retentions
+	for _, cc := range [][]int{{1}, {1, 0}} {
+		op := &otsdbProcessor{oc: oc, im: im, retentionCC: cc}
+		if err := op.run(context.Background(), true, false); err == nil {
+			t.Fatalf("expecting error for retention concurrency %v", cc)
+		}
+	}
+}
+
+func TestOtsdbProcessorSeriesChunk(t *testing.T) {
+	const seriesN, chunk = 5, 2
+	series := map[string][]opentsdb.Meta{"sys.cpu": {}}
+	for i := 0; i < seriesN; i++ {
+		series["sys.cpu"] = append(series["sys.cpu"], opentsdb.Meta{Metric: "sys.cpu", Tags: map[string]string{"host": fmt.Sprintf("host%d", i)}})
+	}
+	otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+	defer otsdbSrv.Close()
+	vmSrv := newFakeVMServer(t)
+	defer vmSrv.Close()
+
+	// imported contains the number of series imported
+	// by the time of the first query of every series
+	var mu sync.Mutex
+	imported := make(map[int]uint64)
+	otsdbSrv.onQuery = func(r *http.Request) {
+		m := r.URL.Query().Get("m")
+		var idx int
+		if _, err := fmt.Sscanf(m[strings.LastIndex(m, "host=host")+len("host=host"):], "%d", &idx); err != nil {
+			t.Errorf("cannot parse series index from %q: %s", m, err)
+			return
+		}
+		mu.Lock()
+		if _, ok := imported[idx]; !ok {
+			imported[idx] = vmSrv.seriesCount()
+		}
+		mu.Unlock()
+	}
+
+	oc, err := opentsdb.NewClient(opentsdb.Config{
+		Addr:       otsdbSrv.URL,
+		Limit:      100,
+		Retentions: []string{"sum-1m-avg:1h:2h"},
+		Filters:    []string{"sys"},
+	})
+	if err != nil {
+		t.Fatalf("cannot create OpenTSDB client: %s", err)
+	}
+	im, err := vm.NewImporter(context.Background(), vm.Config{
+		Addr:               vmSrv.URL,
+		Concurrency:        1,
+		BatchSize:          1e3,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	op := &otsdbProcessor{
+		oc:          oc,
+		im:          im,
+		otsdbcc:     2,
+		seriesChunk: chunk,
+	}
+	if err := op.run(context.Background(), true, true); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	total := vmSrv.seriesCount()
+	if total == 0 || total%seriesN != 0 {
+		t.Fatalf("unexpected number of imported series %d for %d series", total, seriesN)
+	}
+	perSeries := total / seriesN
+	for idx := 0; idx < seriesN; idx++ {
+		// all the series of previous chunks must be imported
+		// before fetching the chunk of the series
+		want := uint64(idx/chunk*chunk) * perSeries
+		if got := imported[idx]; got < want {
+			t.Fatalf("unexpected number of imported series %d before fetching series %d; want at least %d", got, idx, want)
+		}
+	}
+
+	op = &otsdbProcessor{oc: oc, im: im, seriesChunk: -1}
+	if err := op.run(context.Background(), true, false); err == nil {
+		t.Fatalf("expecting error for negative series chunk")
+	}
+}
+
+func TestOtsdbProcessorSeriesChunkImportError(t *testing.T) {
+	series := map[string][]opentsdb.Meta{"sys.cpu": {}}
+	for i := 0; i < 10; i++ {
+		series["sys.cpu"] = append(series["sys.cpu"], opentsdb.Meta{Metric: "sys.cpu", Tags: map[string]string{"host": fmt.Sprintf("host%d", i)}})
+	}
+	otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+	defer otsdbSrv.Close()
+	vmSrv := newFakeVMServer(t)
+	vmSrv.failImport = true
+	defer vmSrv.Close()
+
+	oc, err := opentsdb.NewClient(opentsdb.Config{
+		Addr:       otsdbSrv.URL,
+		Limit:      100,
+		Retentions: []string{"sum-1m-avg:1h:2h"},
+		Filters:    []string{"sys"},
+	})
+	if err != nil {
+		t.Fatalf("cannot create OpenTSDB client: %s", err)
+	}
+	// the failures of the batches imported before Flush
+	// must not block Flush, so the run is repeated for catching them
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		im, err := vm.NewImporter(ctx, vm.Config{
+			Addr:               vmSrv.URL,
+			Concurrency:        1,
+			BatchSize:          1,
+			DisableProgressBar: true,
+		})
+		if err != nil {
+			t.Fatalf("cannot create importer: %s", err)
+		}
+		// the cancelled importer ctx stops retries of the failed imports
+		cancel()
+		op := &otsdbProcessor{
+			oc:          oc,
+			im:          im,
+			otsdbcc:     1,
+			seriesChunk: 1,
+		}
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- op.run(context.Background(), true, false)
+		}()
+		select {
+		case err := <-errCh:
+			if err == nil {
+				t.Fatalf("expecting import error")
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timeout waiting for the failed import")
+		}
+	}
+}
+
+func TestOtsdbProcessorQuietProgress(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.cpu": {
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host1"}},
+		},
+	}
+	otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+	defer otsdbSrv.Close()
+	vmSrv := newFakeVMServer(t)
+	defer vmSrv.Close()
+
+	oc, err := opentsdb.NewClient(opentsdb.Config{
+		Addr:       otsdbSrv.URL,
+		Limit:      100,
+		Retentions: []string{"sum-1m-avg:1h:1d"},
+		Filters:    []string{"sys"},
+	})
+	if err != nil {
+		t.Fatalf("cannot create OpenTSDB client: %s", err)
+	}
+	im, err := vm.NewImporter(context.Background(), vm.Config{
+		Addr:               vmSrv.URL,
+		Concurrency:        1,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	op := &otsdbProcessor{
+		oc:            oc,
+		im:            im,
+		otsdbcc:       1,
+		quietProgress: true,
+	}
+	if err := op.run(context.Background(), true, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// the final progress is logged even if periodic logging is disabled
+	total := len(oc.Retentions[0].QueryRanges)
+	if want := fmt.Sprintf("100%% (%d/%d ranges)", total, total); !strings.Contains(logs.String(), want) {
+		t.Fatalf("expecting %q in logs; got\n%s", want, logs.String())
+	}
+}
+
+func TestOtsdbProcessorDiscoverMetrics(t *testing.T) {
+	metrics := []string{"disk.free", "sys.cpu.nice", "sys.cpu.user", "sys.mem"}
+	var requests uint64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&requests, 1)
+		q := r.URL.Query().Get("q")
+		if q == "bad" {
+			http.Error(w, "cannot serve the query", http.StatusBadRequest)
+			return
+		}
+		// responses for shorter filters are slower,
+		// so they arrive in the order different from the order of filters
+		time.Sleep(time.Duration(10-len(q)) * 5 * time.Millisecond)
+		found := make([]string, 0)
+		for _, m := range metrics {
+			if strings.HasPrefix(m, q) {
+				found = append(found, m)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(found)
+	}))
+	defer srv.Close()
+
+	f := func(filters []string, concurrency int, want []string, wantErr bool) {
+		t.Helper()
+		atomic.StoreUint64(&requests, 0)
+		oc, err := opentsdb.NewClient(opentsdb.Config{
+			Addr:    srv.URL,
+			Limit:   100,
+			Filters: filters,
+		})
+		if err != nil {
+			t.Fatalf("cannot create OpenTSDB client: %s", err)
+		}
+		op := &otsdbProcessor{oc: oc, otsdbcc: concurrency}
+		got, err := op.discoverMetrics(context.Background())
+		if wantErr {
+			if err == nil {
+				t.Fatalf("expecting error")
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected metrics %q; want %q", got, want)
+		}
+		if n := atomic.LoadUint64(&requests); n != uint64(len(filters)) {
+			t.Fatalf("unexpected number of requests %d; want %d", n, len(filters))
+		}
+	}
+
+	// metrics matching overlapping filters are returned once in the order of filters
+	want := []string{"sys.cpu.nice", "sys.cpu.user", "sys.mem", "disk.free"}
+	f([]string{"sys.cpu", "sys", "s", "d", "disk"}, 1, want, false)
+	f([]string{"sys.cpu", "sys", "s", "d", "disk"}, 4, want, false)
+	f([]string{"sys.cpu", "sys", "s", "d", "disk"}, 10, want, false)
+	// any failed filter aborts the discovery
+	f([]string{"sys", "bad", "d"}, 1, nil, true)
+	f([]string{"sys", "bad", "d"}, 3, nil, true)
+}
+
+func TestOtsdbProcessorMultipleMetrics(t *testing.T) {
+	series := make(map[string][]opentsdb.Meta)
+	for i := 0; i < 10; i++ {
+		metric := fmt.Sprintf("sys.metric%d", i)
+		series[metric] = []opentsdb.Meta{
+			{Metric: metric, Tags: map[string]string{"host": "host1"}},
+			{Metric: metric, Tags: map[string]string{"host": "host2"}},
+		}
+	}
+	f := func(metricCC int) {
+		t.Helper()
+		otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+		defer otsdbSrv.Close()
+		vmSrv := newFakeVMServer(t)
+		defer vmSrv.Close()
+
+		oc, err := opentsdb.NewClient(opentsdb.Config{
+			Addr:       otsdbSrv.URL,
+			Limit:      100,
+			Retentions: []string{"sum-1m-avg:1h:1d"},
+			Filters:    []string{"sys"},
+		})
+		if err != nil {
+			t.Fatalf("cannot create OpenTSDB client: %s", err)
+		}
+		im, err := vm.NewImporter(context.Background(), vm.Config{
+			Addr:               vmSrv.URL,
+			Concurrency:        1,
+			DisableProgressBar: true,
+		})
+		if err != nil {
+			t.Fatalf("cannot create importer: %s", err)
+		}
+		goroutines := runtime.NumGoroutine()
+		var doneMu sync.Mutex
+		done := make(map[string]opentsdb.MetricStats)
+		op := &otsdbProcessor{
+			oc:       oc,
+			im:       im,
+			otsdbcc:  2,
+			metricCC: metricCC,
+			timings: opentsdb.Timings{
+				OnDone: func(ms opentsdb.MetricStats) {
+					doneMu.Lock()
+					done[ms.Metric] = ms
+					doneMu.Unlock()
+				},
+			},
+		}
+		if err := op.run(context.Background(), true, false); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(done) != len(series) {
+			t.Fatalf("unexpected number of metrics passed to callback %d; want %d", len(done), len(series))
+		}
+		if ss := im.StatsSnapshot(); ss.Samples != op.samples {
+			t.Fatalf("unexpected number of samples in importer stats %d; want %d", ss.Samples, op.samples)
+		}
+		queryRanges := len(oc.Retentions[0].QueryRanges)
+		if queries, want := otsdbSrv.queriesCount(), uint64(len(series)*2*queryRanges); queries != want {
+			t.Fatalf("unexpected number of queries %d; want %d", queries, want)
+		}
+		if n := vmSrv.seriesCount(); n < 1 {
+			t.Fatalf("expecting data to be imported")
+		}
+		if op.samples != uint64(len(series)*2*queryRanges) {
+			t.Fatalf("unexpected number of imported samples %d", op.samples)
+		}
+		timings := op.timings.Done()
+		if len(timings) != len(series) {
+			t.Fatalf("unexpected number of metric timings %d; want %d", len(timings), len(series))
+		}
+		for _, ms := range timings {
+			if ms.Series != 2 || ms.Samples != uint64(2*queryRanges) {
+				t.Fatalf("unexpected timing for %s: series %d; samples %d", ms.Metric, ms.Series, ms.Samples)
+			}
+		}
+		// all the workers, bars and importer goroutines must be stopped on return,
+		// while idle HTTP connections may need some time to be closed
+		otsdbSrv.CloseClientConnections()
+		vmSrv.CloseClientConnections()
+		deadline := time.Now().Add(5 * time.Second)
+		for runtime.NumGoroutine() > goroutines {
+			if time.Now().After(deadline) {
+				t.Fatalf("goroutines leak: %d goroutines on start; %d goroutines on finish", goroutines, runtime.NumGoroutine())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	f(1)
+	f(4)
+}
+
+func TestOtsdbProcessorStrict(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.ok": {
+			{Metric: "sys.ok", Tags: map[string]string{"host": "host1"}},
+		},
+		"sys.failed": {
+			{Metric: "sys.failed", Tags: map[string]string{"host": "host1"}},
+			{Metric: "sys.failed", Tags: map[string]string{"host": "host2"}},
+		},
+	}
+	f := func(failMetrics map[string]bool, failImport, strict, wantErr bool, wantFailed uint64) {
+		t.Helper()
+		otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+		otsdbSrv.failMetrics = failMetrics
+		defer otsdbSrv.Close()
+		vmSrv := newFakeVMServer(t)
+		vmSrv.failImport = failImport
+		defer vmSrv.Close()
+
+		oc, err := opentsdb.NewClient(opentsdb.Config{
+			Addr:       otsdbSrv.URL,
+			Limit:      100,
+			Retentions: []string{"sum-1m-avg:1h:1d"},
+			Filters:    []string{"sys"},
+			Strict:     strict,
+		})
+		if err != nil {
+			t.Fatalf("cannot create OpenTSDB client: %s", err)
+		}
+		im, err := vm.NewImporter(context.Background(), vm.Config{
+			Addr:               vmSrv.URL,
+			Concurrency:        1,
+			DisableProgressBar: true,
+		})
+		if err != nil {
+			t.Fatalf("cannot create importer: %s", err)
+		}
+		op := &otsdbProcessor{
+			oc:      oc,
+			im:      im,
+			otsdbcc: 1,
+			strict:  strict,
+		}
+		err = op.run(context.Background(), true, false)
+		if !wantErr {
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			return
+		}
+		if err == nil {
+			t.Fatalf("expecting error")
+		}
+		var sfe *seriesFailedError
+		if !strict {
+			if errors.As(err, &sfe) {
+				t.Fatalf("unexpected strict mode error in non-strict mode: %s", err)
+			}
+			return
+		}
+		if !errors.As(err, &sfe) {
+			t.Fatalf("expecting strict mode error; got %s", err)
+		}
+		if sfe.failed != wantFailed {
+			t.Fatalf("unexpected number of failed series %d; want %d", sfe.failed, wantFailed)
+		}
+		// the typed errors of OpenTSDB client and importer are preserved
+		var qe *opentsdb.RequestError
+		var re *vm.ResponseError
+		switch {
+		case failImport:
+			if !errors.As(err, &re) || re.StatusCode != http.StatusBadRequest || !errors.Is(err, vm.ErrBadRequest) {
+				t.Fatalf("expecting import error with status code 400; got %s", err)
+			}
+		case !errors.As(err, &qe) || qe.StatusCode != http.StatusBadRequest:
+			t.Fatalf("expecting OpenTSDB error with status code 400; got %s", err)
+		}
+	}
+
+	// failed queries are skipped in non-strict mode
+	f(map[string]bool{"sys.failed": true}, false, false, false, 0)
+	// the first failed query aborts the run in strict mode
+	f(map[string]bool{"sys.failed": true}, false, true, true, 1)
+	// all the series are buffered by importer and fail on close
+	f(nil, true, true, true, 3)
+}
+
+func TestOtsdbProcessorEmptyMetrics(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.ok": {
+			{Metric: "sys.ok", Tags: map[string]string{"host": "host1"}},
+		},
+		"sys.empty": {},
+	}
+	f := func(strict, wantErr bool) {
+		t.Helper()
+		otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+		defer otsdbSrv.Close()
+		vmSrv := newFakeVMServer(t)
+		defer vmSrv.Close()
+
+		oc, err := opentsdb.NewClient(opentsdb.Config{
+			Addr:       otsdbSrv.URL,
+			Limit:      100,
+			Retentions: []string{"sum-1m-avg:1h:1d"},
+			Filters:    []string{"sys"},
+			Strict:     strict,
+		})
+		if err != nil {
+			t.Fatalf("cannot create OpenTSDB client: %s", err)
+		}
+		im, err := vm.NewImporter(context.Background(), vm.Config{
+			Addr:               vmSrv.URL,
+			Concurrency:        1,
+			DisableProgressBar: true,
+		})
+		if err != nil {
+			t.Fatalf("cannot create importer: %s", err)
+		}
+		op := &otsdbProcessor{
+			oc:      oc,
+			im:      im,
+			otsdbcc: 1,
+			strict:  strict,
+		}
+		err = op.run(context.Background(), true, false)
+		if wantErr {
+			if err == nil {
+				t.Fatalf("expecting error")
+			}
+			if n := vmSrv.seriesCount(); n != 0 {
+				t.Fatalf("unexpected number of imported series %d; want 0", n)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if n := vmSrv.seriesCount(); n == 0 {
+				t.Fatalf("expecting series of sys.ok to be imported")
+			}
+		}
+		if len(op.emptyMetrics) != 1 || op.emptyMetrics[0] != "sys.empty" {
+			t.Fatalf("unexpected metrics without series: %v", op.emptyMetrics)
+		}
+	}
+
+	// metrics without series are skipped in non-strict mode
+	f(false, false)
+	// metrics without series fail the run in strict mode
+	f(true, true)
+}
+
+func TestOtsdbProcessorTagFilters(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.cpu": {
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "web-1"}},
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "web-2"}},
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "db-1"}},
+		},
+		"sys.db": {
+			{Metric: "sys.db", Tags: map[string]string{"host": "db-1"}},
+		},
+	}
+	otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+	var queriesMu sync.Mutex
+	var queries []string
+	otsdbSrv.onQuery = func(r *http.Request) {
+		queriesMu.Lock()
+		queries = append(queries, r.URL.Query().Get("m"))
+		queriesMu.Unlock()
+	}
+	defer otsdbSrv.Close()
+	vmSrv := newFakeVMServer(t)
+	defer vmSrv.Close()
+
+	oc, err := opentsdb.NewClient(opentsdb.Config{
+		Addr:       otsdbSrv.URL,
+		Limit:      100,
+		Retentions: []string{"sum-1m-avg:1h:1d"},
+		Filters:    []string{"sys", "host=web*"},
+		Strict:     true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create OpenTSDB client: %s", err)
+	}
+	im, err := vm.NewImporter(context.Background(), vm.Config{
+		Addr:               vmSrv.URL,
+		Concurrency:        1,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	op := &otsdbProcessor{
+		oc:      oc,
+		im:      im,
+		otsdbcc: 1,
+		strict:  true,
+	}
+	// metrics without series matching tag filters
+	// aren't considered empty even in strict mode
+	if err := op.run(context.Background(), true, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(op.emptyMetrics) != 0 {
+		t.Fatalf("unexpected metrics without series: %v", op.emptyMetrics)
+	}
+	if len(queries) == 0 {
+		t.Fatalf("expecting data queries to OpenTSDB")
+	}
+	for _, q := range queries {
+		if !strings.Contains(q, "sys.cpu{host=web-") {
+			t.Fatalf("unexpected query for series not matching tag filters: %q", q)
+		}
+	}
+}
+
+func TestOtsdbProcessorSkipErrors(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.ok": {
+			{Metric: "sys.ok", Tags: map[string]string{"host": "host1"}},
+		},
+		"sys.failed": {
+			{Metric: "sys.failed", Tags: map[string]string{"host": "host1"}},
+			{Metric: "sys.failed", Tags: map[string]string{"host": "host2"}},
+		},
+	}
+	otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+	otsdbSrv.failMetrics = map[string]bool{"sys.failed": true}
+	defer otsdbSrv.Close()
+	vmSrv := newFakeVMServer(t)
+	defer vmSrv.Close()
+
+	oc, err := opentsdb.NewClient(opentsdb.Config{
+		Addr:       otsdbSrv.URL,
+		Limit:      100,
+		Retentions: []string{"sum-1m-avg:1h:1d"},
+		Filters:    []string{"sys"},
+		Strict:     true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create OpenTSDB client: %s", err)
+	}
+	im, err := vm.NewImporter(context.Background(), vm.Config{
+		Addr:               vmSrv.URL,
+		Concurrency:        1,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	errorLogFile := filepath.Join(t.TempDir(), "errors.txt")
+	op := &otsdbProcessor{
+		oc:         oc,
+		im:         im,
+		otsdbcc:    2,
+		skipErrors: true,
+		failures:   opentsdb.Failures{ErrorLogFile: errorLogFile},
+	}
+	if err := op.run(context.Background(), true, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := vmSrv.seriesCount(); n < 1 {
+		t.Fatalf("expecting series of sys.ok to be imported")
+	}
+	data, err := os.ReadFile(errorLogFile)
+	if err != nil {
+		t.Fatalf("cannot read error log file: %s", err)
+	}
+	want := `{__name__="sys_failed",host="host1"}` + "\n" + `{__name__="sys_failed",host="host2"}` + "\n"
+	if string(data) != want {
+		t.Fatalf("unexpected list of skipped series;\ngot\n%s\nwant\n%s", data, want)
+	}
+}
+
+func TestOtsdbProcessorRetryManifest(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.ok": {
+			{Metric: "sys.ok", Tags: map[string]string{"host": "host1"}},
+		},
+		"sys.failed": {
+			{Metric: "sys.failed", Tags: map[string]string{"host": "host1"}},
+			{Metric: "sys.failed", Tags: map[string]string{"host": "host2"}},
+		},
+	}
+	newProcessor := func(otsdbAddr, vmAddr string) *otsdbProcessor {
+		t.Helper()
+		oc, err := opentsdb.NewClient(opentsdb.Config{
+			Addr:       otsdbAddr,
+			Limit:      100,
+			Retentions: []string{"sum-1m-avg:1h:1d"},
+			Filters:    []string{"sys"},
+			Strict:     true,
+		})
+		if err != nil {
+			t.Fatalf("cannot create OpenTSDB client: %s", err)
+		}
+		im, err := vm.NewImporter(context.Background(), vm.Config{
+			Addr:               vmAddr,
+			Concurrency:        1,
+			DisableProgressBar: true,
+		})
+		if err != nil {
+			t.Fatalf("cannot create importer: %s", err)
+		}
+		return &otsdbProcessor{oc: oc, im: im, otsdbcc: 2, skipErrors: true}
+	}
+	manifestPath := filepath.Join(t.TempDir(), "retry.json")
+
+	otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+	otsdbSrv.failMetrics = map[string]bool{"sys.failed": true}
+	defer otsdbSrv.Close()
+	vmSrv := newFakeVMServer(t)
+	defer vmSrv.Close()
+	op := newProcessor(otsdbSrv.URL, vmSrv.URL)
+	op.failures.Manifest = opentsdb.NewRetryManifest(manifestPath)
+	if err := op.run(context.Background(), true, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ranges := vmSrv.seriesCount()
+	if ranges < 1 {
+		t.Fatalf("expecting series of sys.ok to be imported")
+	}
+
+	rm, err := opentsdb.LoadRetryManifest(manifestPath)
+	if err != nil {
+		t.Fatalf("cannot load retry manifest: %s", err)
+	}
+	if uint64(rm.Len()) != 2*ranges {
+		t.Fatalf("unexpected number of failed queries %d; want %d", rm.Len(), 2*ranges)
+	}
+	for _, q := range rm.Queries {
+		if q.Series.Metric != "sys.failed" {
+			t.Fatalf("unexpected metric %q in retry manifest", q.Series.Metric)
+		}
+	}
+
+	// OpenTSDB without any metrics proves the discovery is skipped
+	retrySrv := newFakeOtsdbServer(t, nil, map[int64]float64{testTS: 1})
+	defer retrySrv.Close()
+	retryVMSrv := newFakeVMServer(t)
+	defer retryVMSrv.Close()
+	op = newProcessor(retrySrv.URL, retryVMSrv.URL)
+	op.retryQueries = rm.Queries
+	op.failures.Manifest = opentsdb.NewRetryManifest(manifestPath)
+	if err := op.run(context.Background(), true, false); err != nil {
+		t.Fatalf("unexpected error on retry: %s", err)
+	}
+	if n := retrySrv.queriesCount(); n != 2*ranges {
+		t.Fatalf("unexpected number of retried queries %d; want %d", n, 2*ranges)
+	}
+	if n := retryVMSrv.seriesCount(); n != 2*ranges {
+		t.Fatalf("unexpected number of imported series on retry %d; want %d", n, 2*ranges)
+	}
+	// successful retry leaves no failed queries
+	rm, err = opentsdb.LoadRetryManifest(manifestPath)
+	if err != nil {
+		t.Fatalf("cannot load retry manifest: %s", err)
+	}
+	if rm.Len() != 0 {
+		t.Fatalf("unexpected number of failed queries after retry: %d", rm.Len())
+	}
+}
+
+func TestOtsdbProcessorSeriesTimeout(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.cpu": {
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host1"}},
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "stuck"}},
+		},
+	}
+	f := func(strict, wantErr bool) {
+		t.Helper()
+		otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+		otsdbSrv.onQuery = func(r *http.Request) {
+			if strings.Contains(r.URL.Query().Get("m"), "host=stuck") {
+				// hang until the query is abandoned
+				<-r.Context().Done()
+			}
+		}
+		defer otsdbSrv.Close()
+		vmSrv := newFakeVMServer(t)
+		defer vmSrv.Close()
+
+		oc, err := opentsdb.NewClient(opentsdb.Config{
+			Addr:       otsdbSrv.URL,
+			Limit:      100,
+			Retentions: []string{"sum-1m-avg:1h:1d"},
+			Filters:    []string{"sys"},
+			Strict:     strict,
+		})
+		if err != nil {
+			t.Fatalf("cannot create OpenTSDB client: %s", err)
+		}
+		im, err := vm.NewImporter(context.Background(), vm.Config{
+			Addr:               vmSrv.URL,
+			Concurrency:        1,
+			DisableProgressBar: true,
+		})
+		if err != nil {
+			t.Fatalf("cannot create importer: %s", err)
+		}
+		manifestPath := filepath.Join(t.TempDir(), "retry.json")
+		op := &otsdbProcessor{
+			oc:            oc,
+			im:            im,
+			otsdbcc:       2,
+			strict:        strict,
+			seriesTimeout: 100 * time.Millisecond,
+			failures:      opentsdb.Failures{Manifest: opentsdb.NewRetryManifest(manifestPath)},
+		}
+		err = op.run(context.Background(), true, false)
+		if wantErr {
+			var sfe *seriesFailedError
+			if !errors.As(err, &sfe) {
+				t.Fatalf("expecting strict mode error; got %v", err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		ranges := uint64(len(oc.Retentions[0].QueryRanges))
+		if n := vmSrv.seriesCount(); n != ranges {
+			t.Fatalf("unexpected number of imported series %d; want %d", n, ranges)
+		}
+		if n := atomic.LoadUint64(&op.timedOut); n != ranges {
+			t.Fatalf("unexpected number of abandoned queries %d; want %d", n, ranges)
+		}
+		// abandoned queries are recorded for retrying them later
+		rm, err := opentsdb.LoadRetryManifest(manifestPath)
+		if err != nil {
+			t.Fatalf("cannot load retry manifest: %s", err)
+		}
+		if uint64(rm.Len()) != ranges {
+			t.Fatalf("unexpected number of failed queries %d; want %d", rm.Len(), ranges)
+		}
+		for _, q := range rm.Queries {
+			if q.Series.Tags["host"] != "stuck" {
+				t.Fatalf("unexpected series %v in retry manifest", q.Series)
+			}
+		}
+	}
+
+	// stuck series are abandoned without failing the migration
+	f(false, false)
+	// stuck series fail the migration in strict mode
+	f(true, true)
+}
+
+func TestOtsdbProcessorMalformedResponses(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.cpu":    {{Metric: "sys.cpu", Tags: map[string]string{"host": "host1"}}},
+		"sys.broken": {{Metric: "sys.broken", Tags: map[string]string{"host": "host1"}}},
+	}
+	f := func(strict, wantErr bool) {
+		t.Helper()
+		otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+		otsdbSrv.truncateMetrics = map[string]bool{"sys.broken": true}
+		defer otsdbSrv.Close()
+		vmSrv := newFakeVMServer(t)
+		defer vmSrv.Close()
+
+		oc, err := opentsdb.NewClient(opentsdb.Config{
+			Addr:          otsdbSrv.URL,
+			Limit:         100,
+			Retentions:    []string{"sum-1m-avg:1h:1d"},
+			Filters:       []string{"sys"},
+			Retries:       1,
+			RetryInterval: time.Millisecond,
+			Strict:        strict,
+		})
+		if err != nil {
+			t.Fatalf("cannot create OpenTSDB client: %s", err)
+		}
+		im, err := vm.NewImporter(context.Background(), vm.Config{
+			Addr:               vmSrv.URL,
+			Concurrency:        1,
+			DisableProgressBar: true,
+		})
+		if err != nil {
+			t.Fatalf("cannot create importer: %s", err)
+		}
+		manifestPath := filepath.Join(t.TempDir(), "retry.json")
+		op := &otsdbProcessor{
+			oc:       oc,
+			im:       im,
+			otsdbcc:  2,
+			strict:   strict,
+			failures: opentsdb.Failures{Manifest: opentsdb.NewRetryManifest(manifestPath)},
+		}
+		err = op.run(context.Background(), true, false)
+		if wantErr {
+			var sfe *seriesFailedError
+			if !errors.As(err, &sfe) {
+				t.Fatalf("expecting strict mode error; got %v", err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		ranges := uint64(len(oc.Retentions[0].QueryRanges))
+		if n := vmSrv.seriesCount(); n != ranges {
+			t.Fatalf("unexpected number of imported series %d; want %d", n, ranges)
+		}
+		if n := atomic.LoadUint64(&op.malformed); n != ranges {
+			t.Fatalf("unexpected number of skipped queries %d; want %d", n, ranges)
+		}
+		// every malformed response is retried before skipping the series
+		if n := otsdbSrv.queriesCount(); n != 3*ranges {
+			t.Fatalf("unexpected number of queries %d; want %d", n, 3*ranges)
+		}
+		// skipped queries are recorded for retrying them later
+		rm, err := opentsdb.LoadRetryManifest(manifestPath)
+		if err != nil {
+			t.Fatalf("cannot load retry manifest: %s", err)
+		}
+		if uint64(rm.Len()) != ranges {
+			t.Fatalf("unexpected number of failed queries %d; want %d", rm.Len(), ranges)
+		}
+		for _, q := range rm.Queries {
+			if q.Series.Metric != "sys.broken" {
+				t.Fatalf("unexpected series %v in retry manifest", q.Series)
+			}
+		}
+	}
+
+	// series with malformed responses are skipped without failing the migration
+	f(false, false)
+	// malformed responses fail the migration in strict mode
+	f(true, true)
+}
+
+func TestOtsdbProcessorQueryJitter(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.cpu": {
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host1"}},
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host2"}},
+		},
+	}
+	otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+	defer otsdbSrv.Close()
+	vmSrv := newFakeVMServer(t)
+	defer vmSrv.Close()
+
+	oc, err := opentsdb.NewClient(opentsdb.Config{
+		Addr:       otsdbSrv.URL,
+		Limit:      100,
+		Retentions: []string{"sum-1m-avg:1h:1d"},
+		Filters:    []string{"sys"},
+	})
+	if err != nil {
+		t.Fatalf("cannot create OpenTSDB client: %s", err)
+	}
+	im, err := vm.NewImporter(context.Background(), vm.Config{
+		Addr:               vmSrv.URL,
+		Concurrency:        1,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	op := &otsdbProcessor{
+		oc:          oc,
+		im:          im,
+		otsdbcc:     4,
+		queryJitter: 50 * time.Millisecond,
+	}
+	if err := op.run(context.Background(), true, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := 2 * uint64(len(oc.Retentions[0].QueryRanges))
+	if n := otsdbSrv.queriesCount(); n != want {
+		t.Fatalf("unexpected number of queries %d; want %d", n, want)
+	}
+	if n := vmSrv.seriesCount(); n != want {
+		t.Fatalf("unexpected number of imported series %d; want %d", n, want)
+	}
+
+	// the delay is interrupted on cancellation
+	op.queryJitter = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	op.waitJitter(ctx)
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("waitJitter must return on cancellation; waited for %s", d)
+	}
+}
+
+func TestOtsdbProcessorKeepNaN(t *testing.T) {
+	f := func(keepNaN bool, wantSamples int) {
+		t.Helper()
+		otsdbSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`[{"metric":"sys.cpu","tags":{"host":"h1"},"aggregateTags":[],` +
+				`"dps":{"1626019200":1,"1626019260":NaN,"1626019320":null,"1626019380":"NaN"}}]`))
+		}))
+		defer otsdbSrv.Close()
+		vmSrv := newFakeVMServer(t)
+		defer vmSrv.Close()
+
+		oc, err := opentsdb.NewClient(opentsdb.Config{
+			Addr:       otsdbSrv.URL,
+			Retentions: []string{"sum-1m-avg:1h:1d"},
+			FillPolicy: opentsdb.FillPolicyNaN,
+		})
+		if err != nil {
+			t.Fatalf("cannot create OpenTSDB client: %s", err)
+		}
+		im, err := vm.NewImporter(context.Background(), vm.Config{
+			Addr:               vmSrv.URL,
+			Concurrency:        1,
+			DisableProgressBar: true,
+		})
+		if err != nil {
+			t.Fatalf("cannot create importer: %s", err)
+		}
+		op := &otsdbProcessor{oc: oc, im: im, keepNaN: keepNaN}
+		q := queryObj{
+			Series:    opentsdb.Meta{Metric: "sys.cpu", Tags: map[string]string{"host": "h1"}},
+			Rt:        opentsdb.RetentionMeta{FirstOrder: "sum", SecondOrder: "avg", AggTime: "1m"},
+			Tr:        opentsdb.TimeRange{Start: 3600, End: 0},
+			StartTime: testTS + 1800,
+		}
+		n, err := op.do(context.Background(), q)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if n != wantSamples {
+			t.Fatalf("unexpected number of imported samples %d; want %d", n, wantSamples)
+		}
+		im.Close()
+		for vmErr := range im.Errors() {
+			if vmErr.Err != nil {
+				t.Fatalf("unexpected import error: %s", vmErr.Err)
+			}
+		}
+	}
+
+	// missing values are dropped by default
+	f(false, 1)
+	// missing values are imported as NaN
+	f(true, 4)
+}
+
+func TestOtsdbProcessorOutOfOrder(t *testing.T) {
+	f := func(dedup bool, wantSorted, wantOutOfOrder uint64) {
+		t.Helper()
+		otsdbSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`[{"metric":"sys.cpu","tags":{"host":"h1"},"aggregateTags":[],` +
+				`"dps":{"1626019260":2,"1626019200":1,"1626019320":3}}]`))
+		}))
+		defer otsdbSrv.Close()
+		vmSrv := newFakeVMServer(t)
+		defer vmSrv.Close()
+
+		oc, err := opentsdb.NewClient(opentsdb.Config{
+			Addr:       otsdbSrv.URL,
+			Retentions: []string{"sum-1m-avg:1h:1d"},
+		})
+		if err != nil {
+			t.Fatalf("cannot create OpenTSDB client: %s", err)
+		}
+		im, err := vm.NewImporter(context.Background(), vm.Config{
+			Addr:               vmSrv.URL,
+			Concurrency:        1,
+			DisableProgressBar: true,
+		})
+		if err != nil {
+			t.Fatalf("cannot create importer: %s", err)
+		}
+		op := &otsdbProcessor{oc: oc, im: im, dedup: dedup}
+		q := queryObj{
+			Series:    opentsdb.Meta{Metric: "sys.cpu", Tags: map[string]string{"host": "h1"}},
+			Rt:        opentsdb.RetentionMeta{FirstOrder: "sum", SecondOrder: "avg", AggTime: "1m"},
+			Tr:        opentsdb.TimeRange{Start: 3600, End: 0},
+			StartTime: testTS + 1800,
+		}
+		if _, err := op.do(context.Background(), q); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		im.Close()
+		for vmErr := range im.Errors() {
+			if vmErr.Err != nil {
+				t.Fatalf("unexpected import error: %s", vmErr.Err)
+			}
+		}
+		if n := atomic.LoadUint64(&op.sortedSeries); n != wantSorted {
+			t.Fatalf("unexpected number of sorted series %d; want %d", n, wantSorted)
+		}
+		if n := im.StatsSnapshot().OutOfOrderSeries; n != wantOutOfOrder {
+			t.Fatalf("unexpected number of imported out-of-order series %d; want %d", n, wantOutOfOrder)
+		}
+	}
+
+	// out-of-order series are imported as is
+	f(false, 0, 1)
+	// out-of-order series are sorted before the import
+	f(true, 1, 0)
+}
+
+func TestOtsdbProcessorVerify(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.cpu": {
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host1"}},
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host2"}},
+		},
+	}
+	f := func(exportTimestamps []int64, tolerance float64, wantErr bool) {
+		t.Helper()
+		otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1, testTS + 60: 2, testTS + 120: 3, testTS + 180: 4})
+		defer otsdbSrv.Close()
+		vmSrv := newFakeVMServer(t)
+		vmSrv.exportTimestamps = exportTimestamps
+		defer vmSrv.Close()
+
+		oc, err := opentsdb.NewClient(opentsdb.Config{
+			Addr:       otsdbSrv.URL,
+			Limit:      100,
+			Retentions: []string{"sum-1m-avg:1h:1d"},
+			Filters:    []string{"sys"},
+		})
+		if err != nil {
+			t.Fatalf("cannot create OpenTSDB client: %s", err)
+		}
+		vmCfg := vm.Config{
+			Addr:               vmSrv.URL,
+			Concurrency:        1,
+			DisableProgressBar: true,
+		}
+		im, err := vm.NewImporter(context.Background(), vmCfg)
+		if err != nil {
+			t.Fatalf("cannot create importer: %s", err)
+		}
+		vmQuerier, err := vm.NewQuerier(vmCfg)
+		if err != nil {
+			t.Fatalf("cannot create querier: %s", err)
+		}
+		op := &otsdbProcessor{
+			oc:        oc,
+			im:        im,
+			vmQuerier: vmQuerier,
+			verifier:  opentsdb.NewVerifier(1, tolerance, 0),
+		}
+		err = op.run(context.Background(), true, false)
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error: %v; wantErr: %v", err, wantErr)
+		}
+	}
+
+	// the same samples
+	f([]int64{1000, 2000, 3000, 4000}, 0, false)
+	// samples with duplicate timestamps are counted once
+	f([]int64{1000, 2000, 2000, 3000, 4000}, 0, false)
+	// missing samples
+	f([]int64{1000, 2000, 3000}, 0, true)
+	f([]int64{1000, 2000, 3000}, 0.25, false)
+	// extra samples
+	f([]int64{1000, 2000, 3000, 4000, 5000}, 0.1, true)
+	// no data in VictoriaMetrics
+	f(nil, 0.5, true)
+}
+
+func TestOtsdbProcessorMaxInflightSamples(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.cpu": {
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host1"}},
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host2"}},
+		},
+	}
+	otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1, testTS + 60: 2})
+	defer otsdbSrv.Close()
+	vmSrv := newFakeVMServer(t)
+	defer vmSrv.Close()
+
+	oc, err := opentsdb.NewClient(opentsdb.Config{
+		Addr:       otsdbSrv.URL,
+		Limit:      100,
+		Retentions: []string{"sum-1m-avg:1h:1d"},
+		Filters:    []string{"sys"},
+	})
+	if err != nil {
+		t.Fatalf("cannot create OpenTSDB client: %s", err)
+	}
+	// BatchSize is bigger than the fetched data, so samples
+	// stay in-flight until the importer is closed
+	im, err := vm.NewImporter(context.Background(), vm.Config{
+		Addr:               vmSrv.URL,
+		Concurrency:        1,
+		BatchSize:          1e3,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	op := &otsdbProcessor{
+		oc: oc,
+		im: im,
+		// the limit is reached after the first query
+		maxInflightSamples: 2,
+	}
+	if err := op.run(ctx, true, false); err == nil {
+		t.Fatalf("expecting the import to be blocked by in-flight samples limit")
+	}
+	// a few queries could be sent before the first fetched samples
+	// reached the importer, but the rest of queries must be blocked
+	queries := otsdbSrv.queriesCount()
+	if total := uint64(len(series["sys.cpu"]) * len(oc.Retentions[0].QueryRanges)); queries >= total {
+		t.Fatalf("in-flight samples limit must block sending queries; got %d queries out of %d", queries, total)
+	}
+}
+
+func TestProgressMessage(t *testing.T) {
+	f := func(current, total int64, samples uint64, elapsed time.Duration, want string) {
+		t.Helper()
+		if got := progressMessage(current, total, samples, elapsed); got != want {
+			t.Fatalf("unexpected message %q; want %q", got, want)
+		}
+	}
+
+	f(0, 290, 0, time.Minute, "0% (0/290 ranges), 0 samples, ETA ?")
+	f(123, 290, 1234567, 5*time.Minute, "42% (123/290 ranges), 1.2M samples, ETA 6m47s")
+	f(10, 20, 1500, time.Second, "50% (10/20 ranges), 1.5K samples, ETA 1s")
+	f(20, 20, 3e9, time.Hour, "100% (20/20 ranges), 3.0G samples, ETA 0s")
+	f(0, 0, 0, 0, "0% (0/0 ranges), 0 samples, ETA 0s")
+}
+
+func TestQueueStatsMessage(t *testing.T) {
+	f := func(qs vm.QueueStats, wantBackpressure bool) {
+		t.Helper()
+		msg := queueStatsMessage(qs)
+		if got := strings.Contains(msg, "can't keep up"); got != wantBackpressure {
+			t.Fatalf("unexpected backpressure hint in %q; want %v", msg, wantBackpressure)
+		}
+	}
+	f(vm.QueueStats{Capacity: 4, Workers: 1}, false)
+	// the queue is full, while workers still have capacity
+	f(vm.QueueStats{Queued: 4, Capacity: 4, Workers: 2, BusyWorkers: 1}, false)
+	// all the workers are busy, while the queue isn't full
+	f(vm.QueueStats{Queued: 1, Capacity: 4, Workers: 1, BusyWorkers: 1}, false)
+	f(vm.QueueStats{Queued: 4, Capacity: 4, Workers: 1, BusyWorkers: 1, InflightSamples: 100}, true)
+}
+
+func TestOtsdbProcessorWorkers(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.cpu": {
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host1"}},
+			{Metric: "sys.cpu", Tags: map[string]string{"host": "host2"}},
+		},
+	}
+	otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+	defer otsdbSrv.Close()
+	vmSrv := newFakeVMServer(t)
+	defer vmSrv.Close()
+
+	oc, err := opentsdb.NewClient(opentsdb.Config{
+		Addr:       otsdbSrv.URL,
+		Limit:      100,
+		Retentions: []string{"sum-1m-avg:1h:1d"},
+		Filters:    []string{"sys"},
+	})
+	if err != nil {
+		t.Fatalf("cannot create OpenTSDB client: %s", err)
+	}
+	var maxWorkers, maxBusy, maxInflight int64
+	otsdbSrv.onQuery = func(_ *http.Request) {
+		// onQuery is called concurrently, but the max values are only approximate anyway
+		if n := atomic.LoadInt64(&fetchWorkers); n > atomic.LoadInt64(&maxWorkers) {
+			atomic.StoreInt64(&maxWorkers, n)
+		}
+		if n := atomic.LoadInt64(&busyFetchWorkers); n > atomic.LoadInt64(&maxBusy) {
+			atomic.StoreInt64(&maxBusy, n)
+		}
+		if n := oc.InflightRequests(); n > atomic.LoadInt64(&maxInflight) {
+			atomic.StoreInt64(&maxInflight, n)
+		}
+	}
+	im, err := vm.NewImporter(context.Background(), vm.Config{
+		Addr:               vmSrv.URL,
+		Concurrency:        3,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	op := &otsdbProcessor{oc: oc, im: im, otsdbcc: 2, metricCC: 2}
+	if err := op.run(context.Background(), true, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := atomic.LoadInt64(&maxWorkers); n < 1 || n > 2 {
+		t.Fatalf("unexpected number of running fetch workers %d; want 1..2", n)
+	}
+	if n := atomic.LoadInt64(&maxBusy); n < 1 {
+		t.Fatalf("expecting busy fetch workers during queries")
+	}
+	if n := atomic.LoadInt64(&maxInflight); n < 1 {
+		t.Fatalf("expecting in-flight requests during queries")
+	}
+	// all the workers must be stopped after the import
+	if n := atomic.LoadInt64(&fetchWorkers); n != 0 {
+		t.Fatalf("unexpected number of running fetch workers after the import %d", n)
+	}
+	if n := atomic.LoadInt64(&busyFetchWorkers); n != 0 {
+		t.Fatalf("unexpected number of busy fetch workers after the import %d", n)
+	}
+	if n := oc.InflightRequests(); n != 0 {
+		t.Fatalf("unexpected number of in-flight requests after the import %d", n)
+	}
+	want := "Effective concurrency: up to 4 OpenTSDB fetch workers (2 metrics x 2 workers per metric); 3 importer workers"
+	if msg := op.concurrencyMessage(); msg != want {
+		t.Fatalf("unexpected concurrency message\ngot:  %q\nwant: %q", msg, want)
+	}
+	op.retentionCC = []int{3}
+	if n := opentsdb.FetchConcurrency(op.otsdbcc, op.retentionCC); n != 3 {
+		t.Fatalf("unexpected fetch concurrency with per-retention workers %d; want 3", n)
+	}
+}
+
+func TestMsecsTimeValue(t *testing.T) {
+	f := func(args []string, want msecsTimeValue, wantErr bool) {
+		t.Helper()
+		var got msecsTimeValue
+		app := &cli.App{
+			Flags: []cli.Flag{&cli.GenericFlag{Name: otsdbMsecsTime, Value: &msecsTimeValue{}}},
+			Action: func(c *cli.Context) error {
+				got = *c.Generic(otsdbMsecsTime).(*msecsTimeValue)
+				return nil
+			},
+		}
+		err := app.Run(append([]string{"vmctl"}, args...))
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error for %q: %v; want error: %v", args, err, wantErr)
+		}
+		if err == nil && got != want {
+			t.Fatalf("unexpected value for %q: %+v; want %+v", args, got, want)
+		}
+	}
+	f(nil, msecsTimeValue{}, false)
+	// the flag without value is kept for backward compatibility
+	f([]string{"--" + otsdbMsecsTime}, msecsTimeValue{msecs: true}, false)
+	f([]string{"--" + otsdbMsecsTime + "=false"}, msecsTimeValue{}, false)
+	f([]string{"--" + otsdbMsecsTime + "=auto"}, msecsTimeValue{auto: true}, false)
+	f([]string{"--" + otsdbMsecsTime + "=foo"}, msecsTimeValue{}, true)
+}
+
+func TestOtsdbTimeBounds(t *testing.T) {
+	f := func(args []string, msecs bool, wantHardTS, wantMinTS int64, wantErr bool) {
+		t.Helper()
+		var hardTS, minTS int64
+		app := &cli.App{
+			Flags: []cli.Flag{
+				&cli.Int64Flag{Name: otsdbHardTSStart},
+				&cli.Int64Flag{Name: otsdbOffsetDays},
+				&cli.StringFlag{Name: otsdbStartTS},
+				&cli.StringFlag{Name: otsdbEndTS},
+			},
+			Action: func(c *cli.Context) error {
+				var err error
+				hardTS, minTS, err = otsdbTimeBounds(c, msecs)
+				return err
+			},
+		}
+		err := app.Run(append([]string{"vmctl"}, args...))
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error for %q: %v; want error: %v", args, err, wantErr)
+		}
+		if err == nil && (hardTS != wantHardTS || minTS != wantMinTS) {
+			t.Fatalf("unexpected bounds for %q: %d, %d; want %d, %d", args, hardTS, minTS, wantHardTS, wantMinTS)
+		}
+	}
+	f(nil, false, 0, 0, false)
+	f([]string{"--" + otsdbHardTSStart, "1672531200"}, false, 1672531200, 0, false)
+	f([]string{"--" + otsdbStartTS, "2023-01-01T00:00:00Z", "--" + otsdbEndTS, "2023-02-01"}, false, 1675209600, 1672531200, false)
+	f([]string{"--" + otsdbStartTS, "2023-01-01T02:00:00+02:00"}, true, 0, 1672531200000, false)
+	// start-ts can be combined with numeric flags
+	f([]string{"--" + otsdbStartTS, "2023-01-01", "--" + otsdbHardTSStart, "1675209600"}, false, 1675209600, 1672531200, false)
+	f([]string{"--" + otsdbStartTS, "2023-02-01", "--" + otsdbEndTS, "2023-01-01"}, false, 0, 0, true)
+	f([]string{"--" + otsdbEndTS, "2023-01-01", "--" + otsdbHardTSStart, "1675209600"}, false, 0, 0, true)
+	f([]string{"--" + otsdbEndTS, "2023-01-01", "--" + otsdbOffsetDays, "1"}, false, 0, 0, true)
+	f([]string{"--" + otsdbStartTS, "foo"}, false, 0, 0, true)
+}
+
+func TestOtsdbProcessorSortMetrics(t *testing.T) {
+	series := make(map[string][]opentsdb.Meta)
+	for _, metric := range []string{"sys.e", "sys.c", "sys.a", "sys.d", "sys.b"} {
+		series[metric] = []opentsdb.Meta{{Metric: metric, Tags: map[string]string{"host": "host1"}}}
+	}
+	otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1})
+	defer otsdbSrv.Close()
+	vmSrv := newFakeVMServer(t)
+	defer vmSrv.Close()
+
+	// the fake server returns metrics in random order of map iteration
+	var mu sync.Mutex
+	var queried []string
+	otsdbSrv.onQuery = func(r *http.Request) {
+		m := r.URL.Query().Get("m")
+		metric := m[strings.LastIndex(m, ":")+1 : strings.IndexByte(m, '{')]
+		mu.Lock()
+		if len(queried) == 0 || queried[len(queried)-1] != metric {
+			queried = append(queried, metric)
+		}
+		mu.Unlock()
+	}
+	oc, err := opentsdb.NewClient(opentsdb.Config{
+		Addr:       otsdbSrv.URL,
+		Limit:      100,
+		Retentions: []string{"sum-1m-avg:1h:1d"},
+		Filters:    []string{"sys"},
+	})
+	if err != nil {
+		t.Fatalf("cannot create OpenTSDB client: %s", err)
+	}
+	im, err := vm.NewImporter(context.Background(), vm.Config{
+		Addr:               vmSrv.URL,
+		Concurrency:        1,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	op := &otsdbProcessor{oc: oc, im: im, otsdbcc: 1, sortMetrics: true}
+	if err := op.run(context.Background(), true, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := []string{"sys.a", "sys.b", "sys.c", "sys.d", "sys.e"}
+	if !reflect.DeepEqual(queried, want) {
+		t.Fatalf("unexpected order of metrics %q; want %q", queried, want)
+	}
+}
+
+func TestOtsdbOutputConfig(t *testing.T) {
+	f := func(args []string, want otsdbOutputParams, wantErr bool) {
+		t.Helper()
+		var got otsdbOutputParams
+		app := &cli.App{
+			Commands: []*cli.Command{{
+				Name: "opentsdb",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: otsdbOutput, Value: outputVM},
+					&cli.StringFlag{Name: otsdbRemoteWriteURL},
+					&cli.IntFlag{Name: otsdbSeriesChunk},
+					&cli.StringFlag{Name: otsdbOutputDir},
+					&cli.Int64Flag{Name: otsdbOutputFileSize, Value: 1 << 30},
+					&cli.BoolFlag{Name: otsdbIncremental},
+				},
+				Action: func(c *cli.Context) error {
+					var err error
+					got, err = otsdbOutputConfig(c)
+					return err
+				},
+			}},
+		}
+		err := app.Run(append([]string{"vmctl", "opentsdb"}, args...))
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error: %v; wantErr: %v", err, wantErr)
+		}
+		if got != want {
+			t.Fatalf("unexpected output params %+v; want %+v", got, want)
+		}
+	}
+
+	f(nil, otsdbOutputParams{}, false)
+	f([]string{"--output=remote_write", "--remote-write-url=http://prometheus:9090/api/v1/write"},
+		otsdbOutputParams{remoteWriteURL: "http://prometheus:9090/api/v1/write"}, false)
+	f([]string{"--output=remote_write"}, otsdbOutputParams{}, true)
+	f([]string{"--remote-write-url=http://prometheus:9090/api/v1/write"}, otsdbOutputParams{}, true)
+	f([]string{"--output=remote_write", "--remote-write-url=http://prometheus:9090/api/v1/write", "--otsdb-series-chunk=10"},
+		otsdbOutputParams{}, true)
+	f([]string{"--output=file", "--output-dir=/tmp/dump"}, otsdbOutputParams{dir: "/tmp/dump", fileSize: 1 << 30}, false)
+	f([]string{"--output=file", "--output-dir=/tmp/dump", "--output-file-size=1000"}, otsdbOutputParams{dir: "/tmp/dump", fileSize: 1000}, false)
+	f([]string{"--output=file"}, otsdbOutputParams{}, true)
+	f([]string{"--output-dir=/tmp/dump"}, otsdbOutputParams{}, true)
+	f([]string{"--output=file", "--output-dir=/tmp/dump", "--otsdb-incremental"}, otsdbOutputParams{}, true)
+	f([]string{"--output=kafka"}, otsdbOutputParams{}, true)
+}
+
+func TestIsInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	queryCtx, queryCancel := context.WithTimeout(ctx, time.Millisecond)
+	defer queryCancel()
+	<-queryCtx.Done()
+	// the errors of queries exceeding --otsdb-series-timeout must fail the run in strict mode
+	if err := fmt.Errorf("opentsdb error: %w", queryCtx.Err()); isInterrupted(ctx, err) {
+		t.Fatalf("query timeout %q mustn't be treated as interruption", err)
+	}
+	cancel()
+	if err := fmt.Errorf("opentsdb error: %w", ctx.Err()); !isInterrupted(ctx, err) {
+		t.Fatalf("expecting %q to be treated as interruption", err)
+	}
+	if err := errors.New("cannot parse the data"); isInterrupted(ctx, err) {
+		t.Fatalf("unexpected interruption for %q", err)
+	}
+}
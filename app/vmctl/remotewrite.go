@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/backoff"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/vm"
+)
+
+// remoteWriteSink sends the series fetched from OpenTSDB
+// to Prometheus remote write receiver via --output=remote_write.
+// Series are collected into batches of cfg.BatchSize samples
+// and are sent by cfg.Concurrency workers, retrying on errors.
+type remoteWriteSink struct {
+	// inflight is the number of samples accepted by Input,
+	// but not yet sent to the receiver.
+	// It must be the first field for 64-bit alignment on 32-bit platforms
+	inflight int64
+
+	c           *vm.RemoteWriteClient
+	backoff     *backoff.Backoff
+	statsFormat string
+
+	close  chan struct{}
+	input  chan *vm.TimeSeries
+	errors chan *vm.ImportError
+
+	wg   sync.WaitGroup
+	once sync.Once
+
+	s remoteWriteStats
+}
+
+// newRemoteWriteSink starts the workers sending series to remoteWriteURL.
+// Cancelling ctx stops retries of failed requests.
+func newRemoteWriteSink(ctx context.Context, remoteWriteURL string, cfg vm.Config) (*remoteWriteSink, error) {
+	if cfg.Concurrency < 1 {
+		return nil, fmt.Errorf("concurrency can't be lower than 1")
+	}
+	switch cfg.StatsFormat {
+	case "", vm.StatsFormatText, vm.StatsFormatJSON:
+	default:
+		return nil, fmt.Errorf("unsupported stats format %q; supported values are %q and %q",
+			cfg.StatsFormat, vm.StatsFormatText, vm.StatsFormatJSON)
+	}
+	c, err := vm.NewRemoteWriteClient(remoteWriteURL, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = 1e5
+	}
+	rws := &remoteWriteSink{
+		c:           c,
+		backoff:     backoff.New(),
+		statsFormat: cfg.StatsFormat,
+		close:       make(chan struct{}),
+		input:       make(chan *vm.TimeSeries, int(cfg.Concurrency)*4),
+		errors:      make(chan *vm.ImportError, cfg.Concurrency),
+		s:           remoteWriteStats{startTime: time.Now()},
+	}
+	rws.wg.Add(int(cfg.Concurrency))
+	for i := 0; i < int(cfg.Concurrency); i++ {
+		go func() {
+			defer rws.wg.Done()
+			rws.startWorker(ctx, cfg.BatchSize, cfg.FlushInterval)
+		}()
+	}
+	return rws, nil
+}
+
+// Input passes ts to the workers.
+// It returns the first error of workers, so the caller could stop sending series.
+func (rws *remoteWriteSink) Input(ts *vm.TimeSeries) error {
+	// samples are accounted before sending, since workers
+	// may process them before select returns
+	samples := int64(len(ts.Values))
+	atomic.AddInt64(&rws.inflight, samples)
+	select {
+	case <-rws.close:
+		atomic.AddInt64(&rws.inflight, -samples)
+		return fmt.Errorf("remote write sink is closed")
+	case rws.input <- ts:
+		return nil
+	case err := <-rws.errors:
+		atomic.AddInt64(&rws.inflight, -samples)
+		if err != nil && err.Err != nil {
+			return err.Err
+		}
+		return fmt.Errorf("process aborted")
+	}
+}
+
+// Errors returns a channel for receiving remote write errors.
+// Every worker sends the batch left on Close to it as well,
+// with nil Err if the batch was sent successfully.
+func (rws *remoteWriteSink) Errors() chan *vm.ImportError { return rws.errors }
+
+// Close sends the buffered series and waits until the workers are finished
+func (rws *remoteWriteSink) Close() {
+	rws.once.Do(func() {
+		close(rws.close)
+		close(rws.input)
+		rws.wg.Wait()
+		close(rws.errors)
+
+		rws.s.Lock()
+		rws.s.endTime = time.Now()
+		rws.s.Unlock()
+	})
+}
+
+// InflightSamples returns the number of samples accepted by Input,
+// which weren't sent to the receiver yet.
+func (rws *remoteWriteSink) InflightSamples() int64 {
+	return atomic.LoadInt64(&rws.inflight)
+}
+
+func (rws *remoteWriteSink) startWorker(ctx context.Context, batchSize int, flushInterval time.Duration) {
+	var batch []*vm.TimeSeries
+	var samples int
+	var flushC <-chan time.Time
+	if flushInterval > 0 {
+		t := time.NewTicker(flushInterval)
+		defer t.Stop()
+		flushC = t.C
+	}
+	send := func() *vm.ImportError {
+		var err error
+		if len(batch) > 0 {
+			err = rws.write(ctx, batch)
+		}
+		atomic.AddInt64(&rws.inflight, -int64(samples))
+		importErr := &vm.ImportError{Batch: batch, Err: err}
+		// make a new batch, since old one may be referenced by importErr
+		batch, samples = nil, 0
+		return importErr
+	}
+	for {
+		select {
+		case ts, ok := <-rws.input:
+			if !ok {
+				// Close was called, so the rest of series is sent
+				rws.errors <- send()
+				return
+			}
+			batch = append(batch, ts)
+			samples += len(ts.Values)
+			if samples < batchSize {
+				continue
+			}
+		case <-flushC:
+			// send the partially filled batch, so samples
+			// do not wait for the batch to fill up for too long
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := send(); err.Err != nil {
+			rws.errors <- err
+		}
+	}
+}
+
+// write sends batch, retrying on errors until ctx is cancelled
+func (rws *remoteWriteSink) write(ctx context.Context, batch []*vm.TimeSeries) error {
+	var res vm.RemoteWriteResult
+	retryableFunc := func() error {
+		var err error
+		res, err = rws.c.Write(batch)
+		return err
+	}
+	attempts, err := rws.backoff.Retry(ctx, retryableFunc)
+	rws.s.Lock()
+	defer rws.s.Unlock()
+	rws.s.retries += attempts
+	if err != nil {
+		rws.s.errors++
+		return fmt.Errorf("remote write failed with %d retries: %w", attempts, err)
+	}
+	rws.s.samples += uint64(res.Samples)
+	rws.s.series += uint64(res.Series)
+	rws.s.bytes += uint64(res.Bytes)
+	rws.s.sentBytes += uint64(res.SentBytes)
+	rws.s.outOfOrderSeries += uint64(res.OutOfOrderSeries)
+	rws.s.requests++
+	return nil
+}
+
+// StatsSnapshot returns the current stats of rws.
+// The fields which make sense only for VictoriaMetrics importer are left empty.
+func (rws *remoteWriteSink) StatsSnapshot() vm.ImporterStats {
+	rws.s.Lock()
+	defer rws.s.Unlock()
+	st := vm.ImporterStats{
+		Duration:         rws.s.duration(),
+		Samples:          rws.s.samples,
+		Series:           rws.s.series,
+		Bytes:            rws.s.bytes,
+		SentBytes:        rws.s.sentBytes,
+		Requests:         rws.s.requests,
+		Retries:          rws.s.retries,
+		Errors:           rws.s.errors,
+		OutOfOrderSeries: rws.s.outOfOrderSeries,
+	}
+	if st.SentBytes > 0 {
+		st.CompressionRatio = float64(st.Bytes) / float64(st.SentBytes)
+	}
+	if secs := st.Duration.Seconds(); secs > 0 {
+		st.SamplesPerSecond = float64(st.Samples) / secs
+		st.BytesPerSecond = float64(st.Bytes) / secs
+	}
+	return st
+}
+
+// Stats returns rws stats in the configured format
+func (rws *remoteWriteSink) Stats() string {
+	st := rws.StatsSnapshot()
+	if rws.statsFormat == vm.StatsFormatJSON {
+		data, err := json.Marshal(remoteWriteJSONStats{
+			DurationSeconds:  st.Duration.Seconds(),
+			Samples:          st.Samples,
+			SamplesPerSecond: st.SamplesPerSecond,
+			Series:           st.Series,
+			Bytes:            st.Bytes,
+			SentBytes:        st.SentBytes,
+			Requests:         st.Requests,
+			Retries:          st.Retries,
+			Errors:           st.Errors,
+			OutOfOrderSeries: st.OutOfOrderSeries,
+		})
+		if err != nil {
+			return fmt.Sprintf("cannot marshal remote write stats: %s", err)
+		}
+		return string(data)
+	}
+	return fmt.Sprintf("Remote write stats for %q:\n"+
+		"  time spent while importing: %v;\n"+
+		"  total samples: %d;\n"+
+		"  samples/s: %.2f;\n"+
+		"  total series: %d;\n"+
+		"  total bytes: %s;\n"+
+		"  total bytes sent: %s;\n"+
+		"  remote write requests: %d;\n"+
+		"  remote write requests retries: %d;\n"+
+		"  remote write errors: %d;\n"+
+		"  series with out-of-order timestamps: %d;",
+		rws.c.Addr(), st.Duration,
+		st.Samples, st.SamplesPerSecond, st.Series,
+		byteCountSI(int64(st.Bytes)), byteCountSI(int64(st.SentBytes)),
+		st.Requests, st.Retries, st.Errors, st.OutOfOrderSeries)
+}
+
+// remoteWriteStats contains the totals of the series sent by remoteWriteSink
+type remoteWriteStats struct {
+	sync.Mutex
+	samples          uint64
+	series           uint64
+	bytes            uint64
+	sentBytes        uint64
+	requests         uint64
+	retries          uint64
+	errors           uint64
+	outOfOrderSeries uint64
+	startTime        time.Time
+	// endTime is set on remoteWriteSink.Close.
+	// Zero value means the import is still in progress
+	endTime time.Time
+}
+
+// duration returns the duration of the import.
+// Must be called under the lock.
+func (s *remoteWriteStats) duration() time.Duration {
+	if s.endTime.IsZero() {
+		return time.Since(s.startTime)
+	}
+	return s.endTime.Sub(s.startTime)
+}
+
+// remoteWriteJSONStats is a stable representation of remote write stats
+// for parsing by scripts. Field names match the ones of VictoriaMetrics importer stats.
+type remoteWriteJSONStats struct {
+	DurationSeconds  float64 `json:"durationSeconds"`
+	Samples          uint64  `json:"samples"`
+	SamplesPerSecond float64 `json:"samplesPerSecond"`
+	Series           uint64  `json:"series"`
+	Bytes            uint64  `json:"bytes"`
+	SentBytes        uint64  `json:"sentBytes"`
+	Requests         uint64  `json:"requests"`
+	Retries          uint64  `json:"retries"`
+	Errors           uint64  `json:"errors"`
+	OutOfOrderSeries uint64  `json:"outOfOrderSeries"`
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/backoff"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/vm"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/golang/snappy"
+)
+
+func TestRemoteWriteSink(t *testing.T) {
+	var mu sync.Mutex
+	var series, requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		compressed, _ := io.ReadAll(r.Body)
+		data, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Errorf("cannot decode snappy body: %s", err)
+		}
+		var wr prompb.WriteRequest
+		if err := wr.Unmarshal(data); err != nil {
+			t.Errorf("cannot unmarshal write request: %s", err)
+		}
+		mu.Lock()
+		series += len(wr.Timeseries)
+		requests++
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	rws, err := newRemoteWriteSink(context.Background(), srv.URL, vm.Config{
+		Concurrency: 2,
+		BatchSize:   4,
+		RoundDigits: 100,
+	})
+	if err != nil {
+		t.Fatalf("cannot create remote write sink: %s", err)
+	}
+	for i := 0; i < 10; i++ {
+		ts := &vm.TimeSeries{Name: "foo", Timestamps: []int64{1000, 2000}, Values: []float64{1, 2}}
+		if err := rws.Input(ts); err != nil {
+			t.Fatalf("unexpected input error: %s", err)
+		}
+	}
+	rws.Close()
+	for importErr := range rws.Errors() {
+		if importErr.Err != nil {
+			t.Fatalf("unexpected remote write error: %s", importErr.Err)
+		}
+	}
+
+	if n := rws.InflightSamples(); n != 0 {
+		t.Fatalf("unexpected number of in-flight samples %d; want 0", n)
+	}
+	st := rws.StatsSnapshot()
+	if st.Samples != 20 || st.Series != 10 || st.Errors != 0 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if series != 10 {
+		t.Fatalf("unexpected number of received series %d; want 10", series)
+	}
+	// every batch contains 2 series, except of the batches left on Close
+	if requests < 5 || uint64(requests) != st.Requests {
+		t.Fatalf("unexpected number of requests %d; stats: %d", requests, st.Requests)
+	}
+}
+
+func TestRemoteWriteSinkBadRequest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	rws, err := newRemoteWriteSink(context.Background(), srv.URL, vm.Config{Concurrency: 1, BatchSize: 1})
+	if err != nil {
+		t.Fatalf("cannot create remote write sink: %s", err)
+	}
+	ts := &vm.TimeSeries{Name: "foo", Timestamps: []int64{1000}, Values: []float64{1}}
+	if err := rws.Input(ts); err != nil {
+		t.Fatalf("unexpected input error: %s", err)
+	}
+	// client errors aren't retried, so the error is returned immediately
+	importErr := <-rws.Errors()
+	if !errors.Is(importErr.Err, backoff.ErrBadRequest) || len(importErr.Batch) != 1 {
+		t.Fatalf("unexpected error %v for batch of %d series", importErr.Err, len(importErr.Batch))
+	}
+	rws.Close()
+	if st := rws.StatsSnapshot(); st.Errors != 1 || st.Samples != 0 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+func TestNewRemoteWriteSinkInvalid(t *testing.T) {
+	f := func(remoteWriteURL string, cfg vm.Config) {
+		t.Helper()
+		if _, err := newRemoteWriteSink(context.Background(), remoteWriteURL, cfg); err == nil {
+			t.Fatalf("expecting error for URL %q and config %+v", remoteWriteURL, cfg)
+		}
+	}
+
+	f("http://localhost:9090/api/v1/write", vm.Config{})
+	f("http://localhost:9090/api/v1/write", vm.Config{Concurrency: 1, StatsFormat: "xml"})
+	f("localhost:9090/api/v1/write", vm.Config{Concurrency: 1})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/opentsdb"
+)
+
+// buildReport returns the migration report for the run started at startTime.
+// runErr is the error returned by otsdbProcessor.run.
+func (op *otsdbProcessor) buildReport(runErr error, startTime time.Time) opentsdb.Report {
+	r := opentsdb.Report{
+		Version:    opentsdb.ReportVersion,
+		Status:     opentsdb.RunStatusSuccess,
+		StartTime:  startTime.UTC(),
+		FinishTime: time.Now().UTC(),
+		Metrics:    []opentsdb.MetricReport{},
+	}
+	if runErr != nil {
+		r.Status = opentsdb.RunStatusFailed
+		var mre *maxRuntimeError
+		// reaching max runtime is reported via maxRuntimeError, while context.DeadlineExceeded
+		// may be caused by OpenTSDB queries exceeding --otsdb-series-timeout
+		if errors.Is(runErr, context.Canceled) || errors.As(runErr, &mre) {
+			r.Status = opentsdb.RunStatusInterrupted
+		}
+		r.Error = runErr.Error()
+	}
+	if op.noImport {
+		// nothing is imported, so the totals of the read data are reported
+		r.Samples, r.Series = atomic.LoadUint64(&op.samples), atomic.LoadUint64(&op.readSeries)
+	} else if ss, ok := op.im.(statsSnapshotter); ok {
+		st := ss.StatsSnapshot()
+		r.Samples, r.Series, r.Bytes, r.SentBytes, r.ImportErrors = st.Samples, st.Series, st.Bytes, st.SentBytes, st.Errors
+	}
+	discovered := make([]opentsdb.MetricStats, 0, len(op.discovered))
+	for _, ms := range op.discovered {
+		discovered = append(discovered, opentsdb.MetricStats{Metric: ms.metric, Series: len(ms.series)})
+	}
+	r.AddMetrics(&op.timings, &op.failures, discovered, op.emptyMetrics)
+	return r
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/opentsdb"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/vm"
+)
+
+func TestOtsdbProcessorReport(t *testing.T) {
+	series := map[string][]opentsdb.Meta{
+		"sys.ok": {
+			{Metric: "sys.ok", Tags: map[string]string{"host": "host1"}},
+			{Metric: "sys.ok", Tags: map[string]string{"host": "host2"}},
+		},
+		"sys.failed": {
+			{Metric: "sys.failed", Tags: map[string]string{"host": "host1"}},
+		},
+		"sys.empty": {},
+	}
+	f := func(skipErrors bool, wantStatus string, wantMetrics map[string]opentsdb.MetricReport) {
+		t.Helper()
+		otsdbSrv := newFakeOtsdbServer(t, series, map[int64]float64{testTS: 1, testTS + 60: 2})
+		otsdbSrv.failMetrics = map[string]bool{"sys.failed": true}
+		defer otsdbSrv.Close()
+		vmSrv := newFakeVMServer(t)
+		defer vmSrv.Close()
+
+		oc, err := opentsdb.NewClient(opentsdb.Config{
+			Addr:       otsdbSrv.URL,
+			Limit:      100,
+			Retentions: []string{"sum-1m-avg:1h:1d"},
+			Filters:    []string{"sys"},
+			Strict:     true,
+		})
+		if err != nil {
+			t.Fatalf("cannot create OpenTSDB client: %s", err)
+		}
+		im, err := vm.NewImporter(context.Background(), vm.Config{
+			Addr:               vmSrv.URL,
+			Concurrency:        1,
+			DisableProgressBar: true,
+		})
+		if err != nil {
+			t.Fatalf("cannot create importer: %s", err)
+		}
+		op := &otsdbProcessor{
+			oc:         oc,
+			im:         im,
+			otsdbcc:    1,
+			skipErrors: skipErrors,
+		}
+		start := time.Now()
+		runErr := op.run(context.Background(), true, false)
+		r := op.buildReport(runErr, start)
+		if r.Version != opentsdb.ReportVersion {
+			t.Fatalf("unexpected report version %d; want %d", r.Version, opentsdb.ReportVersion)
+		}
+		if r.Status != wantStatus {
+			t.Fatalf("unexpected run status %q; want %q", r.Status, wantStatus)
+		}
+		if (runErr != nil) != (r.Error != "") {
+			t.Fatalf("unexpected report error %q for run error %v", r.Error, runErr)
+		}
+		if r.FinishTime.Before(r.StartTime) {
+			t.Fatalf("finish time %s must be after start time %s", r.FinishTime, r.StartTime)
+		}
+		got := make(map[string]opentsdb.MetricReport, len(r.Metrics))
+		for _, m := range r.Metrics {
+			// duration and bytes depend on the environment
+			if r.Status == opentsdb.RunStatusSuccess && m.Samples > 0 && m.Bytes == 0 {
+				t.Fatalf("expecting non-zero bytes for %q with %d samples", m.Metric, m.Samples)
+			}
+			m.DurationSeconds, m.Bytes = 0, 0
+			got[m.Metric] = m
+		}
+		for metric, want := range wantMetrics {
+			if got[metric] != want {
+				t.Fatalf("unexpected report for %q: %+v; want %+v", metric, got[metric], want)
+			}
+		}
+	}
+
+	// failed queries are skipped and counted for every query range
+	f(true, opentsdb.RunStatusSuccess, map[string]opentsdb.MetricReport{
+		"sys.ok":     {Metric: "sys.ok", Status: opentsdb.MetricStatusDone, Series: 2, Samples: 28},
+		"sys.failed": {Metric: "sys.failed", Status: opentsdb.MetricStatusDone, Series: 1, Errors: 7},
+		"sys.empty":  {Metric: "sys.empty", Status: opentsdb.MetricStatusEmpty},
+	})
+	// the report is built for the failed run as well,
+	// since the first failed query stops the run
+	f(false, opentsdb.RunStatusFailed, map[string]opentsdb.MetricReport{
+		"sys.failed": {Metric: "sys.failed", Status: opentsdb.MetricStatusIncomplete, Series: 1, Errors: 1},
+		"sys.empty":  {Metric: "sys.empty", Status: opentsdb.MetricStatusEmpty},
+	})
+}
@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// WriteFileAtomic atomically writes data to the file at path.
+// The data is written into a temporary file first, which is synced to disk
+// and then renamed to path, so the crash in the middle of write
+// can't leave empty or partially written file at path.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("cannot create %q: %s", tmpPath, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("cannot write to %q: %s", tmpPath, err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("cannot sync %q: %s", tmpPath, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("cannot close %q: %s", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("cannot rename %q to %q: %s", tmpPath, path, err)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir persists the directory entries, such as the renamed file, at dir
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		// directories can't be synced on Windows
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("cannot open dir %q: %s", dir, err)
+	}
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return fmt.Errorf("cannot sync dir %q: %s", dir, err)
+	}
+	return d.Close()
+}
@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	f := func(data string) {
+		t.Helper()
+		if err := WriteFileAtomic(path, []byte(data), 0600); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("cannot read file: %s", err)
+		}
+		if string(got) != data {
+			t.Fatalf("unexpected file contents %q; want %q", got, data)
+		}
+		if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+			t.Fatalf("temporary file must be renamed; got stat error %v", err)
+		}
+	}
+
+	f(`{"foo":1}`)
+	// the existing file is overwritten
+	f(`{"bar":2}`)
+	f(``)
+
+	if err := WriteFileAtomic(filepath.Join(t.TempDir(), "missing", "state.json"), nil, 0600); err == nil {
+		t.Fatalf("expecting error for missing dir")
+	}
+}
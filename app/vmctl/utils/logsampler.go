@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// LogSampler limits the number of logged messages by logging only
+// the first of every n messages. It is used for debug messages logged
+// per request, since there may be millions of requests during the migration.
+// It is safe for concurrent use.
+type LogSampler struct {
+	every uint64
+	n     uint64
+}
+
+// NewLogSampler returns LogSampler logging 1 of every n messages.
+// Zero n means logging every message.
+func NewLogSampler(n uint64) *LogSampler {
+	if n == 0 {
+		n = 1
+	}
+	return &LogSampler{every: n}
+}
+
+// Sample returns whether the next message must be logged.
+// Nil LogSampler logs every message.
+func (ls *LogSampler) Sample() bool {
+	if ls == nil || ls.every == 1 {
+		return true
+	}
+	n := atomic.AddUint64(&ls.n, 1)
+	return (n-1)%ls.every == 0
+}
+
+// Printf logs the message via log.Printf if it is sampled
+func (ls *LogSampler) Printf(format string, args ...interface{}) {
+	if ls.Sample() {
+		log.Printf(format, args...)
+	}
+}
@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLogSampler(t *testing.T) {
+	f := func(ls *LogSampler, messages int, want uint64) {
+		t.Helper()
+		var sampled uint64
+		var wg sync.WaitGroup
+		for i := 0; i < messages; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if ls.Sample() {
+					atomic.AddUint64(&sampled, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		if sampled != want {
+			t.Fatalf("unexpected number of sampled messages %d; want %d", sampled, want)
+		}
+	}
+
+	f(nil, 10, 10)
+	f(NewLogSampler(0), 10, 10)
+	f(NewLogSampler(1), 10, 10)
+	// the first message of every n is sampled
+	f(NewLogSampler(3), 10, 4)
+	f(NewLogSampler(1000), 10, 1)
+}
@@ -2,7 +2,10 @@ package utils
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"net/http"
+	"os"
 	"strings"
 )
 
@@ -23,3 +26,52 @@ func TLSConfig(insecureSkipVerify bool) *tls.Config {
 		InsecureSkipVerify: insecureSkipVerify,
 	}
 }
+
+// TransportWithCerts creates http.Transport object with TLS configuration
+// based on the provided certificate files.
+// See TLSConfigWithCerts for details.
+func TransportWithCerts(certFile, keyFile, CAFile string, insecureSkipVerify bool) (*http.Transport, error) {
+	tlsCfg, err := TLSConfigWithCerts(certFile, keyFile, CAFile, insecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tlsCfg
+	return t, nil
+}
+
+// TLSConfigWithCerts creates tls.Config object from provided arguments.
+// certFile and keyFile are optional and must be set together for client certificate auth.
+// CAFile is optional and is used for verifying the server certificate.
+// Returns error if any of the files can't be loaded.
+func TLSConfigWithCerts(certFile, keyFile, CAFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("TLS cert file and key file must be set together")
+	}
+	var certs []tls.Certificate
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load TLS certificate from cert file %q and key file %q: %w", certFile, keyFile, err)
+		}
+		certs = []tls.Certificate{cert}
+	}
+
+	var rootCAs *x509.CertPool
+	if CAFile != "" {
+		pem, err := os.ReadFile(CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA file %q: %w", CAFile, err)
+		}
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("cannot parse data from CA file %q", CAFile)
+		}
+	}
+
+	return &tls.Config{
+		Certificates:       certs,
+		InsecureSkipVerify: insecureSkipVerify,
+		RootCAs:            rootCAs,
+	}, nil
+}
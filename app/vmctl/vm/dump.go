@@ -0,0 +1,366 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dump files are written by Importer if Config.OutputDir is set.
+// Every file starts with the header line
+//
+//	VMCTLDUMP1 <format> <gzip|none>
+//
+// followed by records with the bodies of import requests in the given format.
+// Every record starts with 20-byte header of little-endian uint32 values:
+// the payload size, the number of series, the number of samples,
+// the payload size before compression and CRC32-C checksum
+// of the preceding header fields and the payload. The payload follows the header.
+
+// DumpFileExt is the extension of dump files
+const DumpFileExt = ".vmdump"
+
+const (
+	dumpMagic            = "VMCTLDUMP1"
+	dumpRecordHeaderSize = 20
+	// maxDumpRecordSize protects from allocating too much memory
+	// when reading the corrupted record header
+	maxDumpRecordSize = 1 << 30
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// dumpFormat returns the import format of dump files for cfg
+func dumpFormat(cfg Config) (string, error) {
+	if len(cfg.ExtraLabels) > 0 {
+		return "", fmt.Errorf("extra labels can't be added to dump files; set them when loading the files instead")
+	}
+	switch cfg.ImportFormat {
+	case "", ImportFormatJSONL:
+		return ImportFormatJSONL, nil
+	case ImportFormatNative:
+		return ImportFormatNative, nil
+	default:
+		return "", fmt.Errorf("unsupported import format %q for dump files; supported values are %q and %q",
+			cfg.ImportFormat, ImportFormatJSONL, ImportFormatNative)
+	}
+}
+
+// dumpWriter writes records to dump files in dir,
+// starting the next file once maxSize is reached.
+type dumpWriter struct {
+	dir     string
+	header  string
+	maxSize int64
+	// prefix of file names is unique per writer,
+	// so the files of different runs don't clash
+	prefix string
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	seq  int
+}
+
+func newDumpWriter(dir, format string, compressed bool, maxSize int64) (*dumpWriter, error) {
+	if maxSize < 0 {
+		return nil, fmt.Errorf("output file size can't be negative; got %d", maxSize)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create output dir: %s", err)
+	}
+	compression := "none"
+	if compressed {
+		compression = "gzip"
+	}
+	return &dumpWriter{
+		dir:     dir,
+		header:  fmt.Sprintf("%s %s %s\n", dumpMagic, format, compression),
+		maxSize: maxSize,
+		prefix:  fmt.Sprintf("%s-%d", format, time.Now().UnixNano()),
+	}, nil
+}
+
+// write writes the record with data to the current file and returns its name
+func (dw *dumpWriter) write(data []byte, series, samples, size int) (string, error) {
+	if len(data) > maxDumpRecordSize {
+		return "", fmt.Errorf("too big dump record of %d bytes; max size is %d bytes", len(data), maxDumpRecordSize)
+	}
+	rec := make([]byte, dumpRecordHeaderSize, dumpRecordHeaderSize+len(data))
+	binary.LittleEndian.PutUint32(rec[0:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(series))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(samples))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(size))
+	crc := crc32.Update(crc32.Checksum(rec[:16], crc32cTable), crc32cTable, data)
+	binary.LittleEndian.PutUint32(rec[16:], crc)
+	rec = append(rec, data...)
+
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if dw.f != nil && dw.maxSize > 0 && dw.size+int64(len(rec)) > dw.maxSize {
+		if err := dw.closeFile(); err != nil {
+			return "", err
+		}
+	}
+	if dw.f == nil {
+		if err := dw.openFile(); err != nil {
+			return "", err
+		}
+	}
+	if _, err := dw.f.Write(rec); err != nil {
+		// drop the partially written record, so the retried one follows the last complete record
+		_ = dw.f.Truncate(dw.size)
+		_, _ = dw.f.Seek(dw.size, io.SeekStart)
+		return "", fmt.Errorf("cannot write to dump file %q: %s", dw.f.Name(), err)
+	}
+	dw.size += int64(len(rec))
+	return dw.f.Name(), nil
+}
+
+func (dw *dumpWriter) openFile() error {
+	path := filepath.Join(dw.dir, fmt.Sprintf("%s-%06d%s", dw.prefix, dw.seq, DumpFileExt))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot create dump file: %s", err)
+	}
+	if _, err := f.WriteString(dw.header); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("cannot write header to dump file %q: %s", path, err)
+	}
+	dw.f = f
+	dw.size = int64(len(dw.header))
+	dw.seq++
+	return nil
+}
+
+func (dw *dumpWriter) closeFile() error {
+	f := dw.f
+	dw.f = nil
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("cannot sync dump file %q: %s", f.Name(), err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("cannot close dump file %q: %s", f.Name(), err)
+	}
+	return nil
+}
+
+// close closes the current file
+func (dw *dumpWriter) close() error {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if dw.f == nil {
+		return nil
+	}
+	return dw.closeFile()
+}
+
+// dumpImport writes tsBatch to the dump file
+func (im *Importer) dumpImport(tsBatch []*TimeSeries) error {
+	start := time.Now()
+	header, write, _, err := im.batchWriter(tsBatch)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	totalBytes, totalSamples, outOfOrder, err := im.encodeBatch(&buf, header, write, tsBatch)
+	if err != nil {
+		return err
+	}
+	path, err := im.dump.write(buf.Bytes(), len(tsBatch), totalSamples, totalBytes)
+	if err != nil {
+		im.accountRequest(start)
+		return err
+	}
+	im.accountImport(start, path, len(tsBatch), totalSamples, totalBytes, buf.Len(), outOfOrder)
+	return nil
+}
+
+// DumpRecord is a record of dump file
+type DumpRecord struct {
+	// Data is the body of import request
+	Data []byte
+	// Series is the number of series in Data
+	Series int
+	// Samples is the number of samples in Data
+	Samples int
+	// Size is the size of Data before compression
+	Size int
+	// Format is the import format of Data
+	Format string
+	// Compressed defines whether Data is gzipped
+	Compressed bool
+}
+
+// DumpReader reads records from dump file
+type DumpReader struct {
+	// Format is the import format of records
+	Format string
+	// Compressed defines whether the records are gzipped
+	Compressed bool
+
+	f      *os.File
+	br     *bufio.Reader
+	offset int64
+}
+
+// OpenDump opens the dump file at path and verifies its header
+func OpenDump(path string) (*DumpReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open dump file: %s", err)
+	}
+	br := bufio.NewReaderSize(f, 64*1024)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("cannot read header of dump file %q: %s", path, err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != dumpMagic {
+		_ = f.Close()
+		return nil, fmt.Errorf("%q isn't a dump file: unexpected header %q", path, strings.TrimSpace(line))
+	}
+	dr := &DumpReader{
+		Format: fields[1],
+		f:      f,
+		br:     br,
+		offset: int64(len(line)),
+	}
+	switch fields[2] {
+	case "gzip":
+		dr.Compressed = true
+	case "none":
+	default:
+		_ = f.Close()
+		return nil, fmt.Errorf("unsupported compression %q in header of dump file %q", fields[2], path)
+	}
+	return dr, nil
+}
+
+// Next returns the next record after verifying its checksum.
+// It returns io.EOF when there are no more records.
+func (dr *DumpReader) Next() (*DumpRecord, error) {
+	var hdr [dumpRecordHeaderSize]byte
+	if _, err := io.ReadFull(dr.br, hdr[:]); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, dr.recordError(err)
+	}
+	n := binary.LittleEndian.Uint32(hdr[0:])
+	if n > maxDumpRecordSize {
+		return nil, dr.recordError(fmt.Errorf("too big record size %d", n))
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(dr.br, data); err != nil {
+		return nil, dr.recordError(err)
+	}
+	crc := crc32.Update(crc32.Checksum(hdr[:16], crc32cTable), crc32cTable, data)
+	if crc != binary.LittleEndian.Uint32(hdr[16:]) {
+		return nil, dr.recordError(fmt.Errorf("checksum mismatch"))
+	}
+	dr.offset += int64(dumpRecordHeaderSize) + int64(n)
+	return &DumpRecord{
+		Data:    data,
+		Series:  int(binary.LittleEndian.Uint32(hdr[4:])),
+		Samples: int(binary.LittleEndian.Uint32(hdr[8:])),
+		Size:    int(binary.LittleEndian.Uint32(hdr[12:])),
+
+		Format:     dr.Format,
+		Compressed: dr.Compressed,
+	}, nil
+}
+
+func (dr *DumpReader) recordError(err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = fmt.Errorf("file is truncated")
+	}
+	return fmt.Errorf("cannot read record of dump file %q at offset %d: %s", dr.f.Name(), dr.offset, err)
+}
+
+// Close closes the dump file
+func (dr *DumpReader) Close() error {
+	return dr.f.Close()
+}
+
+// DumpFiles returns the sorted paths of dump files in dir
+func DumpFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read dump dir: %s", err)
+	}
+	var paths []string
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), DumpFileExt) {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, e.Name()))
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// ImportRecord sends rec read from the dump file to VictoriaMetrics, retrying on errors.
+// The format of rec must match the import format of im.
+func (im *Importer) ImportRecord(ctx context.Context, rec *DumpRecord) error {
+	if im.noImport {
+		return nil
+	}
+	if im.dump != nil {
+		return fmt.Errorf("dump records can be imported only into VictoriaMetrics")
+	}
+	if rec.Format != im.importFormat {
+		return fmt.Errorf("cannot import dump record in %q format via import requests in %q format", rec.Format, im.importFormat)
+	}
+	retryableFunc := func() error { return im.importRecord(rec) }
+	attempts, err := im.backoff.Retry(ctx, retryableFunc)
+	im.s.Lock()
+	im.s.retries += attempts
+	if err != nil {
+		im.s.errors++
+	}
+	im.s.Unlock()
+	importRetries.Add(int(attempts))
+	if err != nil {
+		importErrors.Inc()
+		return fmt.Errorf("import failed with %d retries: %w", attempts, err)
+	}
+	return nil
+}
+
+func (im *Importer) importRecord(rec *DumpRecord) error {
+	start := time.Now()
+	ep := im.nextEndpoint()
+	req, err := http.NewRequest(http.MethodPost, ep.importPath, bytes.NewReader(rec.Data))
+	if err != nil {
+		return fmt.Errorf("cannot create request to %q: %s", ep.addr, err)
+	}
+	setHeaders(req, im.headers)
+	if im.user != "" {
+		req.SetBasicAuth(im.user, im.password)
+	}
+	if rec.Compressed {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	im.rl.Register(len(rec.Data))
+	if err := do(im.c, req); err != nil {
+		im.accountRequest(start)
+		return fmt.Errorf("import request error for %q: %w", ep.addr, err)
+	}
+	im.accountImport(start, ep.addr, rec.Series, rec.Samples, rec.Size, len(rec.Data), 0)
+	return nil
+}
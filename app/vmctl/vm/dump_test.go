@@ -0,0 +1,187 @@
+package vm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestImporterDump(t *testing.T) {
+	f := func(compress bool) {
+		t.Helper()
+		dir := t.TempDir()
+		im, err := NewImporter(context.Background(), Config{
+			// the address isn't used for dump files
+			Addr:               "http://unused:8428",
+			OutputDir:          dir,
+			OutputFileSize:     100,
+			Compress:           compress,
+			Concurrency:        1,
+			DisableProgressBar: true,
+		})
+		if err != nil {
+			t.Fatalf("cannot create importer: %s", err)
+		}
+		batches := [][]*TimeSeries{
+			{{Name: "foo", LabelPairs: []LabelPair{{Name: "host", Value: "a"}}, Timestamps: []int64{1000, 2000}, Values: []float64{1, 2}}},
+			{{Name: "bar", Timestamps: []int64{1000}, Values: []float64{3}}},
+		}
+		var wantBodies []string
+		for _, batch := range batches {
+			if err := im.Import(batch); err != nil {
+				t.Fatalf("unexpected import error: %s", err)
+			}
+			var b bytes.Buffer
+			for _, ts := range batch {
+				if _, err := ts.write(&b); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+			wantBodies = append(wantBodies, b.String())
+		}
+		im.Close()
+		if n := im.StatsSnapshot().Samples; n != 3 {
+			t.Fatalf("unexpected number of dumped samples %d; want 3", n)
+		}
+
+		paths, err := DumpFiles(dir)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// every record exceeds the max file size, so it is written to its own file
+		if len(paths) != len(batches) {
+			t.Fatalf("unexpected number of dump files %d; want %d", len(paths), len(batches))
+		}
+
+		var mu sync.Mutex
+		var gotBodies []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			var body io.Reader = r.Body
+			if r.Header.Get("Content-Encoding") == "gzip" {
+				zr, err := gzip.NewReader(r.Body)
+				if err != nil {
+					t.Errorf("cannot read gzipped body: %s", err)
+				}
+				body = zr
+			}
+			b, _ := io.ReadAll(body)
+			mu.Lock()
+			gotBodies = append(gotBodies, string(b))
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer srv.Close()
+
+		loader, err := NewImporter(context.Background(), Config{
+			Addr:               srv.URL,
+			Concurrency:        1,
+			DisableProgressBar: true,
+		})
+		if err != nil {
+			t.Fatalf("cannot create importer: %s", err)
+		}
+		defer loader.Close()
+		for _, path := range paths {
+			dr, err := OpenDump(path)
+			if err != nil {
+				t.Fatalf("cannot open dump file: %s", err)
+			}
+			if dr.Format != ImportFormatJSONL || dr.Compressed != compress {
+				t.Fatalf("unexpected header of dump file: format %q, compressed %v", dr.Format, dr.Compressed)
+			}
+			for {
+				rec, err := dr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("cannot read dump record: %s", err)
+				}
+				if err := loader.ImportRecord(context.Background(), rec); err != nil {
+					t.Fatalf("unexpected import error: %s", err)
+				}
+			}
+			_ = dr.Close()
+		}
+		if !reflect.DeepEqual(gotBodies, wantBodies) {
+			t.Fatalf("unexpected bodies\n%q\nwant\n%q", gotBodies, wantBodies)
+		}
+		if s := loader.StatsSnapshot(); s.Samples != 3 || s.Series != 2 {
+			t.Fatalf("unexpected stats of loading: %d samples, %d series; want 3 samples, 2 series", s.Samples, s.Series)
+		}
+	}
+
+	f(false)
+	f(true)
+}
+
+func TestDumpReaderCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	dw, err := newDumpWriter(dir, ImportFormatJSONL, false, 0)
+	if err != nil {
+		t.Fatalf("cannot create dump writer: %s", err)
+	}
+	path, err := dw.write([]byte(`{"metric":{"__name__":"foo"},"timestamps":[1],"values":[1]}`), 1, 1, 60)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := dw.close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f := func(data []byte, wantErr string) {
+		t.Helper()
+		path := dir + "/corrupted" + DumpFileExt
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		dr, err := OpenDump(path)
+		if err == nil {
+			_, err = dr.Next()
+			_ = dr.Close()
+		}
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Fatalf("unexpected error %v; want error containing %q", err, wantErr)
+		}
+	}
+
+	flipped := append([]byte{}, data...)
+	flipped[len(flipped)-3] ^= 1
+	f(flipped, "checksum mismatch")
+	f(data[:len(data)-1], "file is truncated")
+	f(data[:len(data)-70], "file is truncated")
+	f([]byte("foo bar\n"), "isn't a dump file")
+	f([]byte("VMCTLDUMP1 jsonl zstd\n"), "unsupported compression")
+}
+
+func TestNewImporterDumpInvalid(t *testing.T) {
+	f := func(cfg Config) {
+		t.Helper()
+		cfg.OutputDir = t.TempDir()
+		cfg.Concurrency = 1
+		cfg.DisableProgressBar = true
+		if _, err := NewImporter(context.Background(), cfg); err == nil {
+			t.Fatalf("expecting error for config %+v", cfg)
+		}
+	}
+
+	f(Config{ImportFormat: ImportFormatCSV})
+	f(Config{ExtraLabels: []string{"job=migration"}})
+	f(Config{OutputFileSize: -1})
+}
@@ -0,0 +1,221 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Querier performs read requests to VictoriaMetrics
+// via Prometheus querying API.
+// See https://docs.victoriametrics.com/#prometheus-querying-api-usage
+type Querier struct {
+	queryPath   string
+	exportPath  string
+	user        string
+	password    string
+	extraLabels map[string]string
+	c           *http.Client
+	headers     http.Header
+}
+
+// NewQuerier creates Querier for VictoriaMetrics configured in cfg.
+// For cluster version (see Config.AccountID) queries are sent via vmselect path,
+// so cfg.Addr must be able to serve both insert and select requests.
+// If multiple addresses are set in cfg.Addr, queries are sent to the first one.
+func NewQuerier(cfg Config) (*Querier, error) {
+	tenant, err := TenantID(cfg.AccountID, cfg.ProjectID)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := parseHeaders(cfg.Headers)
+	if err != nil {
+		return nil, err
+	}
+	addClientHeaders(headers, cfg)
+	var addr string
+	if addrs := splitAddrs(cfg.Addr); len(addrs) > 0 {
+		addr = addrs[0]
+	}
+	prefix := addr
+	if tenant != "" {
+		// see https://docs.victoriametrics.com/Cluster-VictoriaMetrics.html#url-format
+		prefix = fmt.Sprintf("%s/select/%s/prometheus", addr, tenant)
+	}
+	extraLabels := make(map[string]string, len(cfg.ExtraLabels))
+	for _, l := range cfg.ExtraLabels {
+		if k, v, ok := strings.Cut(l, "="); ok {
+			extraLabels[k] = v
+		}
+	}
+	return &Querier{
+		queryPath:   prefix + "/api/v1/query",
+		exportPath:  prefix + "/api/v1/export",
+		user:        cfg.User,
+		password:    cfg.Password,
+		extraLabels: extraLabels,
+		c:           c,
+		headers:     headers,
+	}, nil
+}
+
+// Selector returns series selector matching series with the given labels.
+// Metric name must be passed via __name__ label.
+func Selector(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	sb.WriteString("{")
+	for i, k := range keys {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(k)
+		sb.WriteString("=")
+		sb.WriteString(strconv.Quote(labels[k]))
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
+
+type queryResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		Result []struct {
+			Value [2]interface{} `json:"value"`
+		} `json:"result"`
+	} `json:"data"`
+	Error string `json:"error"`
+}
+
+// LastTimestamp returns the timestamp in milliseconds of the latest sample
+// of series matching the given selector on the time range [start, end].
+// Zero is returned if there are no samples on the time range.
+func (q *Querier) LastTimestamp(ctx context.Context, selector string, start, end time.Time) (int64, error) {
+	window := int64(math.Ceil(end.Sub(start).Seconds()))
+	if window < 1 {
+		window = 1
+	}
+	params := url.Values{}
+	params.Set("query", fmt.Sprintf("max(tlast_over_time(%s[%ds]))", selector, window))
+	params.Set("time", strconv.FormatInt(end.Unix(), 10))
+	body, err := q.get(ctx, q.queryPath, params)
+	if err != nil {
+		return 0, err
+	}
+	var qr queryResponse
+	if err := json.Unmarshal(body, &qr); err != nil {
+		return 0, fmt.Errorf("cannot parse response %q: %s", string(body), err)
+	}
+	if qr.Status != "success" {
+		return 0, fmt.Errorf("unexpected response status %q: %s", qr.Status, qr.Error)
+	}
+	if len(qr.Data.Result) == 0 {
+		return 0, nil
+	}
+	v, ok := qr.Data.Result[0].Value[1].(string)
+	if !ok {
+		return 0, fmt.Errorf("unexpected value %v in response", qr.Data.Result[0].Value[1])
+	}
+	ts, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse timestamp %q: %s", v, err)
+	}
+	return int64(math.Round(ts * 1e3)), nil
+}
+
+type exportRow struct {
+	Metric     map[string]string `json:"metric"`
+	Timestamps []int64           `json:"timestamps"`
+}
+
+// CountSamples returns the number of samples on the time range [start, end]
+// of the series with exactly the given labels and Config.ExtraLabels.
+// Samples with duplicate timestamps are counted once.
+// Metric name must be passed via __name__ label.
+func (q *Querier) CountSamples(ctx context.Context, labels map[string]string, start, end time.Time) (int, error) {
+	want := make(map[string]string, len(labels)+len(q.extraLabels))
+	for k, v := range labels {
+		want[k] = v
+	}
+	for k, v := range q.extraLabels {
+		want[k] = v
+	}
+	params := url.Values{}
+	params.Set("match[]", Selector(want))
+	params.Set("start", formatTime(start))
+	params.Set("end", formatTime(end))
+	body, err := q.get(ctx, q.exportPath, params)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	dec := json.NewDecoder(bytes.NewReader(body))
+	for {
+		var row exportRow
+		if err := dec.Decode(&row); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, fmt.Errorf("cannot parse export response: %s", err)
+		}
+		// selector matches series with extra labels as well,
+		// so they must be skipped
+		if len(row.Metric) != len(want) {
+			continue
+		}
+		for i, ts := range row.Timestamps {
+			// timestamps are sorted, so duplicates are adjacent
+			if i > 0 && ts == row.Timestamps[i-1] {
+				continue
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// formatTime formats t as unix timestamp in seconds with milliseconds precision
+func formatTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixMilli())/1e3, 'f', 3, 64)
+}
+
+func (q *Querier) get(ctx context.Context, path string, params url.Values) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, path+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request to %q: %s", path, err)
+	}
+	setHeaders(req, q.headers)
+	if q.user != "" {
+		req.SetBasicAuth(q.user, q.password)
+	}
+	resp, err := q.c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected error when performing request: %s", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response code %d: %s", resp.StatusCode, string(body))
+	}
+	return body, nil
+}
@@ -0,0 +1,125 @@
+package vm
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQuerierLastTimestamp(t *testing.T) {
+	f := func(accountID string, code int, response string, want int64, wantErr bool) {
+		t.Helper()
+		var gotPath, gotQuery, gotTime string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotPath = r.URL.Path
+			gotQuery = r.URL.Query().Get("query")
+			gotTime = r.URL.Query().Get("time")
+			w.WriteHeader(code)
+			_, _ = w.Write([]byte(response))
+		}))
+		defer srv.Close()
+
+		q, err := NewQuerier(Config{Addr: srv.URL, AccountID: accountID})
+		if err != nil {
+			t.Fatalf("cannot create querier: %s", err)
+		}
+		start, end := time.Unix(1000, 0), time.Unix(4600, 0)
+		got, err := q.LastTimestamp(context.Background(), `{__name__="foo"}`, start, end)
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error: %v; wantErr: %v", err, wantErr)
+		}
+		if got != want {
+			t.Fatalf("unexpected timestamp %d; want %d", got, want)
+		}
+		wantPath := "/api/v1/query"
+		if accountID != "" {
+			wantPath = "/select/" + accountID + "/prometheus/api/v1/query"
+		}
+		if gotPath != wantPath {
+			t.Fatalf("unexpected path %q; want %q", gotPath, wantPath)
+		}
+		if wantQuery := `max(tlast_over_time({__name__="foo"}[3600s]))`; gotQuery != wantQuery {
+			t.Fatalf("unexpected query %q; want %q", gotQuery, wantQuery)
+		}
+		if gotTime != "4600" {
+			t.Fatalf("unexpected time %q; want %q", gotTime, "4600")
+		}
+	}
+
+	f("", http.StatusOK, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[4600,"4500.123"]}]}}`, 4500123, false)
+	f("1:2", http.StatusOK, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[4600,"1200"]}]}}`, 1200000, false)
+	// no data
+	f("", http.StatusOK, `{"status":"success","data":{"resultType":"vector","result":[]}}`, 0, false)
+	f("", http.StatusBadRequest, `{"status":"error","error":"cannot parse query"}`, 0, true)
+	f("", http.StatusOK, `{"status":"error","error":"timeout"}`, 0, true)
+	f("", http.StatusOK, `foo`, 0, true)
+}
+
+func TestQuerierCountSamples(t *testing.T) {
+	f := func(extraLabels []string, code int, response string, wantMatch string, want int, wantErr bool) {
+		t.Helper()
+		var gotPath, gotMatch, gotStart, gotEnd string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotPath = r.URL.Path
+			gotMatch = r.URL.Query().Get("match[]")
+			gotStart = r.URL.Query().Get("start")
+			gotEnd = r.URL.Query().Get("end")
+			w.WriteHeader(code)
+			_, _ = w.Write([]byte(response))
+		}))
+		defer srv.Close()
+
+		q, err := NewQuerier(Config{Addr: srv.URL, ExtraLabels: extraLabels})
+		if err != nil {
+			t.Fatalf("cannot create querier: %s", err)
+		}
+		start, end := time.UnixMilli(1000500), time.Unix(4600, 0)
+		got, err := q.CountSamples(context.Background(), map[string]string{"__name__": "foo", "job": "bar"}, start, end)
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error: %v; wantErr: %v", err, wantErr)
+		}
+		if got != want {
+			t.Fatalf("unexpected samples count %d; want %d", got, want)
+		}
+		if gotPath != "/api/v1/export" {
+			t.Fatalf("unexpected path %q; want %q", gotPath, "/api/v1/export")
+		}
+		if gotMatch != wantMatch {
+			t.Fatalf("unexpected match %q; want %q", gotMatch, wantMatch)
+		}
+		if gotStart != "1000.500" || gotEnd != "4600.000" {
+			t.Fatalf("unexpected time range [%q, %q]", gotStart, gotEnd)
+		}
+	}
+
+	f(nil, http.StatusOK, `{"metric":{"__name__":"foo","job":"bar"},"values":[1,2,3],"timestamps":[1001000,1002000,1003000]}`,
+		`{__name__="foo",job="bar"}`, 3, false)
+	// duplicate timestamps
+	f(nil, http.StatusOK, `{"metric":{"__name__":"foo","job":"bar"},"values":[1,2,3],"timestamps":[1001000,1001000,1003000]}`,
+		`{__name__="foo",job="bar"}`, 2, false)
+	// series with other labels must be ignored
+	f(nil, http.StatusOK, `{"metric":{"__name__":"foo","job":"bar"},"values":[1],"timestamps":[1001000]}
+{"metric":{"__name__":"foo","job":"bar","instance":"baz"},"values":[1,2],"timestamps":[1001000,1002000]}`,
+		`{__name__="foo",job="bar"}`, 1, false)
+	f([]string{"env=prod"}, http.StatusOK, `{"metric":{"__name__":"foo","job":"bar","env":"prod"},"values":[1],"timestamps":[1001000]}`,
+		`{__name__="foo",env="prod",job="bar"}`, 1, false)
+	// no data
+	f(nil, http.StatusOK, ``, `{__name__="foo",job="bar"}`, 0, false)
+	f(nil, http.StatusBadRequest, `cannot parse match`, `{__name__="foo",job="bar"}`, 0, true)
+	f(nil, http.StatusOK, `foo`, `{__name__="foo",job="bar"}`, 0, true)
+}
+
+func TestSelector(t *testing.T) {
+	f := func(labels map[string]string, want string) {
+		t.Helper()
+		if got := Selector(labels); got != want {
+			t.Fatalf("unexpected selector %s; want %s", got, want)
+		}
+	}
+
+	f(nil, `{}`)
+	f(map[string]string{"__name__": "foo"}, `{__name__="foo"}`)
+	f(map[string]string{"__name__": "foo", "job": `b"ar`, "env": "prod"}, `{__name__="foo",env="prod",job="b\"ar"}`)
+}
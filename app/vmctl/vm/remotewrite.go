@@ -0,0 +1,196 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/backoff"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/limiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompbmarshal"
+	"github.com/golang/snappy"
+)
+
+// RemoteWriteClient sends series to Prometheus remote write receiver,
+// so any Prometheus-compatible storage may be the destination.
+// See https://prometheus.io/docs/concepts/remote_write_spec/
+type RemoteWriteClient struct {
+	url string
+	// addr is used in logs and errors, so it mustn't contain credentials
+	addr     string
+	c        *http.Client
+	headers  http.Header
+	user     string
+	password string
+	rl       *limiter.Limiter
+
+	// extraLabels are added to every series,
+	// since remote write receivers don't support extra_label query args
+	extraLabels []LabelPair
+
+	significantFigures int
+	roundDigits        int
+	dedupInterval      int64
+}
+
+// NewRemoteWriteClient returns a client for remote write receiver at remoteWriteURL.
+// Auth, TLS, headers, rate limit, extra labels, rounding and deduplication settings
+// are taken from cfg, while the address, tenant, import format and compression of cfg aren't used.
+func NewRemoteWriteClient(remoteWriteURL string, cfg Config) (*RemoteWriteClient, error) {
+	u, err := url.Parse(remoteWriteURL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse remote write URL %q: %s", remoteWriteURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q of remote write URL %q; supported schemes are http and https",
+			u.Scheme, u.Redacted())
+	}
+	if cfg.AccountID != "" || cfg.ProjectID != "" {
+		return nil, fmt.Errorf("tenant can't be set for remote write; put it into the remote write URL instead")
+	}
+	extraLabels, err := parseExtraLabels(cfg.ExtraLabels)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := parseHeaders(cfg.Headers)
+	if err != nil {
+		return nil, err
+	}
+	addClientHeaders(headers, cfg)
+	return &RemoteWriteClient{
+		url:         remoteWriteURL,
+		addr:        u.Redacted(),
+		c:           c,
+		headers:     headers,
+		user:        cfg.User,
+		password:    cfg.Password,
+		rl:          limiter.NewLimiter(cfg.RateLimit),
+		extraLabels: extraLabels,
+
+		significantFigures: cfg.SignificantFigures,
+		roundDigits:        cfg.RoundDigits,
+		dedupInterval:      cfg.DedupInterval.Milliseconds(),
+	}, nil
+}
+
+// Addr returns the remote write URL without credentials
+func (c *RemoteWriteClient) Addr() string { return c.addr }
+
+// RemoteWriteResult contains the stats of the successful remote write request
+type RemoteWriteResult struct {
+	Series           int
+	Samples          int
+	Bytes            int
+	SentBytes        int
+	OutOfOrderSeries int
+}
+
+// Write sends tsBatch in a single remote write request.
+// Samples of tsBatch are deduplicated and rounded in place according to the client config.
+// Client errors except of 429 are wrapped into backoff.ErrBadRequest, since they mustn't be retried.
+func (c *RemoteWriteClient) Write(tsBatch []*TimeSeries) (RemoteWriteResult, error) {
+	var res RemoteWriteResult
+	var wr prompbmarshal.WriteRequest
+	for _, ts := range tsBatch {
+		if c.dedupInterval > 0 {
+			ts.Timestamps, ts.Values = deduplicateSamples(ts.Timestamps, ts.Values, c.dedupInterval)
+		}
+		ts = roundTimeseriesValue(ts, c.significantFigures, c.roundDigits)
+		if HasOutOfOrderTimestamps(ts.Timestamps) {
+			res.OutOfOrderSeries++
+		}
+		wr.Timeseries = append(wr.Timeseries, newRemoteWriteSeries(ts, c.extraLabels))
+		res.Samples += len(ts.Values)
+	}
+	res.Series = len(tsBatch)
+	data := prompbmarshal.MarshalWriteRequest(nil, &wr)
+	body := snappy.Encode(nil, data)
+	res.Bytes, res.SentBytes = len(data), len(body)
+
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return res, fmt.Errorf("cannot create request to %q: %s", c.addr, err)
+	}
+	setHeaders(req, c.headers)
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	c.rl.Register(len(body))
+	if err := doRemoteWrite(c.c, req); err != nil {
+		return res, fmt.Errorf("remote write request error for %q: %w", c.addr, err)
+	}
+
+	importedBytes.Add(res.Bytes)
+	bytesSent.Add(res.SentBytes)
+	importedSamples.Add(res.Samples)
+	importedSeries.Add(res.Series)
+	outOfOrderSeries.Add(res.OutOfOrderSeries)
+	importRequests.Inc()
+	return res, nil
+}
+
+// newRemoteWriteSeries converts ts into remote write series.
+// Extra labels override the labels of ts with the same name,
+// the same way as VictoriaMetrics does for extra_label query args.
+func newRemoteWriteSeries(ts *TimeSeries, extraLabels []LabelPair) prompbmarshal.TimeSeries {
+	labels := make([]prompbmarshal.Label, 0, len(ts.LabelPairs)+len(extraLabels)+1)
+	labels = append(labels, prompbmarshal.Label{Name: "__name__", Value: ts.Name})
+	for _, lp := range ts.LabelPairs {
+		if hasLabel(extraLabels, lp.Name) {
+			continue
+		}
+		labels = append(labels, prompbmarshal.Label{Name: lp.Name, Value: lp.Value})
+	}
+	for _, lp := range extraLabels {
+		labels = append(labels, prompbmarshal.Label{Name: lp.Name, Value: lp.Value})
+	}
+	samples := make([]prompbmarshal.Sample, len(ts.Values))
+	for i, v := range ts.Values {
+		samples[i] = prompbmarshal.Sample{Value: v, Timestamp: ts.Timestamps[i]}
+	}
+	return prompbmarshal.TimeSeries{Labels: labels, Samples: samples}
+}
+
+func hasLabel(labels []LabelPair, name string) bool {
+	for _, lp := range labels {
+		if lp.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// doRemoteWrite performs the remote write request.
+// Unlike import requests, any 2xx response means success, since receivers
+// respond with different codes. Client errors except of 429 aren't retried.
+func doRemoteWrite(c *http.Client, req *http.Request) error {
+	resp, err := c.Do(req)
+	if err != nil {
+		return fmt.Errorf("unexpected error when performing request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode/100 == 2 {
+		// drain the body, so the connection could be re-used
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body for status code %d: %w", resp.StatusCode, err)
+	}
+	re := &ResponseError{StatusCode: resp.StatusCode, Body: string(body)}
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		re.err = backoff.ErrBadRequest
+	}
+	return re
+}
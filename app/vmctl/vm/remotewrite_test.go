@@ -0,0 +1,137 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/backoff"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/golang/snappy"
+)
+
+func TestRemoteWriteClientWrite(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	var series []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, r.URL.Path)
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" ||
+			r.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+			t.Errorf("unexpected remote write headers %v", r.Header)
+		}
+		if user, password, ok := r.BasicAuth(); !ok || user != "foo" || password != "bar" {
+			t.Errorf("unexpected basic auth %q:%q", user, password)
+		}
+		compressed, _ := io.ReadAll(r.Body)
+		data, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Errorf("cannot decode snappy body: %s", err)
+		}
+		var wr prompb.WriteRequest
+		if err := wr.Unmarshal(data); err != nil {
+			t.Errorf("cannot unmarshal write request: %s", err)
+		}
+		for _, ts := range wr.Timeseries {
+			var sb strings.Builder
+			for _, l := range ts.Labels {
+				sb.WriteString(string(l.Name) + "=" + string(l.Value) + ",")
+			}
+			for _, s := range ts.Samples {
+				fmt.Fprintf(&sb, " %d:%g", s.Timestamp, s.Value)
+			}
+			series = append(series, sb.String())
+		}
+		// any 2xx code means success
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c, err := NewRemoteWriteClient(srv.URL+"/api/v1/write", Config{
+		User:        "foo",
+		Password:    "bar",
+		Concurrency: 1,
+		ExtraLabels: []string{"job=migration"},
+		RoundDigits: 100,
+	})
+	if err != nil {
+		t.Fatalf("cannot create remote write client: %s", err)
+	}
+	batch := []*TimeSeries{
+		{
+			Name:       "cpu",
+			LabelPairs: []LabelPair{{Name: "host", Value: "h1"}, {Name: "job", Value: "otsdb"}},
+			Timestamps: []int64{1000, 2000},
+			Values:     []float64{1, 2.5},
+		},
+		{
+			Name:       "mem",
+			Timestamps: []int64{1000},
+			Values:     []float64{3},
+		},
+	}
+	res, err := c.Write(batch)
+	if err != nil {
+		t.Fatalf("unexpected write error: %s", err)
+	}
+	if res.Series != 2 || res.Samples != 3 || res.SentBytes == 0 {
+		t.Fatalf("unexpected write result %+v", res)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(paths, []string{"/api/v1/write"}) {
+		t.Fatalf("unexpected requests %v", paths)
+	}
+	// extra labels override the labels of series
+	want := []string{
+		"__name__=cpu,host=h1,job=migration, 1000:1 2000:2.5",
+		"__name__=mem,job=migration, 1000:3",
+	}
+	if !reflect.DeepEqual(series, want) {
+		t.Fatalf("unexpected series\n%q\nwant\n%q", series, want)
+	}
+}
+
+func TestRemoteWriteClientBadRequest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("out of order sample"))
+	}))
+	defer srv.Close()
+
+	c, err := NewRemoteWriteClient(srv.URL, Config{Concurrency: 1})
+	if err != nil {
+		t.Fatalf("cannot create remote write client: %s", err)
+	}
+	_, err = c.Write([]*TimeSeries{{Name: "foo", Timestamps: []int64{1}, Values: []float64{1}}})
+	// client errors mustn't be retried
+	if !errors.Is(err, backoff.ErrBadRequest) || !strings.Contains(err.Error(), "out of order sample") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var re *ResponseError
+	if !errors.As(err, &re) || re.StatusCode != http.StatusBadRequest || re.Body != "out of order sample" {
+		t.Fatalf("expecting response error with status code 400; got %v", err)
+	}
+}
+
+func TestNewRemoteWriteClientInvalid(t *testing.T) {
+	f := func(remoteWriteURL string, cfg Config) {
+		t.Helper()
+		if _, err := NewRemoteWriteClient(remoteWriteURL, cfg); err == nil {
+			t.Fatalf("expecting error for URL %q and config %+v", remoteWriteURL, cfg)
+		}
+	}
+
+	f("localhost:9090/api/v1/write", Config{})
+	f("http://localhost:9090/api/v1/write", Config{AccountID: "1"})
+	f("http://localhost:9090/api/v1/write", Config{ExtraLabels: []string{"job"}})
+}
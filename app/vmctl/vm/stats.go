@@ -1,34 +1,330 @@
 package vm
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"sync"
 	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// Supported formats for Importer.Stats
+const (
+	StatsFormatText = "text"
+	StatsFormatJSON = "json"
+)
+
+// Importer metrics exposed by vmctl at /metrics page.
+// They are accumulated across all the importers.
+// The metrics are registered in a separate set, since the default set
+// may contain metrics of VictoriaMetrics components, which don't work in vmctl.
+var (
+	metricsSet = metrics.NewSet()
+
+	importedSamples = metricsSet.NewCounter(`vmctl_imported_samples_total`)
+	importedSeries  = metricsSet.NewCounter(`vmctl_imported_series_total`)
+	importedBytes   = metricsSet.NewCounter(`vmctl_imported_bytes_total`)
+	bytesSent       = metricsSet.NewCounter(`vmctl_bytes_sent_total`)
+	importRequests  = metricsSet.NewCounter(`vmctl_import_requests_total`)
+	importRetries   = metricsSet.NewCounter(`vmctl_import_retries_total`)
+	importErrors    = metricsSet.NewCounter(`vmctl_import_errors_total`)
+
+	outOfOrderSeries = metricsSet.NewCounter(`vmctl_out_of_order_series_total`)
+)
+
+// Queue metrics are calculated over the importers which weren't closed yet.
+var (
+	importersMu sync.Mutex
+	importers   = make(map[*Importer]struct{})
+
+	_ = metricsSet.NewGauge(`vmctl_import_queue_series`, func() float64 {
+		return float64(totalQueueStats().Queued)
+	})
+	_ = metricsSet.NewGauge(`vmctl_import_inflight_samples`, func() float64 {
+		return float64(totalQueueStats().InflightSamples)
+	})
+	_ = metricsSet.NewGauge(`vmctl_import_busy_workers`, func() float64 {
+		return float64(totalQueueStats().BusyWorkers)
+	})
+	_ = metricsSet.NewGauge(`vmctl_import_workers`, func() float64 {
+		return float64(totalQueueStats().Workers)
+	})
 )
 
+func registerImporter(im *Importer) {
+	importersMu.Lock()
+	importers[im] = struct{}{}
+	importersMu.Unlock()
+}
+
+func unregisterImporter(im *Importer) {
+	importersMu.Lock()
+	delete(importers, im)
+	importersMu.Unlock()
+}
+
+// totalQueueStats returns the sum of queue stats of all the registered importers
+func totalQueueStats() QueueStats {
+	importersMu.Lock()
+	defer importersMu.Unlock()
+	var total QueueStats
+	for im := range importers {
+		qs := im.QueueStats()
+		total.Queued += qs.Queued
+		total.Capacity += qs.Capacity
+		total.InflightSamples += qs.InflightSamples
+		total.BusyWorkers += qs.BusyWorkers
+		total.Workers += qs.Workers
+	}
+	return total
+}
+
+// WriteMetrics writes importer metrics to w in Prometheus text exposition format
+func WriteMetrics(w io.Writer) {
+	metricsSet.WritePrometheus(w)
+}
+
+// peakRateWindow is the minimal duration over which
+// the peak import rate is calculated
+const peakRateWindow = 10 * time.Second
+
 type stats struct {
 	sync.Mutex
 	samples      uint64
+	series       uint64
 	bytes        uint64
+	sentBytes    uint64
 	requests     uint64
 	retries      uint64
+	errors       uint64
 	startTime    time.Time
 	idleDuration time.Duration
+	// endTime is set on Importer.Close.
+	// Zero value means the import is still in progress
+	endTime time.Time
+
+	// outOfOrderSeries is the number of imported series
+	// with timestamps not sorted in ascending order
+	outOfOrderSeries uint64
+
+	// httpRequests is the number of HTTP requests sent to VictoriaMetrics,
+	// including the failed and retried ones.
+	// requestsDuration is the total duration of these requests
+	httpRequests     uint64
+	requestsDuration time.Duration
+
+	// the samples and bytes imported since windowStart
+	// are accumulated for calculating the peak rates
+	windowStart   time.Time
+	windowSamples uint64
+	windowBytes   uint64
+	peakSamplesPS float64
+	peakBytesPS   float64
+}
+
+// add accounts the samples and bytes imported at the given time.
+// Must be called under the lock.
+func (s *stats) add(now time.Time, samples, bytes uint64) {
+	s.samples += samples
+	s.bytes += bytes
+
+	if s.windowStart.IsZero() {
+		s.windowStart = s.startTime
+	}
+	s.windowSamples += samples
+	s.windowBytes += bytes
+	d := now.Sub(s.windowStart)
+	if d < peakRateWindow {
+		return
+	}
+	if v := float64(s.windowSamples) / d.Seconds(); v > s.peakSamplesPS {
+		s.peakSamplesPS = v
+	}
+	if v := float64(s.windowBytes) / d.Seconds(); v > s.peakBytesPS {
+		s.peakBytesPS = v
+	}
+	s.windowStart = now
+	s.windowSamples, s.windowBytes = 0, 0
+}
+
+// duration returns the wall-clock duration of the import
+// from ResetStats till Close. Must be called under the lock.
+func (s *stats) duration() time.Duration {
+	if s.endTime.IsZero() {
+		return time.Since(s.startTime)
+	}
+	return s.endTime.Sub(s.startTime)
+}
+
+// compressionRatio returns the ratio of the imported bytes before compression
+// to the bytes sent over the network. Must be called under the lock.
+func (s *stats) compressionRatio() float64 {
+	if s.sentBytes == 0 {
+		return 0
+	}
+	return float64(s.bytes) / float64(s.sentBytes)
+}
+
+// avgRequestDuration returns the average duration of HTTP requests
+// to VictoriaMetrics. Must be called under the lock.
+func (s *stats) avgRequestDuration() time.Duration {
+	if s.httpRequests == 0 {
+		return 0
+	}
+	return s.requestsDuration / time.Duration(s.httpRequests)
+}
+
+// rates returns average and peak rates of the imported samples and bytes.
+// Peak rates are never lower than the average ones, since the import
+// may be shorter than peakRateWindow. Must be called under the lock.
+func (s *stats) rates() (samplesPS, bytesPS, peakSamplesPS, peakBytesPS float64) {
+	if d := s.duration().Seconds(); d > 0 {
+		samplesPS = float64(s.samples) / d
+		bytesPS = float64(s.bytes) / d
+	}
+	peakSamplesPS, peakBytesPS = s.peakSamplesPS, s.peakBytesPS
+	if peakSamplesPS < samplesPS {
+		peakSamplesPS = samplesPS
+	}
+	if peakBytesPS < bytesPS {
+		peakBytesPS = bytesPS
+	}
+	return samplesPS, bytesPS, peakSamplesPS, peakBytesPS
+}
+
+// ImporterStats is a snapshot of Importer stats.
+// See Importer.StatsSnapshot.
+type ImporterStats struct {
+	// Duration is the duration of the import since Importer.ResetStats
+	// till Importer.Close, or till now if the importer isn't closed yet
+	Duration time.Duration
+	// IdleDuration is the total time workers spent waiting for data
+	IdleDuration time.Duration
+	Samples      uint64
+	Series       uint64
+	// Bytes is the size of the imported data before compression
+	Bytes uint64
+	// SentBytes is the size of the data sent over the network
+	SentBytes uint64
+	// Requests is the number of successful import requests
+	Requests uint64
+	Retries  uint64
+	// Errors is the number of import requests failed after all the retries
+	Errors uint64
+	// OutOfOrderSeries is the number of imported series
+	// with timestamps not sorted in ascending order
+	OutOfOrderSeries uint64
+	// CompressionRatio is the ratio of Bytes to SentBytes
+	CompressionRatio float64
+	// HTTPRequests is the number of HTTP requests to VictoriaMetrics,
+	// including the failed and retried ones
+	HTTPRequests uint64
+	// AvgRequestDuration is the average duration of HTTPRequests
+	AvgRequestDuration time.Duration
+
+	SamplesPerSecond     float64
+	BytesPerSecond       float64
+	PeakSamplesPerSecond float64
+	PeakBytesPerSecond   float64
+}
+
+func (s *stats) snapshot() ImporterStats {
+	s.Lock()
+	defer s.Unlock()
+
+	samplesPS, bytesPS, peakSamplesPS, peakBytesPS := s.rates()
+	return ImporterStats{
+		Duration:             s.duration(),
+		IdleDuration:         s.idleDuration,
+		Samples:              s.samples,
+		Series:               s.series,
+		Bytes:                s.bytes,
+		SentBytes:            s.sentBytes,
+		Requests:             s.requests,
+		Retries:              s.retries,
+		Errors:               s.errors,
+		OutOfOrderSeries:     s.outOfOrderSeries,
+		CompressionRatio:     s.compressionRatio(),
+		HTTPRequests:         s.httpRequests,
+		AvgRequestDuration:   s.avgRequestDuration(),
+		SamplesPerSecond:     samplesPS,
+		BytesPerSecond:       bytesPS,
+		PeakSamplesPerSecond: peakSamplesPS,
+		PeakBytesPerSecond:   peakBytesPS,
+	}
+}
+
+// jsonStats is a stable representation of stats
+// for parsing by scripts
+type jsonStats struct {
+	DurationSeconds      float64 `json:"durationSeconds"`
+	IdleDurationSeconds  float64 `json:"idleDurationSeconds"`
+	Samples              uint64  `json:"samples"`
+	SamplesPerSecond     float64 `json:"samplesPerSecond"`
+	PeakSamplesPerSecond float64 `json:"peakSamplesPerSecond"`
+	Series               uint64  `json:"series"`
+	Bytes                uint64  `json:"bytes"`
+	BytesPerSecond       float64 `json:"bytesPerSecond"`
+	PeakBytesPerSecond   float64 `json:"peakBytesPerSecond"`
+	SentBytes            uint64  `json:"sentBytes"`
+	SentBytesPerSecond   float64 `json:"sentBytesPerSecond"`
+	Requests             uint64  `json:"requests"`
+	Retries              uint64  `json:"retries"`
+	Errors               uint64  `json:"errors"`
+	OutOfOrderSeries     uint64  `json:"outOfOrderSeries"`
+
+	CompressionRatio          float64 `json:"compressionRatio"`
+	HTTPRequests              uint64  `json:"httpRequests"`
+	AvgRequestDurationSeconds float64 `json:"avgRequestDurationSeconds"`
+}
+
+// JSON returns stats serialized into a single-line JSON object
+func (s *stats) JSON() string {
+	ss := s.snapshot()
+	duration := ss.Duration.Seconds()
+	js := jsonStats{
+		DurationSeconds:      duration,
+		IdleDurationSeconds:  ss.IdleDuration.Seconds(),
+		Samples:              ss.Samples,
+		SamplesPerSecond:     ss.SamplesPerSecond,
+		PeakSamplesPerSecond: ss.PeakSamplesPerSecond,
+		Series:               ss.Series,
+		Bytes:                ss.Bytes,
+		BytesPerSecond:       ss.BytesPerSecond,
+		PeakBytesPerSecond:   ss.PeakBytesPerSecond,
+		SentBytes:            ss.SentBytes,
+		Requests:             ss.Requests,
+		Retries:              ss.Retries,
+		Errors:               ss.Errors,
+		OutOfOrderSeries:     ss.OutOfOrderSeries,
+
+		CompressionRatio:          ss.CompressionRatio,
+		HTTPRequests:              ss.HTTPRequests,
+		AvgRequestDurationSeconds: ss.AvgRequestDuration.Seconds(),
+	}
+	if duration > 0 {
+		js.SentBytesPerSecond = float64(ss.SentBytes) / duration
+	}
+	data, err := json.Marshal(js)
+	if err != nil {
+		logger.Panicf("BUG: cannot marshal stats: %s", err)
+	}
+	return string(data)
 }
 
 func (s *stats) String() string {
 	s.Lock()
 	defer s.Unlock()
 
-	totalImportDuration := time.Since(s.startTime)
+	totalImportDuration := s.duration()
 	totalImportDurationS := totalImportDuration.Seconds()
-	var samplesPerS float64
-	if s.samples > 0 && totalImportDurationS > 0 {
-		samplesPerS = float64(s.samples) / totalImportDurationS
-	}
-	bytesPerS := byteCountSI(0)
-	if s.bytes > 0 && totalImportDurationS > 0 {
-		bytesPerS = byteCountSI(int64(float64(s.bytes) / totalImportDurationS))
+	samplesPerS, bytesPS, peakSamplesPerS, peakBytesPS := s.rates()
+	sentBytesPerS := byteCountSI(0)
+	if s.sentBytes > 0 && totalImportDurationS > 0 {
+		sentBytesPerS = byteCountSI(int64(float64(s.sentBytes) / totalImportDurationS))
 	}
 
 	return fmt.Sprintf("VictoriaMetrics importer stats:\n"+
@@ -36,12 +332,21 @@ func (s *stats) String() string {
 		"  time spent while importing: %v;\n"+
 		"  total samples: %d;\n"+
 		"  samples/s: %.2f;\n"+
+		"  peak samples/s: %.2f;\n"+
 		"  total bytes: %s;\n"+
 		"  bytes/s: %s;\n"+
+		"  peak bytes/s: %s;\n"+
+		"  total bytes sent: %s;\n"+
+		"  bytes sent/s: %s;\n"+
+		"  compression ratio: %.2f;\n"+
 		"  import requests: %d;\n"+
-		"  import requests retries: %d;",
+		"  import requests retries: %d;\n"+
+		"  HTTP requests: %d;\n"+
+		"  avg request duration: %v;\n"+
+		"  series with out-of-order timestamps: %d;",
 		s.idleDuration, totalImportDuration,
-		s.samples, samplesPerS,
-		byteCountSI(int64(s.bytes)), bytesPerS,
-		s.requests, s.retries)
+		s.samples, samplesPerS, peakSamplesPerS,
+		byteCountSI(int64(s.bytes)), byteCountSI(int64(bytesPS)), byteCountSI(int64(peakBytesPS)),
+		byteCountSI(int64(s.sentBytes)), sentBytesPerS, s.compressionRatio(),
+		s.requests, s.retries, s.httpRequests, s.avgRequestDuration(), s.outOfOrderSeries)
 }
@@ -0,0 +1,91 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsJSON(t *testing.T) {
+	s := &stats{
+		samples:      100,
+		series:       10,
+		bytes:        2048,
+		sentBytes:    1024,
+		requests:     2,
+		retries:      1,
+		errors:       1,
+		startTime:    time.Now().Add(-10 * time.Second),
+		idleDuration: time.Second,
+
+		outOfOrderSeries: 3,
+
+		httpRequests:     4,
+		requestsDuration: 2 * time.Second,
+	}
+	data := s.JSON()
+	if strings.Contains(data, "\n") {
+		t.Fatalf("stats must be printed on a single line; got %q", data)
+	}
+	var js jsonStats
+	if err := json.Unmarshal([]byte(data), &js); err != nil {
+		t.Fatalf("cannot parse stats %q: %s", data, err)
+	}
+	if js.Samples != 100 || js.Series != 10 || js.Bytes != 2048 || js.SentBytes != 1024 || js.Requests != 2 || js.Retries != 1 || js.Errors != 1 || js.OutOfOrderSeries != 3 {
+		t.Fatalf("unexpected stats %+v", js)
+	}
+	if js.DurationSeconds < 10 || js.IdleDurationSeconds != 1 {
+		t.Fatalf("unexpected durations in stats %+v", js)
+	}
+	if js.SamplesPerSecond <= 0 || js.SamplesPerSecond > 10 {
+		t.Fatalf("unexpected samples/s in stats %+v", js)
+	}
+	if js.SentBytesPerSecond <= 0 || js.SentBytesPerSecond >= js.BytesPerSecond {
+		t.Fatalf("unexpected sent bytes/s in stats %+v", js)
+	}
+	if js.CompressionRatio != 2 || js.HTTPRequests != 4 || js.AvgRequestDurationSeconds != 0.5 {
+		t.Fatalf("unexpected network stats %+v", js)
+	}
+}
+
+func TestStatsRates(t *testing.T) {
+	start := time.Now().Add(-time.Minute)
+	s := &stats{startTime: start}
+	// 100 samples/s during the first window
+	s.add(start.Add(peakRateWindow), 1000, 10000)
+	// 300 samples/s during the second window
+	s.add(start.Add(2*peakRateWindow), 3000, 30000)
+	// partial window isn't accounted in peak rates
+	s.add(start.Add(2*peakRateWindow+time.Second), 1000, 10000)
+	s.endTime = start.Add(50 * time.Second)
+
+	if d := s.duration(); d != 50*time.Second {
+		t.Fatalf("duration must be calculated till endTime; got %s", d)
+	}
+	samplesPS, bytesPS, peakSamplesPS, peakBytesPS := s.rates()
+	if samplesPS != 100 || bytesPS != 1000 {
+		t.Fatalf("unexpected average rates %.2f samples/s and %.2f bytes/s; want 100 and 1000", samplesPS, bytesPS)
+	}
+	if peakSamplesPS != 300 || peakBytesPS != 3000 {
+		t.Fatalf("unexpected peak rates %.2f samples/s and %.2f bytes/s; want 300 and 3000", peakSamplesPS, peakBytesPS)
+	}
+
+	// peak rates are at least average ones for imports shorter than peakRateWindow
+	s = &stats{startTime: start}
+	s.add(start.Add(time.Second), 500, 5000)
+	s.endTime = start.Add(5 * time.Second)
+	samplesPS, bytesPS, peakSamplesPS, peakBytesPS = s.rates()
+	if samplesPS != 100 || peakSamplesPS != samplesPS || peakBytesPS != bytesPS {
+		t.Fatalf("unexpected rates %.2f samples/s with peak %.2f and %.2f bytes/s with peak %.2f",
+			samplesPS, peakSamplesPS, bytesPS, peakBytesPS)
+	}
+}
+
+func TestNewImporterInvalidStatsFormat(t *testing.T) {
+	_, err := NewImporter(context.Background(), Config{Concurrency: 1, StatsFormat: "xml"})
+	if err == nil {
+		t.Fatalf("expecting error for unsupported stats format")
+	}
+}
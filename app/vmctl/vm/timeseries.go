@@ -3,6 +3,24 @@ package vm
 import (
 	"fmt"
 	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/decimal"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/encoding"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
+)
+
+const (
+	// ImportFormatJSONL is a JSON line format of import requests
+	ImportFormatJSONL = "jsonl"
+	// ImportFormatPrometheus is a Prometheus text exposition format of import requests
+	ImportFormatPrometheus = "prometheus"
+	// ImportFormatCSV is a CSV format of import requests
+	ImportFormatCSV = "csv"
+	// ImportFormatNative is a VictoriaMetrics native format of import requests
+	ImportFormatNative = "native"
 )
 
 // TimeSeries represents a time series.
@@ -90,3 +108,239 @@ func (ts *TimeSeries) write(w io.Writer) (int, error) {
 	}
 	return cw.n, cw.err
 }
+
+var promLabelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// foo{bar="baz"} 66 1567296000000
+func (ts *TimeSeries) writePrometheus(w io.Writer) (int, error) {
+	cw := &cWriter{w: w}
+	labels := ts.Name
+	if len(ts.LabelPairs) > 0 {
+		var sb strings.Builder
+		sb.WriteString(ts.Name)
+		sb.WriteString("{")
+		for i, lp := range ts.LabelPairs {
+			if i > 0 {
+				sb.WriteString(",")
+			}
+			fmt.Fprintf(&sb, "%s=\"%s\"", lp.Name, promLabelValueReplacer.Replace(lp.Value))
+		}
+		sb.WriteString("}")
+		labels = sb.String()
+	}
+	for i := range ts.Timestamps {
+		cw.printf("%s %v %d\n", labels, ts.Values[i], ts.Timestamps[i])
+	}
+	return cw.n, cw.err
+}
+
+// csvLayout defines columns of a CSV import request.
+// Columns with label values go first, followed by a value column per each metric name.
+// The last column contains timestamps, since VictoriaMetrics doesn't count
+// empty trailing column and rejects such lines.
+// See https://docs.victoriametrics.com/#how-to-import-csv-data
+type csvLayout struct {
+	labels  []string
+	metrics []string
+	// labelCols and metricCols map names to column indexes
+	// relative to the first column of the group
+	labelCols  map[string]int
+	metricCols map[string]int
+}
+
+func newCSVLayout(tsBatch []*TimeSeries) (*csvLayout, error) {
+	cl := &csvLayout{
+		labelCols:  make(map[string]int),
+		metricCols: make(map[string]int),
+	}
+	for _, ts := range tsBatch {
+		if _, ok := cl.metricCols[ts.Name]; !ok {
+			if strings.Contains(ts.Name, ",") {
+				return nil, fmt.Errorf("metric name %q can't be imported in csv format, since it contains comma", ts.Name)
+			}
+			cl.metricCols[ts.Name] = 0
+			cl.metrics = append(cl.metrics, ts.Name)
+		}
+		for _, lp := range ts.LabelPairs {
+			if _, ok := cl.labelCols[lp.Name]; !ok {
+				if strings.Contains(lp.Name, ",") {
+					return nil, fmt.Errorf("label name %q can't be imported in csv format, since it contains comma", lp.Name)
+				}
+				cl.labelCols[lp.Name] = 0
+				cl.labels = append(cl.labels, lp.Name)
+			}
+		}
+	}
+	sort.Strings(cl.labels)
+	sort.Strings(cl.metrics)
+	for i, name := range cl.labels {
+		cl.labelCols[name] = i
+	}
+	for i, name := range cl.metrics {
+		cl.metricCols[name] = i
+	}
+	return cl, nil
+}
+
+// format returns the value of format query arg for cl
+func (cl *csvLayout) format() string {
+	var sb strings.Builder
+	col := 1
+	for _, name := range cl.labels {
+		fmt.Fprintf(&sb, "%d:label:%s,", col, name)
+		col++
+	}
+	for _, name := range cl.metrics {
+		fmt.Fprintf(&sb, "%d:metric:%s,", col, name)
+		col++
+	}
+	fmt.Fprintf(&sb, "%d:time:unix_ms", col)
+	return sb.String()
+}
+
+// x64,host_19,,66,1567296000000
+func (cl *csvLayout) write(ts *TimeSeries, w io.Writer) (int, error) {
+	labelValues := make([]string, len(cl.labels))
+	for _, lp := range ts.LabelPairs {
+		labelValues[cl.labelCols[lp.Name]] = csvQuote(lp.Value)
+	}
+	labels := strings.Join(labelValues, ",")
+	if len(labelValues) > 0 {
+		labels += ","
+	}
+	metricCol := cl.metricCols[ts.Name]
+	before := strings.Repeat(",", metricCol)
+	after := strings.Repeat(",", len(cl.metrics)-metricCol)
+
+	cw := &cWriter{w: w}
+	for i := range ts.Timestamps {
+		cw.printf("%s%s%v%s%d\n", labels, before, ts.Values[i], after, ts.Timestamps[i])
+	}
+	return cw.n, cw.err
+}
+
+func csvQuote(s string) string {
+	if !strings.ContainsAny(s, ",\"\n\r") {
+		return s
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// nativeMaxRowsPerBlock is the max number of samples in a single native block.
+// It matches the max number of rows per block in VictoriaMetrics storage.
+const nativeMaxRowsPerBlock = 8 * 1024
+
+// nativeTimeRange returns the time range header of a native import request
+// covering all the samples in tsBatch. VictoriaMetrics drops samples outside of it.
+func nativeTimeRange(tsBatch []*TimeSeries) []byte {
+	minTs, maxTs := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, ts := range tsBatch {
+		for _, t := range ts.Timestamps {
+			if t < minTs {
+				minTs = t
+			}
+			if t > maxTs {
+				maxTs = t
+			}
+		}
+	}
+	if minTs > maxTs {
+		minTs, maxTs = 0, 0
+	}
+	dst := make([]byte, 0, 16)
+	dst = encoding.MarshalInt64(dst, minTs)
+	dst = encoding.MarshalInt64(dst, maxTs)
+	return dst
+}
+
+// nativeEncoder marshals series into native blocks.
+// Every block is prefixed with the marshaled metric name.
+// See https://docs.victoriametrics.com/#how-to-import-data-in-native-format
+type nativeEncoder struct {
+	mn       storage.MetricName
+	b        storage.Block
+	tsid     storage.TSID
+	values   []int64
+	mnBuf    []byte
+	blockBuf []byte
+	buf      []byte
+}
+
+func (ne *nativeEncoder) write(ts *TimeSeries, w io.Writer) (int, error) {
+	// tags order doesn't matter, since VictoriaMetrics sorts labels on ingestion
+	ne.mn.Reset()
+	ne.mn.MetricGroup = append(ne.mn.MetricGroup, ts.Name...)
+	for _, lp := range ts.LabelPairs {
+		ne.mn.AddTag(lp.Name, lp.Value)
+	}
+	ne.mnBuf = ne.mn.Marshal(ne.mnBuf[:0])
+
+	timestamps, values := ts.Timestamps, ts.Values
+	if HasOutOfOrderTimestamps(timestamps) {
+		// native blocks must contain samples ordered by timestamp
+		timestamps, values = sortSamples(timestamps, values)
+	}
+	var n int
+	for len(timestamps) > 0 {
+		size := nativeMaxRowsPerBlock
+		if size > len(timestamps) {
+			size = len(timestamps)
+		}
+		var scale int16
+		ne.values, scale = decimal.AppendFloatToDecimal(ne.values[:0], values[:size])
+		ne.b.Init(&ne.tsid, timestamps[:size], ne.values, scale, 64)
+		ne.blockBuf = ne.b.MarshalPortable(ne.blockBuf[:0])
+
+		ne.buf = encoding.MarshalUint32(ne.buf[:0], uint32(len(ne.mnBuf)))
+		ne.buf = append(ne.buf, ne.mnBuf...)
+		ne.buf = encoding.MarshalUint32(ne.buf, uint32(len(ne.blockBuf)))
+		ne.buf = append(ne.buf, ne.blockBuf...)
+		written, err := w.Write(ne.buf)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		timestamps, values = timestamps[size:], values[size:]
+	}
+	return n, nil
+}
+
+// HasOutOfOrderTimestamps returns whether timestamps aren't sorted in ascending order.
+// Duplicate timestamps aren't considered out of order.
+func HasOutOfOrderTimestamps(timestamps []int64) bool {
+	for i := 1; i < len(timestamps); i++ {
+		if timestamps[i] < timestamps[i-1] {
+			return true
+		}
+	}
+	return false
+}
+
+// deduplicateSamples leaves at most one sample per dedupInterval in milliseconds
+// the same way as VictoriaMetrics does for -dedup.minScrapeInterval.
+// storage.DeduplicateSamples expects samples sorted by timestamp,
+// so out-of-order samples are sorted first.
+func deduplicateSamples(timestamps []int64, values []float64, dedupInterval int64) ([]int64, []float64) {
+	if HasOutOfOrderTimestamps(timestamps) {
+		timestamps, values = sortSamples(timestamps, values)
+	}
+	return storage.DeduplicateSamples(timestamps, values, dedupInterval)
+}
+
+// sortSamples returns copies of timestamps and values sorted by timestamp
+func sortSamples(timestamps []int64, values []float64) ([]int64, []float64) {
+	idx := make([]int, len(timestamps))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		return timestamps[idx[i]] < timestamps[idx[j]]
+	})
+	sortedTimestamps := make([]int64, len(idx))
+	sortedValues := make([]float64, len(idx))
+	for i, j := range idx {
+		sortedTimestamps[i] = timestamps[j]
+		sortedValues[i] = values[j]
+	}
+	return sortedTimestamps, sortedValues
+}
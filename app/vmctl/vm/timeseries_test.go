@@ -2,9 +2,18 @@ package vm
 
 import (
 	"bytes"
+	"fmt"
 	"math"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/protoparser/common"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/protoparser/csvimport"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/protoparser/native/stream"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/protoparser/prometheus"
 )
 
 func TestTimeSeries_Write(t *testing.T) {
@@ -87,3 +96,261 @@ func TestTimeSeries_Write(t *testing.T) {
 		})
 	}
 }
+
+func TestTimeSeries_WritePrometheus(t *testing.T) {
+	f := func(ts *TimeSeries, exp string) {
+		t.Helper()
+		var b bytes.Buffer
+		n, err := ts.writePrometheus(&b)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if n != b.Len() {
+			t.Fatalf("unexpected number of written bytes %d; want %d", n, b.Len())
+		}
+		if got := b.String(); got != exp {
+			t.Fatalf("unexpected output\ngot:\n%s\nwant:\n%s", got, exp)
+		}
+
+		var rows prometheus.Rows
+		rows.UnmarshalWithErrLogger(b.String(), func(s string) {
+			t.Fatalf("cannot parse output: %s", s)
+		})
+		var got []string
+		for _, r := range rows.Rows {
+			labels := make([]string, 0, len(r.Tags))
+			for _, tag := range r.Tags {
+				labels = append(labels, fmt.Sprintf("%s=%q", tag.Key, tag.Value))
+			}
+			got = append(got, fmt.Sprintf("%s{%s} %v %d", r.Metric, strings.Join(labels, ","), r.Value, r.Timestamp))
+		}
+		var want []string
+		for i := range ts.Timestamps {
+			labels := make([]string, 0, len(ts.LabelPairs))
+			for _, lp := range ts.LabelPairs {
+				labels = append(labels, fmt.Sprintf("%s=%q", lp.Name, lp.Value))
+			}
+			want = append(want, fmt.Sprintf("%s{%s} %v %d", ts.Name, strings.Join(labels, ","), ts.Values[i], ts.Timestamps[i]))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected parsed rows\ngot:  %q\nwant: %q", got, want)
+		}
+	}
+
+	f(&TimeSeries{
+		Name:       "foo",
+		Timestamps: []int64{1577877162200, 1577877162300},
+		Values:     []float64{1, 1.5},
+	}, "foo 1 1577877162200\nfoo 1.5 1577877162300\n")
+	f(&TimeSeries{
+		Name:       "sys.cpu.user",
+		LabelPairs: []LabelPair{{Name: "host", Value: "a"}, {Name: "path", Value: `C:\tmp "x"` + "\n"}},
+		Timestamps: []int64{1577877162200},
+		Values:     []float64{-2},
+	}, `sys.cpu.user{host="a",path="C:\\tmp \"x\"\n"} -2 1577877162200`+"\n")
+}
+
+func TestCSVLayout(t *testing.T) {
+	tsBatch := []*TimeSeries{
+		{
+			Name:       "foo",
+			LabelPairs: []LabelPair{{Name: "host", Value: "a"}},
+			Timestamps: []int64{1000, 2000},
+			Values:     []float64{1, 2},
+		},
+		{
+			Name:       "bar",
+			LabelPairs: []LabelPair{{Name: "dc", Value: `eu,"1"`}, {Name: "host", Value: "b"}},
+			Timestamps: []int64{3000},
+			Values:     []float64{3},
+		},
+	}
+	cl, err := newCSVLayout(tsBatch)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := cl.format(), "1:label:dc,2:label:host,3:metric:bar,4:metric:foo,5:time:unix_ms"; got != want {
+		t.Fatalf("unexpected format %q; want %q", got, want)
+	}
+	var b bytes.Buffer
+	for _, ts := range tsBatch {
+		if _, err := cl.write(ts, &b); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	exp := ",a,,1,1000\n" +
+		",a,,2,2000\n" +
+		`"eu,""1""",b,3,,3000` + "\n"
+	if got := b.String(); got != exp {
+		t.Fatalf("unexpected output\ngot:\n%s\nwant:\n%s", got, exp)
+	}
+
+	cds, err := csvimport.ParseColumnDescriptors(cl.format())
+	if err != nil {
+		t.Fatalf("cannot parse format: %s", err)
+	}
+	var rows csvimport.Rows
+	rows.Unmarshal(b.String(), cds)
+	var got []string
+	for _, r := range rows.Rows {
+		var labels []string
+		for _, tag := range r.Tags {
+			if tag.Value != "" {
+				labels = append(labels, fmt.Sprintf("%s=%q", tag.Key, tag.Value))
+			}
+		}
+		got = append(got, fmt.Sprintf("%s{%s} %v %d", r.Metric, strings.Join(labels, ","), r.Value, r.Timestamp))
+	}
+	want := []string{
+		`foo{host="a"} 1 1000`,
+		`foo{host="a"} 2 2000`,
+		`bar{dc="eu,\"1\"",host="b"} 3 3000`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected parsed rows\ngot:  %q\nwant: %q", got, want)
+	}
+
+	if _, err := newCSVLayout([]*TimeSeries{{Name: "foo,bar"}}); err == nil {
+		t.Fatalf("expecting error for metric name with comma")
+	}
+	if _, err := newCSVLayout([]*TimeSeries{{Name: "foo", LabelPairs: []LabelPair{{Name: "a,b", Value: "c"}}}}); err == nil {
+		t.Fatalf("expecting error for label name with comma")
+	}
+}
+
+func TestHasOutOfOrderTimestamps(t *testing.T) {
+	f := func(timestamps []int64, want bool) {
+		t.Helper()
+		if got := HasOutOfOrderTimestamps(timestamps); got != want {
+			t.Fatalf("unexpected result for %v: %v; want %v", timestamps, got, want)
+		}
+	}
+
+	f(nil, false)
+	f([]int64{1}, false)
+	f([]int64{1, 2, 3}, false)
+	// duplicates aren't out of order
+	f([]int64{1, 2, 2, 3}, false)
+	f([]int64{2, 1}, true)
+	f([]int64{1, 3, 2, 4}, true)
+}
+
+func TestDeduplicateSamples(t *testing.T) {
+	f := func(timestamps []int64, values []float64, interval int64, wantTimestamps []int64, wantValues []float64) {
+		t.Helper()
+		gotTimestamps, gotValues := deduplicateSamples(timestamps, values, interval)
+		if !reflect.DeepEqual(gotTimestamps, wantTimestamps) || !reflect.DeepEqual(gotValues, wantValues) {
+			t.Fatalf("unexpected samples %v %v; want %v %v", gotTimestamps, gotValues, wantTimestamps, wantValues)
+		}
+	}
+
+	f([]int64{}, []float64{}, 10, []int64{}, []float64{})
+	f([]int64{1000}, []float64{1}, 10, []int64{1000}, []float64{1})
+	// samples sparser than the interval are left as is
+	f([]int64{1000, 2000, 3000}, []float64{1, 2, 3}, 1000, []int64{1000, 2000, 3000}, []float64{1, 2, 3})
+	// the last sample is left per every interval aligned to it
+	f([]int64{1000, 1500, 2000, 2500, 3000}, []float64{1, 2, 3, 4, 5}, 1000,
+		[]int64{1000, 2000, 3000}, []float64{1, 3, 5})
+	f([]int64{1, 1000, 1500, 2999, 3001}, []float64{1, 2, 3, 4, 5}, 3000,
+		[]int64{2999, 3001}, []float64{4, 5})
+	// the biggest value is left for equal timestamps
+	f([]int64{1000, 2000, 2000}, []float64{1, 3, 2}, 1000, []int64{1000, 2000}, []float64{1, 3})
+	// out-of-order samples are sorted
+	f([]int64{2500, 1000, 2000, 1500}, []float64{4, 1, 3, 2}, 1000, []int64{1000, 2000, 2500}, []float64{1, 3, 4})
+}
+
+func TestNativeEncoder(t *testing.T) {
+	common.StartUnmarshalWorkers()
+	defer common.StopUnmarshalWorkers()
+
+	long := &TimeSeries{Name: "long", LabelPairs: []LabelPair{{Name: "job", Value: "node"}}}
+	for i := 0; i < 2*nativeMaxRowsPerBlock+10; i++ {
+		long.Timestamps = append(long.Timestamps, 1577877162000+int64(i)*1000)
+		long.Values = append(long.Values, float64(i)*0.5)
+	}
+	tsBatch := []*TimeSeries{
+		{
+			Name:       "foo",
+			LabelPairs: []LabelPair{{Name: "job", Value: "x"}, {Name: "host", Value: "a"}},
+			Timestamps: []int64{1577877162200, 1577877162100, 1577877162300},
+			Values:     []float64{2, 1, 3},
+		},
+		{
+			Name:       "sys.cpu.user",
+			Timestamps: []int64{1577877162001},
+			Values:     []float64{-1.25e10},
+		},
+		long,
+	}
+
+	var b bytes.Buffer
+	b.Write(nativeTimeRange(tsBatch))
+	ne := &nativeEncoder{}
+	for _, ts := range tsBatch {
+		n, err := ne.write(ts, &b)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if n == 0 {
+			t.Fatalf("expecting non-zero number of written bytes for %s", ts.Name)
+		}
+	}
+
+	type samples struct {
+		timestamps []int64
+		values     []float64
+	}
+	var mu sync.Mutex
+	got := make(map[string]*samples)
+	blocks := 0
+	err := stream.Parse(&b, false, func(block *stream.Block) error {
+		mu.Lock()
+		defer mu.Unlock()
+		blocks++
+		key := block.MetricName.String()
+		s := got[key]
+		if s == nil {
+			s = &samples{}
+			got[key] = s
+		}
+		s.timestamps = append(s.timestamps, block.Timestamps...)
+		s.values = append(s.values, block.Values...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("cannot parse native data: %s", err)
+	}
+	if blocks != 5 {
+		t.Fatalf("unexpected number of blocks %d; want 5", blocks)
+	}
+
+	f := func(key string, timestamps []int64, values []float64) {
+		t.Helper()
+		s := got[key]
+		if s == nil {
+			t.Fatalf("missing series %s in %v", key, got)
+		}
+		idx := make([]int, len(s.timestamps))
+		for i := range idx {
+			idx[i] = i
+		}
+		sort.Slice(idx, func(i, j int) bool { return s.timestamps[idx[i]] < s.timestamps[idx[j]] })
+		gotTimestamps := make([]int64, len(idx))
+		gotValues := make([]float64, len(idx))
+		for i, j := range idx {
+			gotTimestamps[i], gotValues[i] = s.timestamps[j], s.values[j]
+		}
+		if !reflect.DeepEqual(gotTimestamps, timestamps) {
+			t.Fatalf("unexpected timestamps for %s; got %v; want %v", key, gotTimestamps, timestamps)
+		}
+		if !reflect.DeepEqual(gotValues, values) {
+			t.Fatalf("unexpected values for %s; got %v; want %v", key, gotValues, values)
+		}
+	}
+	f(`foo{job="x",host="a"}`, []int64{1577877162100, 1577877162200, 1577877162300}, []float64{1, 2, 3})
+	f(`sys.cpu.user{}`, []int64{1577877162001}, []float64{-1.25e10})
+	f(`long{job="node"}`, long.Timestamps, long.Values)
+	if len(got) != 3 {
+		t.Fatalf("unexpected number of series %d; want 3", len(got))
+	}
+}
@@ -7,15 +7,21 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/backoff"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/barpool"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/limiter"
+	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmctl/utils"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/decimal"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
 	"github.com/cheggaaa/pb/v3"
 )
 
@@ -25,18 +31,48 @@ type Config struct {
 	// VictoriaMetrics address to perform import requests
 	//   --httpListenAddr value for single node version
 	//   --httpListenAddr value of vmselect  component for cluster version
+	// Multiple comma-separated addresses may be set, so import requests
+	// are spread among them in round-robin manner.
 	Addr string
 	// Concurrency defines number of worker
 	// performing the import requests concurrently
 	Concurrency uint8
 	// Whether to apply gzip compression
 	Compress bool
+	// CompressLevel defines gzip compression level if Compress is set.
+	// See compress/gzip for supported values. Zero value means gzip.BestSpeed
+	CompressLevel int
 	// AccountID for cluster version.
+	// It may be set in accountID:projectID form.
 	// Empty value assumes it is a single node version
 	AccountID string
+	// ProjectID for cluster version. Requires AccountID to be set
+	// and can't be combined with AccountID in accountID:projectID form.
+	ProjectID string
+	// ImportFormat defines the format of import requests.
+	// Supported values are "jsonl", "prometheus", "csv" and "native".
+	// Empty value means "jsonl".
+	ImportFormat string
+	// OutputDir is an optional path to the directory for dump files.
+	// If set, the import request bodies are written to the files in the directory
+	// instead of sending them, so they could be loaded into VictoriaMetrics later
+	// via Importer.ImportRecord. Only "jsonl" and "native" ImportFormat are supported then,
+	// and Compress defines whether the bodies are gzipped.
+	OutputDir string
+	// OutputFileSize is the max size of dump file in bytes, after reaching which
+	// the next file is started. Zero value means the size isn't limited.
+	OutputFileSize int64
+	// ImportPath overrides the default import path for ImportFormat,
+	// for example "/api/v1/import/prometheus".
+	// For cluster version the path is relative to /insert/<tenant>/prometheus.
+	ImportPath string
 	// BatchSize defines how many samples
 	// importer collects before sending the import request
 	BatchSize int
+	// FlushInterval defines the max duration samples are collected
+	// before sending the import request, even if BatchSize isn't reached.
+	// Zero value means samples are sent only when BatchSize is reached.
+	FlushInterval time.Duration
 	// User name for basic auth
 	User string
 	// Password for basic auth
@@ -48,36 +84,104 @@ type Config struct {
 	// RoundDigits defines the number of decimal digits after the point that must be left
 	// in metric values before importing.
 	RoundDigits int
+	// DedupInterval defines the interval, at most one sample per which is left
+	// for every series before importing, the same way as VictoriaMetrics does
+	// for -dedup.minScrapeInterval. Zero value disables the deduplication.
+	DedupInterval time.Duration
 	// ExtraLabels that will be added to all imported series. Must be in label=value format.
 	ExtraLabels []string
 	// RateLimit defines a data transfer speed in bytes per second.
-	// Is applied to each worker (see Concurrency) independently.
+	// It is shared among all the workers (see Concurrency) and is applied
+	// to the bytes sent over the network, e.g. after compression.
+	// Zero value means no limit.
 	RateLimit int64
 	// Whether to disable progress bar per VM worker
 	DisableProgressBar bool
+	// StatsFormat defines the format of Importer.Stats output.
+	// Supported values are "text" and "json". Empty value means "text".
+	StatsFormat string
+	// TLSCAFile, TLSCertFile and TLSKeyFile are optional paths to the TLS files
+	// used for connecting to VictoriaMetrics via https.
+	// TLSCertFile and TLSKeyFile are required for mutual TLS.
+	TLSCAFile   string
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSInsecureSkipVerify defines whether to skip TLS certificate verification
+	TLSInsecureSkipVerify bool
+	// Headers is an optional list of HTTP headers in "Name: value" format
+	// sent with every request to VictoriaMetrics
+	Headers []string
+	// UserAgent is sent in User-Agent header with every request to VictoriaMetrics.
+	// Go's default User-Agent is sent if it is empty
+	UserAgent string
+	// RequestID is an optional ID sent in X-Request-Id header with every request to VictoriaMetrics
+	RequestID string
+	// LogRequests defines whether to log import requests at debug level
+	LogRequests bool
+	// LogSampleRate defines that only 1 of every LogSampleRate import requests
+	// is logged if LogRequests is set. Zero value means logging every request.
+	LogSampleRate uint64
+
+	// NoImport defines whether to drop the series instead of sending them
+	// to VictoriaMetrics. The connectivity to VictoriaMetrics isn't checked then,
+	// so the read speed of the source could be measured without VictoriaMetrics.
+	NoImport bool
 }
 
 // Importer performs insertion of timeseries
 // via VictoriaMetrics import protocol
 // see https://docs.victoriametrics.com/#how-to-import-time-series-data
 type Importer struct {
-	addr       string
-	importPath string
-	compress   bool
-	user       string
-	password   string
+	// inflight is the number of samples accepted by Input,
+	// but not yet sent to VictoriaMetrics.
+	// It must be the first field for 64-bit alignment on 32-bit platforms
+	inflight int64
+
+	// endpoints contains the addresses import requests are spread among
+	endpoints []endpoint
+	// c is used for all requests to VictoriaMetrics
+	c *http.Client
+	// headers are set to all requests to VictoriaMetrics
+	headers http.Header
+	// next is the index of endpoint for the next import request
+	next     uint32
+	compress bool
+	user     string
+	password string
+	// compressLevel is gzip level used if compress is set
+	compressLevel int
+	// importFormat is the format of import requests
+	importFormat string
+	// busy is the number of workers sending import requests at the moment
+	busy        int32
+	concurrency int
 
 	close  chan struct{}
 	input  chan *TimeSeries
 	errors chan *ImportError
+	// flushCh contains a channel per worker for Flush requests
+	flushCh []chan chan *ImportError
 
 	rl *limiter.Limiter
 
 	wg   sync.WaitGroup
 	once sync.Once
 
-	s       *stats
-	backoff *backoff.Backoff
+	s           *stats
+	statsFormat string
+	backoff     *backoff.Backoff
+
+	// requestLog samples import requests logged if Config.LogRequests is set.
+	// It is nil if requests aren't logged.
+	requestLog *utils.LogSampler
+
+	// noImport defines whether to drop the series instead of importing them
+	noImport bool
+	// dedupInterval is the deduplication interval in milliseconds
+	dedupInterval int64
+
+	// dump writes the import request bodies to files if Config.OutputDir is set
+	dump *dumpWriter
 }
 
 // ResetStats resets im stats.
@@ -87,61 +191,216 @@ func (im *Importer) ResetStats() {
 	}
 }
 
-// Stats returns im stats.
+// QueueStats contains the state of Importer queue.
+// The full queue with all the workers busy means
+// VictoriaMetrics can't keep up with the incoming data.
+type QueueStats struct {
+	// Queued is the number of series waiting in the input queue
+	Queued int
+	// Capacity is the capacity of the input queue
+	Capacity int
+	// InflightSamples is the number of samples accepted by Input,
+	// which weren't sent to VictoriaMetrics yet
+	InflightSamples int64
+	// BusyWorkers is the number of workers sending import requests at the moment
+	BusyWorkers int
+	// Workers is the total number of workers
+	Workers int
+}
+
+// QueueStats returns the current state of im queue.
+func (im *Importer) QueueStats() QueueStats {
+	return QueueStats{
+		Queued:          len(im.input),
+		Capacity:        cap(im.input),
+		InflightSamples: im.InflightSamples(),
+		BusyWorkers:     int(atomic.LoadInt32(&im.busy)),
+		Workers:         im.concurrency,
+	}
+}
+
+// InflightSamples returns the number of samples accepted by Input,
+// which weren't sent to VictoriaMetrics yet. The samples of failed
+// import requests are no longer considered in-flight.
+func (im *Importer) InflightSamples() int64 {
+	return atomic.LoadInt64(&im.inflight)
+}
+
+// StatsSnapshot returns the current im stats.
+// It may be called concurrently with the import, but not with ResetStats.
+func (im *Importer) StatsSnapshot() ImporterStats {
+	return im.s.snapshot()
+}
+
+// Stats returns im stats in the configured format.
 func (im *Importer) Stats() string {
+	if im.statsFormat == StatsFormatJSON {
+		return im.s.JSON()
+	}
 	return im.s.String()
 }
 
+// addQueryArg adds the query arg with the given name and value to path.
+func addQueryArg(path, name, value string) string {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	return path + separator + name + "=" + url.QueryEscape(value)
+}
+
 // AddExtraLabelsToImportPath - adds extra labels query params to given url path.
+// VictoriaMetrics overrides labels of the imported series with extra labels
+// if they have the same name.
 func AddExtraLabelsToImportPath(path string, extraLabels []string) (string, error) {
+	labels, err := parseExtraLabels(extraLabels)
+	if err != nil {
+		return path, err
+	}
 	dst := path
 	separator := "?"
-	for _, extraLabel := range extraLabels {
-		if !strings.Contains(extraLabel, "=") {
-			return path, fmt.Errorf("bad format for extra_label flag, it must be `key=value`, got: %q", extraLabel)
-		}
+	for _, l := range labels {
 		if strings.Contains(dst, "?") {
 			separator = "&"
 		}
-		dst += fmt.Sprintf("%sextra_label=%s", separator, extraLabel)
+		dst += fmt.Sprintf("%sextra_label=%s=%s", separator, url.QueryEscape(l.Name), url.QueryEscape(l.Value))
 	}
 	return dst, nil
 }
 
+// parseExtraLabels parses extra labels in label=value format
+func parseExtraLabels(extraLabels []string) ([]LabelPair, error) {
+	var labels []LabelPair
+	names := make(map[string]struct{}, len(extraLabels))
+	for _, extraLabel := range extraLabels {
+		name, value, ok := strings.Cut(extraLabel, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("bad format for extra_label flag, it must be `key=value`, got: %q", extraLabel)
+		}
+		if _, ok := names[name]; ok {
+			return nil, fmt.Errorf("duplicate extra_label name %q", name)
+		}
+		names[name] = struct{}{}
+		labels = append(labels, LabelPair{Name: name, Value: value})
+	}
+	return labels, nil
+}
+
+// TenantID returns the tenant in accountID:projectID form for the given
+// accountID and projectID, or an empty string if accountID isn't set.
+// accountID may already contain projectID, in which case projectID must be empty.
+// Both parts must be 32-bit unsigned integers.
+func TenantID(accountID, projectID string) (string, error) {
+	if accountID == "" {
+		if projectID != "" {
+			return "", fmt.Errorf("projectID %q can't be set without accountID", projectID)
+		}
+		return "", nil
+	}
+	if acc, proj, ok := strings.Cut(accountID, ":"); ok {
+		if projectID != "" {
+			return "", fmt.Errorf("projectID %q can't be set when accountID %q already contains projectID", projectID, accountID)
+		}
+		if proj == "" {
+			return "", fmt.Errorf("missing projectID in accountID %q; it must be set in accountID:projectID form", accountID)
+		}
+		accountID, projectID = acc, proj
+	}
+	if _, err := strconv.ParseUint(accountID, 10, 32); err != nil {
+		return "", fmt.Errorf("cannot parse accountID %q: it must be a 32-bit unsigned integer", accountID)
+	}
+	if projectID == "" {
+		return accountID, nil
+	}
+	if _, err := strconv.ParseUint(projectID, 10, 32); err != nil {
+		return "", fmt.Errorf("cannot parse projectID %q: it must be a 32-bit unsigned integer", projectID)
+	}
+	return accountID + ":" + projectID, nil
+}
+
 // NewImporter creates new Importer for the given cfg.
 func NewImporter(ctx context.Context, cfg Config) (*Importer, error) {
 	if cfg.Concurrency < 1 {
 		return nil, fmt.Errorf("concurrency can't be lower than 1")
 	}
+	if cfg.DedupInterval < 0 {
+		return nil, fmt.Errorf("dedup interval can't be negative; got %s", cfg.DedupInterval)
+	}
+	switch cfg.StatsFormat {
+	case "", StatsFormatText, StatsFormatJSON:
+	default:
+		return nil, fmt.Errorf("unsupported stats format %q; supported values are %q and %q",
+			cfg.StatsFormat, StatsFormatText, StatsFormatJSON)
+	}
 
-	addr := strings.TrimRight(cfg.Addr, "/")
-	// if single version
-	// see https://docs.victoriametrics.com/#how-to-import-time-series-data
-	importPath := addr + "/api/v1/import"
-	if cfg.AccountID != "" {
-		// if cluster version
-		// see https://docs.victoriametrics.com/Cluster-VictoriaMetrics.html#url-format
-		importPath = fmt.Sprintf("%s/insert/%s/prometheus/api/v1/import", addr, cfg.AccountID)
+	compressLevel := cfg.CompressLevel
+	if compressLevel == 0 {
+		compressLevel = gzip.BestSpeed
+	}
+	if compressLevel < gzip.HuffmanOnly || compressLevel > gzip.BestCompression {
+		return nil, fmt.Errorf("unsupported compression level %d; supported values are in range [%d..%d] and %d, %d",
+			compressLevel, gzip.BestSpeed, gzip.BestCompression, gzip.DefaultCompression, gzip.HuffmanOnly)
+	}
+
+	var endpoints []endpoint
+	var importFormat string
+	var dump *dumpWriter
+	var err error
+	switch {
+	case cfg.OutputDir != "":
+		importFormat, err = dumpFormat(cfg)
+		if err == nil {
+			dump, err = newDumpWriter(cfg.OutputDir, importFormat, cfg.Compress, cfg.OutputFileSize)
+		}
+	default:
+		endpoints, importFormat, err = importEndpoints(cfg)
 	}
-	importPath, err := AddExtraLabelsToImportPath(importPath, cfg.ExtraLabels)
 	if err != nil {
 		return nil, err
 	}
+	c, err := newHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := parseHeaders(cfg.Headers)
+	if err != nil {
+		return nil, err
+	}
+	addClientHeaders(headers, cfg)
 
 	im := &Importer{
-		addr:       addr,
-		importPath: importPath,
-		compress:   cfg.Compress,
-		user:       cfg.User,
-		password:   cfg.Password,
-		rl:         limiter.NewLimiter(cfg.RateLimit),
-		close:      make(chan struct{}),
-		input:      make(chan *TimeSeries, cfg.Concurrency*4),
-		errors:     make(chan *ImportError, cfg.Concurrency),
-		backoff:    backoff.New(),
+		endpoints: endpoints,
+		c:         c,
+		headers:   headers,
+		compress:  cfg.Compress,
+		user:      cfg.User,
+		password:  cfg.Password,
+		rl:        limiter.NewLimiter(cfg.RateLimit),
+		close:     make(chan struct{}),
+		input:     make(chan *TimeSeries, cfg.Concurrency*4),
+		errors:    make(chan *ImportError, cfg.Concurrency),
+		backoff:   backoff.New(),
+
+		concurrency: int(cfg.Concurrency),
+
+		statsFormat:   cfg.StatsFormat,
+		compressLevel: compressLevel,
+		importFormat:  importFormat,
+		dedupInterval: cfg.DedupInterval.Milliseconds(),
+		dump:          dump,
+	}
+	if cfg.LogRequests {
+		im.requestLog = utils.NewLogSampler(cfg.LogSampleRate)
 	}
-	if err := im.Ping(); err != nil {
-		return nil, fmt.Errorf("ping to %q failed: %s", addr, err)
+	switch {
+	case cfg.NoImport:
+		im.noImport = true
+	case im.dump != nil:
+		// nothing is sent over the network
+	default:
+		if err := im.Ping(ctx); err != nil {
+			return nil, err
+		}
 	}
 
 	if cfg.BatchSize < 1 {
@@ -155,12 +414,15 @@ func NewImporter(ctx context.Context, cfg Config) (*Importer, error) {
 			pbPrefix := fmt.Sprintf(`{{ green "VM worker %d:" }}`, i)
 			bar = barpool.AddWithTemplate(pbPrefix+pbTpl, 0)
 		}
+		flushCh := make(chan chan *ImportError)
+		im.flushCh = append(im.flushCh, flushCh)
 		go func(bar *pb.ProgressBar) {
 			defer im.wg.Done()
-			im.startWorker(ctx, bar, cfg.BatchSize, cfg.SignificantFigures, cfg.RoundDigits)
+			im.startWorker(ctx, bar, flushCh, cfg.BatchSize, cfg.FlushInterval, cfg.SignificantFigures, cfg.RoundDigits)
 		}(bar)
 	}
 	im.ResetStats()
+	registerImporter(im)
 	return im, nil
 }
 
@@ -174,22 +436,97 @@ type ImportError struct {
 	// The error that appeared during insert
 	// If err is nil - no error happened and Batch
 	// Is the latest delivered Batch.
+	// Unexpected responses are wrapped as *ResponseError.
 	Err error
 }
 
+// importEndpoints returns the endpoints for import requests to VictoriaMetrics
+// at cfg.Addr and the import format used for them.
+func importEndpoints(cfg Config) ([]endpoint, string, error) {
+	importFormat := cfg.ImportFormat
+	if importFormat == "" {
+		importFormat = ImportFormatJSONL
+	}
+	path := cfg.ImportPath
+	switch importFormat {
+	case ImportFormatJSONL:
+		// see https://docs.victoriametrics.com/#how-to-import-data-in-json-line-format
+		if path == "" {
+			path = "/api/v1/import"
+		}
+	case ImportFormatPrometheus:
+		// see https://docs.victoriametrics.com/#how-to-import-data-in-prometheus-exposition-format
+		if path == "" {
+			path = "/api/v1/import/prometheus"
+		}
+	case ImportFormatCSV:
+		// see https://docs.victoriametrics.com/#how-to-import-csv-data
+		if path == "" {
+			path = "/api/v1/import/csv"
+		}
+	case ImportFormatNative:
+		// see https://docs.victoriametrics.com/#how-to-import-data-in-native-format
+		if path == "" {
+			path = "/api/v1/import/native"
+		}
+	default:
+		return nil, "", fmt.Errorf("unsupported import format %q; supported values are %q, %q, %q and %q",
+			importFormat, ImportFormatJSONL, ImportFormatPrometheus, ImportFormatCSV, ImportFormatNative)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	tenant, err := TenantID(cfg.AccountID, cfg.ProjectID)
+	if err != nil {
+		return nil, "", err
+	}
+	var endpoints []endpoint
+	for _, addr := range splitAddrs(cfg.Addr) {
+		// if single version
+		// see https://docs.victoriametrics.com/#how-to-import-time-series-data
+		importPath := addr + path
+		if tenant != "" {
+			// if cluster version
+			// see https://docs.victoriametrics.com/Cluster-VictoriaMetrics.html#url-format
+			importPath = fmt.Sprintf("%s/insert/%s/prometheus%s", addr, tenant, path)
+		}
+		importPath, err := AddExtraLabelsToImportPath(importPath, cfg.ExtraLabels)
+		if err != nil {
+			return nil, "", err
+		}
+		endpoints = append(endpoints, endpoint{addr: addr, importPath: importPath})
+	}
+	if len(endpoints) == 0 {
+		return nil, "", fmt.Errorf("VictoriaMetrics address can't be empty")
+	}
+	return endpoints, importFormat, nil
+}
+
 // Errors returns a channel for receiving
 // import errors if any
 func (im *Importer) Errors() chan *ImportError { return im.errors }
 
 // Input returns a channel for sending timeseries
-// that need to be imported
+// that need to be imported.
+// Samples of ts are deduplicated in place if Config.DedupInterval is set.
+// Input is safe for concurrent use by multiple goroutines.
 func (im *Importer) Input(ts *TimeSeries) error {
+	if im.dedupInterval > 0 {
+		ts.Timestamps, ts.Values = deduplicateSamples(ts.Timestamps, ts.Values, im.dedupInterval)
+	}
+	// samples are accounted before sending, since workers
+	// may process them before select returns
+	samples := int64(len(ts.Values))
+	atomic.AddInt64(&im.inflight, samples)
 	select {
 	case <-im.close:
+		atomic.AddInt64(&im.inflight, -samples)
 		return fmt.Errorf("importer is closed")
 	case im.input <- ts:
 		return nil
 	case err := <-im.errors:
+		atomic.AddInt64(&im.inflight, -samples)
 		if err != nil && err.Err != nil {
 			return err.Err
 		}
@@ -197,6 +534,32 @@ func (im *Importer) Input(ts *TimeSeries) error {
 	}
 }
 
+// Flush imports the series passed to Input before the call
+// and waits until they are sent to VictoriaMetrics.
+// Series passed to Input concurrently with Flush may be imported as well.
+// The first import error is returned instead of being sent to Errors channel.
+// The errors of batches imported before the call may be returned as well,
+// if they can't be sent to Errors channel.
+func (im *Importer) Flush() *ImportError {
+	dones := make([]chan *ImportError, 0, len(im.flushCh))
+	for _, flushCh := range im.flushCh {
+		done := make(chan *ImportError, 1)
+		select {
+		case <-im.close:
+			return nil
+		case flushCh <- done:
+			dones = append(dones, done)
+		}
+	}
+	var firstErr *ImportError
+	for _, done := range dones {
+		if err := <-done; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
 // Close sends signal to all goroutines to exit
 // and waits until they are finished
 func (im *Importer) Close() {
@@ -205,66 +568,153 @@ func (im *Importer) Close() {
 		close(im.input)
 		im.wg.Wait()
 		close(im.errors)
+		unregisterImporter(im)
+		if im.dump != nil {
+			if err := im.dump.close(); err != nil {
+				logger.Errorf("%s", err)
+			}
+		}
+
+		im.s.Lock()
+		im.s.endTime = time.Now()
+		im.s.Unlock()
 	})
 }
 
-func (im *Importer) startWorker(ctx context.Context, bar *pb.ProgressBar, batchSize, significantFigures, roundDigits int) {
+func (im *Importer) startWorker(ctx context.Context, bar *pb.ProgressBar, flushCh <-chan chan *ImportError,
+	batchSize int, flushInterval time.Duration, significantFigures, roundDigits int) {
 	var batch []*TimeSeries
 	var dataPoints int
 	var waitForBatch time.Time
+	var flushC <-chan time.Time
+	if flushInterval > 0 {
+		t := time.NewTicker(flushInterval)
+		defer t.Stop()
+		flushC = t.C
+	}
+	add := func(ts *TimeSeries) {
+		// init waitForBatch when first
+		// value was received
+		if waitForBatch.IsZero() {
+			waitForBatch = time.Now()
+		}
+
+		ts = roundTimeseriesValue(ts, significantFigures, roundDigits)
+		batch = append(batch, ts)
+		dataPoints += len(ts.Values)
+
+		if bar != nil {
+			bar.Add(len(ts.Values))
+		}
+	}
+	importBatch := func() *ImportError {
+		im.s.Lock()
+		im.s.idleDuration += time.Since(waitForBatch)
+		im.s.Unlock()
+
+		atomic.AddInt32(&im.busy, 1)
+		err := im.flush(ctx, batch)
+		atomic.AddInt32(&im.busy, -1)
+		var importErr *ImportError
+		if err != nil {
+			im.s.Lock()
+			im.s.errors++
+			im.s.Unlock()
+			importErrors.Inc()
+			importErr = &ImportError{
+				Batch: batch,
+				Err:   err,
+			}
+			// make a new batch, since old one was referenced as err
+			batch = make([]*TimeSeries, len(batch))
+		}
+		// the samples are no longer in-flight only after the error is counted,
+		// so the failed samples are never observed as sent
+		atomic.AddInt64(&im.inflight, -int64(dataPoints))
+		dataPoints = 0
+		batch = batch[:0]
+		waitForBatch = time.Now()
+		return importErr
+	}
+	flushBatch := func() {
+		err := importBatch()
+		if err == nil {
+			return
+		}
+		select {
+		case im.errors <- err:
+		case done := <-flushCh:
+			// Errors channel may be not read while Flush waits for the worker,
+			// so the error is returned to Flush instead
+			done <- err
+		}
+	}
 	for {
 		select {
 		case <-im.close:
 			for ts := range im.input {
 				ts = roundTimeseriesValue(ts, significantFigures, roundDigits)
 				batch = append(batch, ts)
+				dataPoints += len(ts.Values)
 			}
 			exitErr := &ImportError{
 				Batch: batch,
 			}
 			retryableFunc := func() error { return im.Import(batch) }
-			_, err := im.backoff.Retry(ctx, retryableFunc)
+			atomic.AddInt32(&im.busy, 1)
+			attempts, err := im.backoff.Retry(ctx, retryableFunc)
+			atomic.AddInt32(&im.busy, -1)
+			im.s.Lock()
+			im.s.retries += attempts
 			if err != nil {
+				im.s.errors++
 				exitErr.Err = err
 			}
+			im.s.Unlock()
+			importRetries.Add(int(attempts))
+			if err != nil {
+				importErrors.Inc()
+			}
+			atomic.AddInt64(&im.inflight, -int64(dataPoints))
 			im.errors <- exitErr
 			return
 		case ts, ok := <-im.input:
 			if !ok {
 				continue
 			}
-			// init waitForBatch when first
-			// value was received
-			if waitForBatch.IsZero() {
-				waitForBatch = time.Now()
-			}
-
-			ts = roundTimeseriesValue(ts, significantFigures, roundDigits)
-			batch = append(batch, ts)
-			dataPoints += len(ts.Values)
-
-			if bar != nil {
-				bar.Add(len(ts.Values))
-			}
-
+			add(ts)
 			if dataPoints < batchSize {
 				continue
 			}
-			im.s.Lock()
-			im.s.idleDuration += time.Since(waitForBatch)
-			im.s.Unlock()
-
-			if err := im.flush(ctx, batch); err != nil {
-				im.errors <- &ImportError{
-					Batch: batch,
-					Err:   err,
+			flushBatch()
+		case done := <-flushCh:
+			// the series buffered in input before the Flush call
+			// must be imported as well, so the buffered ones are drained
+			// without waiting for the series sent after the call
+		drain:
+			for n := len(im.input); n > 0; n-- {
+				select {
+				case ts, ok := <-im.input:
+					if !ok {
+						break drain
+					}
+					add(ts)
+				default:
+					break drain
 				}
-				// make a new batch, since old one was referenced as err
-				batch = make([]*TimeSeries, len(batch))
 			}
-			dataPoints = 0
-			batch = batch[:0]
-			waitForBatch = time.Now()
+			var err *ImportError
+			if len(batch) > 0 {
+				err = importBatch()
+			}
+			done <- err
+		case <-flushC:
+			// send the partially filled batch, so samples
+			// do not wait for the batch to fill up for too long
+			if len(batch) == 0 {
+				continue
+			}
+			flushBatch()
 		}
 	}
 }
@@ -273,45 +723,170 @@ func (im *Importer) flush(ctx context.Context, b []*TimeSeries) error {
 	retryableFunc := func() error { return im.Import(b) }
 	attempts, err := im.backoff.Retry(ctx, retryableFunc)
 	if err != nil {
-		return fmt.Errorf("import failed with %d retries: %s", attempts, err)
+		return fmt.Errorf("import failed with %d retries: %w", attempts, err)
 	}
 	im.s.Lock()
-	im.s.retries = attempts
+	im.s.retries += attempts
 	im.s.Unlock()
+	importRetries.Add(int(attempts))
 	return nil
 }
 
-// Ping sends a ping to im.addr.
-func (im *Importer) Ping() error {
-	url := fmt.Sprintf("%s/health", im.addr)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+// parseHeaders parses HTTP headers in "Name: value" format
+func parseHeaders(headers []string) (http.Header, error) {
+	h := make(http.Header, len(headers))
+	for _, s := range headers {
+		name, value, ok := strings.Cut(s, ":")
+		if !ok {
+			return nil, fmt.Errorf("missing ':' in header %q; expecting \"Name: value\" format", s)
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("empty name in header %q", s)
+		}
+		h.Add(name, strings.TrimSpace(value))
+	}
+	return h, nil
+}
+
+// addClientHeaders adds User-Agent and X-Request-Id headers from cfg to headers,
+// unless they are already set via cfg.Headers
+func addClientHeaders(headers http.Header, cfg Config) {
+	if cfg.UserAgent != "" && headers.Get("User-Agent") == "" {
+		headers.Set("User-Agent", cfg.UserAgent)
+	}
+	if cfg.RequestID != "" && headers.Get("X-Request-Id") == "" {
+		headers.Set("X-Request-Id", cfg.RequestID)
+	}
+}
+
+// setHeaders adds headers to req.
+// It must be called before setting auth, so auth headers take precedence.
+func setHeaders(req *http.Request, headers http.Header) {
+	for name, values := range headers {
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+}
+
+// newHTTPClient returns http.Client for requests to VictoriaMetrics
+// with TLS settings from cfg
+func newHTTPClient(cfg Config) (*http.Client, error) {
+	tr, err := utils.TransportWithCerts(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSCAFile, cfg.TLSInsecureSkipVerify)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TLS config: %s", err)
+	}
+	// every worker sends import requests over its own connection to every address,
+	// so keep enough idle connections for re-using them between requests.
+	// The default limit of 2 idle connections per host makes workers
+	// re-open connections when Concurrency is higher than 2.
+	maxIdle := int(cfg.Concurrency)
+	if tr.MaxIdleConnsPerHost < maxIdle {
+		tr.MaxIdleConnsPerHost = maxIdle
+	}
+	if n := maxIdle * len(splitAddrs(cfg.Addr)); tr.MaxIdleConns < n {
+		tr.MaxIdleConns = n
+	}
+	return &http.Client{Transport: tr}, nil
+}
+
+// endpoint is VictoriaMetrics address for sending import requests to
+type endpoint struct {
+	addr       string
+	importPath string
+}
+
+// splitAddrs returns the list of comma-separated addresses
+func splitAddrs(s string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(s, ",") {
+		addr = strings.TrimRight(strings.TrimSpace(addr), "/")
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// nextEndpoint returns the endpoint for the next import request.
+// Endpoints are chosen in round-robin manner, so retries of failed
+// requests are sent to other endpoints if there are multiple of them.
+func (im *Importer) nextEndpoint() endpoint {
+	n := atomic.AddUint32(&im.next, 1)
+	return im.endpoints[int(n-1)%len(im.endpoints)]
+}
+
+// pingTimeout limits the duration of every ping request, so a wrong
+// or unreachable address fails the migration before it starts
+// instead of hanging until the first import request.
+const pingTimeout = 10 * time.Second
+
+// Ping sends a ping to all the configured addresses.
+// It is called by NewImporter, so all the migration modes check
+// the connectivity to VictoriaMetrics before fetching the data from the source.
+// Cancelling ctx aborts the in-flight ping.
+func (im *Importer) Ping(ctx context.Context) error {
+	for _, ep := range im.endpoints {
+		if err := im.ping(ctx, ep.addr); err != nil {
+			return fmt.Errorf("ping to %q failed: %s; make sure the address points to VictoriaMetrics "+
+				"(single-node or vminsert for cluster version) and it is reachable", ep.addr, err)
+		}
+	}
+	return nil
+}
+
+func (im *Importer) ping(ctx context.Context, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	url := fmt.Sprintf("%s/health", addr)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return fmt.Errorf("cannot create request to %q: %s", im.addr, err)
+		return fmt.Errorf("cannot create request to %q: %s", addr, err)
 	}
+	setHeaders(req, im.headers)
 	if im.user != "" {
 		req.SetBasicAuth(im.user, im.password)
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := im.c.Do(req)
 	if err != nil {
 		return err
 	}
+	defer func() { _ = resp.Body.Close() }()
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status code: %d", resp.StatusCode)
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("bad status code: %d; response body: %q", resp.StatusCode, body)
 	}
+	// drain the body, so the connection could be re-used by import requests
+	_, _ = io.Copy(io.Discard, resp.Body)
 	return nil
 }
 
 // Import imports tsBatch.
 func (im *Importer) Import(tsBatch []*TimeSeries) error {
-	if len(tsBatch) < 1 {
+	if len(tsBatch) < 1 || im.noImport {
 		return nil
 	}
+	if im.dump != nil {
+		return im.dumpImport(tsBatch)
+	}
 
+	start := time.Now()
+	ep := im.nextEndpoint()
+	importPath := ep.importPath
+	header, write, csvFormat, err := im.batchWriter(tsBatch)
+	if err != nil {
+		return err
+	}
+	if csvFormat != "" {
+		importPath = addQueryArg(importPath, "format", csvFormat)
+	}
 	pr, pw := io.Pipe()
-	req, err := http.NewRequest(http.MethodPost, im.importPath, pr)
+	req, err := http.NewRequest(http.MethodPost, importPath, pr)
 	if err != nil {
-		return fmt.Errorf("cannot create request to %q: %s", im.addr, err)
+		return fmt.Errorf("cannot create request to %q: %s", ep.addr, err)
 	}
+	setHeaders(req, im.headers)
 	if im.user != "" {
 		req.SetBasicAuth(im.user, im.password)
 	}
@@ -321,64 +896,180 @@ func (im *Importer) Import(tsBatch []*TimeSeries) error {
 
 	errCh := make(chan error)
 	go func() {
-		errCh <- do(req)
+		errCh <- do(im.c, req)
 		close(errCh)
 	}()
 
-	w := io.Writer(pw)
+	// the limiter wraps the pipe, so it accounts the bytes sent over the network
+	cw := &countingWriter{w: limiter.NewWriteLimiter(pw, im.rl)}
+	totalBytes, totalSamples, outOfOrder, err := im.encodeBatch(cw, header, write, tsBatch)
+	if err != nil {
+		// abort the request, so it doesn't wait for the rest of the body,
+		// and wait for its goroutine to exit
+		_ = pw.CloseWithError(err)
+		requestErr := <-errCh
+		im.accountRequest(start)
+		if requestErr != nil && errors.Is(err, io.ErrClosedPipe) {
+			// the request has failed before the body was sent,
+			// so its error explains why the body can't be written
+			return fmt.Errorf("import request error for %q: %w", ep.addr, requestErr)
+		}
+		return err
+	}
+	if err := pw.Close(); err != nil {
+		return err
+	}
+
+	requestErr := <-errCh
+	if requestErr != nil {
+		im.accountRequest(start)
+		return fmt.Errorf("import request error for %q: %w", ep.addr, requestErr)
+	}
+	im.accountImport(start, ep.addr, len(tsBatch), totalSamples, totalBytes, cw.n, outOfOrder)
+	return nil
+}
+
+// batchWriter returns the header and the function for writing tsBatch in im.importFormat.
+// csvFormat is the value of format query arg, which must be set for import requests in csv format.
+func (im *Importer) batchWriter(tsBatch []*TimeSeries) ([]byte, func(*TimeSeries, io.Writer) (int, error), string, error) {
+	switch im.importFormat {
+	case ImportFormatPrometheus:
+		return nil, (*TimeSeries).writePrometheus, "", nil
+	case ImportFormatCSV:
+		cl, err := newCSVLayout(tsBatch)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		return nil, cl.write, cl.format(), nil
+	case ImportFormatNative:
+		return nativeTimeRange(tsBatch), (&nativeEncoder{}).write, "", nil
+	default:
+		return nil, (*TimeSeries).write, "", nil
+	}
+}
+
+// encodeBatch writes header and tsBatch encoded via write to w, compressing them if needed.
+// It returns the number of bytes before compression, the number of samples
+// and the number of series with out-of-order timestamps.
+func (im *Importer) encodeBatch(w io.Writer, header []byte, write func(*TimeSeries, io.Writer) (int, error),
+	tsBatch []*TimeSeries) (int, int, int, error) {
+	var zw *gzip.Writer
 	if im.compress {
-		zw, err := gzip.NewWriterLevel(w, 1)
+		var err error
+		zw, err = gzip.NewWriterLevel(w, im.compressLevel)
 		if err != nil {
-			return fmt.Errorf("unexpected error when creating gzip writer: %s", err)
+			return 0, 0, 0, fmt.Errorf("unexpected error when creating gzip writer: %s", err)
 		}
 		w = zw
 	}
-	w = limiter.NewWriteLimiter(w, im.rl)
 	bw := bufio.NewWriterSize(w, 16*1024)
 
-	var totalSamples, totalBytes int
+	totalBytes, err := bw.Write(header)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("write err: %w", err)
+	}
+	var totalSamples, outOfOrder int
 	for _, ts := range tsBatch {
-		n, err := ts.write(bw)
+		if HasOutOfOrderTimestamps(ts.Timestamps) {
+			outOfOrder++
+		}
+		n, err := write(ts, bw)
 		if err != nil {
-			return fmt.Errorf("write err: %w", err)
+			return 0, 0, 0, fmt.Errorf("write err: %w", err)
 		}
 		totalBytes += n
 		totalSamples += len(ts.Values)
 	}
 	if err := bw.Flush(); err != nil {
-		return err
+		return 0, 0, 0, err
 	}
-	if closer, ok := w.(io.Closer); ok {
-		err := closer.Close()
-		if err != nil {
-			return err
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return 0, 0, 0, err
 		}
 	}
-	if err := pw.Close(); err != nil {
-		return err
-	}
+	return totalBytes, totalSamples, outOfOrder, nil
+}
 
-	requestErr := <-errCh
-	if requestErr != nil {
-		return fmt.Errorf("import request error for %q: %w", im.addr, requestErr)
-	}
+// accountRequest accounts the request to the destination started at start
+func (im *Importer) accountRequest(start time.Time) {
+	im.s.Lock()
+	im.s.httpRequests++
+	im.s.requestsDuration += time.Since(start)
+	im.s.Unlock()
+}
 
+// accountImport accounts the successful request started at start, which sent
+// the given number of series and samples encoded into totalBytes, to addr.
+// sentBytes is the number of bytes sent over the network after compression.
+func (im *Importer) accountImport(start time.Time, addr string, series, totalSamples, totalBytes, sentBytes, outOfOrder int) {
+	im.accountRequest(start)
 	im.s.Lock()
-	im.s.bytes += uint64(totalBytes)
-	im.s.samples += uint64(totalSamples)
+	im.s.add(time.Now(), uint64(totalSamples), uint64(totalBytes))
+	im.s.sentBytes += uint64(sentBytes)
+	im.s.series += uint64(series)
+	im.s.outOfOrderSeries += uint64(outOfOrder)
 	im.s.requests++
 	im.s.Unlock()
 
-	return nil
+	importedBytes.Add(totalBytes)
+	bytesSent.Add(sentBytes)
+	importedSamples.Add(totalSamples)
+	importedSeries.Add(series)
+	outOfOrderSeries.Add(outOfOrder)
+	importRequests.Inc()
+
+	if im.requestLog != nil {
+		im.requestLog.Printf("DEBUG: imported %d series with %d samples (%d bytes, %d bytes sent) to %q in %s",
+			series, totalSamples, totalBytes, sentBytes, addr, time.Since(start))
+	}
+}
+
+// countingWriter counts the number of bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+// Write implements io.Writer
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += n
+	return n, err
 }
 
 // ErrBadRequest represents bad request error.
 var ErrBadRequest = errors.New("bad request")
 
-func do(req *http.Request) error {
-	resp, err := http.DefaultClient.Do(req)
+// ResponseError is returned when VictoriaMetrics or remote write receiver
+// responds with unexpected status code. It may be checked via errors.As
+// for distinguishing rejected data from network errors.
+type ResponseError struct {
+	// StatusCode is the status code of the response
+	StatusCode int
+	// Body is the response body with the error details
+	Body string
+
+	// err is the sentinel error the response is classified as, e.g. ErrBadRequest
+	err error
+}
+
+// Error implements error interface
+func (e *ResponseError) Error() string {
+	msg := fmt.Sprintf("unexpected response code %d: %s", e.StatusCode, e.Body)
+	if e.err != nil {
+		return e.err.Error() + ": " + msg
+	}
+	return msg
+}
+
+// Unwrap allows checking the response via errors.Is(err, ErrBadRequest)
+func (e *ResponseError) Unwrap() error { return e.err }
+
+func do(c *http.Client, req *http.Request) error {
+	resp, err := c.Do(req)
 	if err != nil {
-		return fmt.Errorf("unexpected error when performing request: %s", err)
+		return fmt.Errorf("unexpected error when performing request: %w", err)
 	}
 	defer func() {
 		_ = resp.Body.Close()
@@ -386,12 +1077,13 @@ func do(req *http.Request) error {
 	if resp.StatusCode != http.StatusNoContent {
 		body, err := io.ReadAll(resp.Body)
 		if err != nil {
-			return fmt.Errorf("failed to read response body for status code %d: %s", resp.StatusCode, err)
+			return fmt.Errorf("failed to read response body for status code %d: %w", resp.StatusCode, err)
 		}
+		re := &ResponseError{StatusCode: resp.StatusCode, Body: string(body)}
 		if resp.StatusCode == http.StatusBadRequest {
-			return fmt.Errorf("%w: unexpected response code %d: %s", ErrBadRequest, resp.StatusCode, string(body))
+			re.err = ErrBadRequest
 		}
-		return fmt.Errorf("unexpected response code %d: %s", resp.StatusCode, string(body))
+		return re
 	}
 	return nil
 }
@@ -413,14 +1105,23 @@ func byteCountSI(b int64) string {
 func roundTimeseriesValue(ts *TimeSeries, significantFigures, roundDigits int) *TimeSeries {
 	if significantFigures > 0 {
 		for i, v := range ts.Values {
-			ts.Values[i] = decimal.RoundToSignificantFigures(v, significantFigures)
+			ts.Values[i] = keepFinite(v, decimal.RoundToSignificantFigures(v, significantFigures))
 		}
 	}
 	if roundDigits < 100 {
 		for i, v := range ts.Values {
-			ts.Values[i] = decimal.RoundToDecimalDigits(v, roundDigits)
+			ts.Values[i] = keepFinite(v, decimal.RoundToDecimalDigits(v, roundDigits))
 		}
 	}
 
 	return ts
 }
+
+// keepFinite returns v if rounding of finite v overflows to infinity,
+// since too big values can't be rounded without overflow.
+func keepFinite(v, rounded float64) float64 {
+	if math.IsInf(rounded, 0) && !math.IsInf(v, 0) {
+		return v
+	}
+	return rounded
+}
@@ -1,6 +1,35 @@
 package vm
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/decimal"
+)
 
 func TestAddExtraLabelsToImportPath(t *testing.T) {
 	type args struct {
@@ -44,6 +73,32 @@ func TestAddExtraLabelsToImportPath(t *testing.T) {
 			},
 			want: "/api/v1/import?timeout=50&extra_label=instance=host-2&extra_label=job=vmagent",
 		},
+		{
+			name: "ok extra label with special chars",
+			args: args{
+				path:        "/api/v1/import",
+				extraLabels: []string{"batch=2024 q1&a=b", "eq=a=b"},
+			},
+			want: "/api/v1/import?extra_label=batch=2024+q1%26a%3Db&extra_label=eq=a%3Db",
+		},
+		{
+			name: "bad empty label name",
+			args: args{
+				path:        "/api/v1/import",
+				extraLabels: []string{"=value"},
+			},
+			want:    "/api/v1/import",
+			wantErr: true,
+		},
+		{
+			name: "bad duplicate label names",
+			args: args{
+				path:        "/api/v1/import",
+				extraLabels: []string{"source=opentsdb", "source=influx"},
+			},
+			want:    "/api/v1/import",
+			wantErr: true,
+		},
 		{
 			name: "bad incorrect format for extra label",
 			args: args{
@@ -67,3 +122,1163 @@ func TestAddExtraLabelsToImportPath(t *testing.T) {
 		})
 	}
 }
+
+func TestImporterInflightSamples(t *testing.T) {
+	// block import requests until the test checks in-flight samples
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		<-unblock
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	im, err := NewImporter(context.Background(), Config{
+		Addr:               srv.URL,
+		Concurrency:        1,
+		BatchSize:          100,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	ts := &TimeSeries{
+		Name:       "foo",
+		Timestamps: []int64{1, 2, 3},
+		Values:     []float64{1, 2, 3},
+	}
+	for i := 0; i < 5; i++ {
+		if err := im.Input(ts); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if n := im.InflightSamples(); n != 15 {
+		t.Fatalf("unexpected number of in-flight samples %d; want %d", n, 15)
+	}
+	close(unblock)
+	im.Close()
+	for err := range im.Errors() {
+		if err.Err != nil {
+			t.Fatalf("unexpected import error: %s", err.Err)
+		}
+	}
+	if n := im.InflightSamples(); n != 0 {
+		t.Fatalf("unexpected number of in-flight samples after close %d; want 0", n)
+	}
+}
+
+func TestImporterQueueStats(t *testing.T) {
+	// block import requests until the test checks the queue
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		<-unblock
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	im, err := NewImporter(context.Background(), Config{
+		Addr:               srv.URL,
+		Concurrency:        1,
+		BatchSize:          3,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	ts := &TimeSeries{
+		Name:       "foo",
+		Timestamps: []int64{1, 2, 3},
+		Values:     []float64{1, 2, 3},
+	}
+	// the first series fills the batch, so the worker gets stuck on sending it
+	if err := im.Input(ts); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for im.QueueStats().BusyWorkers != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for the worker to send the import request")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 2; i++ {
+		if err := im.Input(ts); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	want := QueueStats{Queued: 2, Capacity: 4, InflightSamples: 9, BusyWorkers: 1, Workers: 1}
+	if qs := im.QueueStats(); qs != want {
+		t.Fatalf("unexpected queue stats %+v; want %+v", qs, want)
+	}
+	if qs := totalQueueStats(); qs.BusyWorkers < 1 || qs.Queued < 2 {
+		t.Fatalf("queue stats of the importer must be accounted in total stats; got %+v", qs)
+	}
+
+	close(unblock)
+	im.Close()
+	for err := range im.Errors() {
+		if err.Err != nil {
+			t.Fatalf("unexpected import error: %s", err.Err)
+		}
+	}
+	want = QueueStats{Capacity: 4, Workers: 1}
+	if qs := im.QueueStats(); qs != want {
+		t.Fatalf("unexpected queue stats after close %+v; want %+v", qs, want)
+	}
+	importersMu.Lock()
+	_, ok := importers[im]
+	importersMu.Unlock()
+	if ok {
+		t.Fatalf("closed importer must be unregistered")
+	}
+}
+
+func TestImporterStatsSnapshot(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	im, err := NewImporter(context.Background(), Config{
+		Addr:               srv.URL,
+		Concurrency:        1,
+		BatchSize:          6,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	if ss := im.StatsSnapshot(); ss.Samples != 0 || ss.Requests != 0 {
+		t.Fatalf("unexpected stats before the import %+v", ss)
+	}
+	ts := &TimeSeries{
+		Name:       "foo",
+		Timestamps: []int64{1, 2, 3},
+		Values:     []float64{1, 2, 3},
+	}
+	for i := 0; i < 5; i++ {
+		if err := im.Input(ts); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	unordered := &TimeSeries{
+		Name:       "bar",
+		Timestamps: []int64{2, 1, 3},
+		Values:     []float64{2, 1, 3},
+	}
+	if err := im.Input(unordered); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	im.Close()
+	for err := range im.Errors() {
+		if err.Err != nil {
+			t.Fatalf("unexpected import error: %s", err.Err)
+		}
+	}
+	ss := im.StatsSnapshot()
+	if ss.Samples != 18 || ss.Series != 6 || ss.OutOfOrderSeries != 1 || ss.Requests < 1 || ss.Errors != 0 {
+		t.Fatalf("unexpected stats %+v", ss)
+	}
+	if ss.Bytes == 0 || ss.SentBytes == 0 || ss.SamplesPerSecond <= 0 {
+		t.Fatalf("unexpected stats %+v", ss)
+	}
+	if ss.HTTPRequests != ss.Requests || ss.AvgRequestDuration <= 0 || ss.CompressionRatio <= 0 {
+		t.Fatalf("unexpected network stats %+v", ss)
+	}
+	// the duration is fixed once the importer is closed
+	time.Sleep(10 * time.Millisecond)
+	if d := im.StatsSnapshot().Duration; d != ss.Duration {
+		t.Fatalf("unexpected duration %s after close; want %s", d, ss.Duration)
+	}
+}
+
+func TestNewImporterInvalidCompressLevel(t *testing.T) {
+	for _, level := range []int{-3, 10} {
+		_, err := NewImporter(context.Background(), Config{Concurrency: 1, Compress: true, CompressLevel: level})
+		if err == nil {
+			t.Fatalf("expecting error for unsupported compression level %d", level)
+		}
+	}
+}
+
+func TestTenantID(t *testing.T) {
+	f := func(accountID, projectID, want string, wantErr bool) {
+		t.Helper()
+		got, err := TenantID(accountID, projectID)
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error: %v; wantErr: %v", err, wantErr)
+		}
+		if got != want {
+			t.Fatalf("unexpected tenant %q; want %q", got, want)
+		}
+	}
+
+	f("", "", "", false)
+	f("15", "", "15", false)
+	f("15", "3", "15:3", false)
+	f("15:3", "", "15:3", false)
+	f("4294967295:0", "", "4294967295:0", false)
+
+	f("", "3", "", true)
+	f("15:3", "4", "", true)
+	f("foo", "", "", true)
+	f("-1", "", "", true)
+	f("4294967296", "", "", true)
+	f("15:", "", "", true)
+	f("15:bar", "", "", true)
+	f("15", "bar", "", true)
+	f("15:3:1", "", "", true)
+}
+
+func TestImporterTenantPath(t *testing.T) {
+	var gotPath atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		gotPath.Store(r.URL.Path)
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	im, err := NewImporter(context.Background(), Config{
+		Addr:               srv.URL,
+		AccountID:          "15",
+		ProjectID:          "3",
+		Concurrency:        1,
+		BatchSize:          100,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	defer im.Close()
+	err = im.Import([]*TimeSeries{{
+		Name:       "foo",
+		Timestamps: []int64{1},
+		Values:     []float64{1},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected import error: %s", err)
+	}
+	if p, want := gotPath.Load(), "/insert/15:3/prometheus/api/v1/import"; p != want {
+		t.Fatalf("unexpected import path %v; want %q", p, want)
+	}
+
+	_, err = NewImporter(context.Background(), Config{Addr: srv.URL, AccountID: "foo", Concurrency: 1})
+	if err == nil {
+		t.Fatalf("expecting error for invalid accountID")
+	}
+}
+
+func TestImporterImportFormat(t *testing.T) {
+	f := func(cfg Config, wantPath, wantFormat, wantBody string) {
+		t.Helper()
+		var gotPath, gotFormat, gotBody atomic.Value
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			b, _ := io.ReadAll(r.Body)
+			gotPath.Store(r.URL.Path)
+			gotFormat.Store(r.URL.Query().Get("format"))
+			gotBody.Store(string(b))
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer srv.Close()
+
+		cfg.Addr = srv.URL
+		cfg.Concurrency = 1
+		cfg.DisableProgressBar = true
+		im, err := NewImporter(context.Background(), cfg)
+		if err != nil {
+			t.Fatalf("cannot create importer: %s", err)
+		}
+		defer im.Close()
+		if err := im.Import(testFormatBatch); err != nil {
+			t.Fatalf("unexpected import error: %s", err)
+		}
+		if p := gotPath.Load(); p != wantPath {
+			t.Fatalf("unexpected import path %v; want %q", p, wantPath)
+		}
+		if f := gotFormat.Load(); f != wantFormat {
+			t.Fatalf("unexpected format arg %v; want %q", f, wantFormat)
+		}
+		if b := gotBody.Load(); b != wantBody {
+			t.Fatalf("unexpected body %v; want %q", b, wantBody)
+		}
+	}
+
+	jsonBody := `{"metric":{"__name__":"foo","host":"a"},"timestamps":[1000],"values":[1]}` + "\n"
+	f(Config{}, "/api/v1/import", "", jsonBody)
+	f(Config{ImportFormat: ImportFormatJSONL, AccountID: "1"}, "/insert/1/prometheus/api/v1/import", "", jsonBody)
+	f(Config{ImportFormat: ImportFormatPrometheus}, "/api/v1/import/prometheus", "", `foo{host="a"} 1 1000`+"\n")
+	f(Config{ImportFormat: ImportFormatCSV, AccountID: "1:2"}, "/insert/1:2/prometheus/api/v1/import/csv",
+		"1:label:host,2:metric:foo,3:time:unix_ms", "a,1,1000\n")
+	f(Config{ImportPath: "custom/import"}, "/custom/import", "", jsonBody)
+
+	var nativeBody bytes.Buffer
+	nativeBody.Write(nativeTimeRange(testFormatBatch))
+	if _, err := (&nativeEncoder{}).write(testFormatBatch[0], &nativeBody); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	f(Config{ImportFormat: ImportFormatNative}, "/api/v1/import/native", "", nativeBody.String())
+
+	_, err := NewImporter(context.Background(), Config{Addr: "http://localhost:8428", Concurrency: 1, ImportFormat: "foo"})
+	if err == nil {
+		t.Fatalf("expecting error for unsupported import format")
+	}
+}
+
+var testFormatBatch = []*TimeSeries{{
+	Name:       "foo",
+	LabelPairs: []LabelPair{{Name: "host", Value: "a"}},
+	Timestamps: []int64{1000},
+	Values:     []float64{1},
+}}
+
+func TestImporterMultipleAddrs(t *testing.T) {
+	newServer := func(code int, requests *int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			atomic.AddInt32(requests, 1)
+			_, _ = io.Copy(io.Discard, r.Body)
+			w.WriteHeader(code)
+		}))
+	}
+	var okRequests, failedRequests int32
+	okSrv := newServer(http.StatusNoContent, &okRequests)
+	defer okSrv.Close()
+	failedSrv := newServer(http.StatusInternalServerError, &failedRequests)
+	defer failedSrv.Close()
+
+	im, err := NewImporter(context.Background(), Config{
+		Addr:               okSrv.URL + ", " + failedSrv.URL + "/",
+		Concurrency:        1,
+		BatchSize:          100,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	defer im.Close()
+
+	batch := []*TimeSeries{{
+		Name:       "foo",
+		Timestamps: []int64{1},
+		Values:     []float64{1},
+	}}
+	for i := 0; i < 4; i++ {
+		err := im.Import(batch)
+		if i%2 == 0 {
+			if err != nil {
+				t.Fatalf("unexpected error for request %d: %s", i, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Fatalf("expecting error for request %d", i)
+		}
+		if !strings.Contains(err.Error(), failedSrv.URL) {
+			t.Fatalf("expecting error %q to contain failed address %q", err, failedSrv.URL)
+		}
+	}
+	if ok, failed := atomic.LoadInt32(&okRequests), atomic.LoadInt32(&failedRequests); ok != 2 || failed != 2 {
+		t.Fatalf("unexpected requests distribution %d/%d; want 2/2", ok, failed)
+	}
+}
+
+func TestNewImporterPingAllAddrs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	downSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+	}))
+	defer downSrv.Close()
+
+	_, err := NewImporter(context.Background(), Config{
+		Addr:        srv.URL + "," + downSrv.URL,
+		Concurrency: 1,
+	})
+	if err == nil {
+		t.Fatalf("expecting ping error")
+	}
+	if !strings.Contains(err.Error(), downSrv.URL) {
+		t.Fatalf("expecting error %q to contain unavailable address %q", err, downSrv.URL)
+	}
+	if !strings.Contains(err.Error(), "not ready") {
+		t.Fatalf("expecting error %q to contain the response body", err)
+	}
+
+	if _, err := NewImporter(context.Background(), Config{Addr: " , ", Concurrency: 1}); err == nil {
+		t.Fatalf("expecting error for empty address")
+	}
+}
+
+func TestNewImporterPingCancel(t *testing.T) {
+	// the server accepts connections, but never responds
+	// like an address behind a firewall dropping packets
+	stop := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	}))
+	defer srv.Close()
+	defer close(stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := NewImporter(ctx, Config{Addr: srv.URL, Concurrency: 1, DisableProgressBar: true})
+	if err == nil {
+		t.Fatalf("expecting ping error")
+	}
+	if !strings.Contains(err.Error(), srv.URL) {
+		t.Fatalf("expecting error %q to contain unreachable address %q", err, srv.URL)
+	}
+	if d := time.Since(start); d > pingTimeout/2 {
+		t.Fatalf("ping must be aborted on context cancel; took %s", d)
+	}
+}
+
+func TestSplitAddrs(t *testing.T) {
+	f := func(s string, want []string) {
+		t.Helper()
+		if got := splitAddrs(s); !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected addresses %q; want %q", got, want)
+		}
+	}
+
+	f("", nil)
+	f(" , ", nil)
+	f("http://localhost:8428/", []string{"http://localhost:8428"})
+	f("http://vm1:8428, http://vm2:8428/,", []string{"http://vm1:8428", "http://vm2:8428"})
+}
+
+func TestNewImporterMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name string, block *pem.Block) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatalf("cannot write %s: %s", name, err)
+		}
+		return path
+	}
+
+	// self-signed client certificate
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %s", err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "vmctl"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %s", err)
+	}
+	clientCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("cannot parse certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("cannot marshal key: %s", err)
+	}
+	certFile := writeFile("client.pem", &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyFile := writeFile("client.key", &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	caFile := writeFile("ca.pem", &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	newImporter := func(cfg Config) (*Importer, error) {
+		cfg.Addr = srv.URL
+		cfg.Concurrency = 1
+		cfg.DisableProgressBar = true
+		return NewImporter(context.Background(), cfg)
+	}
+
+	// server requires client certificate
+	if _, err := newImporter(Config{TLSCAFile: caFile}); err == nil {
+		t.Fatalf("expecting error without client certificate")
+	}
+	// unknown server CA
+	if _, err := newImporter(Config{TLSCertFile: certFile, TLSKeyFile: keyFile}); err == nil {
+		t.Fatalf("expecting error for unknown server CA")
+	}
+
+	f := func(cfg Config) {
+		t.Helper()
+		im, err := newImporter(cfg)
+		if err != nil {
+			t.Fatalf("cannot create importer: %s", err)
+		}
+		defer im.Close()
+		batch := []*TimeSeries{{
+			Name:       "foo",
+			Timestamps: []int64{1},
+			Values:     []float64{1},
+		}}
+		if err := im.Import(batch); err != nil {
+			t.Fatalf("unexpected import error: %s", err)
+		}
+	}
+	f(Config{TLSCAFile: caFile, TLSCertFile: certFile, TLSKeyFile: keyFile})
+	f(Config{TLSInsecureSkipVerify: true, TLSCertFile: certFile, TLSKeyFile: keyFile})
+
+	// invalid files must be detected before any request
+	if _, err := newImporter(Config{TLSCAFile: filepath.Join(dir, "missing.pem")}); err == nil {
+		t.Fatalf("expecting error for missing CA file")
+	}
+	if _, err := newImporter(Config{TLSCertFile: certFile}); err == nil {
+		t.Fatalf("expecting error for cert file without key file")
+	}
+	if _, err := newImporter(Config{TLSCertFile: certFile, TLSKeyFile: caFile}); err == nil {
+		t.Fatalf("expecting error for invalid key file")
+	}
+}
+
+func TestImporterHeaders(t *testing.T) {
+	var mu sync.Mutex
+	var requests []*http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r)
+		mu.Unlock()
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	im, err := NewImporter(context.Background(), Config{
+		Addr:               srv.URL,
+		User:               "foo",
+		Password:           "bar",
+		Concurrency:        1,
+		Compress:           true,
+		DisableProgressBar: true,
+		Headers: []string{
+			"X-Team-Id: team-1",
+			"X-Scope-OrgID:tenant ",
+			"X-Scope-OrgID: other",
+			"Authorization: Bearer token",
+			"X-Request-Id: custom",
+		},
+		UserAgent: "vmctl/test vm-import",
+		RequestID: "run-1",
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	defer im.Close()
+	batch := []*TimeSeries{{
+		Name:       "foo",
+		Timestamps: []int64{1},
+		Values:     []float64{1},
+	}}
+	samples, requestsTotal := importedSamples.Get(), importRequests.Get()
+	if err := im.Import(batch); err != nil {
+		t.Fatalf("unexpected import error: %s", err)
+	}
+	if n := importedSamples.Get() - samples; n != 1 {
+		t.Fatalf("unexpected increase of vmctl_imported_samples_total %d; want 1", n)
+	}
+	if n := importRequests.Get() - requestsTotal; n != 1 {
+		t.Fatalf("unexpected increase of vmctl_import_requests_total %d; want 1", n)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 2 {
+		t.Fatalf("unexpected number of requests %d; want 2", len(requests))
+	}
+	for _, r := range requests {
+		if got := r.Header.Get("X-Team-Id"); got != "team-1" {
+			t.Fatalf("unexpected X-Team-Id header %q for %q", got, r.URL.Path)
+		}
+		if got := r.Header.Values("X-Scope-OrgID"); !reflect.DeepEqual(got, []string{"tenant", "other"}) {
+			t.Fatalf("unexpected X-Scope-OrgID header %q for %q", got, r.URL.Path)
+		}
+		if got := r.Header.Get("User-Agent"); got != "vmctl/test vm-import" {
+			t.Fatalf("unexpected User-Agent header %q for %q", got, r.URL.Path)
+		}
+		// the custom header must take precedence over RequestID
+		if got := r.Header.Values("X-Request-Id"); !reflect.DeepEqual(got, []string{"custom"}) {
+			t.Fatalf("unexpected X-Request-Id header %q for %q", got, r.URL.Path)
+		}
+		// basic auth must take precedence over the custom header
+		if user, password, ok := r.BasicAuth(); !ok || user != "foo" || password != "bar" {
+			t.Fatalf("unexpected basic auth %q:%q for %q", user, password, r.URL.Path)
+		}
+	}
+	if got := requests[1].Header.Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("unexpected Content-Encoding header %q", got)
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	f := func(headers []string, want http.Header, wantErr bool) {
+		t.Helper()
+		got, err := parseHeaders(headers)
+		if (err != nil) != wantErr {
+			t.Fatalf("unexpected error: %v; wantErr: %v", err, wantErr)
+		}
+		if !wantErr && !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected headers %v; want %v", got, want)
+		}
+	}
+
+	f(nil, http.Header{}, false)
+	f([]string{"x-team-id: foo: bar"}, http.Header{"X-Team-Id": {"foo: bar"}}, false)
+	f([]string{"X-Foo: a", "X-Foo: b"}, http.Header{"X-Foo": {"a", "b"}}, false)
+	f([]string{"X-Foo"}, nil, true)
+	f([]string{" : foo"}, nil, true)
+}
+
+func TestImporterRateLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	// well compressible batch
+	var batch []*TimeSeries
+	for i := 0; i < 1000; i++ {
+		ts := &TimeSeries{Name: "foo"}
+		for j := 0; j < 100; j++ {
+			ts.Timestamps = append(ts.Timestamps, int64(j))
+			ts.Values = append(ts.Values, 1)
+		}
+		batch = append(batch, ts)
+	}
+	importBatch := func(cfg Config) (*stats, time.Duration) {
+		t.Helper()
+		cfg.Addr = srv.URL
+		cfg.Concurrency = 1
+		cfg.DisableProgressBar = true
+		im, err := NewImporter(context.Background(), cfg)
+		if err != nil {
+			t.Fatalf("cannot create importer: %s", err)
+		}
+		defer im.Close()
+		start := time.Now()
+		if err := im.Import(batch); err != nil {
+			t.Fatalf("unexpected import error: %s", err)
+		}
+		return im.s, time.Since(start)
+	}
+
+	s, _ := importBatch(Config{})
+	if s.sentBytes != s.bytes {
+		t.Fatalf("sent bytes %d must be equal to bytes %d without compression", s.sentBytes, s.bytes)
+	}
+	s, _ = importBatch(Config{Compress: true})
+	if s.sentBytes == 0 || s.sentBytes*10 > s.bytes {
+		t.Fatalf("unexpected sent bytes %d for %d bytes with compression", s.sentBytes, s.bytes)
+	}
+
+	// the limit must be applied to the compressed bytes:
+	// sending twice the limit takes at least a second, while
+	// limiting the uncompressed bytes would take much longer
+	limit := int64(s.sentBytes / 2)
+	_, d := importBatch(Config{Compress: true, RateLimit: limit})
+	if d < time.Second || d > 5*time.Second {
+		t.Fatalf("unexpected import duration %s with rate limit %d bytes/s", d, limit)
+	}
+}
+
+func TestImporterFlushInterval(t *testing.T) {
+	requests := make(chan int, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		requests <- strings.Count(string(data), "\n")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	f := func(flushInterval time.Duration) {
+		t.Helper()
+		im, err := NewImporter(context.Background(), Config{
+			Addr:               srv.URL,
+			Concurrency:        1,
+			BatchSize:          1e6,
+			FlushInterval:      flushInterval,
+			DisableProgressBar: true,
+		})
+		if err != nil {
+			t.Fatalf("cannot create importer: %s", err)
+		}
+		for i := 0; i < 2; i++ {
+			ts := &TimeSeries{
+				Name:       "foo",
+				Timestamps: []int64{1},
+				Values:     []float64{1},
+			}
+			if err := im.Input(ts); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+		if flushInterval > 0 {
+			// the batch is sent by timer before close
+			deadline := time.Now().Add(5 * time.Second)
+			for im.InflightSamples() > 0 {
+				if time.Now().After(deadline) {
+					t.Fatalf("timeout while waiting for the batch to be flushed")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			var series int
+			for len(requests) > 0 {
+				series += <-requests
+			}
+			if series != 2 {
+				t.Fatalf("unexpected number of flushed series %d; want 2", series)
+			}
+		} else {
+			// the partial batch is sent on close only
+			select {
+			case <-requests:
+				t.Fatalf("unexpected request before close")
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+		im.Close()
+		for err := range im.Errors() {
+			if err.Err != nil {
+				t.Fatalf("unexpected import error: %s", err.Err)
+			}
+		}
+		if flushInterval == 0 {
+			select {
+			case n := <-requests:
+				if n != 2 {
+					t.Fatalf("unexpected number of series %d in the batch sent on close; want 2", n)
+				}
+			default:
+				t.Fatalf("the partial batch must be sent on close")
+			}
+		}
+	}
+
+	f(0)
+	f(10 * time.Millisecond)
+}
+
+func TestRoundTimeseriesValue(t *testing.T) {
+	f := func(significantFigures, roundDigits int, values, want []float64) {
+		t.Helper()
+		// values are rounded in place, so copy them for comparing with want
+		values = append([]float64{}, values...)
+		ts := roundTimeseriesValue(&TimeSeries{Values: values}, significantFigures, roundDigits)
+		if len(ts.Values) != len(want) {
+			t.Fatalf("unexpected number of values %d; want %d", len(ts.Values), len(want))
+		}
+		for i, v := range ts.Values {
+			if decimal.IsStaleNaN(want[i]) {
+				if !decimal.IsStaleNaN(v) {
+					t.Fatalf("unexpected value #%d %v; want stale NaN", i, v)
+				}
+				continue
+			}
+			if math.IsNaN(want[i]) {
+				if !math.IsNaN(v) || decimal.IsStaleNaN(v) {
+					t.Fatalf("unexpected value #%d %v; want NaN", i, v)
+				}
+				continue
+			}
+			if v != want[i] {
+				t.Fatalf("unexpected value #%d %v; want %v", i, v, want[i])
+			}
+		}
+	}
+
+	nan := math.NaN()
+	inf := math.Inf(1)
+	edge := []float64{nan, decimal.StaleNaN, inf, -inf, 0, math.MaxFloat64, -math.MaxFloat64}
+
+	// rounding is disabled
+	f(0, 100, []float64{102.342305, 1.2345}, []float64{102.342305, 1.2345})
+	f(0, 100, edge, edge)
+
+	f(5, 100, []float64{102.342305, -102.342305, 1.23456789e-10}, []float64{102.34, -102.34, 1.2346e-10})
+	f(5, 100, edge, edge)
+
+	f(0, 2, []float64{1.2345, -1.2355, 1e300}, []float64{1.23, -1.24, 1e300})
+	f(0, 2, edge, edge)
+
+	f(3, 1, []float64{12.3456, nan, inf}, []float64{12.3, nan, inf})
+}
+
+func TestImporterDedupInterval(t *testing.T) {
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	if _, err := NewImporter(context.Background(), Config{Addr: srv.URL, Concurrency: 1, DedupInterval: -time.Second}); err == nil {
+		t.Fatalf("expecting error for negative dedup interval")
+	}
+	im, err := NewImporter(context.Background(), Config{
+		Addr:               srv.URL,
+		Concurrency:        1,
+		DedupInterval:      time.Minute,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	ts := &TimeSeries{
+		Name:       "foo",
+		Timestamps: []int64{60000, 90000, 120000, 150000, 180000},
+		Values:     []float64{1, 2, 3, 4, 5},
+	}
+	if err := im.Input(ts); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// only the deduplicated samples are accounted
+	if n := im.InflightSamples(); n != 3 {
+		t.Fatalf("unexpected number of in-flight samples %d; want %d", n, 3)
+	}
+	im.Close()
+	for err := range im.Errors() {
+		if err.Err != nil {
+			t.Fatalf("unexpected import error: %s", err.Err)
+		}
+	}
+	want := `{"metric":{"__name__":"foo"},"timestamps":[60000,120000,180000],"values":[1,3,5]}` + "\n"
+	if body != want {
+		t.Fatalf("unexpected import request body %q; want %q", body, want)
+	}
+}
+
+func TestImporterFlush(t *testing.T) {
+	var series int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		atomic.AddInt64(&series, int64(strings.Count(string(data), "\n")))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	im, err := NewImporter(context.Background(), Config{
+		Addr:               srv.URL,
+		Concurrency:        3,
+		BatchSize:          1e6,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	defer im.Close()
+	for round := 1; round <= 3; round++ {
+		for i := 0; i < 10; i++ {
+			ts := &TimeSeries{
+				Name:       "foo",
+				Timestamps: []int64{1},
+				Values:     []float64{1},
+			}
+			if err := im.Input(ts); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+		if err := im.Flush(); err != nil {
+			t.Fatalf("unexpected flush error: %s", err.Err)
+		}
+		// all the series passed to Input before Flush must be sent,
+		// even if they are buffered in the input channel
+		if n, want := atomic.LoadInt64(&series), int64(round*10); n != want {
+			t.Fatalf("unexpected number of series sent after flush %d; want %d", n, want)
+		}
+		if n := im.InflightSamples(); n != 0 {
+			t.Fatalf("unexpected inflight samples after flush: %d", n)
+		}
+	}
+	// flush without buffered series is a no-op
+	if err := im.Flush(); err != nil {
+		t.Fatalf("unexpected flush error: %s", err.Err)
+	}
+	im.Close()
+	if err := im.Flush(); err != nil {
+		t.Fatalf("unexpected flush error on closed importer: %s", err.Err)
+	}
+}
+
+func TestImporterConnectionsReuse(t *testing.T) {
+	const concurrency = 8
+	var newConns, requests uint64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		atomic.AddUint64(&requests, 1)
+		_, _ = io.Copy(io.Discard, r.Body)
+		// keep the request in-flight for a while,
+		// so all the workers send requests in parallel
+		time.Sleep(10 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddUint64(&newConns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	im, err := NewImporter(context.Background(), Config{
+		Addr:               srv.URL,
+		Concurrency:        concurrency,
+		BatchSize:          1,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	// send bursts of series, so all the workers import them in parallel
+	// and then their connections become idle at the same time
+	for i := 1; i <= 5; i++ {
+		for j := 0; j < concurrency; j++ {
+			if err := im.Input(&TimeSeries{Name: "foo", Timestamps: []int64{1}, Values: []float64{1}}); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadUint64(&requests) < uint64(i*concurrency) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for %d import requests; got %d", i*concurrency, atomic.LoadUint64(&requests))
+			}
+			time.Sleep(time.Millisecond)
+		}
+		// wait for the in-flight requests to finish
+		if err := im.Flush(); err != nil {
+			t.Fatalf("unexpected import error: %s", err.Err)
+		}
+	}
+	im.Close()
+	for err := range im.Errors() {
+		if err.Err != nil {
+			t.Fatalf("unexpected import error: %s", err.Err)
+		}
+	}
+	// every worker must re-use its connection instead of opening
+	// a new one per request; one more connection is used by ping
+	if n := atomic.LoadUint64(&newConns); n > concurrency+1 {
+		t.Fatalf("too many connections opened: %d; want at most %d", n, concurrency+1)
+	}
+}
+
+func TestImporterLogRequests(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	f := func(logRequests bool, sampleRate uint64, wantLines int) {
+		t.Helper()
+		im, err := NewImporter(context.Background(), Config{
+			Addr:               srv.URL,
+			Concurrency:        1,
+			DisableProgressBar: true,
+			LogRequests:        logRequests,
+			LogSampleRate:      sampleRate,
+		})
+		if err != nil {
+			t.Fatalf("cannot create importer: %s", err)
+		}
+		defer im.Close()
+
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		defer log.SetOutput(os.Stderr)
+
+		batch := []*TimeSeries{{Name: "foo", Timestamps: []int64{1, 2}, Values: []float64{1, 2}}}
+		for i := 0; i < 10; i++ {
+			if err := im.Import(batch); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+		if n := strings.Count(logs.String(), "DEBUG: imported 1 series with 2 samples"); n != wantLines {
+			t.Fatalf("unexpected number of logged requests %d; want %d:\n%s", n, wantLines, logs.String())
+		}
+	}
+
+	f(false, 0, 0)
+	f(true, 0, 10)
+	f(true, 1, 10)
+	// the first request of every 3 is logged
+	f(true, 3, 4)
+}
+
+func TestImporterResponseError(t *testing.T) {
+	var statusCode int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&statusCode)))
+		_, _ = w.Write([]byte("cannot parse the data"))
+	}))
+	im, err := NewImporter(context.Background(), Config{
+		Addr:               srv.URL,
+		Concurrency:        1,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	defer im.Close()
+
+	f := func(code int, wantBadRequest bool) {
+		t.Helper()
+		atomic.StoreInt32(&statusCode, int32(code))
+		err := im.Import(testFormatBatch)
+		var re *ResponseError
+		if !errors.As(err, &re) {
+			t.Fatalf("expecting response error; got %v", err)
+		}
+		if re.StatusCode != code || re.Body != "cannot parse the data" {
+			t.Fatalf("unexpected response error %+v; want status code %d", re, code)
+		}
+		if errors.Is(err, ErrBadRequest) != wantBadRequest {
+			t.Fatalf("unexpected bad request error %v; want bad request: %v", err, wantBadRequest)
+		}
+	}
+
+	f(http.StatusBadRequest, true)
+	f(http.StatusServiceUnavailable, false)
+
+	// network errors are distinguishable from the responses of VictoriaMetrics
+	srv.Close()
+	err = im.Import(testFormatBatch)
+	var ne net.Error
+	var re *ResponseError
+	if !errors.As(err, &ne) || errors.As(err, &re) {
+		t.Fatalf("expecting network error; got %v", err)
+	}
+}
+
+func TestImporterImportAbortedRequest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		// drop the connection without reading the request body,
+		// so the request fails while the body is written
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("cannot hijack connection: %s", err)
+			return
+		}
+		_ = conn.Close()
+	}))
+	defer srv.Close()
+	im, err := NewImporter(context.Background(), Config{
+		Addr:               srv.URL,
+		Concurrency:        1,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create importer: %s", err)
+	}
+	defer im.Close()
+
+	// the body of the batch mustn't fit the socket buffers
+	ts := &TimeSeries{Name: "foo"}
+	for i := 0; i < 1e6; i++ {
+		ts.Timestamps = append(ts.Timestamps, int64(i))
+		ts.Values = append(ts.Values, float64(i))
+	}
+	if err := im.Import([]*TimeSeries{ts}); err == nil {
+		t.Fatalf("expecting error for the dropped connection")
+	}
+	// the goroutine sending the request must exit after Import returns
+	buf := make([]byte, 1<<20)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stacks := string(buf[:runtime.Stack(buf, true)])
+		if !strings.Contains(stacks, "vm.(*Importer).Import.func") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the goroutine sending the import request is leaked:\n%s", stacks)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,197 @@
+package vm
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func BenchmarkImporterImport(b *testing.B) {
+	f := func(name string, compress bool, level int) {
+		b.Run(name, func(b *testing.B) {
+			benchmarkImporterImport(b, Config{Compress: compress, CompressLevel: level}, newTestBatch(100, 1000))
+		})
+	}
+
+	f("no_compression", false, 0)
+	f("gzip_best_speed", true, gzip.BestSpeed)
+	f("gzip_default", true, gzip.DefaultCompression)
+	f("gzip_best_compression", true, gzip.BestCompression)
+}
+
+func BenchmarkImporterImportFormat(b *testing.B) {
+	f := func(name string, batch []*TimeSeries) {
+		for _, format := range []string{ImportFormatJSONL, ImportFormatPrometheus, ImportFormatCSV, ImportFormatNative} {
+			b.Run(name+"_"+format, func(b *testing.B) {
+				benchmarkImporterImport(b, Config{ImportFormat: format, Compress: true}, batch)
+			})
+		}
+	}
+
+	f("long_series", newTestBatch(100, 1000))
+	// many small series like fetched from OpenTSDB
+	f("short_series", newTestBatch(10000, 10))
+}
+
+func benchmarkImporterImport(b *testing.B, cfg Config, batch []*TimeSeries) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	cfg.Addr = srv.URL
+	cfg.Concurrency = 1
+	cfg.DisableProgressBar = true
+	im, err := NewImporter(context.Background(), cfg)
+	if err != nil {
+		b.Fatalf("cannot create importer: %s", err)
+	}
+	defer im.Close()
+	var samples int
+	for _, ts := range batch {
+		samples += len(ts.Values)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		if err := im.Import(batch); err != nil {
+			b.Fatalf("unexpected error: %s", err)
+		}
+	}
+	b.ReportMetric(float64(samples*b.N)/time.Since(start).Seconds(), "samples/s")
+	b.ReportMetric(float64(im.StatsSnapshot().SentBytes)/float64(samples*b.N), "sent_bytes/sample")
+}
+
+func BenchmarkImporterBatchSize(b *testing.B) {
+	for _, batchSize := range []int{100, 1e3, 1e4, 1e5} {
+		b.Run(fmt.Sprintf("batch_size_%d", batchSize), func(b *testing.B) {
+			benchmarkImporterBatchSize(b, batchSize)
+		})
+	}
+}
+
+func benchmarkImporterBatchSize(b *testing.B, batchSize int) {
+	var requests int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		atomic.AddInt64(&requests, 1)
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	im, err := NewImporter(context.Background(), Config{
+		Addr:               srv.URL,
+		Concurrency:        1,
+		BatchSize:          batchSize,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		b.Fatalf("cannot create importer: %s", err)
+	}
+	// many small series like fetched from OpenTSDB
+	batch := newTestBatch(1000, 10)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, ts := range batch {
+			if err := im.Input(ts); err != nil {
+				b.Fatalf("unexpected error: %s", err)
+			}
+		}
+	}
+	im.Close()
+	for err := range im.Errors() {
+		if err.Err != nil {
+			b.Fatalf("unexpected import error: %s", err.Err)
+		}
+	}
+	b.ReportMetric(float64(atomic.LoadInt64(&requests))/float64(b.N), "requests/op")
+}
+
+func BenchmarkImporterConcurrency(b *testing.B) {
+	for _, concurrency := range []uint8{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("concurrency_%d", concurrency), func(b *testing.B) {
+			benchmarkImporterConcurrency(b, concurrency)
+		})
+	}
+}
+
+func benchmarkImporterConcurrency(b *testing.B, concurrency uint8) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		_, _ = io.Copy(io.Discard, r.Body)
+		// emulate the time spent by VictoriaMetrics on ingesting the request
+		time.Sleep(time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	im, err := NewImporter(context.Background(), Config{
+		Addr:               srv.URL,
+		Concurrency:        concurrency,
+		BatchSize:          1e3,
+		DisableProgressBar: true,
+	})
+	if err != nil {
+		b.Fatalf("cannot create importer: %s", err)
+	}
+	// many small series like fetched from OpenTSDB
+	batch := newTestBatch(1000, 10)
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		for _, ts := range batch {
+			if err := im.Input(ts); err != nil {
+				b.Fatalf("unexpected error: %s", err)
+			}
+		}
+	}
+	im.Close()
+	for err := range im.Errors() {
+		if err.Err != nil {
+			b.Fatalf("unexpected import error: %s", err.Err)
+		}
+	}
+	b.ReportMetric(float64(len(batch)*10*b.N)/time.Since(start).Seconds(), "samples/s")
+}
+
+// newTestBatch returns a batch of series looking like collected by node_exporter
+func newTestBatch(seriesCount, samplesPerSeries int) []*TimeSeries {
+	batch := make([]*TimeSeries, 0, seriesCount)
+	for i := 0; i < seriesCount; i++ {
+		ts := &TimeSeries{
+			Name: "node_cpu_seconds_total",
+			LabelPairs: []LabelPair{
+				{Name: "instance", Value: fmt.Sprintf("host-%d:9100", i)},
+				{Name: "job", Value: "node"},
+				{Name: "mode", Value: "user"},
+			},
+		}
+		for j := 0; j < samplesPerSeries; j++ {
+			ts.Timestamps = append(ts.Timestamps, int64(1.6e12)+int64(j)*15e3)
+			ts.Values = append(ts.Values, float64(i*samplesPerSeries+j)*1.25)
+		}
+		batch = append(batch, ts)
+	}
+	return batch
+}